@@ -1,3 +1,3 @@
 #!/bin/bash
-CGO_ENABLED=0 go build -ldflags="-s -w" -o dist/ccw ./main.go
+CGO_ENABLED=0 go build -ldflags="-s -w -X github.com/sammwyy/ccw/modules.Version=${VERSION:-dev}" -o dist/ccw ./main.go
 upx --best --lzma dist/ccw
\ No newline at end of file
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/googollee/go-socket.io/engineio"
 	"github.com/googollee/go-socket.io/engineio/transport"
 	"github.com/googollee/go-socket.io/engineio/transport/polling"
 	"github.com/googollee/go-socket.io/engineio/transport/websocket"
+	"github.com/googollee/go-socket.io/parser"
 
 	modules "github.com/sammwyy/ccw/modules"
 
@@ -19,8 +23,17 @@ import (
 )
 
 func main() {
+	// Service management subcommands
+	if len(os.Args) > 1 && (os.Args[1] == "install-service" || os.Args[1] == "uninstall-service") {
+		runServiceCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	// Parse command line flags
 	debug := flag.Bool("debug", false, "Enable debug mode")
+	pidFile := flag.String("pidfile", "", "Write the process ID to this file")
+	takeover := flag.Bool("takeover", false, "Take over the pid file lock even if its process appears to run")
+	logFile := flag.String("log-file", "", "Append logs to this file instead of stderr")
 	flag.Parse()
 
 	// Set Gin mode based on debug flag
@@ -28,12 +41,63 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal("Failed to open log file:", err)
+		}
+		log.SetOutput(file)
+		gin.DefaultWriter = file
+		gin.DefaultErrorWriter = file
+	}
+
+	// Get port from environment or use default
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
 	// Get password from environment
 	authToken := os.Getenv("AUTH_TOKEN")
 	if authToken == "" {
 		log.Fatal("AUTH_TOKEN environment variable is required")
 	}
 
+	// Additional tokens with limited scopes
+	tokens := modules.NewTokens(authToken, os.Getenv("AUTH_TOKENS"))
+
+	// Load module settings, failing before the lock is taken on bad config
+	config := modules.LoadConfig()
+	identity, err := modules.LoadIdentity(config)
+	if err != nil {
+		log.Fatal("Failed to start: ", err)
+	}
+
+	// Refuse to start a second instance before initializing the modules
+	lock, err := modules.AcquireLock(modules.LockPath(*pidFile, port), *takeover)
+	if err != nil {
+		log.Fatal("Failed to start: ", err)
+	}
+	// Failures from here on must not leave the lock behind
+	fatal := func(err error) {
+		lock.Release()
+		log.Fatal("Failed to start: ", err)
+	}
+	listener, err := modules.Listen(port)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Release the lock on shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		lock.Release()
+		os.Exit(0)
+	}()
+
 	// Initialize Gin router
 	r := gin.Default()
 
@@ -53,152 +117,590 @@ func main() {
 		},
 	})
 
+	r.Use(modules.BodyLimitMiddleware(config.MaxBodySize))
+
+	// Initialize per-connection emitter, batching high-frequency streams
+	emitter := modules.NewEmitter(config, "fs:change", "shell:output", "net:capture:packet", "fleet:output")
+
 	// Initialize modules
-	fsModule := modules.NewFileSystemModule(server)
-	netModule := modules.NewNetworkModule(server)
-	shellModule := modules.NewShellModule(server)
+	notifier, err := modules.NewNotifier(config, identity)
+	if err != nil {
+		fatal(err)
+	}
+	quotas := modules.NewQuotas(config, notifier)
+	throttle := modules.NewThrottle(config)
+	outbound, err := modules.NewOutboundPolicy(config)
+	if err != nil {
+		fatal(err)
+	}
+	cache, err := modules.NewDownloadCache(config)
+	if err != nil {
+		fatal(err)
+	}
+	tmpSpaces, err := modules.NewTmpSpaces(config)
+	if err != nil {
+		fatal(err)
+	}
+	paths, err := modules.NewPaths(config)
+	if err != nil {
+		fatal(err)
+	}
+	bookmarks, err := modules.NewBookmarks(config)
+	if err != nil {
+		fatal(err)
+	}
+	index := modules.NewSearchIndex(config, paths)
+	tasks := modules.NewTasks(emitter)
+	fsModule := modules.NewFileSystemModule(server, emitter, config, quotas, throttle, outbound, tmpSpaces, tasks, paths, bookmarks, index)
+	netModule := modules.NewNetworkModule(server, emitter, config, quotas, throttle, outbound, cache, tasks, paths)
+	shellModule, err := modules.NewShellModule(server, emitter, config, paths)
+	if err != nil {
+		fatal(err)
+	}
+	provisionModule := modules.NewProvisionModule(tasks, paths, quotas)
+	fleetModule, err := modules.NewFleetModule(emitter, config)
+	if err != nil {
+		fatal(err)
+	}
+	firewallModule := modules.NewFirewallModule(config)
+	sysModule := modules.NewSystemModule(server, emitter, config, identity, fsModule, netModule, shellModule)
+	resumptions := modules.NewResumptions(config, emitter, fsModule, netModule, shellModule, tasks)
+	limits := modules.NewConnectionLimits(config)
+	store, err := modules.NewStore(config)
+	if err != nil {
+		fatal(err)
+	}
+	guard := modules.NewEventGuard(config, emitter, store)
+	approvals := modules.NewApprovals(config, paths, r, emitter, notifier)
+	healthModule := modules.NewHealthModule(config, sysModule, shellModule, fleetModule, limits, notifier)
+	capabilitiesModule := modules.NewCapabilitiesModule(config, firewallModule, store)
+	sysModule.StartHeartbeat()
+	shellModule.StartSampler()
+	index.Start()
 
 	// Setup Socket.IO handlers
-	setupSocketHandlers(server, fsModule, netModule, shellModule, authToken)
+	setupSocketHandlers(server, emitter, sysModule, fsModule, netModule, shellModule, tasks, resumptions, guard, approvals, tokens, limits, store, notifier)
 
 	// Setup REST API routes with authentication
 	api := r.Group("/api")
-	api.Use(authMiddleware(authToken))
+	api.Use(authMiddleware(tokens, notifier))
+	api.Use(modules.BodyClassMiddleware(config))
+	if store != nil {
+		api.Use(store.Middleware())
+	}
+	api.Use(limits.RequestMiddleware())
+	if config.ReadOnly {
+		api.Use(modules.ReadOnlyMiddleware())
+	}
+	if config.CompressMinSize >= 0 {
+		api.Use(modules.CompressionMiddleware(config.CompressMinSize))
+	}
+	if config.IdempotencyTTL > 0 {
+		api.Use(modules.IdempotencyMiddleware(config.IdempotencyTTL))
+	}
 	{
 		// File system routes
 		fs := api.Group("/fs")
 		{
 			fs.GET("/listdir", fsModule.ListDirectory)
+			fs.GET("/places", fsModule.ListPlaces)
+			fs.GET("/bookmarks", fsModule.ListBookmarks)
+			fs.POST("/bookmarks", fsModule.CreateBookmark)
+			fs.PUT("/bookmarks/:id", fsModule.UpdateBookmark)
+			fs.DELETE("/bookmarks/:id", fsModule.DeleteBookmark)
 			fs.POST("/create", fsModule.CreateFile)
-			fs.DELETE("/delete", fsModule.DeleteFile)
+			fs.DELETE("/delete", approvals.Gate(modules.ApprovalDelete), fsModule.DeleteFile)
 			fs.PUT("/rename", fsModule.RenameFile)
 			fs.POST("/copy", fsModule.CopyFile)
 			fs.POST("/move", fsModule.MoveFile)
 			fs.GET("/read", fsModule.ReadFile)
+			fs.GET("/raw", fsModule.ServeRaw)
+			fs.HEAD("/raw", fsModule.ServeRaw)
+			fs.GET("/download", fsModule.DownloadFile)
+			fs.HEAD("/download", fsModule.DownloadFile)
+			fs.GET("/stream", fsModule.StreamMedia)
+			fs.GET("/download-dir", fsModule.DownloadDirectory)
 			fs.POST("/write", fsModule.WriteFile)
 			fs.POST("/mkdir", fsModule.CreateDirectory)
+			fs.POST("/replicate", fsModule.Replicate)
+			fs.GET("/replicate/export", fsModule.ExportArchive)
+			fs.PUT("/replicate/import", fsModule.ImportArchive)
+			fs.GET("/env", fsModule.ReadEnvFile)
+			fs.PUT("/env", fsModule.UpdateEnvFile)
+			fs.POST("/edit-structured", fsModule.EditStructured)
+			fs.POST("/replace", fsModule.Replace)
+			fs.GET("/grep", fsModule.Grep)
+			fs.GET("/index", fsModule.IndexStatus)
+			fs.POST("/index/rebuild", fsModule.RebuildIndex)
+			fs.POST("/render", fsModule.RenderTemplate)
+			fs.GET("/manifest", fsModule.Manifest)
+			fs.GET("/changes", fsModule.Changes)
+			fs.GET("/watches", fsModule.ListWatches)
+			fs.POST("/tmp", fsModule.CreateTmp)
+			fs.GET("/tmp", fsModule.ListTmp)
+			fs.PUT("/tmp/:id", fsModule.ExtendTmp)
+			fs.DELETE("/tmp/:id", fsModule.DeleteTmp)
+			fs.GET("/mounts", fsModule.ListMounts)
+			fs.POST("/mounts", fsModule.Mount)
+			fs.DELETE("/mounts", fsModule.Unmount)
+			fs.GET("/openby", fsModule.OpenBy)
+			fs.GET("/report", fsModule.Report)
+			fs.GET("/access", fsModule.CheckAccess)
 		}
 
 		// Network routes
 		net := api.Group("/net")
 		{
 			net.POST("/download", netModule.DownloadFile)
-			net.GET("/ports", netModule.GetCurrentPorts) // Reemplaza el scan de puertos
+			net.GET("/ports", netModule.GetCurrentPorts)
+			net.POST("/s3/get", netModule.S3Get)
+			net.POST("/s3/put", netModule.S3Put)
+			net.POST("/ftp/get", netModule.RemoteGet)
+			net.POST("/ftp/put", netModule.RemotePut)
+			net.GET("/cache", netModule.CacheStatus)
+			net.DELETE("/cache", netModule.PurgeCache)
+			net.POST("/speedtest", netModule.Speedtest)
+			net.GET("/speedtest/download", netModule.SpeedtestDownload)
+			net.POST("/speedtest/upload", netModule.SpeedtestUpload)
+			net.GET("/whois", netModule.Whois)
+			net.POST("/discover", netModule.Discover)
+			net.POST("/scan", netModule.Scan)
+			net.GET("/portmap", netModule.ListPortMappings)
+			net.POST("/portmap", netModule.AddPortMapping)
+			net.DELETE("/portmap", netModule.RemovePortMapping)
+			net.GET("/hosts", netModule.GetHosts)
+			net.POST("/hosts", netModule.AddHosts)
+			net.DELETE("/hosts", netModule.RemoveHosts)
+			net.GET("/resolver", netModule.GetResolver)
+			net.POST("/resolver", netModule.AddResolver)
+			net.DELETE("/resolver", netModule.RemoveResolver)
+			net.GET("/firewall", firewallModule.ListRules)
+			net.POST("/firewall/rules", firewallModule.AddRule)
+			net.DELETE("/firewall/rules/:id", firewallModule.RemoveRule)
+			net.POST("/firewall/confirm", firewallModule.ConfirmChange)
+			net.POST("/firewall/rollback", firewallModule.RollbackChange)
 		}
 
 		// Shell routes
 		shell := api.Group("/shell")
 		{
-			shell.POST("/exec", shellModule.ExecuteCommand)
+			shell.POST("/exec", approvals.Gate(modules.ApprovalExec), shellModule.ExecuteCommand)
+			shell.GET("/sessions", shellModule.GetSessions)
+			shell.GET("/profiles", shellModule.GetProfiles)
+			shell.GET("/tmux", shellModule.GetTmuxSessions)
+			shell.POST("/tmux", shellModule.CreateTmuxSession)
+			shell.GET("/templates", shellModule.ListTemplates)
+			shell.POST("/templates", shellModule.CreateTemplate)
+			shell.DELETE("/templates/:name", shellModule.DeleteTemplate)
+			shell.POST("/templates/:name/run", shellModule.RunTemplate)
+		}
+
+		// Provisioning routes
+		api.POST("/provision", provisionModule.Apply)
+
+		// Capability routes
+		api.GET("/capabilities", capabilitiesModule.GetCapabilities)
+
+		// Task routes
+		api.GET("/tasks", tasks.ListTasks)
+		api.GET("/tasks/:id", tasks.GetTask)
+		api.DELETE("/tasks/:id", tasks.CancelTask)
+
+		// Record routes
+		api.GET("/records", store.ListRecords)
+
+		// Notification routes
+		api.GET("/notifications/channels", notifier.ListChannels)
+		api.POST("/notifications/test", notifier.TestChannels)
+
+		// Approval routes
+		api.GET("/approvals", approvals.ListApprovals)
+		api.GET("/approvals/:id", approvals.GetApproval)
+		api.POST("/approvals/:id/approve", approvals.Approve)
+		api.POST("/approvals/:id/reject", approvals.Reject)
+
+		// Fleet routes
+		fleet := api.Group("/fleet")
+		{
+			fleet.GET("/agents", fleetModule.ListAgents)
+			fleet.POST("/exec", fleetModule.Exec)
+			fleet.POST("/register", fleetModule.Register)
+			fleet.GET("/inventory", fleetModule.ListInventory)
+			fleet.DELETE("/inventory/:id", fleetModule.ForgetAgent)
 		}
 	}
 
 	// Socket.IO endpoint (no auth middleware here as it's handled in connection)
-	r.GET("/socket.io/*any", gin.WrapH(server))
-	r.POST("/socket.io/*any", gin.WrapH(server))
+	r.GET("/socket.io/*any", limits.HandshakeMiddleware(tokens), gin.WrapH(server))
+	r.POST("/socket.io/*any", limits.HandshakeMiddleware(tokens), gin.WrapH(server))
 
-	// Health check endpoint (no authentication required)
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	// Health check endpoints (no authentication required)
+	r.GET("/health", healthModule.Live)
+	r.GET("/health/live", healthModule.Live)
+	r.GET("/health/ready", healthModule.Ready)
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	log.Printf("Server starting on port %s as agent %s (%s)", port, identity.Name, identity.ID)
+	modules.NewRegistration(config, identity).Start()
+	if err := modules.NewHTTPServer(config, r).Serve(listener); err != nil {
+		lock.Release()
+		log.Fatal("Failed to start server:", err)
 	}
+}
 
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+func runServiceCommand(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	opts := modules.ServiceOptions{}
+	flags.StringVar(&opts.Name, "name", "ccw", "Service name")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Print the service definition instead of installing it")
+	if command == "install-service" {
+		flags.StringVar(&opts.User, "user", "", "Run the service as this user")
+		flags.StringVar(&opts.PidFile, "pidfile", "", "Write the process ID to this file")
+		flags.StringVar(&opts.LogFile, "log-file", "", "Append logs to this file")
+		flags.BoolVar(&opts.Debug, "debug", false, "Enable debug mode")
+	}
+	flags.Parse(args)
+
+	var err error
+	if command == "install-service" {
+		err = modules.InstallService(opts)
+	} else {
+		err = modules.UninstallService(opts)
+	}
+	if err != nil {
+		log.Fatalf("Failed to %s: %v", strings.TrimSuffix(command, "-service")+" service", err)
+	}
+	if !opts.DryRun {
+		log.Printf("Service %s: %s done", opts.Name, command)
 	}
 }
 
-func setupSocketHandlers(server *socketio.Server, fs *modules.FileSystemModule, net *modules.NetworkModule, shell *modules.ShellModule, authToken string) {
+func setupSocketHandlers(server *socketio.Server, emitter *modules.Emitter, sys *modules.SystemModule, fs *modules.FileSystemModule, net *modules.NetworkModule, shell *modules.ShellModule, tasks *modules.Tasks, resumptions *modules.Resumptions, guard *modules.EventGuard, approvals *modules.Approvals, tokens *modules.Tokens, limits *modules.ConnectionLimits, store *modules.Store, notifier *modules.Notifier) {
+	// Every event goes through the guard, checking its scopes and recording it
+	on := func(event string, handler interface{}) {
+		server.OnEvent("/", event, guard.Handle(event, handler))
+	}
+
 	server.OnConnect("/", func(s socketio.Conn) error {
 		// Check for authentication token in handshake query
 		queryParams := strings.Split(s.URL().RawQuery, "&")
-		authProvided := false
+		var token *modules.Token
 
 		for _, param := range queryParams {
 			if after, ok := strings.CutPrefix(param, "auth="); ok {
-				authValue := after
-				if authValue == authToken {
-					authProvided = true
+				if token = tokens.Lookup(after); token != nil {
 					break
 				}
 			}
 		}
-		if !authProvided {
+		record := modules.Record{Kind: modules.RecordConnection, Action: "socket:connect", Status: http.StatusOK, Client: s.RemoteAddr().String()}
+		if token == nil {
 			log.Println("Unauthorized connection attempt from:", s.RemoteAddr())
+			notifier.Notify(modules.NotifyAuthFailure, modules.SeverityWarning, modules.ConnHost(s), "Unauthorized Socket.IO connection from %s", modules.ConnHost(s))
+			record.Status = http.StatusUnauthorized
+			store.Record(record)
 			s.Close()
 			return nil
 		}
+		record.Token = token.Name
+		if err := limits.Connect(s, token); err != nil {
+			log.Printf("Refused connection from %s: %v", s.RemoteAddr(), err)
+			record.Status = http.StatusTooManyRequests
+			store.Record(record)
+			s.Close()
+			return nil
+		}
+		store.Record(record)
 
 		// Set context for the connection
-		s.SetContext("")
+		s.SetContext(token)
+		s.Join(modules.TokenRoom(token))
+		emitter.Register(s)
+		sys.RegisterConnection(s)
+		sys.Hello(s, resumptions.Issue(s))
+		resumptions.Resume(s)
 		log.Println("Client connected:", s.ID())
 		return nil
 	})
 
+	// System handlers
+	on("sys:subscriptions", func(s socketio.Conn) {
+		sys.ListSubscriptions(s)
+	})
+
+	on("sys:ping", func(s socketio.Conn) {
+		sys.Heartbeat(s, true)
+	})
+
+	on("sys:pong", func(s socketio.Conn) {
+		sys.Heartbeat(s, false)
+	})
+
 	// File system handlers
-	server.OnEvent("/", "fs:watch", func(s socketio.Conn, path string) {
-		log.Printf("Starting file watch for path: %s", path)
-		fs.WatchFiles(s, path)
+	on("fs:watch", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.WatchRequest
+		if result, ok := emitter.Decode(s, "fs:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Starting file watch for path: %s", req.Path)
+		return fs.WatchFiles(s, req.Path, req.Checksum, req.WalkOptions)
 	})
 
-	server.OnEvent("/", "fs:unwatch", func(s socketio.Conn, path string) {
-		log.Printf("Stopping file watch for path: %s", path)
-		fs.UnwatchFiles(s, path)
+	on("fs:unwatch", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.WatchRequest
+		if result, ok := emitter.Decode(s, "fs:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Stopping file watch for path: %s", req.Path)
+		return fs.UnwatchFiles(s, req.Path)
+	})
+
+	on("fs:watch:replay", func(s socketio.Conn, payload json.RawMessage) {
+		var req modules.ReplayRequest
+		if _, ok := emitter.Decode(s, "fs:error", payload, &req); ok {
+			fs.ReplayWatchEvents(s, req.Path, req.Since)
+		}
+	})
+
+	on("fs:grep", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.GrepRequest
+		if result, ok := emitter.Decode(s, "fs:error", payload, &req); !ok {
+			return result
+		}
+		return fs.GrepFiles(s, req)
+	})
+
+	on("fs:transfer:upload", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.UploadRequest
+		if result, ok := emitter.Decode(s, "fs:transfer:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Starting upload to: %s (%d bytes)", req.Path, req.Size)
+		return fs.StartUpload(s, req.Path, req.Size, req.RateLimit)
+	})
+
+	// Chunks stay positional so the binary attachment is decoded directly
+	on("fs:transfer:chunk", func(s socketio.Conn, transferID string, data parser.Buffer) {
+		fs.ReceiveChunk(s, transferID, data)
+	})
+
+	on("fs:transfer:end", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.TransferRequest
+		if result, ok := emitter.Decode(s, "fs:transfer:error", payload, &req); !ok {
+			return result
+		}
+		return fs.FinishUpload(s, req.TransferID)
+	})
+
+	on("fs:transfer:download", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.DownloadStreamRequest
+		if result, ok := emitter.Decode(s, "fs:transfer:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Starting download of: %s", req.Path)
+		return fs.StartDownload(s, req.Path, req.RateLimit)
+	})
+
+	on("fs:transfer:ack", func(s socketio.Conn, payload json.RawMessage) {
+		var req modules.TransferAckRequest
+		if _, ok := emitter.Decode(s, "fs:transfer:error", payload, &req); ok {
+			fs.AckChunk(s, req.TransferID, req.Received)
+		}
+	})
+
+	on("fs:transfer:cancel", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.TransferRequest
+		if result, ok := emitter.Decode(s, "fs:transfer:error", payload, &req); !ok {
+			return result
+		}
+		return fs.CancelTransfer(s, req.TransferID)
 	})
 
 	// Network handlers
-	server.OnEvent("/", "net:monitor:start", func(s socketio.Conn, protocol, iface string, interval int) {
-		log.Printf("Starting port monitoring for %s on %s (interval: %ds)", protocol, iface, interval)
-		net.StartPortMonitoring(s, protocol, iface, interval)
+	on("net:monitor:start", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.MonitorRequest
+		if result, ok := emitter.Decode(s, "net:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Starting port monitoring for %s on %s (interval: %ds)", req.Protocol, req.Interface, req.Interval)
+		return net.StartPortMonitoring(s, req.Protocol, req.Interface, req.Interval, req.PortFilter)
 	})
 
-	server.OnEvent("/", "net:monitor:stop", func(s socketio.Conn, protocol, iface string) {
-		log.Printf("Stopping port monitoring for %s on %s", protocol, iface)
-		net.StopPortMonitoring(s, protocol, iface)
+	on("net:monitor:stop", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.MonitorRequest
+		if result, ok := emitter.Decode(s, "net:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Stopping port monitoring for %s on %s", req.Protocol, req.Interface)
+		return net.StopPortMonitoring(s, req.Protocol, req.Interface)
+	})
+
+	on("net:capture:start", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.CaptureRequest
+		if result, ok := emitter.Decode(s, "net:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Starting packet capture on %s (filter: %q)", req.Interface, req.Filter)
+		return net.StartCapture(s, req)
+	})
+
+	on("net:capture:stop", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.CaptureStopRequest
+		if result, ok := emitter.Decode(s, "net:error", payload, &req); !ok {
+			return result
+		}
+		log.Printf("Stopping packet capture %s", req.CaptureID)
+		return net.StopCapture(s, req.CaptureID)
 	})
 
 	// Shell handlers
-	server.OnEvent("/", "shell:spawn", func(s socketio.Conn, command string) {
-		log.Printf("Spawning interactive shell: %s", command)
-		shell.SpawnInteractiveShell(s, command)
+	on("shell:spawn", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.SpawnRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		if req.Tmux != "" {
+			log.Printf("Attaching to tmux session: %s", req.Tmux)
+			return shell.SpawnTmux(s, req.Tmux, req.DisconnectPolicy)
+		}
+		if req.Profile != "" {
+			log.Printf("Spawning shell profile: %s", req.Profile)
+			return shell.SpawnProfile(s, req.Profile, req.DisconnectPolicy)
+		}
+		if result, ok := approvals.CheckSpawn(s, req.Command); !ok {
+			return result
+		}
+		log.Printf("Spawning interactive shell: %s", req.Command)
+		return shell.SpawnInteractiveShell(s, req.Command, req.DisconnectPolicy)
+	})
+
+	on("shell:input", func(s socketio.Conn, payload json.RawMessage) {
+		var req modules.InputRequest
+		if _, ok := emitter.Decode(s, "shell:error", payload, &req); ok {
+			shell.SendInput(s, req.SessionID, req.Input)
+		}
+	})
+
+	on("shell:password", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.PasswordRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		return shell.SendPassword(s, req.SessionID, req.Password)
+	})
+
+	on("shell:kill", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.SessionRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		return shell.KillSession(s, req.SessionID)
+	})
+
+	on("shell:join", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.SessionRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		return shell.JoinSession(s, req.SessionID)
 	})
 
-	server.OnEvent("/", "shell:input", func(s socketio.Conn, sessionID, input string) {
-		shell.SendInput(s, sessionID, input)
+	on("shell:attach", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.SessionRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		return shell.AttachSession(s, req.SessionID)
 	})
 
-	server.OnEvent("/", "shell:kill", func(s socketio.Conn, sessionID string) {
-		shell.KillSession(s, sessionID)
+	on("shell:info", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.SessionInfoRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		return shell.SessionInfo(s, req.SessionID, req.Env)
+	})
+
+	on("shell:list", func(s socketio.Conn) modules.EventResult {
+		return shell.ListSessions(s)
+	})
+
+	on("shell:stats:start", func(s socketio.Conn) modules.EventResult {
+		return shell.StartStats(s)
+	})
+
+	on("shell:stats:stop", func(s socketio.Conn) modules.EventResult {
+		return shell.StopStats(s)
+	})
+
+	on("shell:leave", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.SessionRequest
+		if result, ok := emitter.Decode(s, "shell:error", payload, &req); !ok {
+			return result
+		}
+		return shell.LeaveSession(s, req.SessionID)
+	})
+
+	on("tasks:subscribe", func(s socketio.Conn) modules.EventResult {
+		return tasks.Subscribe(s)
+	})
+
+	on("tasks:unsubscribe", func(s socketio.Conn) modules.EventResult {
+		return tasks.Unsubscribe(s)
+	})
+
+	on("tasks:cancel", func(s socketio.Conn, payload json.RawMessage) modules.EventResult {
+		var req modules.TaskRequest
+		if result, ok := emitter.Decode(s, "tasks:error", payload, &req); !ok {
+			return result
+		}
+		return tasks.Abort(s, req.TaskID)
 	})
 
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
 		log.Printf("Client disconnected: %s, reason: %s", s.ID(), reason)
+		if token := modules.ConnToken(s); token != nil {
+			store.Record(modules.Record{
+				Kind:    modules.RecordConnection,
+				Token:   token.Name,
+				Action:  "socket:disconnect",
+				Status:  http.StatusOK,
+				Client:  s.RemoteAddr().String(),
+				Details: map[string]any{"reason": reason},
+			})
+		}
+		// Keep what the connection was subscribed to for it to resume
+		resumptions.Suspend(s, reason)
+
 		// Cleanup resources for this connection
 		fs.CleanupConnection(s.ID())
 		net.CleanupConnection(s.ID())
 		shell.CleanupConnection(s.ID())
+		sys.CleanupConnection(s.ID())
+		tasks.CleanupConnection(s.ID())
+		emitter.CleanupConnection(s.ID())
+		limits.Disconnect(s.ID())
 	})
 
-	go func() {
-		if err := server.Serve(); err != nil {
-			log.Fatalf("Socket.IO server error: %v", err)
-		}
-	}()
+	server.OnError("/", sys.SocketError)
+
+	go sys.Serve()
 }
 
-func authMiddleware(password string) gin.HandlerFunc {
+func authMiddleware(tokens *modules.Tokens, notifier *modules.Notifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
-		if authHeader != "Bearer "+password {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		value, ok := strings.CutPrefix(authHeader, "Bearer ")
+		token := tokens.Lookup(value)
+		if !ok || token == nil {
+			notifier.Notify(modules.NotifyAuthFailure, modules.SeverityWarning, c.ClientIP(), "Unauthorized request to %s %s from %s", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"code":    modules.ErrUnauthorized,
+				"message": modules.Localize(c, "Unauthorized"),
+			})
 			return
 		}
+		c.Set("token", token)
 		c.Next()
 		log.Println("Authenticated request:", c.Request.Method, c.Request.URL.Path)
 		log.Println("Client IP:", c.ClientIP())
@@ -0,0 +1,229 @@
+package modules
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POSIX ACL entry tags and permissions, as stored in the
+// system.posix_acl_access extended attribute
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclRead    = 4
+	aclWrite   = 2
+	aclExecute = 1
+)
+
+// AccessReport is the effective access of a user to a path
+type AccessReport struct {
+	Path     string `json:"path"`
+	User     string `json:"user"`
+	UID      int    `json:"uid"`
+	Read     bool   `json:"read"`
+	Write    bool   `json:"write"`
+	Execute  bool   `json:"execute"`           // search, for directories
+	Class    string `json:"class"`             // root, owner, user, group or other: the entry deciding access
+	ACL      bool   `json:"acl"`               // the path has a POSIX ACL
+	ReadOnly bool   `json:"read_only"`         // on a filesystem mounted read-only
+	Blocked  string `json:"blocked,omitempty"` // directory above the path the user can't search
+}
+
+// aclEntry is an entry of a POSIX ACL
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// REST API Handlers
+
+// CheckAccess reports whether a user could read, write or execute a path,
+// from its mode, owner and ACL, and the directories above it
+func (fsm *FileSystemModule) CheckAccess(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+
+	report, err := checkAccess(path, c.Query("user"))
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to check access: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Access checked"),
+		Data:    report,
+	})
+}
+
+// Helper functions
+
+// checkAccess works out the access of a user, given by name or uid, to a
+// path; the user ccw runs as when empty
+func checkAccess(path, name string) (*AccessReport, error) {
+	var account *user.User
+	var err error
+	switch {
+	case name == "":
+		account, err = user.Current()
+	case strings.Trim(name, "0123456789") == "":
+		account, err = user.LookupId(name)
+	default:
+		account, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown user %q", errInvalidRequest, name)
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	groups := make(map[uint32]bool)
+	ids, _ := account.GroupIds()
+	for _, id := range append(ids, account.Gid) {
+		if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups[uint32(gid)] = true
+		}
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		resolved, err = filepath.Abs(resolved)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AccessReport{Path: resolved, User: account.Username, UID: uid}
+	for dir := filepath.Dir(resolved); ; dir = filepath.Dir(dir) {
+		dirInfo, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if perm, _, _ := effectivePermissions(dir, dirInfo, uint32(uid), groups); perm&aclExecute == 0 {
+			report.Blocked = dir // the closest to the root is reported
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	perm, class, acl := effectivePermissions(resolved, info, uint32(uid), groups)
+	report.Class, report.ACL = class, acl
+	report.ReadOnly = mountedReadOnly(resolved)
+	if report.Blocked == "" {
+		report.Read = perm&aclRead != 0
+		report.Write = perm&aclWrite != 0 && !report.ReadOnly
+		report.Execute = perm&aclExecute != 0
+	}
+	return report, nil
+}
+
+// effectivePermissions returns the rwx bits a user gets on a file, with the
+// class of the entry granting them and whether they come from an ACL. Root
+// gets everything, but executes files only when some execute bit is set.
+func effectivePermissions(path string, info fs.FileInfo, uid uint32, groups map[uint32]bool) (uint16, string, bool) {
+	owner, group, ok := fileOwner(info)
+	if !ok {
+		return 0, "other", false
+	}
+	mode := uint16(info.Mode().Perm())
+	if uid == 0 {
+		if info.IsDir() || mode&0111 != 0 {
+			return aclRead | aclWrite | aclExecute, "root", false
+		}
+		return aclRead | aclWrite, "root", false
+	}
+
+	entries := readACL(path)
+	if entries == nil {
+		switch {
+		case owner == uid:
+			return mode >> 6 & 7, "owner", false
+		case groups[group]:
+			return mode >> 3 & 7, "group", false
+		}
+		return mode & 7, "other", false
+	}
+
+	if owner == uid {
+		return mode >> 6 & 7, "owner", true
+	}
+	mask := uint16(7)
+	for _, entry := range entries {
+		if entry.tag == aclMask {
+			mask = entry.perm
+		}
+	}
+	for _, entry := range entries {
+		if entry.tag == aclUser && entry.id == uid {
+			return entry.perm & mask, "user", true
+		}
+	}
+	var perm uint16
+	matched := false
+	for _, entry := range entries {
+		if entry.tag == aclGroupObj && groups[group] || entry.tag == aclGroup && groups[entry.id] {
+			perm |= entry.perm
+			matched = true
+		}
+	}
+	if matched {
+		return perm & mask, "group", true
+	}
+	for _, entry := range entries {
+		if entry.tag == aclOther {
+			return entry.perm, "other", true
+		}
+	}
+	return mode & 7, "other", true
+}
+
+// mountedReadOnly reports whether the filesystem holding path is mounted
+// read-only
+func mountedReadOnly(path string) bool {
+	mounts, err := readMountTable()
+	if err != nil {
+		return false
+	}
+	readOnly, longest := false, -1
+	for _, mount := range mounts {
+		if pathWithin(path, mount.Target) && len(mount.Target) >= longest {
+			longest = len(mount.Target)
+			readOnly = false
+			for _, option := range strings.Split(mount.Options, ",") {
+				readOnly = readOnly || option == "ro"
+			}
+		}
+	}
+	return readOnly
+}
@@ -0,0 +1,26 @@
+package modules
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// readACL reads the access ACL of a file, nil when it has none beyond its
+// mode
+func readACL(path string) []aclEntry {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(path, "system.posix_acl_access", buf)
+	// version 2 header, then entries of tag, perm and id
+	if err != nil || n < 4 || binary.LittleEndian.Uint32(buf) != 2 {
+		return nil
+	}
+	var entries []aclEntry
+	for i := 4; i+8 <= n; i += 8 {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(buf[i:]),
+			perm: binary.LittleEndian.Uint16(buf[i+2:]),
+			id:   binary.LittleEndian.Uint32(buf[i+4:]),
+		})
+	}
+	return entries
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package modules
+
+// readACL finds no ACL, the POSIX ACLs read from extended attributes are
+// Linux's
+func readACL(path string) []aclEntry {
+	return nil
+}
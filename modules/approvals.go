@@ -0,0 +1,427 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Classes of operations that can wait for approval
+const (
+	ApprovalDelete = "delete" // deletes of more than APPROVAL_DELETE_FILES files
+	ApprovalExec   = "exec"   // commands outside APPROVAL_EXEC_ALLOWLIST
+)
+
+// States of approvals
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	ApprovalExpired  = "expired"
+)
+
+// shellMetacharacters make a command string more than a program and its
+// arguments, so it can't be matched against the allowlist
+const shellMetacharacters = ";&|`$()<>\\\n'\"*?[]{}~"
+
+// errTooManyFiles stops counting the files of a delete past the threshold
+var errTooManyFiles = errors.New("too many files")
+
+// approvedKey marks replayed requests in their context, so the gate lets
+// them through. Clients can't set it.
+type approvedKey struct{}
+
+// Approvals holds the dangerous operations waiting for a second token to
+// approve them. Gated requests are kept whole and replayed through the API
+// with the token that sent them once approved.
+type Approvals struct {
+	config    *Config
+	paths     *Paths
+	handler   http.Handler
+	emitter   *Emitter
+	notifier  *Notifier
+	allowlist map[string]bool
+	approvals map[string]*Approval
+	mutex     sync.Mutex
+}
+
+// Approval is an operation waiting for approval, or resolved
+type Approval struct {
+	ID       string          `json:"id"`
+	Class    string          `json:"class"`
+	Token    string          `json:"token"`  // name of the token that requested it
+	Action   string          `json:"action"` // e.g. DELETE /api/fs/delete
+	Target   string          `json:"target"`
+	Details  map[string]any  `json:"details,omitempty"`
+	Status   string          `json:"status"`
+	Created  time.Time       `json:"created"`
+	Expires  time.Time       `json:"expires"`
+	Resolver string          `json:"resolver,omitempty"` // name of the token that approved or rejected it
+	Resolved *time.Time      `json:"resolved,omitempty"`
+	Result   *ApprovalResult `json:"result,omitempty"`
+
+	request *http.Request // replayed once approved
+	body    []byte
+}
+
+// ApprovalResult is the response of an approved operation
+type ApprovalResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+type ApprovalOperation struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func NewApprovals(config *Config, paths *Paths, handler http.Handler, emitter *Emitter, notifier *Notifier) *Approvals {
+	allowlist := make(map[string]bool)
+	for _, command := range strings.Split(config.ApprovalExecAllowlist, ",") {
+		if command = strings.TrimSpace(command); command != "" {
+			allowlist[command] = true
+		}
+	}
+	return &Approvals{
+		config:    config,
+		paths:     paths,
+		handler:   handler,
+		emitter:   emitter,
+		notifier:  notifier,
+		allowlist: allowlist,
+		approvals: make(map[string]*Approval),
+	}
+}
+
+// Gate holds the requests of a class of operations that need approval,
+// answering 202 with ERR_APPROVAL_REQUIRED and the pending approval
+func (a *Approvals) Gate(class string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Context().Value(approvedKey{}) != nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(errorStatus(err), ApprovalOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Invalid request: %v", err),
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var target string
+		var details map[string]any
+		switch class {
+		case ApprovalDelete:
+			target, details = a.checkDelete(c)
+		case ApprovalExec:
+			target, details = a.checkExec(body)
+		}
+		if details == nil {
+			c.Next()
+			return
+		}
+
+		approval := a.hold(c, class, target, details, body)
+		log.Printf("Holding %s of %s for approval %s", class, target, approval.ID)
+		a.notifier.Notify(NotifyApprovalPending, SeverityInfo, approval.ID, "%s requested the %s of %s, waiting for approval %s", approval.Token, class, target, approval.ID)
+		c.AbortWithStatusJSON(http.StatusAccepted, ApprovalOperation{
+			Success: false,
+			Code:    ErrApprovalRequired,
+			Message: Localize(c, "Waiting for approval by another token"),
+			Data:    a.snapshot(approval),
+		})
+	}
+}
+
+// REST API Handlers
+
+// ListApprovals lists the approvals, pending first. Tokens see the ones
+// they requested, approvers all of them.
+func (a *Approvals) ListApprovals(c *gin.Context) {
+	token := RequestToken(c)
+	status := c.Query("status")
+
+	a.mutex.Lock()
+	a.expire()
+	approvals := []Approval{}
+	for _, approval := range a.approvals {
+		if (token.HasScope(ScopeApprove) || approval.Token == token.Name) && (status == "" || approval.Status == status) {
+			approvals = append(approvals, *approval)
+		}
+	}
+	a.mutex.Unlock()
+
+	sort.Slice(approvals, func(i, j int) bool {
+		if pending := approvals[i].Status == ApprovalPending; pending != (approvals[j].Status == ApprovalPending) {
+			return pending
+		}
+		return approvals[i].Created.After(approvals[j].Created)
+	})
+	c.JSON(http.StatusOK, ApprovalOperation{
+		Success: true,
+		Message: Localize(c, "Approvals retrieved"),
+		Data:    approvals,
+	})
+}
+
+// GetApproval returns an approval, with the result of the operation once
+// it was approved
+func (a *Approvals) GetApproval(c *gin.Context) {
+	approval, ok := a.lookup(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, ApprovalOperation{
+		Success: true,
+		Message: Localize(c, "Approval retrieved"),
+		Data:    a.snapshot(approval),
+	})
+}
+
+// Approve runs a pending operation with the token that requested it, and
+// returns its result. It requires the approve permission, from another token
+// than the one that requested it.
+func (a *Approvals) Approve(c *gin.Context) {
+	approval, ok := a.resolve(c, ApprovalApproved)
+	if !ok {
+		return
+	}
+
+	log.Printf("Running %s of %s, approved by %s", approval.Class, approval.Target, approval.Resolver)
+	request := approval.request.Clone(context.WithValue(context.Background(), approvedKey{}, approval.ID))
+	request.Body = io.NopCloser(bytes.NewReader(approval.body))
+	recorder := httptest.NewRecorder()
+	a.handler.ServeHTTP(recorder, request)
+
+	result := &ApprovalResult{Status: recorder.Code, Body: json.RawMessage(recorder.Body.Bytes())}
+	if !json.Valid(result.Body) {
+		result.Body, _ = json.Marshal(recorder.Body.String())
+	}
+	a.mutex.Lock()
+	approval.Result = result
+	approval.request, approval.body = nil, nil
+	a.mutex.Unlock()
+
+	c.JSON(http.StatusOK, ApprovalOperation{
+		Success: true,
+		Message: Localize(c, "Operation approved"),
+		Data:    a.snapshot(approval),
+	})
+}
+
+// Reject drops a pending operation. Approvers can reject any, other tokens
+// the ones they requested.
+func (a *Approvals) Reject(c *gin.Context) {
+	approval, ok := a.resolve(c, ApprovalRejected)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, ApprovalOperation{
+		Success: true,
+		Message: Localize(c, "Operation rejected"),
+		Data:    a.snapshot(approval),
+	})
+}
+
+// Helper functions
+
+// checkDelete returns the details of deletes of more files than
+// APPROVAL_DELETE_FILES, nil for the others and those the handler will
+// refuse anyway
+func (a *Approvals) checkDelete(c *gin.Context) (string, map[string]any) {
+	threshold := a.config.ApprovalDeleteFiles
+	path := c.Query("path")
+	if threshold <= 0 || path == "" || a.paths.Resolve(&path) != nil {
+		return "", nil
+	}
+
+	files := 0
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if files++; files > threshold {
+				return errTooManyFiles
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, errTooManyFiles) {
+		return "", nil
+	}
+	return path, map[string]any{"min_files": files}
+}
+
+// checkExec returns the details of commands outside the allowlist, nil for
+// the allowed ones and invalid requests. Commands without args are shell
+// strings, allowed only when they're a program and plain arguments.
+func (a *Approvals) checkExec(body []byte) (string, map[string]any) {
+	var req CommandRequest
+	if !a.config.ApprovalExec || json.Unmarshal(body, &req) != nil || req.Command == "" {
+		return "", nil
+	}
+
+	program := req.Command
+	if len(req.Args) == 0 {
+		fields := strings.Fields(req.Command)
+		if len(fields) == 0 || strings.ContainsAny(req.Command, shellMetacharacters) {
+			program = ""
+		} else {
+			program = fields[0]
+		}
+	}
+	// Variables like PATH, LD_PRELOAD or BASH_ENV change what an allowed
+	// program runs, so commands with an environment always need approval
+	if program != "" && a.allowlist[program] && len(req.Env) == 0 {
+		return "", nil
+	}
+	details := map[string]any{"command": req.Command, "args": req.Args, "workdir": req.WorkDir}
+	if len(req.Env) > 0 {
+		env := make([]string, 0, len(req.Env))
+		for key := range req.Env {
+			env = append(env, key)
+		}
+		sort.Strings(env)
+		details["env"] = env
+	}
+	return req.Command, details
+}
+
+// CheckSpawn refuses shell:spawn of commands outside the allowlist with
+// APPROVAL_EXEC, since an interactive session can't wait for approval;
+// such commands go through POST /api/shell/exec instead
+func (a *Approvals) CheckSpawn(conn socketio.Conn, command string) (EventResult, bool) {
+	if !a.config.ApprovalExec || command == "" || a.allowlist[command] {
+		return EventResult{}, true
+	}
+	log.Printf("Refused shell:spawn of %s from %s: it requires approval", command, conn.ID())
+	return a.emitter.Fail(conn, "shell:error", map[string]interface{}{
+		"code":    ErrPermission,
+		"message": localizeConn(conn, "Spawning %s requires approval, run it through POST /api/shell/exec", command),
+	}), false
+}
+
+// hold records a pending approval for a request
+func (a *Approvals) hold(c *gin.Context, class, target string, details map[string]any, body []byte) *Approval {
+	// The replay must not be answered from the cache of the original request
+	request := c.Request.Clone(context.Background())
+	request.Header.Del("Idempotency-Key")
+
+	now := time.Now()
+	approval := &Approval{
+		ID:      uuid.NewString(),
+		Class:   class,
+		Token:   RequestToken(c).Name,
+		Action:  c.Request.Method + " " + c.FullPath(),
+		Target:  target,
+		Details: details,
+		Status:  ApprovalPending,
+		Created: now,
+		Expires: now.Add(a.config.ApprovalTTL),
+		request: request,
+		body:    body,
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.expire()
+	a.approvals[approval.ID] = approval
+	return approval
+}
+
+// lookup finds the approval of a request, if the token can see it
+func (a *Approvals) lookup(c *gin.Context) (*Approval, bool) {
+	token := RequestToken(c)
+
+	a.mutex.Lock()
+	a.expire()
+	approval, exists := a.approvals[c.Param("id")]
+	a.mutex.Unlock()
+
+	if !exists || !(token.HasScope(ScopeApprove) || approval.Token == token.Name) {
+		c.JSON(http.StatusNotFound, ApprovalOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Approval not found"),
+		})
+		return nil, false
+	}
+	return approval, true
+}
+
+// resolve approves or rejects a pending approval, checking the token may
+func (a *Approvals) resolve(c *gin.Context, status string) (*Approval, bool) {
+	approval, ok := a.lookup(c)
+	if !ok {
+		return nil, false
+	}
+	token := RequestToken(c)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var message string
+	code := ErrPermission
+	switch {
+	case approval.Status != ApprovalPending:
+		code, message = ErrConflict, Localize(c, "The approval is %s already", approval.Status)
+	case status == ApprovalApproved && !token.HasScope(ScopeApprove):
+		message = Localize(c, "Approving operations requires the approve permission")
+	case status == ApprovalApproved && approval.Token == token.Name:
+		message = Localize(c, "Operations must be approved by another token than the one that requested them")
+	case status == ApprovalRejected && !token.HasScope(ScopeApprove) && approval.Token != token.Name:
+		message = Localize(c, "Rejecting operations requires the approve permission")
+	}
+	if message != "" {
+		c.JSON(codeStatus(code), ApprovalOperation{Success: false, Code: code, Message: message, Data: *approval})
+		return nil, false
+	}
+
+	now := time.Now()
+	approval.Status, approval.Resolver, approval.Resolved = status, token.Name, &now
+	if status == ApprovalRejected {
+		approval.request, approval.body = nil, nil
+	}
+	return approval, true
+}
+
+// snapshot copies an approval, to encode it while it may change
+func (a *Approvals) snapshot(approval *Approval) Approval {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return *approval
+}
+
+// expire marks the approvals past their TTL as expired, and forgets the
+// resolved ones a TTL later. The caller holds the mutex.
+func (a *Approvals) expire() {
+	now := time.Now()
+	for id, approval := range a.approvals {
+		switch {
+		case approval.Status == ApprovalPending && now.After(approval.Expires):
+			approval.Status = ApprovalExpired
+			approval.request, approval.body = nil, nil
+		case approval.Status != ApprovalPending && now.After(approval.Expires.Add(a.config.ApprovalTTL)):
+			delete(a.approvals, id)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package modules
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// archiveFormats are the content types of the formats of directory
+// downloads, by format
+var archiveFormats = map[string]string{
+	"zip":    "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+// REST API Handlers
+
+// DownloadDirectory streams a directory as a zip or tar.gz archive, built on
+// the fly. The tree is walked once before the response starts, so missing
+// paths and trees past the walk limits still get an error response.
+func (fsm *FileSystemModule) DownloadDirectory(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+	format := c.DefaultQuery("format", "zip")
+	contentType, known := archiveFormats[format]
+	if !known {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", fmt.Errorf("format must be zip or tar.gz")),
+		})
+		return
+	}
+
+	boundary := newWalkBoundary(path, walkOptionsQuery(c))
+	var size int64
+	err := walkArchive(path, boundary, newWalkLimits(fsm.config), func(_, _ string, info fs.FileInfo) error {
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err == nil {
+		if info, statErr := os.Stat(path); statErr == nil && !info.IsDir() {
+			err = fmt.Errorf("%w: %s is not a directory", errInvalidRequest, path)
+		}
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to download directory: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	name := filepath.Base(filepath.Clean(path)) + "." + format
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	// Progress counts the bytes of the files read, the archive size isn't
+	// known in advance
+	task := fsm.tasks.Start(c, "archive", path, unitBytes)
+	task.SetTotal(size)
+	c.Status(http.StatusOK)
+
+	// Headers are already sent, errors can only abort the stream
+	err = writeArchive(c.Writer, format, path, boundary, newWalkLimits(fsm.config), task)
+	task.Finish(err)
+	if err != nil {
+		c.Error(err)
+	}
+}
+
+// Helper functions
+
+// walkArchive calls fn with the archive name, path and info of every
+// directory and regular file of root, named below the base name of root
+func walkArchive(root string, boundary *walkBoundary, limits *walkLimits, fn func(name, path string, info fs.FileInfo) error) error {
+	base := filepath.Base(filepath.Clean(root))
+	return limits.walk(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if boundary.excludes(path, d) {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(filepath.Join(base, rel)), path, info)
+	})
+}
+
+// writeArchive writes the archive of root in a format to w, streaming each
+// file as it's read and counting it in a task
+func writeArchive(w io.Writer, format, root string, boundary *walkBoundary, limits *walkLimits, task *Task) error {
+	if format == "zip" {
+		zw := zip.NewWriter(w)
+		err := walkArchive(root, boundary, limits, func(name, path string, info fs.FileInfo) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if info.IsDir() {
+				header.Name += "/"
+				_, err := zw.CreateHeader(header)
+				return err
+			}
+			header.Method = zip.Deflate
+			entry, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			return archiveFile(entry, path, -1, task)
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := walkArchive(root, boundary, limits, func(name, path string, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		// Files growing while archived are cut at their size in the header
+		return archiveFile(tw, path, header.Size, task)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// archiveFile copies the first n bytes of a file to w, all of it when n is
+// negative
+func archiveFile(w io.Writer, path string, n int64, task *Task) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if n < 0 {
+		_, err = io.Copy(w, task.Reader(file))
+	} else {
+		_, err = io.CopyN(w, task.Reader(file), n)
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package modules
+
+import (
+	"crypto/subtle"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Scopes granting access to privileged operations
+const (
+	ScopeAll           = "*"
+	ScopeApprove       = "approve"
+	ScopeAudit         = "audit"
+	ScopeEnvReveal     = "env.reveal"
+	ScopeFirewall      = "firewall"
+	ScopeFleet         = "fleet"
+	ScopeFleetRegister = "fleet.register"
+	ScopeMounts        = "mounts"
+	ScopeNotify        = "notify"
+	ScopeScan          = "scan"
+	ScopeTemplates     = "templates"
+)
+
+type Token struct {
+	Name   string
+	Value  string
+	Scopes map[string]bool
+}
+
+// Tokens is the set of credentials accepted by the API and Socket.IO
+type Tokens struct {
+	tokens []*Token
+}
+
+// NewTokens builds the token table from the admin token, which is granted
+// every scope, and an optional spec of additional tokens in the form
+// "name:token:scope,scope;name:token:scope"
+func NewTokens(adminToken, spec string) *Tokens {
+	tokens := []*Token{{
+		Name:   "admin",
+		Value:  adminToken,
+		Scopes: map[string]bool{ScopeAll: true},
+	}}
+
+	for _, entry := range strings.Split(spec, ";") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+
+		token := &Token{
+			Name:   parts[0],
+			Value:  parts[1],
+			Scopes: make(map[string]bool),
+		}
+		if len(parts) == 3 {
+			for _, scope := range strings.Split(parts[2], ",") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					token.Scopes[scope] = true
+				}
+			}
+		}
+		tokens = append(tokens, token)
+	}
+
+	return &Tokens{tokens: tokens}
+}
+
+// Lookup returns the token matching value, or nil
+func (t *Tokens) Lookup(value string) *Token {
+	for _, token := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Value), []byte(value)) == 1 {
+			return token
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether the token grants scope
+func (t *Token) HasScope(scope string) bool {
+	return t != nil && (t.Scopes[ScopeAll] || t.Scopes[scope])
+}
+
+// RequestToken returns the token that authenticated the request
+func RequestToken(c *gin.Context) *Token {
+	if value, exists := c.Get("token"); exists {
+		if token, ok := value.(*Token); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// ConnToken returns the token that authenticated a Socket.IO connection
+func ConnToken(conn socketio.Conn) *Token {
+	token, _ := conn.Context().(*Token)
+	return token
+}
+
+// ConnHost returns the address of the client of a Socket.IO connection,
+// without its port
+func ConnHost(conn socketio.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// TokenRoom is the Socket.IO room joined by every connection of a token
+func TokenRoom(token *Token) string {
+	if token == nil {
+		return "token:"
+	}
+	return "token:" + token.Name
+}
@@ -0,0 +1,301 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// bookmarksMaxPerToken caps the bookmarks of a token
+const bookmarksMaxPerToken = 1000
+
+// Bookmarks keeps the path bookmarks of each token in BOOKMARKS_FILE, so
+// every session of a token sees the same ones across restarts
+type Bookmarks struct {
+	file    string
+	byToken map[string][]*Bookmark // by token name, in creation order
+	mutex   sync.Mutex
+}
+
+// Bookmark is a path saved by a token
+type Bookmark struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type BookmarkRequest struct {
+	Name string `json:"name" binding:"max=256"` // the last element of the path when empty
+	Path string `json:"path" binding:"required"`
+}
+
+func NewBookmarks(config *Config) (*Bookmarks, error) {
+	b := &Bookmarks{
+		file:    config.BookmarksFile,
+		byToken: make(map[string][]*Bookmark),
+	}
+	content, err := os.ReadFile(b.file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("BOOKMARKS_FILE: %w", err)
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &b.byToken); err != nil {
+			log.Printf("Ignoring corrupt bookmarks file: %v", err)
+			b.byToken = make(map[string][]*Bookmark)
+		}
+	}
+	return b, nil
+}
+
+// REST API Handlers
+
+// ListBookmarks lists the bookmarks of the token, oldest first
+func (fsm *FileSystemModule) ListBookmarks(c *gin.Context) {
+	bookmarks := fsm.bookmarks.list(tokenName(RequestToken(c)))
+	page, total, next, err := paginate(c, bookmarks)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success:    true,
+		Message:    Localize(c, "Bookmarks retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// CreateBookmark bookmarks a path for the token
+func (fsm *FileSystemModule) CreateBookmark(c *gin.Context) {
+	var req BookmarkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+
+	token := RequestToken(c)
+	bookmark, err := fsm.bookmarks.create(tokenName(token), req)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create bookmark: %v", err),
+		})
+		return
+	}
+	fsm.bookmarksChanged(token, "created", bookmark)
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Bookmark created"),
+		Data:    bookmark,
+	})
+}
+
+// UpdateBookmark renames a bookmark of the token or points it to another
+// path
+func (fsm *FileSystemModule) UpdateBookmark(c *gin.Context) {
+	var req BookmarkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+
+	token := RequestToken(c)
+	bookmark, err := fsm.bookmarks.update(tokenName(token), c.Param("id"), req)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to update bookmark: %v", err),
+		})
+		return
+	}
+	fsm.bookmarksChanged(token, "updated", bookmark)
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Bookmark updated"),
+		Data:    bookmark,
+	})
+}
+
+// DeleteBookmark removes a bookmark of the token
+func (fsm *FileSystemModule) DeleteBookmark(c *gin.Context) {
+	token := RequestToken(c)
+	bookmark, err := fsm.bookmarks.remove(tokenName(token), c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to delete bookmark: %v", err),
+		})
+		return
+	}
+	fsm.bookmarksChanged(token, "deleted", bookmark)
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Bookmark deleted"),
+	})
+}
+
+// Helper functions
+
+// bookmarksChanged sends fs:bookmarks to every connection of the token with
+// the change and the bookmarks as they are now
+func (fsm *FileSystemModule) bookmarksChanged(token *Token, action string, bookmark Bookmark) {
+	fsm.emitter.Broadcast(fsm.server, TokenRoom(token), "fs:bookmarks", map[string]interface{}{
+		"action":    action,
+		"bookmark":  bookmark,
+		"bookmarks": fsm.bookmarks.list(tokenName(token)),
+	})
+}
+
+// list returns copies of the bookmarks of a token, the originals change
+// under the mutex
+func (b *Bookmarks) list(token string) []Bookmark {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bookmarks := make([]Bookmark, 0, len(b.byToken[token]))
+	for _, bookmark := range b.byToken[token] {
+		bookmarks = append(bookmarks, *bookmark)
+	}
+	return bookmarks
+}
+
+func (b *Bookmarks) create(token string, req BookmarkRequest) (Bookmark, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.byToken[token]) >= bookmarksMaxPerToken {
+		return Bookmark{}, fmt.Errorf("%w: at most %d bookmarks per token", errInvalidRequest, bookmarksMaxPerToken)
+	}
+	if existing := b.find(token, func(bookmark *Bookmark) bool { return bookmark.Path == req.Path }); existing != nil {
+		return Bookmark{}, fmt.Errorf("%s is bookmarked as %q: %w", req.Path, existing.Name, os.ErrExist)
+	}
+
+	now := time.Now()
+	bookmark := &Bookmark{ID: uuid.NewString(), Name: bookmarkName(req), Path: req.Path, Created: now, Updated: now}
+	b.byToken[token] = append(b.byToken[token], bookmark)
+	if err := b.save(); err != nil {
+		log.Printf("Failed to save bookmarks: %v", err)
+	}
+	return *bookmark, nil
+}
+
+func (b *Bookmarks) update(token, id string, req BookmarkRequest) (Bookmark, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bookmark := b.find(token, func(bookmark *Bookmark) bool { return bookmark.ID == id })
+	if bookmark == nil {
+		return Bookmark{}, fmt.Errorf("bookmark %s: %w", id, os.ErrNotExist)
+	}
+	if existing := b.find(token, func(other *Bookmark) bool { return other.Path == req.Path && other != bookmark }); existing != nil {
+		return Bookmark{}, fmt.Errorf("%s is bookmarked as %q: %w", req.Path, existing.Name, os.ErrExist)
+	}
+
+	bookmark.Name, bookmark.Path, bookmark.Updated = bookmarkName(req), req.Path, time.Now()
+	if err := b.save(); err != nil {
+		log.Printf("Failed to save bookmarks: %v", err)
+	}
+	return *bookmark, nil
+}
+
+func (b *Bookmarks) remove(token, id string) (Bookmark, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bookmarks := b.byToken[token]
+	for i, bookmark := range bookmarks {
+		if bookmark.ID != id {
+			continue
+		}
+		b.byToken[token] = append(bookmarks[:i:i], bookmarks[i+1:]...)
+		if len(b.byToken[token]) == 0 {
+			delete(b.byToken, token)
+		}
+		if err := b.save(); err != nil {
+			log.Printf("Failed to save bookmarks: %v", err)
+		}
+		return *bookmark, nil
+	}
+	return Bookmark{}, fmt.Errorf("bookmark %s: %w", id, os.ErrNotExist)
+}
+
+// find returns the first bookmark of a token matching, nil when none does.
+// The caller holds the mutex.
+func (b *Bookmarks) find(token string, match func(*Bookmark) bool) *Bookmark {
+	for _, bookmark := range b.byToken[token] {
+		if match(bookmark) {
+			return bookmark
+		}
+	}
+	return nil
+}
+
+// save writes the bookmarks file. The caller holds the mutex.
+func (b *Bookmarks) save() error {
+	content, err := json.Marshal(b.byToken)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.file), 0700); err != nil {
+		return err
+	}
+
+	tmp := b.file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.file)
+}
+
+// bookmarkName is the name of a bookmark, the last element of its path when
+// none is given
+func bookmarkName(req BookmarkRequest) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	return filepath.Base(req.Path)
+}
+
+// tokenName is the name bookmarks of a token are kept under
+func tokenName(token *Token) string {
+	if token == nil {
+		return ""
+	}
+	return token.Name
+}
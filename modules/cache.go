@@ -0,0 +1,411 @@
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DownloadCache keeps downloaded files in a content-addressed store, so
+// repeated downloads of an artifact are served locally. Entries are found by
+// URL, revalidated with the server's ETag or Last-Modified, or by checksum,
+// which needs no request at all. A nil cache is disabled.
+type DownloadCache struct {
+	dir     string
+	maxSize int64
+	entries map[string]*CacheEntry // by key
+	mutex   sync.Mutex
+}
+
+// CacheEntry maps a URL or checksum to a stored object
+type CacheEntry struct {
+	Key          string    `json:"key"` // "url:<sha256 of the url>" or "<algorithm>:<hex>"
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	URL          string    `json:"url"` // without credentials, query or fragment
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	LastUsed     time.Time `json:"last_used"`
+}
+
+func NewDownloadCache(config *Config) (*DownloadCache, error) {
+	if config.DownloadCacheDir == "" {
+		return nil, nil
+	}
+
+	cache := &DownloadCache{
+		dir:     config.DownloadCacheDir,
+		maxSize: config.DownloadCacheMaxSize,
+		entries: make(map[string]*CacheEntry),
+	}
+	if err := os.MkdirAll(filepath.Join(cache.dir, "objects"), 0700); err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(cache.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		var entries []*CacheEntry
+		if err := json.Unmarshal(content, &entries); err != nil {
+			log.Printf("Ignoring corrupt download cache index: %v", err)
+		}
+		for _, entry := range entries {
+			// Indexes of older versions keyed entries by the URL as is
+			if raw, ok := strings.CutPrefix(entry.Key, "url:"); ok && strings.Contains(raw, "://") {
+				entry.Key, entry.URL = cacheURLKey(raw), redactURL(raw)
+			}
+			if _, err := os.Stat(cache.objectPath(entry.SHA256)); err == nil {
+				cache.entries[entry.Key] = entry
+			}
+		}
+	}
+	return cache, nil
+}
+
+// REST API Handlers
+
+// CacheStatus lists the cached downloads
+func (nm *NetworkModule) CacheStatus(c *gin.Context) {
+	if nm.cache == nil {
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Download cache is disabled"),
+		})
+		return
+	}
+
+	entries, size := nm.cache.list()
+	page, total, next, err := paginate(c, entries)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Download cache retrieved"),
+		Data: map[string]interface{}{
+			"entries":  page,
+			"size":     size,
+			"max_size": nm.cache.maxSize,
+		},
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// PurgeCache removes the entries of a URL or checksum from the cache, or
+// every entry without a filter
+func (nm *NetworkModule) PurgeCache(c *gin.Context) {
+	if nm.cache == nil {
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Download cache is disabled"),
+		})
+		return
+	}
+
+	var sha string
+	if value := c.Query("checksum"); value != "" {
+		sum, err := parseChecksum(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, NetworkOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", err),
+			})
+			return
+		}
+		sha = sum.algorithm + ":" + sum.expected
+	}
+
+	removed, freed, err := nm.cache.purge(c.Query("url"), sha)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to purge cache: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Download cache purged"),
+		Data: map[string]interface{}{
+			"removed":     removed,
+			"bytes_freed": freed,
+		},
+	})
+}
+
+// Helper functions
+
+// lookup returns the entry of key, or for sha256 checksums any entry of the
+// object, marking it as used
+func (dc *DownloadCache) lookup(key string) *CacheEntry {
+	if dc == nil || key == "" {
+		return nil
+	}
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	entry := dc.entries[key]
+	if entry == nil {
+		if sha, ok := strings.CutPrefix(key, "sha256:"); ok {
+			for _, candidate := range dc.entries {
+				if candidate.SHA256 == sha {
+					entry = candidate
+					break
+				}
+			}
+		}
+	}
+	if entry == nil {
+		return nil
+	}
+	entry.LastUsed = time.Now()
+	copied := *entry
+	return &copied
+}
+
+// restore copies the object of entry to w, verifying its content. Corrupt
+// objects are dropped from the cache.
+func (dc *DownloadCache) restore(entry *CacheEntry, w io.Writer) (int64, error) {
+	file, err := os.Open(dc.objectPath(entry.SHA256))
+	if err != nil {
+		dc.drop(entry.SHA256)
+		return 0, err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, digest), file)
+	if err != nil {
+		return n, err
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != entry.SHA256 {
+		dc.drop(entry.SHA256)
+		return n, fmt.Errorf("%w: cached object %s is corrupt", errChecksumMismatch, entry.SHA256)
+	}
+	return n, nil
+}
+
+// store copies the downloaded file at path into the cache under keys,
+// evicting the least recently used objects beyond the size limit
+func (dc *DownloadCache) store(path string, keys []string, entry CacheEntry) error {
+	if dc == nil {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Join(dc.dir, "objects"), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digest := sha256.New()
+	entry.Size, err = io.Copy(io.MultiWriter(tmp, digest), src)
+	if err != nil {
+		return err
+	}
+	if dc.maxSize > 0 && entry.Size > dc.maxSize {
+		return nil
+	}
+	entry.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dc.objectPath(entry.SHA256)); err != nil {
+		return err
+	}
+
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	entry.LastUsed = time.Now()
+	for _, key := range keys {
+		stored := entry
+		stored.Key = key
+		replaced := dc.entries[key]
+		dc.entries[key] = &stored
+
+		// A new version of a URL may leave the previous object unreferenced
+		if replaced != nil && replaced.SHA256 != entry.SHA256 && !dc.referenced(replaced.SHA256) {
+			dc.remove(replaced.SHA256)
+		}
+	}
+	dc.evict()
+	return dc.save()
+}
+
+// purge removes the entries matching url or checksum, or all without either,
+// deleting the objects no longer referenced. A URL matches its own entry,
+// and as listed, without its query, those of every presigned variant.
+func (dc *DownloadCache) purge(url, checksum string) (int, int64, error) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	shas := make(map[string]bool)
+	for key, entry := range dc.entries {
+		if url == "" && checksum == "" || url != "" && (key == cacheURLKey(url) || entry.URL == url) || checksum != "" && (key == checksum || "sha256:"+entry.SHA256 == checksum) {
+			shas[entry.SHA256] = true
+		}
+	}
+
+	removed := 0
+	var freed int64
+	for sha := range shas {
+		n, size := dc.remove(sha)
+		removed += n
+		freed += size
+	}
+	return removed, freed, dc.save()
+}
+
+// cacheURLKey returns the key of the entry of a URL, hashed so credentials
+// and signatures of the URL are never stored
+func cacheURLKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "url:" + hex.EncodeToString(sum[:])
+}
+
+// drop removes a missing or corrupt object
+func (dc *DownloadCache) drop(sha string) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	dc.remove(sha)
+	if err := dc.save(); err != nil {
+		log.Printf("Failed to save download cache index: %v", err)
+	}
+}
+
+// list returns the entries sorted by key and the size of the stored objects
+func (dc *DownloadCache) list() ([]CacheEntry, int64) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	entries := make([]CacheEntry, 0, len(dc.entries))
+	for _, entry := range dc.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, dc.size()
+}
+
+// evict removes the least recently used objects until the cache fits its
+// size limit. The caller must hold the mutex.
+func (dc *DownloadCache) evict() {
+	if dc.maxSize <= 0 {
+		return
+	}
+	for dc.size() > dc.maxSize {
+		var oldest *CacheEntry
+		for _, entry := range dc.entries {
+			if oldest == nil || entry.LastUsed.Before(oldest.LastUsed) {
+				oldest = entry
+			}
+		}
+		dc.remove(oldest.SHA256)
+	}
+}
+
+// remove deletes an object and its entries, returning how many entries were
+// removed and the size freed. The caller must hold the mutex.
+func (dc *DownloadCache) remove(sha string) (int, int64) {
+	removed := 0
+	var size int64
+	for key, entry := range dc.entries {
+		if entry.SHA256 == sha {
+			delete(dc.entries, key)
+			removed++
+			size = entry.Size
+		}
+	}
+	if err := os.Remove(dc.objectPath(sha)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove cached object %s: %v", sha, err)
+	}
+	return removed, size
+}
+
+// referenced reports whether an entry uses the object. The caller must hold
+// the mutex.
+func (dc *DownloadCache) referenced(sha string) bool {
+	for _, entry := range dc.entries {
+		if entry.SHA256 == sha {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the size of the stored objects. The caller must hold the mutex.
+func (dc *DownloadCache) size() int64 {
+	sizes := make(map[string]int64)
+	for _, entry := range dc.entries {
+		sizes[entry.SHA256] = entry.Size
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// save writes the index. The caller must hold the mutex.
+func (dc *DownloadCache) save() error {
+	entries := make([]*CacheEntry, 0, len(dc.entries))
+	for _, entry := range dc.entries {
+		entries = append(entries, entry)
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := dc.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dc.indexPath())
+}
+
+func (dc *DownloadCache) indexPath() string {
+	return filepath.Join(dc.dir, "index.json")
+}
+
+func (dc *DownloadCache) objectPath(sha string) string {
+	return filepath.Join(dc.dir, "objects", sha)
+}
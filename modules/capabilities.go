@@ -0,0 +1,311 @@
+package modules
+
+import (
+	"net/http"
+	"os/exec"
+	"runtime"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons an operation isn't available
+const (
+	CapabilityUnsupported = "unsupported" // not on this OS
+	CapabilityDisabled    = "disabled"    // by the configuration of the agent
+	CapabilityMissing     = "missing"     // a program it runs isn't installed
+	CapabilityForbidden   = "forbidden"   // the token lacks a permission
+)
+
+// CapabilitiesModule describes what the agent can do for a token, so clients
+// adapt their UI up front instead of hitting errors at run time
+type CapabilitiesModule struct {
+	config   *Config
+	firewall *FirewallModule
+	store    *Store
+}
+
+// Capability tells whether an operation is available, and why not
+type Capability struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"` // unsupported, disabled, missing or forbidden
+	Message string `json:"message,omitempty"`
+}
+
+// ModuleCapabilities are the operations of a module and the limits applying
+// to them, 0 standing for no limit
+type ModuleCapabilities struct {
+	Operations map[string]Capability `json:"operations"`
+	Limits     map[string]int64      `json:"limits,omitempty"`
+}
+
+type CapabilityOperation struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func NewCapabilitiesModule(config *Config, firewall *FirewallModule, store *Store) *CapabilitiesModule {
+	return &CapabilitiesModule{
+		config:   config,
+		firewall: firewall,
+		store:    store,
+	}
+}
+
+// REST API Handlers
+
+// GetCapabilities lists, per module, the operations available to the token
+// of the request on this agent and the limits applying to them
+func (cm *CapabilitiesModule) GetCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, CapabilityOperation{
+		Success: true,
+		Message: Localize(c, "Capabilities retrieved"),
+		Data: gin.H{
+			"os":        runtime.GOOS,
+			"arch":      runtime.GOARCH,
+			"read_only": cm.config.ReadOnly,
+			"modules": map[string]ModuleCapabilities{
+				"fs":        cm.fsCapabilities(c),
+				"net":       cm.netCapabilities(c),
+				"shell":     cm.shellCapabilities(c),
+				"provision": cm.provisionCapabilities(c),
+				"fleet":     cm.fleetCapabilities(c),
+				"records":   cm.recordCapabilities(c),
+				"approvals": cm.approvalCapabilities(c),
+				"notifications": {Operations: map[string]Capability{
+					"channels": available(),
+					"test": capability(
+						enabledBy(c, cm.config.NotifyChannels != "", "No notification channels, set NOTIFY_CHANNELS to configure them"),
+						permitted(c, ScopeNotify, "Sending notifications requires the notify permission"),
+					),
+				}},
+				"tasks": {Operations: map[string]Capability{"list": available(), "cancel": available()}},
+			},
+		},
+	})
+}
+
+// Helper functions
+
+func (cm *CapabilitiesModule) fsCapabilities(c *gin.Context) ModuleCapabilities {
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"files":      available(),
+			"archives":   available(),
+			"transfers":  available(),
+			"watch":      available(),
+			"replicate":  capability(cm.writable(c), available()),
+			"tmp":        capability(cm.writable(c), available()),
+			"raw":        available(),
+			"download":   available(),
+			"stream":     installed(c, "ffmpeg", "Media streaming requires ffmpeg"),
+			"places":     available(),
+			"bookmarks":  available(),
+			"report":     available(),
+			"env":        available(),
+			"structured": capability(cm.writable(c), available()),
+			"replace":    capability(cm.writable(c), available()),
+			"grep":       available(),
+			"index":      enabledBy(c, cm.config.IndexPaths != "", "Content indexing is disabled, set INDEX_PATHS to enable it"),
+			"env_reveal": permitted(c, ScopeEnvReveal, "Revealing values requires the env.reveal permission"),
+			"openby":     supportedOn(c, "linux"),
+			"mounts": capability(
+				cm.writable(c),
+				supportedOn(c, "linux"),
+				enabledBy(c, cm.config.MountsEnabled, "Mount management is disabled, set MOUNTS_ENABLED to enable it"),
+				permitted(c, ScopeMounts, "Managing mounts requires the mounts permission"),
+			),
+		},
+		Limits: map[string]int64{
+			"read_max_size":     cm.config.ReadMaxSize,
+			"write_max_body":    bodyLimit(cm.config, cm.config.BodyLimitWrite),
+			"upload_max_body":   bodyLimit(cm.config, cm.config.BodyLimitUpload),
+			"max_file_size":     cm.config.QuotaMaxFileSize,
+			"daily_bytes":       cm.config.QuotaDailyBytes,
+			"min_free_disk":     cm.config.QuotaMinFreeDisk,
+			"walk_max_depth":    int64(cm.config.WalkMaxDepth),
+			"walk_max_entries":  int64(cm.config.WalkMaxEntries),
+			"walk_max_duration": int64(cm.config.WalkMaxDuration.Seconds()),
+			"tmp_max_ttl":       int64(cm.config.TmpMaxTTL.Seconds()),
+		},
+	}
+}
+
+func (cm *CapabilitiesModule) netCapabilities(c *gin.Context) ModuleCapabilities {
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"download":       capability(cm.writable(c), available()),
+			"download_cache": enabledBy(c, cm.config.DownloadCacheDir != "", "The download cache is disabled, set DOWNLOAD_CACHE_DIR to enable it"),
+			"s3":             capability(cm.writable(c), available()),
+			"ftp":            capability(cm.writable(c), available()),
+			"speedtest":      available(),
+			"whois":          available(),
+			"hosts":          available(),
+			"resolver":       supportedOn(c, "linux", "darwin", "freebsd", "openbsd", "netbsd"),
+			"ports":          supportedOn(c, "linux", "darwin", "freebsd", "openbsd", "netbsd", "windows"),
+			"capture":        installed(c, "tcpdump", "Packet capture requires tcpdump"),
+			"scan":           permitted(c, ScopeScan, "Port scans require the scan permission"),
+			"portmap":        capability(cm.writable(c), permitted(c, ScopeFirewall, "Changing port mappings requires the firewall permission")),
+			"discover":       enabledBy(c, cm.config.DiscoveryEnabled, "LAN discovery is disabled, set DISCOVERY_ENABLED to enable it"),
+			"firewall": capability(
+				cm.writable(c),
+				supportedOn(c, "linux"),
+				cm.firewallBackend(c),
+				permitted(c, ScopeFirewall, "Changing firewall rules requires the firewall permission"),
+			),
+		},
+		Limits: map[string]int64{
+			"rate_limit":        cm.config.RateLimit,
+			"rate_limit_job":    cm.config.RateLimitJob,
+			"download_segments": int64(cm.config.DownloadSegments),
+			"scan_max_probes":   int64(cm.config.ScanMaxProbes),
+			"discovery_rate":    int64(cm.config.DiscoveryRate),
+		},
+	}
+}
+
+func (cm *CapabilitiesModule) shellCapabilities(c *gin.Context) ModuleCapabilities {
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"exec":             capability(cm.writable(c), available()),
+			"sessions":         capability(cm.writable(c), supportedOn(c, "linux", "darwin", "freebsd", "openbsd", "netbsd")),
+			"session_info":     supportedOn(c, "linux"),
+			"tmux":             installed(c, "tmux", "tmux is not installed"),
+			"templates":        capability(cm.writable(c), available()),
+			"manage_templates": capability(cm.writable(c), permitted(c, ScopeTemplates, "Managing templates requires the templates permission")),
+			"stats": capability(
+				supportedOn(c, "linux"),
+				enabledBy(c, cm.config.ShellStatsInterval > 0, "Session statistics are disabled"),
+			),
+		},
+		Limits: map[string]int64{
+			"max_sessions":  int64(cm.config.ShellMaxSessions),
+			"exec_max_body": bodyLimit(cm.config, cm.config.BodyLimitExec),
+			"detach_ttl":    int64(cm.config.ShellDetachTTL.Seconds()),
+		},
+	}
+}
+
+func (cm *CapabilitiesModule) provisionCapabilities(c *gin.Context) ModuleCapabilities {
+	packages := available()
+	if _, err := detectPackageManager(); err != nil {
+		packages = Capability{Reason: CapabilityMissing, Message: Localize(c, "No supported package manager found")}
+	}
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"files":    capability(cm.writable(c), available()),
+			"commands": capability(cm.writable(c), available()),
+			"packages": capability(cm.writable(c), packages),
+			"services": capability(cm.writable(c), installed(c, "systemctl", "Services require systemctl")),
+		},
+	}
+}
+
+func (cm *CapabilitiesModule) fleetCapabilities(c *gin.Context) ModuleCapabilities {
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"agents":       available(),
+			"inventory":    available(),
+			"registration": enabledBy(c, cm.config.FleetController != "", "Registration is disabled, set FLEET_CONTROLLER to enable it"),
+			"register":     permitted(c, ScopeFleetRegister, "Registering agents requires the fleet.register permission"),
+			"exec": capability(
+				cm.writable(c),
+				enabledBy(c, cm.config.FleetAgents != "", "No fleet agents are configured"),
+				permitted(c, ScopeFleet, "Running commands on the fleet requires the fleet permission"),
+			),
+		},
+		Limits: map[string]int64{
+			"parallel": int64(cm.config.FleetParallel),
+		},
+	}
+}
+
+func (cm *CapabilitiesModule) recordCapabilities(c *gin.Context) ModuleCapabilities {
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"search": capability(
+				enabledBy(c, cm.store != nil, "The record store is disabled, set STORE_PATH to enable it"),
+				permitted(c, ScopeAudit, "Searching the records requires the audit permission"),
+			),
+		},
+		Limits: map[string]int64{
+			"retention_days": int64(cm.config.StoreRetention.Hours() / 24),
+		},
+	}
+}
+
+func (cm *CapabilitiesModule) approvalCapabilities(c *gin.Context) ModuleCapabilities {
+	return ModuleCapabilities{
+		Operations: map[string]Capability{
+			"request": available(),
+			"approve": permitted(c, ScopeApprove, "Approving operations requires the approve permission"),
+		},
+		Limits: map[string]int64{
+			"delete_files": int64(cm.config.ApprovalDeleteFiles),
+			"ttl":          int64(cm.config.ApprovalTTL.Seconds()),
+		},
+	}
+}
+
+// writable requires an agent that isn't read-only
+func (cm *CapabilitiesModule) writable(c *gin.Context) Capability {
+	return enabledBy(c, !cm.config.ReadOnly, "The agent is read-only")
+}
+
+// firewallBackend checks that nft or iptables was found at startup
+func (cm *CapabilitiesModule) firewallBackend(c *gin.Context) Capability {
+	if cm.firewall.backend == nil {
+		return Capability{Reason: CapabilityMissing, Message: Localize(c, "No firewall backend found, install nftables or iptables")}
+	}
+	return available()
+}
+
+func available() Capability {
+	return Capability{Enabled: true}
+}
+
+// capability is available unless one of its requirements isn't, reporting
+// the first that isn't
+func capability(requirements ...Capability) Capability {
+	for _, requirement := range requirements {
+		if !requirement.Enabled {
+			return requirement
+		}
+	}
+	return available()
+}
+
+// supportedOn requires the agent to run on one of the operating systems
+func supportedOn(c *gin.Context, systems ...string) Capability {
+	for _, system := range systems {
+		if runtime.GOOS == system {
+			return available()
+		}
+	}
+	return Capability{Reason: CapabilityUnsupported, Message: Localize(c, "Not supported on %s", runtime.GOOS)}
+}
+
+// enabledBy requires a setting of the agent, explained by message
+func enabledBy(c *gin.Context, enabled bool, message string) Capability {
+	if !enabled {
+		return Capability{Reason: CapabilityDisabled, Message: Localize(c, message)}
+	}
+	return available()
+}
+
+// installed requires a program in the PATH, explained by message
+func installed(c *gin.Context, program, message string) Capability {
+	if _, err := exec.LookPath(program); err != nil {
+		return Capability{Reason: CapabilityMissing, Message: Localize(c, message)}
+	}
+	return available()
+}
+
+// permitted requires a permission of the token, explained by message
+func permitted(c *gin.Context, scope, message string) Capability {
+	if !RequestToken(c).HasScope(scope) {
+		return Capability{Reason: CapabilityForbidden, Message: Localize(c, message)}
+	}
+	return available()
+}
@@ -0,0 +1,468 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Link types of pcap files, from the tcpdump.org list
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeRawIPv4  = 228
+	linkTypeRawIPv6  = 229
+	linkTypeSLL2     = 276
+)
+
+// PacketCapture is a running tcpdump capture of a connection
+type PacketCapture struct {
+	id       string
+	connID   string
+	path     string
+	cmd      *exec.Cmd
+	reason   string // why the capture ended, set once
+	packets  int
+	bytes    int64
+	stderr   bytes.Buffer
+	maxBytes int64
+	timer    *time.Timer
+	mutex    sync.Mutex
+}
+
+// PacketSummary describes a captured packet
+type PacketSummary struct {
+	CaptureID       string  `json:"capture_id"`
+	Number          int     `json:"number"`
+	Timestamp       float64 `json:"timestamp"` // Unix time in seconds, to the microsecond
+	Length          int     `json:"length"`    // on the wire, the pcap may hold less
+	Protocol        string  `json:"protocol"`  // tcp, udp, icmp, icmpv6, arp, or the EtherType in hex
+	Source          string  `json:"source,omitempty"`
+	Destination     string  `json:"destination,omitempty"`
+	SourcePort      int     `json:"source_port,omitempty"`
+	DestinationPort int     `json:"destination_port,omitempty"`
+	Flags           string  `json:"flags,omitempty"` // TCP flags as tcpdump writes them, e.g. "S." for SYN-ACK
+}
+
+// Socket.IO Handlers
+
+// StartCapture runs tcpdump on an interface, writing the packets to a pcap
+// file and sending a summary of each one. The capture ends after max_packets
+// packets, duration seconds or max_bytes of pcap, whichever comes first.
+func (nm *NetworkModule) StartCapture(conn socketio.Conn, req CaptureRequest) EventResult {
+	if req.Interface != "any" && !interfacePattern.MatchString(req.Interface) {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid request: %v", fmt.Sprintf("invalid interface %q", req.Interface)),
+		})
+	}
+	if req.Path != "" && nm.config.ReadOnly {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    ErrReadOnly,
+			"message": localizeConn(conn, "The agent is read-only, captures can only be written to a temporary file"),
+		})
+	}
+	if err := nm.paths.Resolve(&req.Path); err != nil {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+		})
+	}
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "Packet capture requires tcpdump"),
+		})
+	}
+
+	maxPackets, duration, maxBytes, snaplen := req.MaxPackets, req.Duration, req.MaxBytes, req.Snaplen
+	if maxPackets == 0 {
+		maxPackets = 1000
+	}
+	if duration == 0 {
+		duration = 60
+	}
+	if maxBytes == 0 {
+		maxBytes = 100 << 20
+	}
+	if snaplen == 0 {
+		snaplen = 262144
+	}
+
+	args := []string{"-i", req.Interface, "-n"}
+	if req.Filter != "" {
+		// Compiling the filter first reports syntax errors in the acknowledgement
+		check := exec.Command("tcpdump", append(args, "-d", "--", req.Filter)...)
+		if output, err := check.CombinedOutput(); err != nil {
+			return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+				"code":    ErrInvalidRequest,
+				"message": localizeConn(conn, "Invalid capture filter: %s", strings.TrimSpace(string(output))),
+			})
+		}
+	}
+
+	capture := &PacketCapture{
+		id:       uuid.NewString(),
+		connID:   conn.ID(),
+		path:     req.Path,
+		maxBytes: maxBytes,
+	}
+	if capture.path == "" {
+		capture.path = filepath.Join(os.TempDir(), "ccw-capture-"+capture.id+".pcap")
+	}
+	file, err := os.OpenFile(capture.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to create capture file: %v", err),
+		})
+	}
+
+	// -U writes each packet to the pipe as soon as it's captured
+	args = append(args, "-U", "-w", "-", "-s", strconv.Itoa(snaplen), "-c", strconv.Itoa(maxPackets))
+	if req.Filter != "" {
+		args = append(args, "--", req.Filter)
+	}
+	capture.cmd = exec.Command("tcpdump", args...)
+	capture.cmd.Stderr = &capture.stderr
+	stdout, err := capture.cmd.StdoutPipe()
+	if err == nil {
+		err = capture.cmd.Start()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(capture.path)
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to start capture: %v", err),
+		})
+	}
+
+	nm.captureMu.Lock()
+	nm.captures[capture.id] = capture
+	nm.captureMu.Unlock()
+
+	capture.timer = time.AfterFunc(time.Duration(duration)*time.Second, func() {
+		capture.stop("duration")
+	})
+	writer := nm.quotas.StreamWriter(ConnToken(conn), capture.path, file)
+	go nm.runCapture(conn, capture, stdout, writer, file)
+
+	return nm.emitter.Reply(conn, "net:capture:started", map[string]interface{}{
+		"capture_id": capture.id,
+		"interface":  req.Interface,
+		"filter":     req.Filter,
+		"path":       capture.path,
+	})
+}
+
+// StopCapture ends a capture of the connection early
+func (nm *NetworkModule) StopCapture(conn socketio.Conn, captureID string) EventResult {
+	nm.captureMu.Lock()
+	capture := nm.captures[captureID]
+	nm.captureMu.Unlock()
+
+	if capture == nil || capture.connID != conn.ID() {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Capture not found"),
+			"capture_id": captureID,
+		})
+	}
+
+	capture.stop("stopped")
+	return EventResult{Success: true, Data: map[string]interface{}{"capture_id": captureID}}
+}
+
+// Helper functions
+
+// runCapture copies the pcap stream of tcpdump to file record by record,
+// summarizing each packet, until tcpdump exits or the capture is stopped
+func (nm *NetworkModule) runCapture(conn socketio.Conn, capture *PacketCapture, stdout io.Reader, writer io.Writer, file *os.File) {
+	err := capture.copy(stdout, writer, func(summary PacketSummary) {
+		nm.emitter.Emit(conn, "net:capture:packet", summary)
+	})
+	// Makes sure tcpdump is gone, keeping the reason the capture was stopped for
+	capture.stop("")
+	capture.timer.Stop()
+	waitErr := capture.cmd.Wait()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	nm.captureMu.Lock()
+	delete(nm.captures, capture.id)
+	nm.captureMu.Unlock()
+
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	payload := map[string]interface{}{
+		"capture_id": capture.id,
+		"path":       capture.path,
+		"packets":    capture.packets,
+		"bytes":      capture.bytes,
+		"reason":     capture.reason,
+	}
+	switch {
+	case err != nil:
+		payload["reason"] = "error"
+		payload["error"] = err.Error()
+	case capture.reason == "":
+		// tcpdump exits by itself after -c packets, or when it fails
+		payload["reason"] = "max_packets"
+		if waitErr != nil {
+			payload["reason"] = "error"
+			payload["error"] = strings.TrimSpace(capture.stderr.String())
+		}
+	}
+	log.Printf("Capture %s ended (%s) after %d packets", capture.id, payload["reason"], capture.packets)
+
+	if conn := nm.emitter.Lookup(capture.connID); conn != nil {
+		nm.emitter.Send(conn, "net:capture:done", payload)
+	}
+}
+
+// stopCaptures ends the captures of a disconnected connection
+func (nm *NetworkModule) stopCaptures(connectionID string) {
+	nm.captureMu.Lock()
+	defer nm.captureMu.Unlock()
+
+	for _, capture := range nm.captures {
+		if capture.connID == connectionID {
+			capture.stop("disconnected")
+		}
+	}
+}
+
+// stop records why the capture ends, unless it already ended, and terminates
+// tcpdump
+func (c *PacketCapture) stop(reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.reason != "" {
+		return
+	}
+	c.reason = reason
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+}
+
+// copy writes the pcap read from r to w, stopping before the file grows past
+// maxBytes. Packets are passed to packet as they're written.
+func (c *PacketCapture) copy(r io.Reader, w io.Writer, packet func(PacketSummary)) error {
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil // tcpdump failed before writing anything, its stderr tells why
+		}
+		return err
+	}
+
+	var order binary.ByteOrder
+	nanoseconds := false
+	switch magic := binary.LittleEndian.Uint32(header); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order, nanoseconds = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order, nanoseconds = binary.BigEndian, magic == 0x4d3cb2a1
+	default:
+		return fmt.Errorf("unexpected pcap magic %#x", magic)
+	}
+	linkType := order.Uint32(header[20:24])
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	c.addBytes(int64(len(header)))
+
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(reader, record); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		included := order.Uint32(record[8:12])
+		if included > 1<<20 {
+			return fmt.Errorf("invalid pcap record of %d bytes", included)
+		}
+		data := make([]byte, included)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		c.mutex.Lock()
+		full := c.bytes+int64(len(record)+len(data)) > c.maxBytes
+		c.mutex.Unlock()
+		if full {
+			c.stop("max_bytes")
+			return nil
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		c.bytes += int64(len(record) + len(data))
+		c.packets++
+		number := c.packets
+		c.mutex.Unlock()
+
+		fraction := float64(order.Uint32(record[4:8])) / 1e6
+		if nanoseconds {
+			fraction /= 1000
+		}
+		summary := summarizePacket(linkType, data)
+		summary.CaptureID = c.id
+		summary.Number = number
+		summary.Timestamp = float64(order.Uint32(record[0:4])) + fraction
+		summary.Length = int(order.Uint32(record[12:16]))
+		packet(summary)
+	}
+}
+
+func (c *PacketCapture) addBytes(n int64) {
+	c.mutex.Lock()
+	c.bytes += n
+	c.mutex.Unlock()
+}
+
+// summarizePacket decodes the addresses, ports and protocol of a packet
+// from its link layer header on
+func summarizePacket(linkType uint32, data []byte) PacketSummary {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return PacketSummary{Protocol: "unknown"}
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		// Skip VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return PacketSummary{Protocol: "unknown"}
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return PacketSummary{Protocol: "unknown"}
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case linkTypeRaw, linkTypeRawIPv4, linkTypeRawIPv6:
+		if len(data) == 0 {
+			return PacketSummary{Protocol: "unknown"}
+		}
+		etherType = 0x0800
+		if data[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+	default:
+		return PacketSummary{Protocol: fmt.Sprintf("linktype %d", linkType)}
+	}
+
+	summary := PacketSummary{Protocol: fmt.Sprintf("0x%04x", etherType)}
+	var protocol byte
+	switch etherType {
+	case 0x0806:
+		summary.Protocol = "arp"
+		if len(data) >= 28 {
+			summary.Source = net.IP(data[14:18]).String()
+			summary.Destination = net.IP(data[24:28]).String()
+		}
+		return summary
+	case 0x0800:
+		summary.Protocol = "ipv4"
+		if len(data) < 20 {
+			return summary
+		}
+		headerLength := int(data[0]&0x0f) * 4
+		protocol = data[9]
+		summary.Source = net.IP(data[12:16]).String()
+		summary.Destination = net.IP(data[16:20]).String()
+		// Only first fragments carry the transport header
+		if fragmentOffset := binary.BigEndian.Uint16(data[6:8]) & 0x1fff; fragmentOffset != 0 || headerLength < 20 || len(data) < headerLength {
+			return summary
+		}
+		data = data[headerLength:]
+	case 0x86dd:
+		summary.Protocol = "ipv6"
+		if len(data) < 40 {
+			return summary
+		}
+		protocol = data[6]
+		summary.Source = net.IP(data[8:24]).String()
+		summary.Destination = net.IP(data[24:40]).String()
+		data = data[40:]
+	default:
+		return summary
+	}
+
+	switch protocol {
+	case 6:
+		summary.Protocol = "tcp"
+		if len(data) >= 14 {
+			summary.SourcePort = int(binary.BigEndian.Uint16(data[0:2]))
+			summary.DestinationPort = int(binary.BigEndian.Uint16(data[2:4]))
+			summary.Flags = tcpFlags(data[13])
+		}
+	case 17:
+		summary.Protocol = "udp"
+		if len(data) >= 4 {
+			summary.SourcePort = int(binary.BigEndian.Uint16(data[0:2]))
+			summary.DestinationPort = int(binary.BigEndian.Uint16(data[2:4]))
+		}
+	case 1:
+		summary.Protocol = "icmp"
+	case 58:
+		summary.Protocol = "icmpv6"
+	}
+	return summary
+}
+
+// tcpFlags writes TCP flags the way tcpdump does, "." standing for ACK
+func tcpFlags(flags byte) string {
+	var b strings.Builder
+	for _, flag := range []struct {
+		mask   byte
+		letter byte
+	}{{0x02, 'S'}, {0x01, 'F'}, {0x04, 'R'}, {0x08, 'P'}, {0x20, 'U'}, {0x40, 'E'}, {0x80, 'W'}, {0x10, '.'}} {
+		if flags&flag.mask != 0 {
+			b.WriteByte(flag.letter)
+		}
+	}
+	if b.Len() == 0 {
+		return "none"
+	}
+	return b.String()
+}
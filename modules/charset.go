@@ -0,0 +1,320 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// textEncodings are the encodings text reads and writes convert from and to,
+// by canonical name
+var textEncodings = map[string]encoding.Encoding{
+	"utf-8":        unicode.UTF8,
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"iso-8859-1":   charmap.ISO8859_1,
+	"windows-1252": charmap.Windows1252,
+	"shift_jis":    japanese.ShiftJIS,
+}
+
+// byteOrderMark is the character starting Unicode text to tell its encoding
+const byteOrderMark = "\uFEFF"
+
+// binaryEncoding sends the content of files as base64 of their bytes, left
+// as they are, for binary files
+const binaryEncoding = "base64"
+
+// TextWriteOptions are how text written to a file is stored. Empty options
+// write the text as sent, and preserve keeps what the file has now.
+type TextWriteOptions struct {
+	Encoding   string `json:"encoding"`    // utf-8 when empty, preserve, or base64 for binary content
+	LineEnding string `json:"line_ending"` // lf, crlf or preserve
+	BOM        string `json:"bom"`         // add, remove or preserve
+}
+
+// encodingAliases are other names clients may use for the encodings
+var encodingAliases = map[string]string{
+	"utf8":      "utf-8",
+	"utf-16":    "utf-16le",
+	"latin-1":   "iso-8859-1",
+	"latin1":    "iso-8859-1",
+	"cp1252":    "windows-1252",
+	"sjis":      "shift_jis",
+	"shift-jis": "shift_jis",
+	"cp932":     "shift_jis",
+}
+
+// Helper functions
+
+// textEncoding returns the canonical name of an encoding
+func textEncoding(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if canonical, ok := encodingAliases[name]; ok {
+		name = canonical
+	}
+	if _, ok := textEncodings[name]; !ok {
+		return "", fmt.Errorf("%w: unknown encoding %q", errInvalidRequest, name)
+	}
+	return name, nil
+}
+
+// detectEncoding guesses the encoding of text from its byte order mark, or
+// else from which encoding decodes it cleanly: UTF-8, then UTF-16 when every
+// other byte is mostly zero, then Shift_JIS when it has double-byte
+// characters, and ISO-8859-1 otherwise, which decodes anything
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	case utf8.Valid(data):
+		return "utf-8"
+	}
+
+	if len(data) >= 2 {
+		var evenZeros, oddZeros int
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 {
+				evenZeros++
+			}
+			if data[i+1] == 0 {
+				oddZeros++
+			}
+		}
+		// Mostly ASCII text has a zero in every other byte
+		pairs := len(data) / 2
+		if oddZeros*10 >= pairs*4 && evenZeros*10 < pairs {
+			return "utf-16le"
+		}
+		if evenZeros*10 >= pairs*4 && oddZeros*10 < pairs {
+			return "utf-16be"
+		}
+	}
+
+	if isShiftJIS(data) {
+		return "shift_jis"
+	}
+	return "iso-8859-1"
+}
+
+// fileTextFormat returns the format of the text of a file, from its first
+// 64 KiB
+func fileTextFormat(path string) (TextFormat, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return TextFormat{}, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 64<<10)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return TextFormat{}, err
+	}
+	if n == len(head) {
+		// Leave out a UTF-8 character cut at the end of the head
+		start := n - 1
+		for start > 0 && start > n-utf8.UTFMax && !utf8.RuneStart(head[start]) {
+			start--
+		}
+		if !utf8.FullRune(head[start:n]) {
+			n = start
+		}
+	}
+	head = head[:n]
+
+	encoding := detectEncoding(head)
+	text, err := decodeText(head, encoding)
+	if err != nil {
+		return TextFormat{}, err
+	}
+	return textFormat(text, encoding), nil
+}
+
+// textFormat describes UTF-8 text as stored in an encoding
+func textFormat(text, encoding string) TextFormat {
+	return TextFormat{
+		Encoding:   encoding,
+		LineEnding: lineEnding(text),
+		BOM:        strings.HasPrefix(text, byteOrderMark),
+	}
+}
+
+// lineEnding tells whether text breaks lines with LF, CRLF or a mix of
+// both, or none when it has a single line
+func lineEnding(text string) string {
+	crlf := strings.Count(text, "\r\n")
+	lf := strings.Count(text, "\n") - crlf
+	switch {
+	case lf == 0 && crlf == 0:
+		return "none"
+	case lf == 0:
+		return "crlf"
+	case crlf == 0:
+		return "lf"
+	}
+	return "mixed"
+}
+
+// setLineEnding breaks every line of text with LF or CRLF
+func setLineEnding(text, ending string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if ending == "crlf" {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+	return text
+}
+
+// encode converts text to how it's written to a file, returning its format
+// once written. Options set to preserve take what the file has now, and are
+// left as sent for a new file.
+func (o TextWriteOptions) encode(path, text string) ([]byte, TextFormat, error) {
+	var current *TextFormat
+	if o.Encoding == "preserve" || o.LineEnding == "preserve" || o.BOM == "preserve" {
+		format, err := fileTextFormat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, TextFormat{}, err
+		}
+		if err == nil {
+			current = &format
+		}
+	}
+
+	encoding := "utf-8"
+	switch o.Encoding {
+	case "":
+	case "preserve":
+		if current != nil {
+			encoding = current.Encoding
+		}
+	default:
+		var err error
+		if encoding, err = textEncoding(o.Encoding); err != nil {
+			return nil, TextFormat{}, err
+		}
+	}
+
+	switch o.LineEnding {
+	case "":
+	case "lf", "crlf":
+		text = setLineEnding(text, o.LineEnding)
+	case "preserve":
+		// Files mixing line endings or with a single line give no style to keep
+		if current != nil && (current.LineEnding == "lf" || current.LineEnding == "crlf") {
+			text = setLineEnding(text, current.LineEnding)
+		}
+	default:
+		return nil, TextFormat{}, fmt.Errorf("%w: unknown line ending %q, use lf, crlf or preserve", errInvalidRequest, o.LineEnding)
+	}
+
+	bom := strings.HasPrefix(text, byteOrderMark)
+	switch o.BOM {
+	case "":
+	case "add", "remove":
+		bom = o.BOM == "add"
+	case "preserve":
+		if current != nil {
+			bom = current.BOM
+		}
+	default:
+		return nil, TextFormat{}, fmt.Errorf("%w: unknown bom %q, use add, remove or preserve", errInvalidRequest, o.BOM)
+	}
+	text = strings.TrimPrefix(text, byteOrderMark)
+	if bom {
+		if !strings.HasPrefix(encoding, "utf-") {
+			return nil, TextFormat{}, fmt.Errorf("%w: %s text has no byte order mark", errInvalidRequest, encoding)
+		}
+		text = byteOrderMark + text
+	}
+
+	encoded, err := encodeText(text, encoding)
+	if err != nil {
+		return nil, TextFormat{}, err
+	}
+	return encoded, textFormat(text, encoding), nil
+}
+
+// binary tells whether content is written as base64 of its bytes
+func (o TextWriteOptions) binary() bool {
+	return strings.EqualFold(strings.TrimSpace(o.Encoding), binaryEncoding)
+}
+
+// decodeBinary returns the bytes of base64 content, which is written as is
+func (o TextWriteOptions) decodeBinary(content string) ([]byte, error) {
+	if o.LineEnding != "" || o.BOM != "" {
+		return nil, fmt.Errorf("%w: line_ending and bom don't apply to base64 content", errInvalidRequest)
+	}
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: content isn't valid base64: %v", errInvalidRequest, err)
+	}
+	return data, nil
+}
+
+// isShiftJIS tells whether data decodes as Shift_JIS without invalid
+// sequences and with at least one double-byte character, as half-width
+// katakana alone are more likely accented Latin-1 letters
+func isShiftJIS(data []byte) bool {
+	doubleByte := false
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b < 0x80, b >= 0xA1 && b <= 0xDF:
+			// ASCII or a half-width katakana
+		case (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xEF):
+			if i+1 >= len(data) {
+				return false
+			}
+			trail := data[i+1]
+			if trail < 0x40 || trail > 0xFC || trail == 0x7F {
+				return false
+			}
+			doubleByte = true
+			i++
+		default:
+			return false
+		}
+	}
+	if !doubleByte {
+		return false
+	}
+	decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(data)
+	return err == nil && !bytes.ContainsRune(decoded, utf8.RuneError)
+}
+
+// decodeText converts text in an encoding to UTF-8
+func decodeText(data []byte, name string) (string, error) {
+	if name == "utf-8" {
+		return string(data), nil
+	}
+	decoded, err := textEncodings[name].NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("decoding %s: %w", name, err)
+	}
+	return string(decoded), nil
+}
+
+// encodeText converts UTF-8 text to an encoding, failing on characters the
+// encoding can't represent
+func encodeText(text, name string) ([]byte, error) {
+	if name == "utf-8" {
+		return []byte(text), nil
+	}
+	encoded, err := textEncodings[name].NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w: the content can't be encoded in %s: %v", errInvalidRequest, name, err)
+	}
+	return encoded, nil
+}
@@ -0,0 +1,348 @@
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Config holds runtime settings shared by the modules
+type Config struct {
+	EmitQueueSize   int
+	EmitBatchWindow time.Duration
+
+	HTTPReadTimeout       time.Duration // of whole requests, body included, 0 for none
+	HTTPReadHeaderTimeout time.Duration // of request headers
+	HTTPWriteTimeout      time.Duration // of whole responses, streams included, 0 for none
+	HTTPIdleTimeout       time.Duration // of keep-alive connections between requests
+	HTTPMaxHeaderBytes    int
+	MaxBodySize           int64 // of request bodies, 0 for no limit
+
+	BodyLimitJSON   int64 // of the bodies of most endpoints, 0 for no limit
+	BodyLimitWrite  int64 // of file content sent as JSON
+	BodyLimitUpload int64 // of raw uploads
+	BodyLimitExec   int64 // of commands to run
+
+	WatchReplayWindow    time.Duration
+	WatchReplayMaxEvents int
+	WatchPollInterval    time.Duration // of watches polling the tree past the inotify limits
+
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	ResumeWindow      time.Duration // subscriptions of dropped connections are kept for, 0 disables resumption
+
+	SocketScopes string // scopes Socket.IO events require, as "event=scope,scope;prefix:*=scope"
+	ReadOnly     bool   // refuses every operation changing the host
+
+	ApprovalDeleteFiles   int           // deletes of more files wait for approval, 0 for none
+	ApprovalExec          bool          // commands outside the allowlist wait for approval
+	ApprovalExecAllowlist string        // comma-separated programs run without approval
+	ApprovalTTL           time.Duration // pending approvals expire after
+
+	NotifyChannels string        // JSON file of notification channels, empty for none
+	NotifyCooldown time.Duration // between notifications of the same event and subject
+
+	CompressMinSize int
+
+	FSHome      string // ~ and relative paths are resolved against, the home of the user when empty
+	FSRoot      string // paths are confined to, empty for no sandbox
+	FSBookmarks string // comma-separated name=path places, or paths
+
+	BookmarksFile string // bookmarks of each token
+
+	ReadMaxSize int64
+
+	IndexPaths       string        // comma-separated trees indexed for searches, empty to disable indexing
+	IndexMaxFileSize int64         // of the files indexed, larger ones are searched without the index
+	IndexMaxFiles    int           // below INDEX_PATHS, past which indexing fails, 0 for no limit
+	IndexInterval    time.Duration // between checks for changed files, 0 to only rebuild on request
+
+	WalkMaxDepth    int           // of recursive operations, 0 for no limit
+	WalkMaxEntries  int           // visited by one recursive operation, 0 for no limit
+	WalkMaxDuration time.Duration // of the walk of one recursive operation, 0 for no limit
+
+	TmpDir        string
+	TmpDefaultTTL time.Duration
+	TmpMaxTTL     time.Duration // 0 for no limit
+
+	StreamMaxJobs int // ffmpeg transcodes running at once, 0 for no limit
+
+	QuotaMaxFileSize int64
+	QuotaDailyBytes  int64
+	QuotaMinFreeDisk int64
+
+	IdempotencyTTL time.Duration
+
+	S3Endpoint  string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PartSize  int64
+
+	DownloadSegments       int
+	DownloadSegmentMinSize int64
+	DownloadCacheDir       string // empty disables the cache
+	DownloadCacheMaxSize   int64
+
+	OutboundAllow string // hosts and CIDRs requests may contact, empty for any
+	OutboundDeny  string // hosts and CIDRs requests may never contact
+
+	RateLimit    int64 // bytes per second shared by all transfers, 0 for unlimited
+	RateLimitJob int64 // bytes per second of each transfer, 0 for unlimited
+
+	PortMonitorBackend string // "auto", "netlink" or "proc"
+
+	HostsFile  string
+	ResolvConf string
+
+	RDAPURL     string // RDAP bootstrap service
+	WhoisServer string // WHOIS server asked first, for registries without RDAP
+	DNSBLZones  string // comma-separated DNS blocklists checked for IP reputation
+
+	DiscoveryEnabled bool
+	DiscoveryRate    int    // probes per second of discovery scans, 0 for unlimited
+	OUIFile          string // MAC vendor database, empty to look for a system one
+
+	MountsEnabled bool
+
+	ScanMaxProbes      int // connections a port scan may make, 0 for unlimited
+	ScanMaxConcurrency int
+
+	PortmapBackend string // "auto", "upnp" or "natpmp"
+	UPnPLocation   string // description URL of the gateway, found by SSDP when empty
+	NATPMPGateway  string // defaults to the default route
+
+	FirewallBackend         string        // "auto", "nftables" or "iptables"
+	FirewallRollbackTimeout time.Duration // 0 to apply firewall changes without confirmation
+
+	ShellProfiles      string        // JSON file of named shell profiles
+	ShellStatsInterval time.Duration // 0 disables sampling session usage
+	ShellOnDisconnect  string        // "kill" or "detach"
+	ShellDetachTTL     time.Duration // 0 keeps detached sessions until killed
+	ShellTemplates     string        // JSON file of command templates, saved on changes
+	ShellMaxSessions   int           // open at once, detached ones included, 0 for no limit
+
+	FleetAgents   string // JSON file of downstream agents, making this agent a controller
+	FleetParallel int    // agents a fleet command runs on at once
+
+	AgentID     string // stable ID of the agent, read from AgentIDFile when empty
+	AgentIDFile string // where a generated ID is kept across restarts
+	AgentName   string // hostname when empty
+	AgentLabels string // comma-separated key=value pairs
+	AgentTags   string // comma-separated
+
+	FleetController       string        // URL of the controller the agent registers with, empty to not register
+	FleetControllerToken  string        // token of the controller with the fleet.register scope
+	FleetAdvertiseURL     string        // URL of the agent sent to the controller
+	FleetRegisterInterval time.Duration // between registration pings
+
+	HealthMinFreeDisk int64 // free bytes of TMP_DIR and the download cache, below which the agent isn't ready
+
+	MaxClients          int // Socket.IO connections open at once, 0 for no limit
+	MaxClientsPerToken  int // Socket.IO connections open at once with the same token, 0 for no limit
+	MaxRequests         int // REST requests in flight, 0 for no limit
+	MaxRequestsPerToken int // REST requests in flight with the same token, 0 for no limit
+
+	StorePath      string        // SQLite database of jobs, audit events and command history, empty to disable it
+	StoreRetention time.Duration // how long records are kept, 0 forever
+}
+
+// LoadConfig reads the module settings from environment variables
+func LoadConfig() *Config {
+	return &Config{
+		EmitQueueSize:   envInt("EMIT_QUEUE_SIZE", 256),
+		EmitBatchWindow: time.Duration(envInt("EMIT_BATCH_WINDOW_MS", 50)) * time.Millisecond,
+
+		HTTPReadTimeout:       time.Duration(envInt("HTTP_READ_TIMEOUT", 0)) * time.Second,
+		HTTPReadHeaderTimeout: time.Duration(envInt("HTTP_READ_HEADER_TIMEOUT", 10)) * time.Second,
+		HTTPWriteTimeout:      time.Duration(envInt("HTTP_WRITE_TIMEOUT", 0)) * time.Second,
+		HTTPIdleTimeout:       time.Duration(envInt("HTTP_IDLE_TIMEOUT", 120)) * time.Second,
+		HTTPMaxHeaderBytes:    envInt("HTTP_MAX_HEADER_BYTES", 1<<20),
+		MaxBodySize:           int64(envInt("MAX_BODY_SIZE", 1<<30)),
+
+		BodyLimitJSON:   int64(envInt("BODY_LIMIT_JSON", 1<<20)),
+		BodyLimitWrite:  int64(envInt("BODY_LIMIT_WRITE", 64<<20)),
+		BodyLimitUpload: int64(envInt("BODY_LIMIT_UPLOAD", 0)),
+		BodyLimitExec:   int64(envInt("BODY_LIMIT_EXEC", 1<<20)),
+
+		WatchReplayWindow:    time.Duration(envInt("WATCH_REPLAY_WINDOW", 300)) * time.Second,
+		WatchReplayMaxEvents: envInt("WATCH_REPLAY_MAX_EVENTS", 1000),
+		WatchPollInterval:    time.Duration(envInt("WATCH_POLL_INTERVAL", 2)) * time.Second,
+
+		HeartbeatInterval: time.Duration(envInt("HEARTBEAT_INTERVAL", 25)) * time.Second,
+		HeartbeatTimeout:  time.Duration(envInt("HEARTBEAT_TIMEOUT", 90)) * time.Second,
+		ResumeWindow:      time.Duration(envInt("RESUME_WINDOW", 120)) * time.Second,
+
+		SocketScopes: os.Getenv("SOCKET_SCOPES"),
+		ReadOnly:     envBool("READ_ONLY", false),
+
+		ApprovalDeleteFiles:   envInt("APPROVAL_DELETE_FILES", 0),
+		ApprovalExec:          envBool("APPROVAL_EXEC", false),
+		ApprovalExecAllowlist: os.Getenv("APPROVAL_EXEC_ALLOWLIST"),
+		ApprovalTTL:           time.Duration(envInt("APPROVAL_TTL", 3600)) * time.Second,
+
+		NotifyChannels: os.Getenv("NOTIFY_CHANNELS"),
+		NotifyCooldown: time.Duration(envInt("NOTIFY_COOLDOWN", 300)) * time.Second,
+
+		CompressMinSize: envInt("COMPRESS_MIN_SIZE", 1024),
+
+		FSHome:      os.Getenv("FS_HOME"),
+		FSRoot:      os.Getenv("FS_ROOT"),
+		FSBookmarks: os.Getenv("FS_BOOKMARKS"),
+
+		BookmarksFile: envString("BOOKMARKS_FILE", defaultConfigFile("bookmarks.json")),
+
+		ReadMaxSize: int64(envInt("READ_MAX_SIZE", 10<<20)),
+
+		IndexPaths:       os.Getenv("INDEX_PATHS"),
+		IndexMaxFileSize: int64(envInt("INDEX_MAX_FILE_SIZE", 1<<20)),
+		IndexMaxFiles:    envInt("INDEX_MAX_FILES", 200000),
+		IndexInterval:    time.Duration(envInt("INDEX_INTERVAL", 600)) * time.Second,
+
+		WalkMaxDepth:    envInt("WALK_MAX_DEPTH", 128),
+		WalkMaxEntries:  envInt("WALK_MAX_ENTRIES", 1000000),
+		WalkMaxDuration: time.Duration(envInt("WALK_MAX_DURATION", 300)) * time.Second,
+
+		TmpDir:        envString("TMP_DIR", filepath.Join(os.TempDir(), "ccw-spaces")),
+		TmpDefaultTTL: time.Duration(envInt("TMP_DEFAULT_TTL", 3600)) * time.Second,
+		TmpMaxTTL:     time.Duration(envInt("TMP_MAX_TTL", 7*24*3600)) * time.Second,
+
+		StreamMaxJobs: envInt("STREAM_MAX_JOBS", 2),
+
+		QuotaMaxFileSize: int64(envInt("QUOTA_MAX_FILE_SIZE", 0)),
+		QuotaDailyBytes:  int64(envInt("QUOTA_DAILY_BYTES", 0)),
+		QuotaMinFreeDisk: int64(envInt("QUOTA_MIN_FREE_DISK", 0)),
+
+		IdempotencyTTL: time.Duration(envInt("IDEMPOTENCY_TTL", 300)) * time.Second,
+
+		S3Endpoint:  os.Getenv("S3_ENDPOINT"),
+		S3Region:    os.Getenv("S3_REGION"),
+		S3AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("S3_SECRET_KEY"),
+		S3PartSize:  int64(envInt("S3_PART_SIZE", 16<<20)),
+
+		DownloadSegments:       envInt("DOWNLOAD_SEGMENTS", 1),
+		DownloadSegmentMinSize: int64(envInt("DOWNLOAD_SEGMENT_MIN_SIZE", 8<<20)),
+		DownloadCacheDir:       os.Getenv("DOWNLOAD_CACHE_DIR"),
+		DownloadCacheMaxSize:   int64(envInt("DOWNLOAD_CACHE_MAX_SIZE", 1<<30)),
+
+		OutboundAllow: os.Getenv("OUTBOUND_ALLOW"),
+		OutboundDeny:  envString("OUTBOUND_DENY", defaultOutboundDeny),
+
+		RateLimit:    int64(envInt("RATE_LIMIT", 0)),
+		RateLimitJob: int64(envInt("RATE_LIMIT_JOB", 0)),
+
+		PortMonitorBackend: envString("PORT_MONITOR_BACKEND", "auto"),
+
+		HostsFile:  envString("HOSTS_FILE", defaultHostsFile()),
+		ResolvConf: envString("RESOLV_CONF", "/etc/resolv.conf"),
+
+		RDAPURL:     envString("RDAP_URL", "https://rdap.org"),
+		WhoisServer: envString("WHOIS_SERVER", "whois.iana.org"),
+		DNSBLZones:  envString("DNSBL_ZONES", "zen.spamhaus.org,bl.spamcop.net,b.barracudacentral.org"),
+
+		DiscoveryEnabled: envBool("DISCOVERY_ENABLED", false),
+		DiscoveryRate:    envInt("DISCOVERY_RATE", 100),
+		OUIFile:          os.Getenv("OUI_FILE"),
+
+		MountsEnabled: envBool("MOUNTS_ENABLED", false),
+
+		ScanMaxProbes:      envInt("SCAN_MAX_PROBES", 65536),
+		ScanMaxConcurrency: envInt("SCAN_MAX_CONCURRENCY", 256),
+
+		PortmapBackend: envString("PORTMAP_BACKEND", "auto"),
+		UPnPLocation:   os.Getenv("UPNP_LOCATION"),
+		NATPMPGateway:  os.Getenv("NATPMP_GATEWAY"),
+
+		FirewallBackend:         envString("FIREWALL_BACKEND", "auto"),
+		FirewallRollbackTimeout: time.Duration(envInt("FIREWALL_ROLLBACK_TIMEOUT", 60)) * time.Second,
+
+		ShellProfiles:      os.Getenv("SHELL_PROFILES"),
+		ShellStatsInterval: time.Duration(envInt("SHELL_STATS_INTERVAL", 5)) * time.Second,
+		ShellOnDisconnect:  envString("SHELL_ON_DISCONNECT", "kill"),
+		ShellDetachTTL:     time.Duration(envInt("SHELL_DETACH_TTL", 0)) * time.Second,
+		ShellTemplates:     os.Getenv("SHELL_TEMPLATES"),
+		ShellMaxSessions:   envInt("SHELL_MAX_SESSIONS", 0),
+
+		FleetAgents:   os.Getenv("FLEET_AGENTS"),
+		FleetParallel: envInt("FLEET_PARALLEL", 10),
+
+		AgentID:     os.Getenv("AGENT_ID"),
+		AgentIDFile: envString("AGENT_ID_FILE", defaultAgentIDFile()),
+		AgentName:   os.Getenv("AGENT_NAME"),
+		AgentLabels: os.Getenv("AGENT_LABELS"),
+		AgentTags:   os.Getenv("AGENT_TAGS"),
+
+		FleetController:       os.Getenv("FLEET_CONTROLLER"),
+		FleetControllerToken:  os.Getenv("FLEET_CONTROLLER_TOKEN"),
+		FleetAdvertiseURL:     os.Getenv("FLEET_ADVERTISE_URL"),
+		FleetRegisterInterval: time.Duration(envInt("FLEET_REGISTER_INTERVAL", 60)) * time.Second,
+
+		HealthMinFreeDisk: int64(envInt("HEALTH_MIN_FREE_DISK", 100<<20)),
+
+		MaxClients:          envInt("MAX_CLIENTS", 0),
+		MaxClientsPerToken:  envInt("MAX_CLIENTS_PER_TOKEN", 0),
+		MaxRequests:         envInt("MAX_REQUESTS", 0),
+		MaxRequestsPerToken: envInt("MAX_REQUESTS_PER_TOKEN", 0),
+
+		StorePath:      os.Getenv("STORE_PATH"),
+		StoreRetention: time.Duration(envInt("STORE_RETENTION_DAYS", 30)) * 24 * time.Hour,
+	}
+}
+
+// Helper functions
+
+// envString returns the variable, or fallback when unset; an empty value is
+// kept, e.g. to clear a default list
+func envString(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func envBool(name string, fallback bool) bool {
+	parsed, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
+// defaultHostsFile is the hosts file of the platform
+func defaultHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), `System32\drivers\etc\hosts`)
+	}
+	return "/etc/hosts"
+}
+
+// defaultAgentIDFile keeps the agent ID in the config directory of the user,
+// or the temporary directory when there's none
+func defaultAgentIDFile() string {
+	return defaultConfigFile("agent-id")
+}
+
+// defaultConfigFile is a file of the agent in the config directory of the
+// user, or the temporary directory when there's none
+func defaultConfigFile(name string) string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "ccw", name)
+	}
+	return filepath.Join(os.TempDir(), "ccw-"+name)
+}
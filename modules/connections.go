@@ -0,0 +1,83 @@
+package modules
+
+import "sort"
+
+// PortMetrics counts the TCP connections of a listening port by state. A
+// growing syn_recv count is the sign of a SYN flood.
+type PortMetrics struct {
+	Port        int            `json:"port"`
+	Connections int            `json:"connections"`
+	States      map[string]int `json:"states"`
+}
+
+// Helper functions
+
+// sendPortMetrics sends the subscribers of monitor that enabled metrics the
+// connection counts of the ports passing their filter
+func (nm *NetworkModule) sendPortMetrics(monitor *PortMonitor, protocols []string, current map[int]portSocket, timestamp int64) {
+	nm.monitorMu.RLock()
+	defer nm.monitorMu.RUnlock()
+
+	var metrics []PortMetrics
+	for connectionID, filter := range monitor.subscribers {
+		if !filter.Metrics {
+			continue
+		}
+		conn := nm.emitter.Lookup(connectionID)
+		if conn == nil {
+			continue
+		}
+
+		// Connections are counted once per tick, for the first subscriber that needs them
+		if metrics == nil {
+			metrics = nm.connectionCounts(protocols, current)
+		}
+		matched := []PortMetrics{}
+		for _, portMetrics := range metrics {
+			if filter.match(portMetrics.Port) {
+				matched = append(matched, portMetrics)
+			}
+		}
+		nm.emitter.Emit(conn, "net:port:metrics", map[string]interface{}{
+			"protocol":  monitor.protocol,
+			"interface": monitor.iface,
+			"ports":     matched,
+			"timestamp": timestamp,
+		})
+	}
+}
+
+// connectionCounts counts the TCP connections of the listening ports,
+// sorted by port. Connections are matched by local port on any address,
+// IPv4 or IPv6, since they're bound to the address they were accepted on.
+func (nm *NetworkModule) connectionCounts(protocols []string, listening map[int]portSocket) []PortMetrics {
+	metrics := []PortMetrics{}
+	tcp := false
+	for _, protocol := range protocols {
+		tcp = tcp || protocol == "tcp"
+	}
+	if !tcp {
+		return metrics
+	}
+
+	counts := make(map[int]*PortMetrics)
+	for port := range listening {
+		counts[port] = &PortMetrics{Port: port, States: make(map[string]int)}
+	}
+
+	connections, _ := nm.ports.connections()
+	for _, connection := range connections {
+		if portMetrics := counts[connection.port]; portMetrics != nil {
+			portMetrics.Connections++
+			portMetrics.States[connection.state]++
+		}
+	}
+
+	for _, portMetrics := range counts {
+		metrics = append(metrics, *portMetrics)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Port < metrics[j].Port
+	})
+	return metrics
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package modules
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// runAs makes cmd run as account, with its groups
+func runAs(cmd *exec.Cmd, account *user.User) error {
+	uid, _ := strconv.ParseUint(account.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, _ := account.GroupIds()
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	return nil
+}
@@ -0,0 +1,13 @@
+package modules
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+)
+
+// runAs fails, starting a process as another user on Windows takes their
+// password or a logon token
+func runAs(cmd *exec.Cmd, account *user.User) error {
+	return fmt.Errorf("%w: running as another user", errUnsupported)
+}
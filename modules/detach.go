@@ -0,0 +1,133 @@
+package modules
+
+import (
+	"fmt"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// DisconnectPolicy is what happens to a session when its owner disconnects:
+// it's killed, or detached until a connection of the same token attaches
+type DisconnectPolicy struct {
+	OnDisconnect string `json:"on_disconnect,omitempty" binding:"omitempty,oneof=kill detach"` // defaults to SHELL_ON_DISCONNECT
+	DetachTTL    *int   `json:"detach_ttl,omitempty" binding:"omitempty,min=0"`                // seconds, 0 forever, defaults to SHELL_DETACH_TTL
+}
+
+// Socket.IO Handlers
+
+// AttachSession makes a connection the owner of a detached session spawned
+// by the same token. Output printed while detached isn't replayed.
+func (sm *ShellModule) AttachSession(conn socketio.Conn, sessionID string) EventResult {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	session, exists := sm.sessions[sessionID]
+	if !exists || !session.Active {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Session not found"),
+			"session_id": sessionID,
+		})
+	}
+	if token := ConnToken(conn); token == nil || token.Name != session.Token {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Access denied"),
+			"session_id": sessionID,
+		})
+	}
+	if session.ClientID != "" && session.ClientID != conn.ID() {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrConflict,
+			"message":    localizeConn(conn, "Session is attached to another connection"),
+			"session_id": sessionID,
+		})
+	}
+
+	var detachedFor time.Duration
+	if session.ClientID == "" {
+		detachedFor = time.Since(session.Detached)
+		if session.detachTimer != nil {
+			session.detachTimer.Stop()
+			session.detachTimer = nil
+		}
+		session.ClientID = conn.ID()
+		session.Detached = time.Time{}
+		sm.clients[conn.ID()] = append(sm.clients[conn.ID()], sessionID)
+	}
+	conn.Join(sessionRoom(sessionID))
+
+	return sm.emitter.Reply(conn, "shell:attached", map[string]interface{}{
+		"session_id":   sessionID,
+		"command":      session.Command.Args[0],
+		"detached_for": detachedFor.Seconds(),
+		"timestamp":    time.Now(),
+	})
+}
+
+// Helper functions
+
+func (p DisconnectPolicy) validate() error {
+	if p.OnDisconnect != "" && p.OnDisconnect != "kill" && p.OnDisconnect != "detach" {
+		return fmt.Errorf("on_disconnect must be kill or detach, not %q", p.OnDisconnect)
+	}
+	if p.DetachTTL != nil && *p.DetachTTL < 0 {
+		return fmt.Errorf("detach_ttl must not be negative")
+	}
+	return nil
+}
+
+// disconnectPolicy resolves the policy of a session from the settings, then
+// its profile, then the spawn request
+func (sm *ShellModule) disconnectPolicy(policies ...DisconnectPolicy) (string, time.Duration) {
+	mode, ttl := sm.config.ShellOnDisconnect, sm.config.ShellDetachTTL
+	for _, policy := range policies {
+		if policy.OnDisconnect != "" {
+			mode = policy.OnDisconnect
+		}
+		if policy.DetachTTL != nil {
+			ttl = time.Duration(*policy.DetachTTL) * time.Second
+		}
+	}
+	return mode, ttl
+}
+
+// detach leaves a session running without an owner, killing it if nobody
+// attaches within its TTL. The caller holds the mutex.
+func (sm *ShellModule) detach(session *ShellSession) {
+	session.ClientID = ""
+	session.Detached = time.Now()
+	if session.DetachTTL > 0 {
+		session.detachTimer = time.AfterFunc(session.DetachTTL, func() {
+			sm.expire(session)
+		})
+	}
+
+	sm.emitter.Broadcast(sm.server, sessionRoom(session.ID), "shell:detached", map[string]interface{}{
+		"session_id": session.ID,
+		"detach_ttl": session.DetachTTL.Seconds(),
+		"timestamp":  time.Now(),
+	})
+}
+
+// expire kills a session still detached when its TTL runs out
+func (sm *ShellModule) expire(session *ShellSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if session.ClientID != "" || sm.sessions[session.ID] != session {
+		return
+	}
+	if session.Command.Process != nil {
+		session.Command.Process.Kill()
+	}
+	session.Active = false
+	delete(sm.sessions, session.ID)
+
+	sm.emitter.Broadcast(sm.server, sessionRoom(session.ID), "shell:killed", map[string]interface{}{
+		"session_id": session.ID,
+		"reason":     "detach_ttl",
+		"timestamp":  time.Now(),
+	})
+}
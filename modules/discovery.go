@@ -0,0 +1,483 @@
+package modules
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// discoveryMaxHosts caps the addresses of a scan, a /20
+const discoveryMaxHosts = 4096
+
+// ouiFiles are the vendor databases tried when OUI_FILE isn't set: the
+// IEEE registry shipped by ieee-data and hwdata, and the nmap and Wireshark
+// prefix lists
+var ouiFiles = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/hwdata/oui.txt",
+	"/usr/share/misc/oui.txt",
+	"/usr/share/nmap/nmap-mac-prefixes",
+	"/usr/share/wireshark/manuf",
+}
+
+// errARPUnsupported marks interfaces ARP can't scan, without an Ethernet
+// address or CAP_NET_RAW
+var errARPUnsupported = errors.New("ARP scans require an Ethernet interface and CAP_NET_RAW")
+
+type DiscoveryRequest struct {
+	Subnet    string `json:"subnet"`                      // IPv4 CIDR, defaults to the network of the interface
+	Interface string `json:"interface"`                   // defaults to the interface on the subnet
+	Method    string `json:"method"`                      // "arp", "ping" or "auto", the default
+	Rate      int    `json:"rate" binding:"min=0"`        // probes per second, at most DISCOVERY_RATE
+	Wait      int    `json:"wait" binding:"min=0,max=10"` // seconds to wait for replies after the last probe, default 2
+}
+
+// DiscoveredHost is a host which answered a discovery probe
+type DiscoveredHost struct {
+	IP                  string  `json:"ip"`
+	MAC                 string  `json:"mac,omitempty"`
+	Vendor              string  `json:"vendor,omitempty"`
+	LocallyAdministered bool    `json:"locally_administered,omitempty"` // randomized or virtual MAC, without a vendor
+	RTT                 float64 `json:"rtt_ms"`
+}
+
+// discoveryScan collects the replies to the probes of a scan
+type discoveryScan struct {
+	sent  map[string]time.Time
+	hosts map[string]*DiscoveredHost
+	mutex sync.Mutex
+}
+
+// REST API Handlers
+
+// Discover finds the live hosts of a local subnet by ARP requests, or echo
+// requests when ARP isn't available. Scans must be enabled with
+// DISCOVERY_ENABLED, and run one at a time at a limited rate.
+func (nm *NetworkModule) Discover(c *gin.Context) {
+	if !nm.config.DiscoveryEnabled {
+		c.JSON(http.StatusForbidden, NetworkOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "LAN discovery is disabled, set DISCOVERY_ENABLED to enable it"),
+		})
+		return
+	}
+
+	var req DiscoveryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	iface, subnet, targets, err := nm.discoveryTargets(req)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to start discovery: %v", err),
+		})
+		return
+	}
+
+	if !nm.discoverMu.TryLock() {
+		c.JSON(http.StatusConflict, NetworkOperation{
+			Success: false,
+			Code:    ErrConflict,
+			Message: Localize(c, "A discovery scan is already running"),
+		})
+		return
+	}
+	defer nm.discoverMu.Unlock()
+
+	rate := nm.config.DiscoveryRate
+	if req.Rate > 0 && (rate <= 0 || req.Rate < rate) {
+		rate = req.Rate
+	}
+	wait := 2 * time.Second
+	if req.Wait > 0 {
+		wait = time.Duration(req.Wait) * time.Second
+	}
+
+	started := time.Now()
+	method := "arp"
+	var hosts []DiscoveredHost
+	if req.Method != "ping" {
+		hosts, err = arpScan(iface, targets, rate, wait)
+	}
+	if req.Method == "ping" || req.Method != "arp" && errors.Is(err, errARPUnsupported) {
+		method = "ping"
+		hosts, err = pingScan(iface, targets, rate, wait)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to scan %s: %v", subnet, err),
+		})
+		return
+	}
+	for i := range hosts {
+		if mac, err := net.ParseMAC(hosts[i].MAC); err == nil {
+			hosts[i].Vendor, hosts[i].LocallyAdministered = nm.macVendor(mac)
+		}
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Discovery completed, %d hosts found", len(hosts)),
+		Data: map[string]interface{}{
+			"interface":   iface.Name,
+			"subnet":      subnet.String(),
+			"method":      method,
+			"probed":      len(targets),
+			"duration_ms": time.Since(started).Milliseconds(),
+			"hosts":       hosts,
+		},
+	})
+}
+
+// Helper functions
+
+// discoveryTargets resolves the interface and subnet of a scan, which must
+// be on the network of one of the addresses of the interface, and lists the
+// host addresses to probe. The addresses of the interface and those the
+// outbound policy denies are skipped.
+func (nm *NetworkModule) discoveryTargets(req DiscoveryRequest) (*net.Interface, *net.IPNet, []net.IP, error) {
+	switch req.Method {
+	case "", "auto", "arp", "ping":
+	default:
+		return nil, nil, nil, fmt.Errorf("%w: unknown method %q", errInvalidRequest, req.Method)
+	}
+	if req.Interface != "" && !interfacePattern.MatchString(req.Interface) {
+		return nil, nil, nil, fmt.Errorf("%w: invalid interface %q", errInvalidRequest, req.Interface)
+	}
+	var subnet *net.IPNet
+	if req.Subnet != "" {
+		_, ipNet, err := net.ParseCIDR(req.Subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, nil, nil, fmt.Errorf("%w: invalid IPv4 subnet %q", errInvalidRequest, req.Subnet)
+		}
+		subnet = ipNet
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var found *net.Interface
+	for i := range interfaces {
+		iface := &interfaces[i]
+		if req.Interface != "" && iface.Name != req.Interface ||
+			req.Interface == "" && (iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			local := &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+			if subnet == nil {
+				subnet, found = local, iface
+				break
+			}
+			if ones, _ := subnet.Mask.Size(); local.Contains(subnet.IP) && ones >= prefixLength(local) {
+				found = iface
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	switch {
+	case found == nil && req.Subnet != "":
+		return nil, nil, nil, fmt.Errorf("%w: %s isn't on a local network", errInvalidRequest, req.Subnet)
+	case found == nil && req.Interface != "":
+		return nil, nil, nil, fmt.Errorf("%w: interface %s has no IPv4 network", errInvalidRequest, req.Interface)
+	case found == nil:
+		return nil, nil, nil, fmt.Errorf("%w: no interface with an IPv4 network found", errInvalidRequest)
+	}
+
+	ones, bits := subnet.Mask.Size()
+	if bits-ones > 12 {
+		return nil, nil, nil, fmt.Errorf("%w: subnets are limited to %d addresses, a /20", errInvalidRequest, discoveryMaxHosts)
+	}
+	first := binary.BigEndian.Uint32(subnet.IP.To4())
+	last := first | (1<<(bits-ones) - 1)
+	if bits-ones >= 2 {
+		// Skip the network and broadcast addresses
+		first, last = first+1, last-1
+	}
+	own := make(map[string]bool)
+	if addrs, err := found.Addrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				own[ipNet.IP.String()] = true
+			}
+		}
+	}
+	var targets []net.IP
+	for n := first; n <= last; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		if !own[ip.String()] && nm.outbound.checkIP(ip, false) == nil {
+			targets = append(targets, ip)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil, nil, fmt.Errorf("%w: no address of %s left to probe", errInvalidRequest, subnet)
+	}
+	return found, subnet, targets, nil
+}
+
+func prefixLength(ipNet *net.IPNet) int {
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+// pingScan sends an ICMP echo request to every target, through an
+// unprivileged ping socket when net.ipv4.ping_group_range allows it, and
+// looks the MAC addresses of the hosts which answered up in the neighbour
+// table
+func pingScan(iface *net.Interface, targets []net.IP, rate int, wait time.Duration) ([]DiscoveredHost, error) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	scan := newDiscoveryScan()
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		buffer := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buffer)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			message, err := icmp.ParseMessage(1, buffer[:n])
+			if err != nil || message.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			host, _, _ := net.SplitHostPort(peer.String())
+			if host == "" {
+				host = peer.String()
+			}
+			scan.reply(host, nil)
+		}
+	}()
+
+	id := rand.Intn(1 << 16)
+	seq := 0
+	err = probe(targets, rate, func(target net.IP) error {
+		seq++
+		data, err := (&icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("ccw")},
+		}).Marshal(nil)
+		if err != nil {
+			return err
+		}
+		var addr net.Addr = &net.IPAddr{IP: target}
+		if conn.LocalAddr().Network() == "udp" {
+			addr = &net.UDPAddr{IP: target}
+		}
+		scan.send(target.String())
+		_, err = conn.WriteTo(data, addr)
+		return err
+	})
+	conn.SetReadDeadline(time.Now().Add(wait))
+	<-received
+	if err != nil {
+		return nil, fmt.Errorf("failed to send echo request: %w", err)
+	}
+
+	neighbours := readNeighbours(iface.Name)
+	hosts := scan.results()
+	for i := range hosts {
+		if mac, ok := neighbours[hosts[i].IP]; ok {
+			hosts[i].MAC = mac.String()
+		}
+	}
+	return hosts, nil
+}
+
+// probe calls send for every target, at most rate times per second
+func probe(targets []net.IP, rate int, send func(net.IP) error) error {
+	interval := time.Duration(0)
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+	next := time.Now()
+	for _, target := range targets {
+		if delay := time.Until(next); delay > 0 {
+			time.Sleep(delay)
+		}
+		next = next.Add(interval)
+		if err := send(target); err != nil && !errors.Is(err, syscall.EHOSTUNREACH) {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDiscoveryScan() *discoveryScan {
+	return &discoveryScan{sent: make(map[string]time.Time), hosts: make(map[string]*DiscoveredHost)}
+}
+
+func (s *discoveryScan) send(ip string) {
+	s.mutex.Lock()
+	s.sent[ip] = time.Now()
+	s.mutex.Unlock()
+}
+
+// reply records the first reply of a probed host
+func (s *discoveryScan) reply(ip string, mac net.HardwareAddr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sent, probed := s.sent[ip]
+	if _, seen := s.hosts[ip]; !probed || seen {
+		return
+	}
+	host := &DiscoveredHost{IP: ip, RTT: float64(time.Since(sent).Microseconds()) / 1000}
+	if mac != nil {
+		host.MAC = mac.String()
+	}
+	s.hosts[ip] = host
+}
+
+// results returns the hosts found, in address order
+func (s *discoveryScan) results() []DiscoveredHost {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hosts := make([]DiscoveredHost, 0, len(s.hosts))
+	for _, host := range s.hosts {
+		hosts = append(hosts, *host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return binary.BigEndian.Uint32(net.ParseIP(hosts[i].IP).To4()) < binary.BigEndian.Uint32(net.ParseIP(hosts[j].IP).To4())
+	})
+	return hosts
+}
+
+// readNeighbours reads the resolved entries of the ARP table of an interface
+func readNeighbours(iface string) map[string]net.HardwareAddr {
+	neighbours := make(map[string]net.HardwareAddr)
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return neighbours
+	}
+	defer file.Close()
+
+	// IP address, HW type, Flags, HW address, Mask, Device
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != iface || fields[2] == "0x0" {
+			continue
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			neighbours[fields[0]] = mac
+		}
+	}
+	return neighbours
+}
+
+// macVendor looks the organization of a MAC address up, loading the vendor
+// database on first use. Locally administered addresses, such as the
+// randomized ones of phones, have none.
+func (nm *NetworkModule) macVendor(mac net.HardwareAddr) (string, bool) {
+	if len(mac) < 3 || mac[0]&0x02 != 0 {
+		return "", len(mac) >= 3
+	}
+	nm.vendorsOnce.Do(func() {
+		paths := ouiFiles
+		if nm.config.OUIFile != "" {
+			paths = []string{nm.config.OUIFile}
+		}
+		for _, path := range paths {
+			if vendors, err := loadOUI(path); err == nil {
+				nm.vendors = vendors
+				return
+			}
+		}
+	})
+	return nm.vendors[fmt.Sprintf("%02X%02X%02X", mac[0], mac[1], mac[2])], false
+}
+
+// loadOUI reads a vendor database, keyed by the hex digits of the prefixes
+func loadOUI(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if prefix, vendor, ok := parseOUILine(scanner.Text()); ok {
+			vendors[prefix] = vendor
+		}
+	}
+	return vendors, scanner.Err()
+}
+
+// parseOUILine reads a line of the IEEE registry ("00-00-0C   (hex)\t\tCisco
+// Systems, Inc", and the same with "000000     (base 16)"), nmap ("00000C Cisco Systems") or Wireshark ("00:00:0C\tCisco
+// \tCisco Systems, Inc") databases. Wireshark entries of longer prefixes are
+// skipped.
+func parseOUILine(line string) (string, string, bool) {
+	if line == "" || line[0] == '#' {
+		return "", "", false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", "", false
+	}
+	prefix := strings.ToUpper(strings.NewReplacer("-", "", ":", "").Replace(fields[0]))
+	if len(prefix) != 6 || strings.Trim(prefix, "0123456789ABCDEF") != "" {
+		return "", "", false
+	}
+
+	vendor := strings.Join(fields[1:], " ")
+	switch {
+	case fields[1] == "(hex)":
+		vendor = strings.Join(fields[2:], " ")
+	case fields[1] == "(base" && len(fields) > 3:
+		vendor = strings.Join(fields[3:], " ")
+	case strings.Contains(line, "\t") && strings.Contains(fields[0], ":"):
+		parts := strings.Split(line, "\t")
+		vendor = strings.TrimSpace(parts[len(parts)-1])
+	}
+	return prefix, vendor, vendor != ""
+}
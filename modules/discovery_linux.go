@@ -0,0 +1,98 @@
+package modules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// arpScan broadcasts an ARP request for every target from the IPv4 address
+// of the interface on their network, collecting the replies
+func arpScan(iface *net.Interface, targets []net.IP, rate int, wait time.Duration) ([]DiscoveredHost, error) {
+	if len(iface.HardwareAddr) != 6 {
+		return nil, errARPUnsupported
+	}
+	var source net.IP
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.Contains(targets[0]) {
+			source = ipNet.IP.To4()
+			break
+		}
+	}
+	if source == nil {
+		return nil, fmt.Errorf("%w: interface %s has no address on the subnet", errInvalidRequest, iface.Name)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return nil, errARPUnsupported
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: iface.Index}); err != nil {
+		return nil, fmt.Errorf("failed to bind to %s: %w", iface.Name, err)
+	}
+	timeout := syscall.NsecToTimeval(int64(200 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return nil, err
+	}
+
+	scan := newDiscoveryScan()
+	done := make(chan struct{})
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		buffer := make([]byte, 1500)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, _, err := syscall.Recvfrom(fd, buffer, 0)
+			// An ARP reply for IPv4 over Ethernet: htype 1, ptype 0x0800,
+			// hlen 6, plen 4, op 2, then the sender addresses
+			if err != nil || n < 28 || binary.BigEndian.Uint16(buffer[6:8]) != 2 ||
+				binary.BigEndian.Uint16(buffer[2:4]) != 0x0800 || buffer[4] != 6 || buffer[5] != 4 {
+				continue
+			}
+			scan.reply(net.IP(buffer[14:18]).String(), net.HardwareAddr(buffer[8:14]))
+		}
+	}()
+
+	broadcast := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+	copy(broadcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	request := make([]byte, 28)
+	binary.BigEndian.PutUint16(request[0:2], 1)
+	binary.BigEndian.PutUint16(request[2:4], 0x0800)
+	request[4], request[5] = 6, 4
+	binary.BigEndian.PutUint16(request[6:8], 1)
+	copy(request[8:14], iface.HardwareAddr)
+	copy(request[14:18], source)
+
+	err = probe(targets, rate, func(target net.IP) error {
+		copy(request[24:28], target.To4())
+		scan.send(target.String())
+		return syscall.Sendto(fd, request, 0, broadcast)
+	})
+	if err == nil {
+		time.Sleep(wait)
+	}
+	close(done)
+	<-received
+	if err != nil {
+		return nil, fmt.Errorf("failed to send ARP request: %w", err)
+	}
+	return scan.results(), nil
+}
+
+// htons converts a 16-bit value to network byte order
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
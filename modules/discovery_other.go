@@ -0,0 +1,14 @@
+//go:build !linux
+
+package modules
+
+import (
+	"net"
+	"time"
+)
+
+// arpScan needs the packet sockets of Linux, scans fall back to echo
+// requests elsewhere
+func arpScan(iface *net.Interface, targets []net.IP, rate int, wait time.Duration) ([]DiscoveredHost, error) {
+	return nil, errARPUnsupported
+}
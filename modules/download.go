@@ -0,0 +1,332 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MirrorAttempt records a mirror that failed before the download succeeded
+type MirrorAttempt struct {
+	URL          string        `json:"url"`
+	Error        string        `json:"error"`
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// downloadResult describes a completed download
+type downloadResult struct {
+	url          string
+	bytesWritten int64
+	contentType  string
+	verification *Verification // when checksums or a signature were requested
+	segments     int           // parallel segments, 0 for a single stream
+	etag         string
+	lastModified string
+	cached       bool // served from the download cache
+}
+
+// Helper functions
+
+// fetchMirrors tries each mirror in order until one delivers the expected
+// content, returning the failed attempts
+func (nm *NetworkModule) fetchMirrors(client *http.Client, token *Token, urls []string, req DownloadRequest, verifier *downloadVerifier, task *Task) (*downloadResult, []MirrorAttempt, error) {
+	var attempts []MirrorAttempt
+	var err error
+	for _, url := range urls {
+		var result *downloadResult
+		if result, err = nm.fetchMirror(client, token, url, req, verifier, task); err == nil {
+			return result, attempts, nil
+		}
+		attempt := MirrorAttempt{URL: url, Error: err.Error()}
+		var verifyErr *VerificationError
+		if errors.As(err, &verifyErr) {
+			attempt.Verification = verifyErr.Verification
+		}
+		attempts = append(attempts, attempt)
+		if !mirrorFailed(err) || task.Err() != nil {
+			break
+		}
+		log.Printf("Download from %s failed: %v", url, err)
+	}
+	return nil, attempts, err
+}
+
+// fetchMirror downloads url into a temporary file next to path, verifies it
+// and moves it into place, so a failed mirror never leaves a
+// partial or corrupt file behind. A cached copy of url is revalidated with
+// the server and used if it didn't change.
+func (nm *NetworkModule) fetchMirror(client *http.Client, token *Token, url string, req DownloadRequest, verifier *downloadVerifier, task *Task) (*downloadResult, error) {
+	httpReq, err := http.NewRequestWithContext(task.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	cached := nm.cache.lookup(cacheURLKey(url))
+	if cached != nil && cached.ETag != "" {
+		httpReq.Header.Set("If-None-Match", cached.ETag)
+	} else if cached != nil && cached.LastModified != "" {
+		httpReq.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return nm.restoreCached(token, cached, req.Path, verifier)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP error: %s", errUpstream, resp.Status)
+	}
+
+	if resp.ContentLength > 0 {
+		if err := nm.quotas.Check(token, req.Path, resp.ContentLength); err != nil {
+			return nil, err
+		}
+		task.SetTotal(resp.ContentLength)
+	}
+
+	// All the segments of a download share the rate limit of the job
+	limiters := nm.throttle.limiters(req.RateLimit)
+
+	result := &downloadResult{
+		url:          url,
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	err = replaceFile(req.Path, func(tmp *os.File) error {
+		segments := nm.downloadSegments(req.Segments, resp)
+		if segments > 1 {
+			if err := nm.fetchSegments(client, token, url, req.Path, tmp, resp, segments, limiters, task); err != nil {
+				return err
+			}
+			result.bytesWritten = resp.ContentLength
+			result.segments = segments
+		} else {
+			// Copy the content, enforcing quotas on servers that omit or lie about the length
+			var err error
+			writer := nm.quotas.Writer(token, req.Path, tmp)
+			result.bytesWritten, err = io.Copy(writer, &throttledReader{reader: task.Reader(resp.Body), limiters: limiters})
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		result.verification, err = verifier.verify(tmp, result.bytesWritten)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// restoreChecksum copies the cached download matching one of the requested
+// checksums to path, if any
+func (nm *NetworkModule) restoreChecksum(token *Token, path string, verifier *downloadVerifier) *downloadResult {
+	if verifier == nil {
+		return nil
+	}
+	for _, sum := range verifier.checksums {
+		entry := nm.cache.lookup(sum.algorithm + ":" + sum.expected)
+		if entry == nil {
+			continue
+		}
+		result, err := nm.restoreCached(token, entry, path, verifier)
+		if err != nil {
+			log.Printf("Failed to restore %s from the download cache: %v", entry.URL, err)
+			return nil
+		}
+		return result
+	}
+	return nil
+}
+
+// cacheDownload stores a completed download in the cache, by URL and by the
+// requested checksums. sha256 checksums are found by content without a key.
+func (nm *NetworkModule) cacheDownload(path string, verifier *downloadVerifier, result *downloadResult) {
+	if nm.cache == nil {
+		return
+	}
+	keys := []string{cacheURLKey(result.url)}
+	if verifier != nil {
+		for _, sum := range verifier.checksums {
+			if sum.algorithm != "sha256" {
+				keys = append(keys, sum.algorithm+":"+sum.expected)
+			}
+		}
+	}
+	entry := CacheEntry{
+		URL:          redactURL(result.url),
+		ContentType:  result.contentType,
+		ETag:         result.etag,
+		LastModified: result.lastModified,
+	}
+	if err := nm.cache.store(path, keys, entry); err != nil {
+		log.Printf("Failed to cache %s: %v", redactURL(result.url), err)
+	}
+}
+
+// restoreCached copies a cached download to path, verified like a fresh one
+func (nm *NetworkModule) restoreCached(token *Token, entry *CacheEntry, path string, verifier *downloadVerifier) (*downloadResult, error) {
+	if err := nm.quotas.Check(token, path, entry.Size); err != nil {
+		return nil, err
+	}
+
+	result := &downloadResult{url: entry.URL, contentType: entry.ContentType, cached: true}
+	err := replaceFile(path, func(tmp *os.File) error {
+		var err error
+		if result.bytesWritten, err = nm.cache.restore(entry, nm.quotas.Writer(token, path, tmp)); err != nil {
+			return err
+		}
+		result.verification, err = verifier.verify(tmp, result.bytesWritten)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// replaceFile calls write with a temporary file next to path, which is moved
+// into place if write succeeds and removed otherwise
+func replaceFile(path string, write func(tmp *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".ccw-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// downloadSegments returns the number of parallel segments to download resp
+// with, 1 unless the server supports ranges and the file is large enough
+func (nm *NetworkModule) downloadSegments(requested int, resp *http.Response) int {
+	segments := requested
+	if segments == 0 {
+		segments = nm.config.DownloadSegments
+	}
+	if segments <= 1 || resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return 1
+	}
+
+	// Every segment is at least DOWNLOAD_SEGMENT_MIN_SIZE bytes
+	if minSize := nm.config.DownloadSegmentMinSize; minSize > 0 {
+		segments = int(min(int64(segments), resp.ContentLength/minSize))
+	}
+	return max(segments, 1)
+}
+
+// fetchSegments downloads the content of resp in parallel byte ranges,
+// written in place into file. The first segment is read from resp itself.
+func (nm *NetworkModule) fetchSegments(client *http.Client, token *Token, url, path string, file *os.File, resp *http.Response, segments int, limiters []*rateLimiter, task *Task) error {
+	ctx, cancel := context.WithCancel(task.Context())
+	defer cancel()
+
+	// Ranges must come from the same version of the file as resp
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	size := resp.ContentLength
+	segmentSize := (size + int64(segments) - 1) / int64(segments)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+			resp.Body.Close()
+		})
+	}
+
+	for start := int64(0); start < size; start += segmentSize {
+		end := min(start+segmentSize, size) - 1
+
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+
+			body := resp.Body
+			if start > 0 {
+				var err error
+				if body, err = fetchRange(ctx, client, url, validator, start, end); err != nil {
+					fail(err)
+					return
+				}
+				defer body.Close()
+			}
+
+			writer := nm.quotas.Writer(token, path, io.NewOffsetWriter(file, start))
+			reader := &throttledReader{reader: task.Reader(io.LimitReader(body, end-start+1)), limiters: limiters}
+			n, err := io.Copy(writer, reader)
+			if err == nil && n != end-start+1 {
+				err = fmt.Errorf("%w: segment %d-%d ended after %d bytes", errUpstream, start, end, n)
+			}
+			if err != nil {
+				fail(err)
+			}
+		}(start, end)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// fetchRange requests the bytes start to end of url, failing if the server
+// ignores the range or the file changed since validator
+func fetchRange(ctx context.Context, client *http.Client, url, validator string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: range request for bytes %d-%d returned %s", errUpstream, start, end, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// mirrorFailed reports whether err is specific to the mirror, so the next
+// mirror may succeed, rather than a local failure like a full disk or quota
+func mirrorFailed(err error) bool {
+	var quotaErr *QuotaError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	return !errors.As(err, &quotaErr) && !errors.As(err, &pathErr) && !errors.As(err, &linkErr)
+}
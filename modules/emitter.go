@@ -0,0 +1,255 @@
+package modules
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Emitter serializes Socket.IO writes per connection through a bounded queue
+type Emitter struct {
+	queueSize   int
+	batchWindow time.Duration
+	batched     map[string]bool
+	queues      map[string]*emitQueue
+	mutex       sync.Mutex
+}
+
+type emitQueue struct {
+	conn     socketio.Conn
+	encoding string // of the stream events
+	events   chan emitEvent
+	dropped  atomic.Int64
+	done     chan struct{}
+}
+
+type emitEvent struct {
+	name string
+	args []interface{}
+}
+
+// EventResult acknowledges a Socket.IO request event, mirroring the
+// success, code and message fields of the REST responses
+type EventResult struct {
+	Success bool        `json:"success"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func NewEmitter(config *Config, batchedEvents ...string) *Emitter {
+	batched := make(map[string]bool)
+	for _, event := range batchedEvents {
+		batched[event] = true
+	}
+
+	queueSize := config.EmitQueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	return &Emitter{
+		queueSize:   queueSize,
+		batchWindow: config.EmitBatchWindow,
+		batched:     batched,
+		queues:      make(map[string]*emitQueue),
+	}
+}
+
+// Register starts the writer of an accepted connection. Events for
+// connections never registered, or already cleaned up, are dropped, so late
+// emits of a finished task don't outlive the client.
+func (e *Emitter) Register(conn socketio.Conn) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, exists := e.queues[conn.ID()]; exists {
+		return
+	}
+	queue := &emitQueue{
+		conn:     conn,
+		encoding: ConnEncoding(conn),
+		events:   make(chan emitEvent, e.queueSize),
+		done:     make(chan struct{}),
+	}
+	e.queues[conn.ID()] = queue
+
+	go e.runQueue(queue)
+}
+
+// Emit queues an event for the connection without blocking the caller.
+// Events are dropped when the queue is full and the client is notified
+// with a sys:dropped event once the queue drains.
+func (e *Emitter) Emit(conn socketio.Conn, event string, args ...interface{}) {
+	queue := e.queue(conn)
+	if queue == nil {
+		return
+	}
+
+	select {
+	case queue.events <- emitEvent{name: event, args: args}:
+	case <-queue.done:
+	default:
+		queue.dropped.Add(1)
+	}
+}
+
+// Send queues an event that must not be dropped, blocking until the queue
+// has room or the connection goes away. It reports whether it was queued.
+func (e *Emitter) Send(conn socketio.Conn, event string, args ...interface{}) bool {
+	queue := e.queue(conn)
+	if queue == nil {
+		return false
+	}
+
+	select {
+	case queue.events <- emitEvent{name: event, args: args}:
+		return true
+	case <-queue.done:
+		return false
+	}
+}
+
+// Reply emits a response event and returns its payload as the
+// acknowledgement of the request that caused it
+func (e *Emitter) Reply(conn socketio.Conn, event string, payload map[string]interface{}) EventResult {
+	e.Emit(conn, event, payload)
+	return EventResult{Success: true, Data: payload}
+}
+
+// Fail emits an error event and returns it as a failed acknowledgement
+func (e *Emitter) Fail(conn socketio.Conn, event string, payload map[string]interface{}) EventResult {
+	e.Emit(conn, event, payload)
+
+	result := EventResult{Success: false}
+	data := make(map[string]interface{})
+	for key, value := range payload {
+		switch key {
+		case "code":
+			result.Code, _ = value.(string)
+		case "message":
+			result.Message, _ = value.(string)
+		default:
+			data[key] = value
+		}
+	}
+	if len(data) > 0 {
+		result.Data = data
+	}
+	return result
+}
+
+// Broadcast queues an event for every connection in a room
+func (e *Emitter) Broadcast(server *socketio.Server, room, event string, args ...interface{}) {
+	server.ForEach("/", room, func(conn socketio.Conn) {
+		e.Emit(conn, event, args...)
+	})
+}
+
+// Lookup returns the connection with the given ID, or nil if it is gone
+func (e *Emitter) Lookup(clientID string) socketio.Conn {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if queue, exists := e.queues[clientID]; exists {
+		return queue.conn
+	}
+	return nil
+}
+
+// CleanupConnection stops the writer of a disconnected client
+func (e *Emitter) CleanupConnection(clientID string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if queue, exists := e.queues[clientID]; exists {
+		close(queue.done)
+		delete(e.queues, clientID)
+	}
+}
+
+// Helper functions
+
+// queue returns the queue of a registered connection, nil when it isn't
+// connected
+func (e *Emitter) queue(conn socketio.Conn) *emitQueue {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.queues[conn.ID()]
+}
+
+func (e *Emitter) runQueue(queue *emitQueue) {
+	for {
+		select {
+		case <-queue.done:
+			return
+		case event := <-queue.events:
+			if e.batched[event.name] && len(event.args) == 1 && e.batchWindow > 0 {
+				// Give bursts a chance to accumulate before flushing
+				time.Sleep(e.batchWindow)
+			}
+
+			e.flush(queue, e.drain(queue, event))
+
+			if dropped := queue.dropped.Swap(0); dropped > 0 {
+				queue.conn.Emit("sys:dropped", map[string]interface{}{
+					"count":     dropped,
+					"timestamp": time.Now(),
+				})
+			}
+		}
+	}
+}
+
+// drain collects the events already waiting behind the first one
+func (e *Emitter) drain(queue *emitQueue, first emitEvent) []emitEvent {
+	events := []emitEvent{first}
+	for len(events) < e.queueSize {
+		select {
+		case event := <-queue.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+	return events
+}
+
+// flush writes the events in order, merging consecutive runs of the
+// same batched event into a single "<event>:batch" emit
+func (e *Emitter) flush(queue *emitQueue, events []emitEvent) {
+	for i := 0; i < len(events); {
+		event := events[i]
+		if !e.batched[event.name] || len(event.args) != 1 {
+			queue.emit(event.name, event.args...)
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(events) && events[j].name == event.name && len(events[j].args) == 1 {
+			j++
+		}
+
+		if j-i == 1 {
+			queue.emit(event.name, event.args...)
+		} else {
+			payloads := make([]interface{}, 0, j-i)
+			for _, batched := range events[i:j] {
+				payloads = append(payloads, batched.args[0])
+			}
+			queue.emit(event.name+":batch", map[string]interface{}{
+				"events": payloads,
+				"count":  len(payloads),
+			})
+		}
+		i = j
+	}
+}
+
+// emit writes an event in the encoding of the connection
+func (queue *emitQueue) emit(event string, args ...interface{}) {
+	queue.conn.Emit(event, encodeFrame(queue.encoding, event, args)...)
+}
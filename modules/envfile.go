@@ -0,0 +1,366 @@
+package modules
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EnvEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Redacted bool   `json:"redacted"`
+	Line     int    `json:"line"`
+}
+
+type EnvUpdateRequest struct {
+	Path  string            `json:"path" binding:"required"`
+	Set   map[string]string `json:"set"`
+	Unset []string          `json:"unset"`
+}
+
+// envLine is a line of an env file, keeping the original text so
+// comments and formatting survive updates
+type envLine struct {
+	raw    string
+	key    string
+	value  string
+	export bool // written as "export KEY=value"
+}
+
+// REST API Handlers
+
+// ReadEnvFile returns the key/value pairs of a .env file, redacting values
+// unless reveal=true is requested by a token holding the env.reveal scope
+func (fsm *FileSystemModule) ReadEnvFile(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+
+	reveal := c.Query("reveal") == "true"
+	if reveal && !RequestToken(c).HasScope(ScopeEnvReveal) {
+		c.JSON(http.StatusForbidden, FileOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Revealing values requires the env.reveal permission"),
+		})
+		return
+	}
+
+	lines, err := readEnvLines(path)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read env file: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Env file read successfully"),
+		Data:    envEntries(lines, reveal),
+	})
+}
+
+// UpdateEnvFile sets and removes keys of a .env file in place
+func (fsm *FileSystemModule) UpdateEnvFile(c *gin.Context) {
+	var req EnvUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+
+	for key := range req.Set {
+		if !validEnvKey(key) {
+			c.JSON(http.StatusBadRequest, FileOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid key: %q", key),
+			})
+			return
+		}
+	}
+
+	lines, err := readEnvLines(req.Path)
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read env file: %v", err),
+		})
+		return
+	}
+
+	unset := make(map[string]bool)
+	for _, key := range req.Unset {
+		unset[key] = true
+	}
+
+	applied := make(map[string]bool)
+	var updated []envLine
+	for _, line := range lines {
+		if line.key != "" && unset[line.key] {
+			continue
+		}
+		if value, ok := req.Set[line.key]; ok && line.key != "" {
+			line = envLine{raw: formatEnvLine(line.key, value, line.export), key: line.key, value: value, export: line.export}
+			applied[line.key] = true
+		}
+		updated = append(updated, line)
+	}
+
+	// New keys are appended in a stable order
+	for _, key := range sortedKeys(req.Set) {
+		if !applied[key] {
+			updated = append(updated, envLine{raw: formatEnvLine(key, req.Set[key], false), key: key, value: req.Set[key]})
+		}
+	}
+
+	var content strings.Builder
+	for _, line := range updated {
+		content.WriteString(line.raw)
+		content.WriteString("\n")
+	}
+
+	token := RequestToken(c)
+	if err := fsm.quotas.Check(token, req.Path, int64(content.Len())); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
+		})
+		return
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(req.Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := writeEnvFile(req.Path, content.String(), mode); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to write env file: %v", err),
+		})
+		return
+	}
+	fsm.quotas.Record(token, int64(content.Len()))
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Env file updated successfully"),
+		Data:    envEntries(updated, false),
+	})
+}
+
+// Helper functions
+
+// envFile reports whether path is an env file, such as .env or .env.local,
+// whose raw content would reveal the values the env module redacts
+func envFile(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), ".env")
+}
+
+// envReadable answers with the error and returns false when path is an env
+// file and the token of the request can't reveal its values
+func (fsm *FileSystemModule) envReadable(c *gin.Context, path string) bool {
+	if envFile(path) && !RequestToken(c).HasScope(ScopeEnvReveal) {
+		c.JSON(http.StatusForbidden, FileOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Reading env files requires the env.reveal permission"),
+		})
+		return false
+	}
+	return true
+}
+
+func readEnvLines(path string) ([]envLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []envLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		key, value, export, ok := parseEnvLine(raw)
+		if !ok {
+			lines = append(lines, envLine{raw: raw})
+			continue
+		}
+		lines = append(lines, envLine{raw: raw, key: key, value: value, export: export})
+	}
+
+	return lines, scanner.Err()
+}
+
+func parseEnvLine(raw string) (key, value string, export, ok bool) {
+	line := strings.TrimSpace(raw)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, false
+	}
+	line, export = strings.CutPrefix(line, "export ")
+
+	key, value, found := strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !found || !validEnvKey(key) {
+		return "", "", false, false
+	}
+
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		value = unquoteEnvValue(value[1:])
+	case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1:
+		value = value[1 : len(value)-1]
+	default:
+		// Strip trailing comments from unquoted values
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+	}
+
+	return key, value, export, true
+}
+
+// unquoteEnvValue reads a double-quoted value up to its closing quote,
+// undoing the escapes dotenv parsers know
+func unquoteEnvValue(quoted string) string {
+	var value strings.Builder
+	for i := 0; i < len(quoted); i++ {
+		switch quoted[i] {
+		case '"':
+			return value.String()
+		case '\\':
+			if i+1 == len(quoted) {
+				value.WriteByte('\\')
+				continue
+			}
+			i++
+			switch quoted[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case '"', '\\', '$':
+				value.WriteByte(quoted[i])
+			default:
+				value.WriteByte('\\')
+				value.WriteByte(quoted[i])
+			}
+		default:
+			value.WriteByte(quoted[i])
+		}
+	}
+	return value.String()
+}
+
+// formatEnvLine writes a value the way docker compose and dotenv read it
+// back unchanged: single-quoted, which nothing expands, unless it holds a
+// quote or a newline, then double-quoted with $ escaped
+func formatEnvLine(key, value string, export bool) string {
+	line := key + "="
+	if export {
+		line = "export " + line
+	}
+	switch {
+	case value != "" && !strings.ContainsAny(value, " \t\"'#$\\\n\r`"):
+		return line + value
+	case !strings.ContainsAny(value, "'\n\r"):
+		return line + "'" + value + "'"
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", `\n`, "\r", `\r`).Replace(value)
+	return line + `"` + escaped + `"`
+}
+
+// writeEnvFile replaces an env file through a temporary file renamed over
+// it, so readers never see it half written
+func writeEnvFile(path, content string, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".ccw-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func validEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, r := range key {
+		if r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func envEntries(lines []envLine, reveal bool) []EnvEntry {
+	entries := []EnvEntry{}
+	for i, line := range lines {
+		if line.key == "" {
+			continue
+		}
+
+		entry := EnvEntry{Key: line.key, Line: i + 1}
+		if reveal {
+			entry.Value = line.value
+		} else {
+			entry.Redacted = true
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,195 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Machine-readable error codes returned in the "code" field of failed
+// operations, so clients can branch on errors without parsing messages
+const (
+	ErrInvalidRequest   = "ERR_INVALID_REQUEST"
+	ErrUnauthorized     = "ERR_UNAUTHORIZED"
+	ErrPermission       = "ERR_PERMISSION"
+	ErrReadOnly         = "ERR_READ_ONLY"
+	ErrApprovalRequired = "ERR_APPROVAL_REQUIRED"
+	ErrHostNotAllowed   = "ERR_HOST_NOT_ALLOWED"
+	ErrNotFound         = "ERR_NOT_FOUND"
+	ErrExists           = "ERR_EXISTS"
+	ErrIsDirectory      = "ERR_IS_DIRECTORY"
+	ErrNotDirectory     = "ERR_NOT_DIRECTORY"
+	ErrNotEmpty         = "ERR_NOT_EMPTY"
+	ErrConflict         = "ERR_CONFLICT"
+	ErrTooLarge         = "ERR_TOO_LARGE"
+	ErrQuotaExceeded    = "ERR_QUOTA_EXCEEDED"
+	ErrNoSpace          = "ERR_NO_SPACE"
+	ErrTimeout          = "ERR_TIMEOUT"
+	ErrUpstream         = "ERR_UPSTREAM"
+	ErrChecksumMismatch = "ERR_CHECKSUM_MISMATCH"
+	ErrSignatureInvalid = "ERR_SIGNATURE_INVALID"
+	ErrInvalidArchive   = "ERR_INVALID_ARCHIVE"
+	ErrInvalidContent   = "ERR_INVALID_CONTENT"
+	ErrProvisionFailed  = "ERR_PROVISION_FAILED"
+	ErrWatchLimit       = "ERR_WATCH_LIMIT"
+	ErrWalkLimit        = "ERR_WALK_LIMIT"
+	ErrMountFailed      = "ERR_MOUNT_FAILED"
+	ErrSessionLimit     = "ERR_SESSION_LIMIT"
+	ErrConnectionLimit  = "ERR_CONNECTION_LIMIT"
+	ErrCancelled        = "ERR_CANCELLED"
+	ErrUnsupported      = "ERR_UNSUPPORTED"
+	ErrOutsideRoot      = "ERR_OUTSIDE_ROOT"
+	ErrTranscodeFailed  = "ERR_TRANSCODE_FAILED"
+	ErrInternal         = "ERR_INTERNAL"
+)
+
+// errUpstream marks failures reported by a remote server or agent
+var errUpstream = errors.New("upstream error")
+
+// errInvalidRequest marks failures caused by the request parameters
+var errInvalidRequest = errors.New("invalid request")
+
+// errInvalidPath marks paths that can't be used, e.g. with NUL bytes
+var errInvalidPath = errors.New("invalid path")
+
+// errOutsideRoot marks paths outside FS_ROOT
+var errOutsideRoot = errors.New("path outside the root directory")
+
+// errChecksumMismatch marks downloaded content that doesn't match the
+// expected checksum
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// errSignatureInvalid marks downloaded content without a valid signature from
+// the expected keys
+var errSignatureInvalid = errors.New("signature invalid")
+
+// errInvalidArchive marks archives that can't be extracted safely
+var errInvalidArchive = errors.New("invalid archive")
+
+// errInvalidContent marks files whose content can't be parsed in their
+// format
+var errInvalidContent = errors.New("invalid content")
+
+// errProvisionFailed marks provisioning runs stopped by a failed step
+var errProvisionFailed = errors.New("provisioning failed")
+
+// errBodyTooLarge marks request bodies past MAX_BODY_SIZE
+var errBodyTooLarge = errors.New("request body too large")
+
+// errFileTooLarge marks files past the size an operation handles
+var errFileTooLarge = errors.New("file too large")
+
+// errSessionLimit marks shells refused past SHELL_MAX_SESSIONS
+var errSessionLimit = errors.New("session limit reached")
+
+// errConnectionLimit marks connections and requests refused past the
+// MAX_CLIENTS and MAX_REQUESTS limits
+var errConnectionLimit = errors.New("connection limit reached")
+
+// errUnsupported marks operations the platform of the agent can't do
+var errUnsupported = errors.New("unsupported on " + runtime.GOOS)
+
+// errHostNotAllowed marks outbound connections refused by the outbound policy
+var errHostNotAllowed = errors.New("host not allowed")
+
+// Helper functions
+
+// errorStatus returns the HTTP status matching err
+func errorStatus(err error) int {
+	status, _ := classifyError(err)
+	return status
+}
+
+// errorCode returns the error code matching err
+func errorCode(err error) string {
+	_, code := classifyError(err)
+	return code
+}
+
+// errorDetails returns the structured details of err sent along its code,
+// nil when it has none
+func errorDetails(err error) any {
+	var walkErr *walkLimitError
+	if errors.As(err, &walkErr) {
+		return walkErr
+	}
+	var mountErr *mountError
+	if errors.As(err, &mountErr) {
+		return mountErr
+	}
+	return nil
+}
+
+func classifyError(err error) (int, string) {
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		return quotaErr.Status, quotaErr.Code
+	}
+
+	var netErr net.Error
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errInvalidRequest), errors.Is(err, errInvalidPath):
+		return http.StatusBadRequest, ErrInvalidRequest
+	case errors.Is(err, errOutsideRoot):
+		return http.StatusForbidden, ErrOutsideRoot
+	case errors.Is(err, errHostNotAllowed):
+		return http.StatusForbidden, ErrHostNotAllowed
+	case errors.Is(err, errChecksumMismatch):
+		return http.StatusUnprocessableEntity, ErrChecksumMismatch
+	case errors.Is(err, errSignatureInvalid):
+		return http.StatusUnprocessableEntity, ErrSignatureInvalid
+	case errors.Is(err, errInvalidArchive):
+		return http.StatusUnprocessableEntity, ErrInvalidArchive
+	case errors.Is(err, errInvalidContent):
+		return http.StatusUnprocessableEntity, ErrInvalidContent
+	case errors.Is(err, errProvisionFailed):
+		return http.StatusUnprocessableEntity, ErrProvisionFailed
+	case errors.Is(err, errTranscodeFailed):
+		return http.StatusUnprocessableEntity, ErrTranscodeFailed
+	case errors.Is(err, errMountFailed):
+		return http.StatusUnprocessableEntity, ErrMountFailed
+	case errors.Is(err, errWalkLimit):
+		return http.StatusUnprocessableEntity, ErrWalkLimit
+	case errors.Is(err, errBodyTooLarge), errors.Is(err, errFileTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, ErrTooLarge
+	case errors.Is(err, errSessionLimit):
+		return http.StatusTooManyRequests, ErrSessionLimit
+	case errors.Is(err, errTaskCancelled):
+		return http.StatusConflict, ErrCancelled
+	case errors.Is(err, errConnectionLimit):
+		return http.StatusTooManyRequests, ErrConnectionLimit
+	case errors.Is(err, errUnsupported):
+		return http.StatusNotImplemented, ErrUnsupported
+	case errors.Is(err, errWatchLimit):
+		return http.StatusServiceUnavailable, ErrWatchLimit
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound, ErrNotFound
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EROFS):
+		return http.StatusForbidden, ErrPermission
+	case errors.Is(err, fs.ErrExist):
+		return http.StatusConflict, ErrExists
+	case errors.Is(err, syscall.EISDIR):
+		return http.StatusConflict, ErrIsDirectory
+	case errors.Is(err, syscall.ENOTDIR):
+		return http.StatusConflict, ErrNotDirectory
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return http.StatusConflict, ErrNotEmpty
+	case errors.Is(err, syscall.EBUSY):
+		return http.StatusConflict, ErrConflict
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return http.StatusInsufficientStorage, ErrNoSpace
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, ErrTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, ErrTimeout
+	case errors.As(err, &netErr), errors.Is(err, errUpstream):
+		return http.StatusBadGateway, ErrUpstream
+	}
+	return http.StatusInternalServerError, ErrInternal
+}
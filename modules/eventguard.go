@@ -0,0 +1,230 @@
+package modules
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// RecordEvent is the kind of records of Socket.IO events
+const RecordEvent = "event"
+
+// unrecordedEvents are sent for every keystroke, chunk or heartbeat, and
+// would flood the records. They're recorded only when refused.
+var unrecordedEvents = map[string]bool{
+	"sys:ping":          true,
+	"sys:pong":          true,
+	"shell:input":       true,
+	"fs:transfer:chunk": true,
+	"fs:transfer:ack":   true,
+}
+
+// secretFields of event payloads are never recorded
+var secretFields = map[string]bool{
+	"password": true,
+	"input":    true,
+	"data":     true,
+}
+
+// targetFields name what an event acts on, in order of preference
+var targetFields = []string{"path", "session_id", "transfer_id", "capture_id", "task_id", "profile", "tmux", "interface"}
+
+// eventRule grants an event, or the events starting with a prefix, to the
+// tokens holding one of its scopes
+type eventRule struct {
+	pattern string // event, or prefix ending with *
+	scopes  []string
+}
+
+// EventGuard checks the scopes of the connection before dispatching each
+// Socket.IO event, and records the event in the store once it's handled
+type EventGuard struct {
+	emitter  *Emitter
+	store    *Store
+	rules    []eventRule
+	readOnly bool // refuses the mutating events
+}
+
+var connType = reflect.TypeOf((*socketio.Conn)(nil)).Elem()
+var resultType = reflect.TypeOf(EventResult{})
+
+// NewEventGuard parses the event rules of SOCKET_SCOPES, in the form
+// "event=scope,scope;prefix:*=scope"
+func NewEventGuard(config *Config, emitter *Emitter, store *Store) *EventGuard {
+	guard := &EventGuard{emitter: emitter, store: store, readOnly: config.ReadOnly}
+	for _, entry := range strings.Split(config.SocketScopes, ";") {
+		pattern, scopes, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || pattern == "" {
+			continue
+		}
+		rule := eventRule{pattern: strings.TrimSpace(pattern)}
+		for _, scope := range strings.Split(scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				rule.scopes = append(rule.scopes, scope)
+			}
+		}
+		guard.rules = append(guard.rules, rule)
+	}
+	return guard
+}
+
+// Handle wraps the handler of an event. The handler runs only if the token
+// of the connection holds a scope the first rule matching the event asks
+// for, and the event doesn't change the host of a read-only agent;
+// otherwise the event fails with ERR_PERMISSION or ERR_READ_ONLY on the
+// error event of its module, and in its acknowledgement if it has one.
+func (g *EventGuard) Handle(event string, handler interface{}) interface{} {
+	value := reflect.ValueOf(handler)
+	kind := value.Type()
+	if kind.Kind() != reflect.Func || kind.NumIn() == 0 || kind.In(0) != connType {
+		panic("event handler of " + event + " must take a socketio.Conn first")
+	}
+	acked := kind.NumOut() == 1 && kind.Out(0) == resultType
+
+	return reflect.MakeFunc(kind, func(args []reflect.Value) []reflect.Value {
+		conn := args[0].Interface().(socketio.Conn)
+		var payload json.RawMessage
+		if len(args) > 1 {
+			payload, _ = args[1].Interface().(json.RawMessage)
+		}
+
+		started := time.Now()
+		var refusal map[string]interface{}
+		if g.readOnly && mutatingEvents[event] {
+			log.Printf("Refused %s from %s: the agent is read-only", event, conn.ID())
+			refusal = map[string]interface{}{
+				"code":    ErrReadOnly,
+				"message": localizeConn(conn, "The agent is read-only"),
+			}
+		} else if scopes := g.scopes(event); scopes != nil && !hasAnyScope(ConnToken(conn), scopes) {
+			log.Printf("Refused %s from %s: requires one of the scopes %s", event, conn.ID(), strings.Join(scopes, ", "))
+			refusal = map[string]interface{}{
+				"code":    ErrPermission,
+				"message": localizeConn(conn, "Permission denied: %s requires the %s permission", event, strings.Join(scopes, " or ")),
+			}
+		}
+		if refusal != nil {
+			refusal["event"] = event
+			result := g.emitter.Fail(conn, eventErrorEvent(event), refusal)
+			g.record(conn, event, payload, started, &result)
+			if acked {
+				return []reflect.Value{reflect.ValueOf(result)}
+			}
+			return nil
+		}
+
+		results := value.Call(args)
+		var result *EventResult
+		if acked {
+			outcome := results[0].Interface().(EventResult)
+			result = &outcome
+		}
+		if !unrecordedEvents[event] {
+			g.record(conn, event, payload, started, result)
+		}
+		return results
+	}).Interface()
+}
+
+// Helper functions
+
+// scopes returns the scopes of the first rule matching an event, nil when
+// none does and the event is open to every token
+func (g *EventGuard) scopes(event string) []string {
+	for _, rule := range g.rules {
+		if rule.pattern == event {
+			return rule.scopes
+		}
+		if prefix, ok := strings.CutSuffix(rule.pattern, "*"); ok && strings.HasPrefix(event, prefix) {
+			return rule.scopes
+		}
+	}
+	return nil
+}
+
+// record stores a handled event with its target and the fields of its
+// payload, secrets left out
+func (g *EventGuard) record(conn socketio.Conn, event string, payload json.RawMessage, started time.Time, result *EventResult) {
+	if g.store == nil {
+		return
+	}
+
+	record := Record{
+		Time:     started,
+		Kind:     RecordEvent,
+		Action:   event,
+		Status:   http.StatusOK,
+		Duration: time.Since(started).Milliseconds(),
+		Client:   conn.RemoteAddr().String(),
+	}
+	if token := ConnToken(conn); token != nil {
+		record.Token = token.Name
+	}
+
+	var fields map[string]any
+	if json.Unmarshal(payload, &fields) == nil && len(fields) > 0 {
+		for name := range secretFields {
+			delete(fields, name)
+		}
+		for _, name := range targetFields {
+			if target, ok := fields[name].(string); ok && target != "" {
+				record.Target = target
+				break
+			}
+		}
+		record.Details = fields
+	}
+	if result != nil && !result.Success {
+		record.Status = codeStatus(result.Code)
+		if record.Details == nil {
+			record.Details = map[string]any{}
+		}
+		record.Details["code"] = result.Code
+	}
+	g.store.Record(record)
+}
+
+// hasAnyScope reports whether a token holds one of scopes
+func hasAnyScope(token *Token, scopes []string) bool {
+	for _, scope := range scopes {
+		if token.HasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventErrorEvent returns the error event of the module of an event
+func eventErrorEvent(event string) string {
+	if strings.HasPrefix(event, "fs:transfer:") {
+		return "fs:transfer:error"
+	}
+	module, _, _ := strings.Cut(event, ":")
+	return module + ":error"
+}
+
+// codeStatus returns the HTTP status recorded for a failed event
+func codeStatus(code string) int {
+	switch code {
+	case ErrInvalidRequest:
+		return http.StatusBadRequest
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrPermission, ErrReadOnly, ErrOutsideRoot, ErrHostNotAllowed:
+		return http.StatusForbidden
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrExists, ErrConflict:
+		return http.StatusConflict
+	case ErrSessionLimit:
+		return http.StatusTooManyRequests
+	case ErrWatchLimit:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnprocessableEntity
+}
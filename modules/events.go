@@ -0,0 +1,162 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Socket.IO event payloads. Each event takes a single JSON object validated
+// with the same binding tags as the REST request bodies.
+
+type WatchRequest struct {
+	Path     string `json:"path" binding:"required"`
+	Checksum bool   `json:"checksum"` // only report changes of the content of files
+	WalkOptions
+}
+
+type ReplayRequest struct {
+	Path  string `json:"path" binding:"required"`
+	Since string `json:"since" binding:"required"`
+}
+
+type UploadRequest struct {
+	Path      string `json:"path" binding:"required"`
+	Size      int64  `json:"size" binding:"min=0"`
+	RateLimit int64  `json:"rate_limit" binding:"min=0"` // bytes per second
+}
+
+type DownloadStreamRequest struct {
+	Path      string `json:"path" binding:"required"`
+	RateLimit int64  `json:"rate_limit" binding:"min=0"` // bytes per second
+}
+
+type TransferRequest struct {
+	TransferID string `json:"transfer_id" binding:"required"`
+}
+
+type TransferAckRequest struct {
+	TransferID string `json:"transfer_id" binding:"required"`
+	Received   int64  `json:"received" binding:"min=0"`
+}
+
+type MonitorRequest struct {
+	Protocol  string `json:"protocol" binding:"required,oneof=tcp udp both"`
+	Interface string `json:"interface"`
+	Interval  int    `json:"interval" binding:"omitempty,min=1,max=3600"`
+	PortFilter
+}
+
+type CaptureRequest struct {
+	Interface  string `json:"interface" binding:"required"`
+	Filter     string `json:"filter"`                                  // BPF filter expression, e.g. "tcp port 443"
+	MaxPackets int    `json:"max_packets" binding:"min=0,max=1000000"` // default 1000
+	Duration   int    `json:"duration" binding:"min=0,max=3600"`       // seconds, default 60
+	MaxBytes   int64  `json:"max_bytes" binding:"min=0"`               // pcap file size, default 100MB
+	Snaplen    int    `json:"snaplen" binding:"min=0,max=262144"`      // bytes kept of each packet
+	Path       string `json:"path"`                                    // pcap file, defaults to a temporary file
+}
+
+type CaptureStopRequest struct {
+	CaptureID string `json:"capture_id" binding:"required"`
+}
+
+type SpawnRequest struct {
+	Command string `json:"command"`
+	Profile string `json:"profile"` // spawns a shell profile instead of command
+	Tmux    string `json:"tmux"`    // attaches to this tmux session instead
+	DisconnectPolicy
+}
+
+type InputRequest struct {
+	SessionID string `json:"session_id" binding:"required"`
+	Input     string `json:"input"`
+}
+
+type PasswordRequest struct {
+	SessionID string `json:"session_id" binding:"required"`
+	Password  string `json:"password" binding:"required"`
+}
+
+type SessionRequest struct {
+	SessionID string `json:"session_id" binding:"required"`
+}
+
+type SessionInfoRequest struct {
+	SessionID string `json:"session_id" binding:"required"`
+	Env       bool   `json:"env"` // requires the env.reveal scope
+}
+
+// FieldError describes why a payload field was rejected
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+// Decode unmarshals and validates the payload of an event into req. On
+// failure it emits errorEvent with the offending fields and returns the
+// failed acknowledgement.
+func (e *Emitter) Decode(conn socketio.Conn, errorEvent string, raw json.RawMessage, req interface{}) (EventResult, bool) {
+	trimmed := strings.TrimSpace(string(raw))
+	if !strings.HasPrefix(trimmed, "{") {
+		return e.Fail(conn, errorEvent, map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Payload must be a JSON object, positional arguments are not supported"),
+		}), false
+	}
+
+	if err := json.Unmarshal(raw, req); err != nil {
+		return e.Fail(conn, errorEvent, map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid request: %v", err),
+		}), false
+	}
+
+	if err := binding.Validator.ValidateStruct(req); err != nil {
+		fields := fieldErrors(req, err)
+		names := make([]string, len(fields))
+		for i, field := range fields {
+			names[i] = field.Field
+		}
+		return e.Fail(conn, errorEvent, map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid fields: %s", strings.Join(names, ", ")),
+			"errors":  fields,
+		}), false
+	}
+
+	return EventResult{Success: true}, true
+}
+
+// Helper functions
+
+// fieldErrors lists validation failures by their JSON field names
+func fieldErrors(req interface{}, err error) []FieldError {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return nil
+	}
+
+	structType := reflect.TypeOf(req)
+	for structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fieldErr := range validationErrors {
+		name := fieldErr.Field()
+		if field, ok := structType.FieldByName(fieldErr.StructField()); ok {
+			if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, FieldError{Field: name, Rule: fieldErr.Tag(), Param: fieldErr.Param()})
+	}
+	return fields
+}
@@ -0,0 +1,318 @@
+package modules
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxLinkSize bounds the symlink targets stored as zip entry content
+const maxLinkSize = 4096
+
+// ArchiveExtraction describes an archive unpacked after a download
+type ArchiveExtraction struct {
+	Destination string `json:"destination"`
+	Format      string `json:"format"` // "tar", "tar.gz" or "zip"
+	Files       int    `json:"files"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// archiveExtractor writes archive entries below root, a directory without
+// symlinks in its path. Entries are never written through symlinks leading
+// out of root, whatever links the archive or the directory already contain.
+type archiveExtractor struct {
+	quotas *Quotas
+	token  *Token
+	root   string
+	strip  int
+	result *ArchiveExtraction
+}
+
+// Helper functions
+
+// extractArchive unpacks the tar, tar.gz or zip archive at path into
+// destination, dropping the first strip components of entry names
+func (nm *NetworkModule) extractArchive(token *Token, path, destination string, strip int) (*ArchiveExtraction, error) {
+	e, err := newArchiveExtractor(nm.quotas, token, destination, strip)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(512)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		e.result.Format = "tar.gz"
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		defer gz.Close()
+		err = e.extractTar(gz)
+		return e.result, err
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		e.result.Format = "zip"
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		archive, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		err = e.extractZip(archive)
+		return e.result, err
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		e.result.Format = "tar"
+		err := e.extractTar(reader)
+		return e.result, err
+	}
+	return nil, fmt.Errorf("%w: unsupported format, expected tar, tar.gz or zip", errInvalidArchive)
+}
+
+// newArchiveExtractor creates destination and returns an extractor writing
+// below it, each file checked against the quotas of token
+func newArchiveExtractor(quotas *Quotas, token *Token, destination string, strip int) (*archiveExtractor, error) {
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(destination)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveExtractor{
+		quotas: quotas,
+		token:  token,
+		root:   root,
+		strip:  strip,
+		result: &ArchiveExtraction{Destination: destination},
+	}, nil
+}
+
+func (e *archiveExtractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.dir(header.Name, mode)
+		case tar.TypeReg:
+			err = e.file(header.Name, mode, tr)
+		case tar.TypeSymlink:
+			err = e.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = e.hardlink(header.Name, header.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *archiveExtractor) extractZip(archive *zip.Reader) error {
+	for _, entry := range archive.File {
+		mode := entry.Mode()
+		if mode.IsDir() {
+			if err := e.dir(entry.Name, mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		if mode&os.ModeSymlink != 0 {
+			var link []byte
+			if link, err = io.ReadAll(io.LimitReader(content, maxLinkSize)); err == nil {
+				err = e.symlink(entry.Name, string(link))
+			}
+		} else if mode.IsRegular() {
+			err = e.file(entry.Name, mode.Perm(), content)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// target returns the parts of the path of entry name below root, nil when
+// stripping removes the whole name
+func (e *archiveExtractor) target(name string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return nil, fmt.Errorf("%w: illegal entry path: %s", errInvalidArchive, name)
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) <= e.strip {
+		return nil, nil
+	}
+	return parts[e.strip:], nil
+}
+
+// mkdirAll creates the directories parts below root, following existing
+// symlinks only while they stay within root, and returns the real path
+func (e *archiveExtractor) mkdirAll(parts []string) (string, error) {
+	dir := e.root
+	for _, part := range parts {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case info.Mode()&os.ModeSymlink != 0:
+			real, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return "", err
+			}
+			if !e.within(real) {
+				return "", fmt.Errorf("%w: %s links out of the destination", errInvalidArchive, dir)
+			}
+			dir = real
+		case !info.IsDir():
+			return "", &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+	}
+	return dir, nil
+}
+
+// create returns the path of a new entry, replacing any file or symlink
+// already there
+func (e *archiveExtractor) create(parts []string) (string, error) {
+	dir, err := e.mkdirAll(parts[:len(parts)-1])
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, parts[len(parts)-1])
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+func (e *archiveExtractor) dir(name string, mode os.FileMode) error {
+	parts, err := e.target(name)
+	if parts == nil || err != nil {
+		return err
+	}
+	dir, err := e.mkdirAll(parts)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode|0700)
+}
+
+func (e *archiveExtractor) file(name string, mode os.FileMode, content io.Reader) error {
+	parts, err := e.target(name)
+	if parts == nil || err != nil {
+		return err
+	}
+	path, err := e.create(parts)
+	if err != nil {
+		return err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(e.quotas.Writer(e.token, path, file), content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	e.result.Bytes += n
+	if err != nil {
+		return err
+	}
+	e.result.Files++
+	return nil
+}
+
+func (e *archiveExtractor) symlink(name, link string) error {
+	parts, err := e.target(name)
+	if parts == nil || err != nil {
+		return err
+	}
+	path, err := e.create(parts)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(link) || !e.within(filepath.Join(filepath.Dir(path), link)) {
+		return fmt.Errorf("%w: %s links out of the destination: %s", errInvalidArchive, name, link)
+	}
+	return os.Symlink(link, path)
+}
+
+func (e *archiveExtractor) hardlink(name, link string) error {
+	parts, err := e.target(name)
+	if parts == nil || err != nil {
+		return err
+	}
+	linkParts, err := e.target(link)
+	if err != nil {
+		return err
+	}
+	if linkParts == nil {
+		return fmt.Errorf("%w: %s links to a stripped entry: %s", errInvalidArchive, name, link)
+	}
+	oldPath, err := e.mkdirAll(linkParts[:len(linkParts)-1])
+	if err != nil {
+		return err
+	}
+	path, err := e.create(parts)
+	if err != nil {
+		return err
+	}
+	return os.Link(filepath.Join(oldPath, linkParts[len(linkParts)-1]), path)
+}
+
+// within reports whether path is root or below it
+func (e *archiveExtractor) within(path string) bool {
+	return path == e.root || strings.HasPrefix(path, e.root+string(filepath.Separator))
+}
@@ -0,0 +1,11 @@
+package modules
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves the blocks of the first size bytes of a file
+func preallocate(file *os.File, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, size)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package modules
+
+import "os"
+
+// preallocate extends a file to size without reserving its blocks, there's
+// no portable fallocate
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -1,25 +1,47 @@
 package modules
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	socketio "github.com/googollee/go-socket.io"
 )
 
 type FileSystemModule struct {
-	server   *socketio.Server
-	watchers map[string]*fsnotify.Watcher
-	clients  map[string]map[string]bool // clientID -> paths being watched
-	mutex    sync.RWMutex
+	server    *socketio.Server
+	emitter   *Emitter
+	config    *Config
+	quotas    *Quotas
+	throttle  *Throttle
+	outbound  *OutboundPolicy
+	watches   map[watchKey]*sharedWatch
+	clients   map[string]map[string]watchKey // clientID -> watch of each watched path
+	transfers map[string]*FileTransfer
+	hashes    *hashCache
+	journals  *watchJournals
+	tmp       *TmpSpaces
+	tasks     *Tasks
+	paths     *Paths
+	bookmarks *Bookmarks
+	index     *SearchIndex
+	mutex     sync.RWMutex
+
+	transcodes chan struct{} // one slot per ffmpeg transcode, nil for no limit
 }
 
 type FileInfo struct {
@@ -29,20 +51,57 @@ type FileInfo struct {
 	Mode    string    `json:"mode"`
 	ModTime time.Time `json:"mod_time"`
 	IsDir   bool      `json:"is_dir"`
+	Error   string    `json:"error,omitempty"` // why the metadata is missing, for inaccessible entries
+}
+
+// EntryError is an entry of a directory that couldn't be read
+type EntryError struct {
+	Path   string `json:"path"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
 }
 
 type FileOperation struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Data    any    `json:"data,omitempty"`
+	Success    bool         `json:"success"`
+	Code       string       `json:"code,omitempty"`
+	Message    string       `json:"message"`
+	Data       any          `json:"data,omitempty"`
+	Total      *int         `json:"total,omitempty"`       // list size before pagination
+	NextCursor string       `json:"next_cursor,omitempty"` // cursor of the next page, if any
+	Errors     []EntryError `json:"errors,omitempty"`      // entries left out or incomplete
+	Text       *TextFormat  `json:"text,omitempty"`        // of the content of text reads and writes
+}
+
+// TextFormat describes how the text of a file is stored
+type TextFormat struct {
+	Encoding   string `json:"encoding"`
+	LineEnding string `json:"line_ending"` // lf, crlf, mixed, or none for a single line
+	BOM        bool   `json:"bom"`         // stripped from the text read
 }
 
-func NewFileSystemModule(server *socketio.Server) *FileSystemModule {
-	return &FileSystemModule{
-		server:   server,
-		watchers: make(map[string]*fsnotify.Watcher),
-		clients:  make(map[string]map[string]bool),
+func NewFileSystemModule(server *socketio.Server, emitter *Emitter, config *Config, quotas *Quotas, throttle *Throttle, outbound *OutboundPolicy, tmp *TmpSpaces, tasks *Tasks, paths *Paths, bookmarks *Bookmarks, index *SearchIndex) *FileSystemModule {
+	fsm := &FileSystemModule{
+		server:    server,
+		emitter:   emitter,
+		config:    config,
+		quotas:    quotas,
+		throttle:  throttle,
+		outbound:  outbound,
+		watches:   make(map[watchKey]*sharedWatch),
+		clients:   make(map[string]map[string]watchKey),
+		transfers: make(map[string]*FileTransfer),
+		hashes:    newHashCache(),
+		journals:  newWatchJournals(config),
+		tmp:       tmp,
+		tasks:     tasks,
+		paths:     paths,
+		bookmarks: bookmarks,
+		index:     index,
 	}
+	if config.StreamMaxJobs > 0 {
+		fsm.transcodes = make(chan struct{}, config.StreamMaxJobs)
+	}
+	return fsm
 }
 
 // REST API Handlers
@@ -53,55 +112,163 @@ func (fsm *FileSystemModule) ListDirectory(c *gin.Context) {
 	if path == "" {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: "path parameter is required",
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
 		})
 		return
 	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
 
-	entries, err := os.ReadDir(path)
+	order, err := parseListingOrder(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	// Entries read before a failure are listed, the failure is reported
+	// with them
+	entries, err := os.ReadDir(path)
+	if err != nil && len(entries) == 0 {
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to read directory: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read directory: %v", err),
 		})
 		return
 	}
+	var entryErrors []EntryError
+	if err != nil {
+		entryErrors = append(entryErrors, EntryError{Path: path, Code: errorCode(err), Reason: err.Error()})
+	}
+	inaccessible := c.Query("inaccessible") == "true"
 
 	var files []FileInfo
+	var lastModified time.Time
+	if dirInfo, err := os.Stat(path); err == nil {
+		lastModified = dirInfo.ModTime()
+	}
+
+	// The ETag covers every listed field, so it changes with any entry
+	listingHash := sha256.New()
 	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
 		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since the directory was read
+			continue
+		}
 		if err != nil {
+			entryErrors = append(entryErrors, EntryError{Path: entryPath, Code: errorCode(err), Reason: err.Error()})
+			fmt.Fprintf(listingHash, "%s\x00%s\n", entry.Name(), err)
+			if inaccessible {
+				files = append(files, FileInfo{
+					Name:  entry.Name(),
+					Path:  entryPath,
+					Mode:  entry.Type().String(),
+					IsDir: entry.IsDir(),
+					Error: err.Error(),
+				})
+			}
 			continue
 		}
 
 		files = append(files, FileInfo{
 			Name:    entry.Name(),
-			Path:    filepath.Join(path, entry.Name()),
+			Path:    entryPath,
 			Size:    info.Size(),
 			Mode:    info.Mode().String(),
 			ModTime: info.ModTime(),
 			IsDir:   entry.IsDir(),
 		})
+
+		fmt.Fprintf(listingHash, "%s\x00%d\x00%s\x00%d\n", entry.Name(), info.Size(), info.Mode(), info.ModTime().UnixNano())
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+	}
+
+	etag := `W/"` + hex.EncodeToString(listingHash.Sum(nil))[:32] + `"`
+	if notModified(c, etag, lastModified) {
+		return
+	}
+
+	order.sort(files)
+	page, total, next, err := paginate(c, files)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	data, err := selectFields(c, page)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to select fields: %v", err),
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, FileOperation{
-		Success: true,
-		Message: "Directory listed successfully",
-		Data:    files,
+		Success:    true,
+		Message:    Localize(c, "Directory listed successfully"),
+		Data:       data,
+		Total:      &total,
+		NextCursor: next,
+		Errors:     entryErrors,
 	})
 }
 
 // CreateFile creates a new file
 func (fsm *FileSystemModule) CreateFile(c *gin.Context) {
 	var req struct {
-		Path    string `json:"path" binding:"required"`
-		Content string `json:"content"`
+		Path       string `json:"path" binding:"required"`
+		Content    string `json:"content"`
+		Size       int64  `json:"size" binding:"min=0"`                                    // extends the file past its content
+		Allocation string `json:"allocation" binding:"omitempty,oneof=sparse preallocate"` // of the extension, sparse by default
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+	if req.Size > 0 && req.Size < int64(len(req.Content)) {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", fmt.Errorf("size is smaller than the content")),
+		})
+		return
+	}
+
+	// Sparse extensions take no space until written
+	allocated := int64(len(req.Content))
+	if req.Allocation == "preallocate" {
+		allocated = max(allocated, req.Size)
+	}
+	token := RequestToken(c)
+	if err := fsm.quotas.Check(token, req.Path, allocated); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
 		})
 		return
 	}
@@ -109,18 +276,20 @@ func (fsm *FileSystemModule) CreateFile(c *gin.Context) {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(req.Path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to create directory: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create directory: %v", err),
 		})
 		return
 	}
 
 	file, err := os.Create(req.Path)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to create file: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create file: %v", err),
 		})
 		return
 	}
@@ -128,17 +297,35 @@ func (fsm *FileSystemModule) CreateFile(c *gin.Context) {
 
 	if req.Content != "" {
 		if _, err := file.WriteString(req.Content); err != nil {
-			c.JSON(http.StatusInternalServerError, FileOperation{
+			c.JSON(errorStatus(err), FileOperation{
 				Success: false,
-				Message: fmt.Sprintf("Failed to write content: %v", err),
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to write content: %v", err),
 			})
 			return
 		}
 	}
 
+	if req.Size > int64(len(req.Content)) {
+		if req.Allocation == "preallocate" {
+			err = preallocate(file, req.Size)
+		} else {
+			err = file.Truncate(req.Size)
+		}
+		if err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to allocate file: %v", err),
+			})
+			return
+		}
+	}
+	fsm.quotas.Record(token, allocated)
+
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File created successfully",
+		Message: Localize(c, "File created successfully"),
 	})
 }
 
@@ -148,23 +335,32 @@ func (fsm *FileSystemModule) DeleteFile(c *gin.Context) {
 	if path == "" {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: "path parameter is required",
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
 		})
 		return
 	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
 
-	err := os.RemoveAll(path)
+	err := checkWalkLimits(path, newWalkLimits(fsm.config))
+	if err == nil {
+		err = os.RemoveAll(path)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to delete: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to delete: %v", err),
+			Data:    errorDetails(err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File/directory deleted successfully",
+		Message: Localize(c, "File/directory deleted successfully"),
 	})
 }
 
@@ -178,23 +374,28 @@ func (fsm *FileSystemModule) RenameFile(c *gin.Context) {
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
 		})
 		return
 	}
+	if !fsm.resolvePaths(c, &req.OldPath, &req.NewPath) {
+		return
+	}
 
 	err := os.Rename(req.OldPath, req.NewPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to rename: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to rename: %v", err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File/directory renamed successfully",
+		Message: Localize(c, "File/directory renamed successfully"),
 	})
 }
 
@@ -208,23 +409,42 @@ func (fsm *FileSystemModule) CopyFile(c *gin.Context) {
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Source, &req.Destination) {
+		return
+	}
+
+	size, err := fsm.checkCopySpace(req.Source, req.Destination)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to copy: %v", err),
+			Data:    errorDetails(err),
 		})
 		return
 	}
 
-	err := copyPath(req.Source, req.Destination)
+	task := fsm.tasks.Start(c, "copy", req.Source, unitBytes)
+	task.SetTotal(size)
+	err = copyPath(req.Source, req.Destination, task)
+	task.Finish(err)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to copy: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to copy: %v", err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File/directory copied successfully",
+		Message: Localize(c, "File/directory copied successfully"),
 	})
 }
 
@@ -238,33 +458,54 @@ func (fsm *FileSystemModule) MoveFile(c *gin.Context) {
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Source, &req.Destination) {
+		return
+	}
+
+	size, err := fsm.checkCopySpace(req.Source, req.Destination)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to move: %v", err),
+			Data:    errorDetails(err),
 		})
 		return
 	}
 
 	// First copy, then delete source
-	err := copyPath(req.Source, req.Destination)
+	task := fsm.tasks.Start(c, "move", req.Source, unitBytes)
+	task.SetTotal(size)
+	err = copyPath(req.Source, req.Destination, task)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		task.Finish(err)
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to move (copy failed): %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to move (copy failed): %v", err),
 		})
 		return
 	}
 
 	err = os.RemoveAll(req.Source)
+	task.Finish(err)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to move (delete source failed): %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to move (delete source failed): %v", err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File/directory moved successfully",
+		Message: Localize(c, "File/directory moved successfully"),
 	})
 }
 
@@ -274,24 +515,101 @@ func (fsm *FileSystemModule) ReadFile(c *gin.Context) {
 	if path == "" {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: "path parameter is required",
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) || !fsm.envReadable(c, path) {
+		return
+	}
+	// Text is converted to UTF-8 from the encoding, detected by default, and
+	// binary files sent as base64
+	encoding := strings.ToLower(c.DefaultQuery("encoding", "auto"))
+	if encoding != "auto" && encoding != binaryEncoding {
+		var err error
+		if encoding, err = textEncoding(encoding); err != nil {
+			c.JSON(http.StatusBadRequest, FileOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "%v", err),
+			})
+			return
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
+		})
+		return
+	}
+
+	// Weak ETag from size and mtime by default, or a strong content hash
+	etag := fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+	if c.Query("etag") == "checksum" && info.Mode().IsRegular() {
+		sum, err := fsm.hashes.fileSum(path, info, true)
+		if err == nil {
+			etag = `"` + sum + `"`
+		}
+	}
+	if notModified(c, etag, info.ModTime()) {
+		return
+	}
+
+	if c.Query("raw") == "true" {
+		fsm.streamFile(c, path, info)
+		return
+	}
+
+	if max := fsm.config.ReadMaxSize; max > 0 && info.Size() > max {
+		c.JSON(http.StatusRequestEntityTooLarge, FileOperation{
+			Success: false,
+			Code:    ErrTooLarge,
+			Message: Localize(c, "File is %d bytes, over the %d byte limit for JSON reads; use /api/fs/download to stream it", info.Size(), max),
 		})
 		return
 	}
 
 	content, err := os.ReadFile(path)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to read file: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
+		})
+		return
+	}
+	if encoding == binaryEncoding {
+		c.JSON(http.StatusOK, FileOperation{
+			Success: true,
+			Message: Localize(c, "File read successfully"),
+			Data:    base64.StdEncoding.EncodeToString(content),
 		})
 		return
 	}
+	if encoding == "auto" {
+		encoding = detectEncoding(content)
+	}
+	text, err := decodeText(content, encoding)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
+		})
+		return
+	}
+	format := textFormat(text, encoding)
 
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File read successfully",
-		Data:    string(content),
+		Message: Localize(c, "File read successfully"),
+		Data:    strings.TrimPrefix(text, byteOrderMark),
+		Text:    &format,
 	})
 }
 
@@ -300,28 +618,64 @@ func (fsm *FileSystemModule) WriteFile(c *gin.Context) {
 	var req struct {
 		Path    string `json:"path" binding:"required"`
 		Content string `json:"content" binding:"required"`
+		TextWriteOptions
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
 		})
 		return
 	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
 
-	err := os.WriteFile(req.Path, []byte(req.Content), 0644)
+	var content []byte
+	var format *TextFormat
+	var err error
+	if req.binary() {
+		content, err = req.decodeBinary(req.Content)
+	} else {
+		var text TextFormat
+		content, text, err = req.encode(req.Path, req.Content)
+		format = &text
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to write file: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to write file: %v", err),
 		})
 		return
 	}
 
+	token := RequestToken(c)
+	if err := fsm.quotas.Check(token, req.Path, int64(len(content))); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
+		})
+		return
+	}
+
+	if err := os.WriteFile(req.Path, content, 0644); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to write file: %v", err),
+		})
+		return
+	}
+	fsm.quotas.Record(token, int64(len(content)))
+
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "File written successfully",
+		Message: Localize(c, "File written successfully"),
+		Text:    format,
 	})
 }
 
@@ -334,30 +688,46 @@ func (fsm *FileSystemModule) CreateDirectory(c *gin.Context) {
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
 		})
 		return
 	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
 
 	err := os.MkdirAll(req.Path, 0755)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, FileOperation{
+		c.JSON(errorStatus(err), FileOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to create directory: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create directory: %v", err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, FileOperation{
 		Success: true,
-		Message: "Directory created successfully",
+		Message: Localize(c, "Directory created successfully"),
 	})
 }
 
 // Socket.IO Handlers
 
-// WatchFiles starts watching a directory for file changes
-func (fsm *FileSystemModule) WatchFiles(conn socketio.Conn, path string) {
+// WatchFiles starts watching a directory for file changes, sharing the watch
+// of other clients on the same path and options. In checksum mode writes
+// that leave the content of a file as it was aren't reported, and the walk
+// options keep the watch out of other mounted filesystems.
+func (fsm *FileSystemModule) WatchFiles(conn socketio.Conn, path string, checksum bool, options WalkOptions) EventResult {
+	if err := fsm.paths.Resolve(&path); err != nil {
+		return fsm.emitter.Fail(conn, "fs:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+			"path":    path,
+		})
+	}
+
 	fsm.mutex.Lock()
 	defer fsm.mutex.Unlock()
 
@@ -365,146 +735,314 @@ func (fsm *FileSystemModule) WatchFiles(conn socketio.Conn, path string) {
 
 	// Initialize client map if not exists
 	if fsm.clients[clientID] == nil {
-		fsm.clients[clientID] = make(map[string]bool)
+		fsm.clients[clientID] = make(map[string]watchKey)
 	}
 
 	// Check if already watching this path for this client
-	if fsm.clients[clientID][path] {
-		conn.Emit("fs:error", map[string]interface{}{
-			"message": "Already watching this path",
+	if _, watching := fsm.clients[clientID][path]; watching {
+		return fsm.emitter.Fail(conn, "fs:error", map[string]interface{}{
+			"code":    ErrConflict,
+			"message": localizeConn(conn, "Already watching this path"),
 			"path":    path,
 		})
-		return
 	}
 
-	watcher, err := fsnotify.NewWatcher()
+	// Watch the directory recursively
+	key := watchKey{path: path, options: options}
+	watch, err := fsm.subscribeWatch(conn, key, checksum)
 	if err != nil {
-		conn.Emit("fs:error", map[string]interface{}{
-			"message": fmt.Sprintf("Failed to create watcher: %v", err),
+		payload := map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to watch path: %v", err),
 			"path":    path,
-		})
-		return
-	}
-
-	// Watch the directory recursively
-	err = filepath.WalkDir(path, func(walkPath string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
 		}
-		if d.IsDir() {
-			return watcher.Add(walkPath)
+		if details := errorDetails(err); details != nil {
+			payload["details"] = details
 		}
-		return nil
+		return fsm.emitter.Fail(conn, "fs:error", payload)
+	}
+
+	fsm.clients[clientID][path] = key
+	fsm.journals.acquire(path, options)
+
+	if watch.stream.Fallback != nil {
+		fsm.emitter.Emit(conn, "fs:error", watchErrorPayload(conn, path, watch.stream.Fallback))
+	}
+	return fsm.emitter.Reply(conn, "fs:watching", map[string]interface{}{
+		"message": localizeConn(conn, "Started watching directory"),
+		"path":    path,
+		"mode":    watch.stream.Mode(),
 	})
+}
 
-	if err != nil {
-		watcher.Close()
-		conn.Emit("fs:error", map[string]interface{}{
-			"message": fmt.Sprintf("Failed to watch path: %v", err),
+// UnwatchFiles stops watching a directory
+func (fsm *FileSystemModule) UnwatchFiles(conn socketio.Conn, path string) EventResult {
+	if err := fsm.paths.Resolve(&path); err != nil {
+		return fsm.emitter.Fail(conn, "fs:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
 			"path":    path,
 		})
-		return
 	}
 
-	watcherKey := fmt.Sprintf("%s:%s", clientID, path)
-	fsm.watchers[watcherKey] = watcher
-	fsm.clients[clientID][path] = true
-
-	// Start watching in a goroutine
-	go func() {
-		defer watcher.Close()
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
 
-				eventData := map[string]interface{}{
-					"path":      event.Name,
-					"operation": event.Op.String(),
-					"timestamp": time.Now(),
-				}
+	clientID := conn.ID()
 
-				conn.Emit("fs:change", eventData)
+	if key, exists := fsm.clients[clientID][path]; exists {
+		fsm.unsubscribeWatch(key, clientID)
+		delete(fsm.clients[clientID], path)
+		fsm.journals.release(path)
 
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				conn.Emit("fs:error", map[string]interface{}{
-					"message": fmt.Sprintf("Watcher error: %v", err),
-					"path":    path,
-				})
-			}
-		}
-	}()
+		return fsm.emitter.Reply(conn, "fs:unwatched", map[string]interface{}{
+			"message": localizeConn(conn, "Stopped watching directory"),
+			"path":    path,
+		})
+	}
 
-	conn.Emit("fs:watching", map[string]interface{}{
-		"message": "Started watching directory",
+	return fsm.emitter.Fail(conn, "fs:error", map[string]interface{}{
+		"code":    ErrNotFound,
+		"message": localizeConn(conn, "Path not being watched"),
 		"path":    path,
 	})
 }
 
-// UnwatchFiles stops watching a directory
-func (fsm *FileSystemModule) UnwatchFiles(conn socketio.Conn, path string) {
-	fsm.mutex.Lock()
-	defer fsm.mutex.Unlock()
+// Subscriptions returns the watched paths and transfers of a client
+func (fsm *FileSystemModule) Subscriptions(clientID string) (watches []string, transfers []map[string]interface{}) {
+	fsm.mutex.RLock()
+	defer fsm.mutex.RUnlock()
 
-	clientID := conn.ID()
-	watcherKey := fmt.Sprintf("%s:%s", clientID, path)
+	watches = []string{}
+	for path := range fsm.clients[clientID] {
+		watches = append(watches, path)
+	}
+	sort.Strings(watches)
+
+	transfers = []map[string]interface{}{}
+	for _, transfer := range fsm.transfers {
+		if transfer.ClientID == clientID {
+			transfers = append(transfers, map[string]interface{}{
+				"transfer_id": transfer.ID,
+				"direction":   transfer.Direction,
+				"path":        transfer.Path,
+				"size":        transfer.Size,
+				"bytes":       transfer.Bytes,
+			})
+		}
+	}
 
-	if watcher, exists := fsm.watchers[watcherKey]; exists {
-		watcher.Close()
-		delete(fsm.watchers, watcherKey)
+	return watches, transfers
+}
 
-		if fsm.clients[clientID] != nil {
-			delete(fsm.clients[clientID], path)
+// CleanupConnection cleans up resources when a client disconnects
+func (fsm *FileSystemModule) CleanupConnection(clientID string) {
+	fsm.mutex.Lock()
+
+	var transfers []*FileTransfer
+	for _, transfer := range fsm.transfers {
+		if transfer.ClientID == clientID {
+			transfers = append(transfers, transfer)
 		}
+	}
 
-		conn.Emit("fs:unwatched", map[string]interface{}{
-			"message": "Stopped watching directory",
-			"path":    path,
+	for path, key := range fsm.clients[clientID] {
+		fsm.unsubscribeWatch(key, clientID)
+		fsm.journals.release(path)
+	}
+	delete(fsm.clients, clientID)
+	fsm.mutex.Unlock()
+
+	for _, transfer := range transfers {
+		fsm.abortTransfer(transfer)
+	}
+}
+
+// streamFile copies a file to the response as it is read, without
+// buffering it in memory; the response is sent chunked
+func (fsm *FileSystemModule) streamFile(c *gin.Context, path string, info os.FileInfo) {
+	if info.IsDir() {
+		c.JSON(http.StatusConflict, FileOperation{
+			Success: false,
+			Code:    ErrIsDirectory,
+			Message: Localize(c, "path is a directory"),
 		})
-	} else {
-		conn.Emit("fs:error", map[string]interface{}{
-			"message": "Path not being watched",
-			"path":    path,
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
 		})
+		return
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
+
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, file)
 }
 
-// CleanupConnection cleans up resources when a client disconnects
-func (fsm *FileSystemModule) CleanupConnection(clientID string) {
-	fsm.mutex.Lock()
-	defer fsm.mutex.Unlock()
+// checkCopySpace fails fast when the destination filesystem cannot hold a
+// copy of src, or src is past the walk limits, rather than leaving a
+// partial tree behind
+func (fsm *FileSystemModule) checkCopySpace(src, dst string) (int64, error) {
+	size, err := treeSize(src, newWalkLimits(fsm.config))
+	if err != nil {
+		return 0, err
+	}
+	return size, fsm.quotas.CheckSpace(dst, size)
+}
+
+// treeSize returns the total size of the regular files under path
+func treeSize(path string, limits *walkLimits) (int64, error) {
+	var size int64
+	err := limits.walk(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// checkWalkLimits walks a tree to fail before a recursive operation starts
+// when it would go past the walk limits; other errors are left to the
+// operation
+func checkWalkLimits(path string, limits *walkLimits) error {
+	return limits.walk(path, func(string, fs.DirEntry, error) error {
+		return nil
+	})
+}
+
+// notModified sets the validators of a response and answers 304 when the
+// client's If-None-Match or If-Modified-Since shows it is up to date
+func notModified(c *gin.Context, etag string, modTime time.Time) bool {
+	c.Header("ETag", etag)
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
 
-	if paths, exists := fsm.clients[clientID]; exists {
-		for path := range paths {
-			watcherKey := fmt.Sprintf("%s:%s", clientID, path)
-			if watcher, exists := fsm.watchers[watcherKey]; exists {
-				watcher.Close()
-				delete(fsm.watchers, watcherKey)
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				c.Status(http.StatusNotModified)
+				return true
 			}
 		}
-		delete(fsm.clients, clientID)
+		return false
+	}
+
+	if since := c.GetHeader("If-Modified-Since"); since != "" && !modTime.IsZero() {
+		sinceTime, err := http.ParseTime(since)
+		if err == nil && !modTime.Truncate(time.Second).After(sinceTime) {
+			c.Status(http.StatusNotModified)
+			return true
+		}
 	}
+
+	return false
+}
+
+// listingOrder is the order of the entries of a directory listing
+type listingOrder struct {
+	key        string // name, size or mod_time
+	descending bool
+	dirsFirst  bool
 }
 
-// Helper function to copy files and directories recursively
-func copyPath(src, dst string) error {
+// parseListingOrder reads the sort, order and dirs_first query parameters,
+// by default directories first, then by case-insensitive name
+func parseListingOrder(c *gin.Context) (listingOrder, error) {
+	order := listingOrder{key: c.DefaultQuery("sort", "name"), dirsFirst: c.Query("dirs_first") != "false"}
+	switch order.key {
+	case "name", "size", "mod_time":
+	default:
+		return order, fmt.Errorf("invalid sort %q, expected name, size or mod_time", order.key)
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		order.descending = true
+	default:
+		return order, fmt.Errorf("invalid order %q, expected asc or desc", c.Query("order"))
+	}
+	return order, nil
+}
+
+// sort orders files, breaking ties by name so the order is the same on
+// every listing
+func (o listingOrder) sort(files []FileInfo) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if o.dirsFirst && a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		var diff int
+		switch o.key {
+		case "size":
+			diff = cmp.Compare(a.Size, b.Size)
+		case "mod_time":
+			diff = a.ModTime.Compare(b.ModTime)
+		}
+		if diff == 0 {
+			diff = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		}
+		if diff == 0 {
+			diff = strings.Compare(a.Name, b.Name)
+		}
+		if o.descending {
+			return diff > 0
+		}
+		return diff < 0
+	})
+}
+
+// resolvePaths normalizes the paths of a request in place, answering with
+// the error when one is invalid or outside the root
+func (fsm *FileSystemModule) resolvePaths(c *gin.Context, paths ...*string) bool {
+	if err := fsm.paths.Resolve(paths...); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
+		})
+		return false
+	}
+	return true
+}
+
+// copyPath copies a file or directory, counting the bytes copied in a task
+// and stopping once it's cancelled
+func copyPath(src, dst string, task *Task) error {
 	srcInfo, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
 
 	if srcInfo.IsDir() {
-		return copyDir(src, dst)
+		return copyDir(src, dst, task)
 	}
-	return copyFile(src, dst)
+	return copyFile(src, dst, task)
 }
 
-func copyFile(src, dst string) error {
+func copyFile(src, dst string, task *Task) error {
 	// Create destination directory if it doesn't exist
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return err
@@ -522,8 +1060,12 @@ func copyFile(src, dst string) error {
 	}
 	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
+	_, err = io.Copy(dstFile, task.Reader(srcFile))
 	if err != nil {
+		// Don't leave half a copy behind a cancelled task
+		if task.Err() != nil {
+			os.Remove(dst)
+		}
 		return err
 	}
 
@@ -535,7 +1077,7 @@ func copyFile(src, dst string) error {
 	return os.Chmod(dst, srcInfo.Mode())
 }
 
-func copyDir(src, dst string) error {
+func copyDir(src, dst string, task *Task) error {
 	srcInfo, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -555,11 +1097,11 @@ func copyDir(src, dst string) error {
 		dstPath := filepath.Join(dst, entry.Name())
 
 		if entry.IsDir() {
-			if err := copyDir(srcPath, dstPath); err != nil {
+			if err := copyDir(srcPath, dstPath, task); err != nil {
 				return err
 			}
 		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
+			if err := copyFile(srcPath, dstPath, task); err != nil {
 				return err
 			}
 		}
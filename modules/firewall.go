@@ -0,0 +1,564 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// firewallChains are the chains rules can be added to, in evaluation order
+var firewallChains = []string{"input", "forward", "output"}
+
+// interfacePattern matches network interface names, at most 15 characters
+var interfacePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,15}$`)
+
+// errRuleNotFound marks a firewall rule ID that doesn't exist
+var errRuleNotFound = errors.New("firewall rule not found")
+
+// errChangePending marks changes refused until the pending one is resolved
+var errChangePending = errors.New("a firewall change is waiting for confirmation")
+
+// FirewallModule manages firewall rules in a table (nftables) or chains
+// (iptables) of the agent's own, so rules of other tools are never touched.
+// Applied changes are rolled back unless confirmed in time, so a rule cutting
+// off the agent undoes itself.
+type FirewallModule struct {
+	backend  firewallBackend // nil when neither nft nor iptables is installed
+	rollback time.Duration   // default rollback timeout, 0 to apply changes for good
+	pending  *firewallChange
+	mutex    sync.Mutex
+}
+
+// FirewallRule is a rule managed by the agent
+type FirewallRule struct {
+	ID          string `json:"id"`
+	Chain       string `json:"chain" binding:"required,oneof=input forward output"`
+	Action      string `json:"action" binding:"required,oneof=accept drop reject"`
+	Protocol    string `json:"protocol,omitempty" binding:"omitempty,oneof=tcp udp icmp icmpv6"`
+	Source      string `json:"source,omitempty"`      // IP or CIDR
+	Destination string `json:"destination,omitempty"` // IP or CIDR
+	Port        string `json:"port,omitempty"`        // destination port or range "8000-8999", with tcp or udp
+	Interface   string `json:"interface,omitempty"`   // incoming, or outgoing in the output chain
+}
+
+type FirewallRuleRequest struct {
+	FirewallRule
+	DryRun          bool `json:"dry_run"`
+	RollbackTimeout *int `json:"rollback_timeout" binding:"omitempty,min=0,max=3600"` // seconds, defaults to FIREWALL_ROLLBACK_TIMEOUT
+}
+
+type FirewallChangeRequest struct {
+	ChangeID string `json:"change_id" binding:"required"`
+}
+
+// FirewallDiff lists the backend rules a change adds and removes
+type FirewallDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// firewallChange is an applied change waiting for confirmation
+type firewallChange struct {
+	id       string
+	previous []FirewallRule
+	expires  time.Time
+	timer    *time.Timer
+}
+
+// firewallBackend applies the agent's rules with a firewall tool
+type firewallBackend interface {
+	name() string
+	rules() ([]FirewallRule, error)
+	render(rules []FirewallRule) []string // one command per rule, for diffs
+	apply(rules []FirewallRule) error     // replaces all the agent's rules at once
+}
+
+func NewFirewallModule(config *Config) *FirewallModule {
+	fm := &FirewallModule{rollback: config.FirewallRollbackTimeout}
+
+	switch config.FirewallBackend {
+	case "nftables":
+		fm.backend = &nftBackend{}
+	case "iptables":
+		fm.backend = &iptablesBackend{}
+	default:
+		if _, err := exec.LookPath("nft"); err == nil {
+			fm.backend = &nftBackend{}
+		} else if _, err := exec.LookPath("iptables-restore"); err == nil {
+			fm.backend = &iptablesBackend{}
+		}
+	}
+	return fm
+}
+
+// REST API Handlers
+
+// ListRules lists the firewall rules managed by the agent
+func (fm *FirewallModule) ListRules(c *gin.Context) {
+	if !fm.available(c) {
+		return
+	}
+
+	fm.mutex.Lock()
+	rules, err := fm.backend.rules()
+	pending := fm.pendingData()
+	fm.mutex.Unlock()
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to list firewall rules: %v", err),
+		})
+		return
+	}
+
+	if rules == nil {
+		rules = []FirewallRule{}
+	}
+	page, total, next, err := paginate(c, rules)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Firewall rules retrieved"),
+		Data: map[string]interface{}{
+			"backend": fm.backend.name(),
+			"rules":   page,
+			"pending": pending,
+		},
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// AddRule appends a rule to its chain
+func (fm *FirewallModule) AddRule(c *gin.Context) {
+	if !fm.available(c) || !fm.authorized(c) {
+		return
+	}
+
+	var req FirewallRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	rule := req.FirewallRule
+	if err := rule.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	rule.ID = uuid.NewString()[:8]
+
+	// Rules are appended after the last rule of their chain
+	add := func(rules []FirewallRule) ([]FirewallRule, error) {
+		updated := make([]FirewallRule, 0, len(rules)+1)
+		added := false
+		for i, existing := range rules {
+			updated = append(updated, existing)
+			if !added && existing.Chain == rule.Chain && (i == len(rules)-1 || rules[i+1].Chain != rule.Chain) {
+				updated = append(updated, rule)
+				added = true
+			}
+		}
+		if !added {
+			updated = append(updated, rule)
+		}
+		return updated, nil
+	}
+
+	data, err := fm.change(add, req.DryRun, fm.timeout(req.RollbackTimeout))
+	if err != nil {
+		fm.changeFailed(c, err, "Failed to add firewall rule: %v")
+		return
+	}
+
+	data["rule"] = rule
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Firewall rule added"),
+		Data:    data,
+	})
+}
+
+// RemoveRule removes a rule by ID
+func (fm *FirewallModule) RemoveRule(c *gin.Context) {
+	if !fm.available(c) || !fm.authorized(c) {
+		return
+	}
+
+	var timeout *int
+	if value := c.Query("rollback_timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || seconds > 3600 {
+			c.JSON(http.StatusBadRequest, NetworkOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", "rollback_timeout must be between 0 and 3600 seconds"),
+			})
+			return
+		}
+		timeout = &seconds
+	}
+
+	id := c.Param("id")
+	remove := func(rules []FirewallRule) ([]FirewallRule, error) {
+		updated := make([]FirewallRule, 0, len(rules))
+		for _, rule := range rules {
+			if rule.ID != id {
+				updated = append(updated, rule)
+			}
+		}
+		if len(updated) == len(rules) {
+			return nil, errRuleNotFound
+		}
+		return updated, nil
+	}
+
+	data, err := fm.change(remove, c.Query("dry_run") == "true", fm.timeout(timeout))
+	if err != nil {
+		fm.changeFailed(c, err, "Failed to remove firewall rule: %v")
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Firewall rule removed"),
+		Data:    data,
+	})
+}
+
+// ConfirmChange keeps a change waiting for confirmation, which proves the
+// agent is still reachable
+func (fm *FirewallModule) ConfirmChange(c *gin.Context) {
+	fm.resolve(c, true)
+}
+
+// RollbackChange undoes a change waiting for confirmation right away
+func (fm *FirewallModule) RollbackChange(c *gin.Context) {
+	fm.resolve(c, false)
+}
+
+// Helper functions
+
+func (fm *FirewallModule) available(c *gin.Context) bool {
+	if fm.backend == nil {
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "No firewall backend found, install nftables or iptables"),
+		})
+		return false
+	}
+	return true
+}
+
+func (fm *FirewallModule) authorized(c *gin.Context) bool {
+	if !RequestToken(c).HasScope(ScopeFirewall) {
+		c.JSON(http.StatusForbidden, NetworkOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Changing firewall rules requires the firewall permission"),
+		})
+		return false
+	}
+	return true
+}
+
+// changeFailed responds to a change that couldn't be made
+func (fm *FirewallModule) changeFailed(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, errChangePending):
+		c.JSON(http.StatusConflict, NetworkOperation{
+			Success: false,
+			Code:    ErrConflict,
+			Message: Localize(c, "Another firewall change is waiting for confirmation"),
+		})
+	case errors.Is(err, errRuleNotFound):
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Firewall rule %s not found", c.Param("id")),
+		})
+	default:
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, message, err),
+		})
+	}
+}
+
+// timeout returns the rollback timeout of a change, the default unless the
+// request sets one
+func (fm *FirewallModule) timeout(seconds *int) time.Duration {
+	if seconds == nil {
+		return fm.rollback
+	}
+	return time.Duration(*seconds) * time.Second
+}
+
+// change applies the rules edit returns, unless dryRun. Changes with a
+// timeout are rolled back when it expires without confirmation; meanwhile
+// other changes are refused.
+func (fm *FirewallModule) change(edit func([]FirewallRule) ([]FirewallRule, error), dryRun bool, timeout time.Duration) (map[string]interface{}, error) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	if fm.pending != nil && !dryRun {
+		return nil, errChangePending
+	}
+
+	current, err := fm.backend.rules()
+	if err != nil {
+		return nil, err
+	}
+	updated, err := edit(current)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"diff":    diffLines(fm.backend.render(current), fm.backend.render(updated)),
+		"dry_run": dryRun,
+	}
+	if dryRun {
+		return data, nil
+	}
+
+	if err := fm.backend.apply(updated); err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		change := &firewallChange{
+			id:       uuid.NewString(),
+			previous: current,
+			expires:  time.Now().Add(timeout),
+		}
+		change.timer = time.AfterFunc(timeout, func() {
+			fm.expire(change)
+		})
+		fm.pending = change
+		data["pending"] = fm.pendingData()
+	}
+	return data, nil
+}
+
+// expire rolls back a change nobody confirmed in time
+func (fm *FirewallModule) expire(change *firewallChange) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	if fm.pending != change {
+		return
+	}
+	fm.pending = nil
+	if err := fm.backend.apply(change.previous); err != nil {
+		log.Printf("Failed to roll back firewall change %s: %v", change.id, err)
+		return
+	}
+	log.Printf("Rolled back unconfirmed firewall change %s", change.id)
+}
+
+// resolve confirms or rolls back the pending change
+func (fm *FirewallModule) resolve(c *gin.Context, confirm bool) {
+	if !fm.available(c) || !fm.authorized(c) {
+		return
+	}
+
+	var req FirewallChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	change := fm.pending
+	if change == nil || change.id != req.ChangeID {
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "No firewall change %s is waiting for confirmation", req.ChangeID),
+		})
+		return
+	}
+	change.timer.Stop()
+	fm.pending = nil
+
+	if confirm {
+		c.JSON(http.StatusOK, NetworkOperation{
+			Success: true,
+			Message: Localize(c, "Firewall change confirmed"),
+			Data:    map[string]interface{}{"change_id": change.id},
+		})
+		return
+	}
+
+	if err := fm.backend.apply(change.previous); err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to roll back firewall change: %v", err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Firewall change rolled back"),
+		Data:    map[string]interface{}{"change_id": change.id},
+	})
+}
+
+// pendingData describes the pending change, if any. The caller must hold the
+// mutex.
+func (fm *FirewallModule) pendingData() map[string]interface{} {
+	if fm.pending == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"change_id":   fm.pending.id,
+		"rollback_at": fm.pending.expires,
+	}
+}
+
+// normalize validates a rule, writing addresses in their canonical form
+func (r *FirewallRule) normalize() error {
+	var err error
+	if r.Source, err = normalizeAddress(r.Source); err != nil {
+		return fmt.Errorf("invalid source: %v", err)
+	}
+	if r.Destination, err = normalizeAddress(r.Destination); err != nil {
+		return fmt.Errorf("invalid destination: %v", err)
+	}
+	if r.Source != "" && r.Destination != "" && addressFamily(r.Source) != addressFamily(r.Destination) {
+		return fmt.Errorf("source and destination must both be IPv4 or IPv6")
+	}
+
+	family := r.family()
+	if r.Protocol == "icmp" && family == 6 || r.Protocol == "icmpv6" && family == 4 {
+		return fmt.Errorf("protocol %s doesn't match the address family", r.Protocol)
+	}
+
+	if r.Port != "" {
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return fmt.Errorf("port requires protocol tcp or udp")
+		}
+		first, last, found := strings.Cut(r.Port, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && found {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 1 || end > 65535 || start > end {
+			return fmt.Errorf("invalid port %q", r.Port)
+		}
+		r.Port = strconv.Itoa(start)
+		if end != start {
+			r.Port += "-" + strconv.Itoa(end)
+		}
+	}
+
+	if r.Interface != "" && !interfacePattern.MatchString(r.Interface) {
+		return fmt.Errorf("invalid interface %q", r.Interface)
+	}
+	return nil
+}
+
+// family returns the IP version the rule applies to, 0 for both
+func (r *FirewallRule) family() int {
+	switch {
+	case r.Source != "":
+		return addressFamily(r.Source)
+	case r.Destination != "":
+		return addressFamily(r.Destination)
+	case r.Protocol == "icmp":
+		return 4
+	case r.Protocol == "icmpv6":
+		return 6
+	}
+	return 0
+}
+
+// normalizeAddress parses an IP or CIDR, returning single addresses without
+// their prefix length
+func normalizeAddress(address string) (string, error) {
+	if address == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String(), nil
+	}
+	_, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", err
+	}
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String(), nil
+	}
+	return ipNet.String(), nil
+}
+
+func addressFamily(address string) int {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		ip = net.ParseIP(address)
+	}
+	if ip != nil && ip.To4() == nil {
+		return 6
+	}
+	return 4
+}
+
+// diffLines returns the lines only in before and only in after
+func diffLines(before, after []string) FirewallDiff {
+	diff := FirewallDiff{Added: []string{}, Removed: []string{}}
+	counts := make(map[string]int)
+	for _, line := range before {
+		counts[line]++
+	}
+	for _, line := range after {
+		if counts[line] > 0 {
+			counts[line]--
+		} else {
+			diff.Added = append(diff.Added, line)
+		}
+	}
+	for _, line := range before {
+		if counts[line] > 0 {
+			counts[line]--
+			diff.Removed = append(diff.Removed, line)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,502 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// FleetModule makes the agent a controller of the downstream agents listed
+// in FLEET_AGENTS, running commands on many of them at once
+type FleetModule struct {
+	emitter   *Emitter
+	agents    map[string]*FleetAgent
+	parallel  int
+	client    *http.Client
+	inventory map[string]*RegisteredAgent // by ID
+	mutex     sync.RWMutex
+}
+
+// FleetAgent is a downstream agent of the controller
+type FleetAgent struct {
+	Name  string   `json:"name"`
+	URL   string   `json:"url"`
+	Token string   `json:"token,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// RegisteredAgent is an agent of the inventory, as of its last registration
+// ping
+type RegisteredAgent struct {
+	AgentRegistration
+	Address  string    `json:"address"` // the last ping came from
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"` // pinged within three intervals
+}
+
+type FleetExecRequest struct {
+	CommandRequest
+	Agents   []string `json:"agents"`    // names of the agents, every agent when neither agents nor tags are given
+	Tags     []string `json:"tags"`      // agents with any of these tags
+	SocketID string   `json:"socket_id"` // connection receiving fleet:output and fleet:result events
+}
+
+// FleetHostResult is the outcome of a command on one agent
+type FleetHostResult struct {
+	Agent   string `json:"agent"`
+	Success bool   `json:"success"` // the command ran and exited with 0
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+	*CommandResult
+}
+
+type FleetExecResult struct {
+	ExecID    string            `json:"exec_id"`
+	Results   []FleetHostResult `json:"results"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Duration  string            `json:"duration"`
+}
+
+// fleetEvent is a line of the NDJSON stream of /api/shell/exec
+type fleetEvent struct {
+	Event   string          `json:"event"`
+	Success bool            `json:"success"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func NewFleetModule(emitter *Emitter, config *Config) (*FleetModule, error) {
+	agents, err := loadFleetAgents(config.FleetAgents)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FleetModule{
+		emitter:   emitter,
+		agents:    agents,
+		parallel:  max(config.FleetParallel, 1),
+		inventory: make(map[string]*RegisteredAgent),
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}},
+	}, nil
+}
+
+// REST API Handlers
+
+// ListAgents lists the downstream agents, without their tokens
+func (fm *FleetModule) ListAgents(c *gin.Context) {
+	agents := make([]FleetAgent, 0, len(fm.agents))
+	for _, agent := range fm.agents {
+		listed := *agent
+		listed.Token = ""
+		agents = append(agents, listed)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Name < agents[j].Name
+	})
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Agents retrieved"),
+		Data:    agents,
+	})
+}
+
+// Register records a registration ping of an agent in the inventory. The
+// token of agents only needs the fleet.register scope.
+func (fm *FleetModule) Register(c *gin.Context) {
+	if !RequestToken(c).HasScope(ScopeFleetRegister) {
+		c.JSON(http.StatusForbidden, ShellOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Registering agents requires the fleet.register permission"),
+		})
+		return
+	}
+
+	var req AgentRegistration
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if req.ID == "" || len(req.ID) > 128 {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "id must be 1 to 128 characters"),
+		})
+		return
+	}
+
+	fm.mutex.Lock()
+	fm.inventory[req.ID] = &RegisteredAgent{
+		AgentRegistration: req,
+		Address:           c.ClientIP(),
+		LastSeen:          time.Now(),
+	}
+	fm.mutex.Unlock()
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Agent registered"),
+	})
+}
+
+// ListInventory lists the agents that registered, by name, with whether they
+// are still pinging. ?tag= keeps the agents with a tag.
+func (fm *FleetModule) ListInventory(c *gin.Context) {
+	tag := c.Query("tag")
+	now := time.Now()
+
+	fm.mutex.RLock()
+	agents := make([]RegisteredAgent, 0, len(fm.inventory))
+	for _, agent := range fm.inventory {
+		if tag != "" && !slices.Contains(agent.Tags, tag) {
+			continue
+		}
+		listed := *agent
+		listed.Online = now.Sub(agent.LastSeen) <= 3*time.Duration(max(agent.Interval, 1))*time.Second
+		agents = append(agents, listed)
+	}
+	fm.mutex.RUnlock()
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Name != agents[j].Name {
+			return agents[i].Name < agents[j].Name
+		}
+		return agents[i].ID < agents[j].ID
+	})
+
+	page, total, next, err := paginate(c, agents)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success:    true,
+		Message:    Localize(c, "Inventory retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// ForgetAgent removes an agent from the inventory, until its next ping
+func (fm *FleetModule) ForgetAgent(c *gin.Context) {
+	if !RequestToken(c).HasScope(ScopeFleet) {
+		c.JSON(http.StatusForbidden, ShellOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Managing the fleet requires the fleet permission"),
+		})
+		return
+	}
+
+	id := c.Param("id")
+	fm.mutex.Lock()
+	_, exists := fm.inventory[id]
+	delete(fm.inventory, id)
+	fm.mutex.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, ShellOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Agent not found: %s", id),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Agent removed from the inventory"),
+	})
+}
+
+// Exec runs a command on the selected agents concurrently, at most
+// FLEET_PARALLEL at a time, and returns the result of every agent. The
+// output of each agent is streamed to socket_id as it's printed.
+func (fm *FleetModule) Exec(c *gin.Context) {
+	if !RequestToken(c).HasScope(ScopeFleet) {
+		c.JSON(http.StatusForbidden, ShellOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Running commands on the fleet requires the fleet permission"),
+		})
+		return
+	}
+	if len(fm.agents) == 0 {
+		c.JSON(http.StatusNotFound, ShellOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "No fleet agents are configured"),
+		})
+		return
+	}
+
+	var req FleetExecRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	agents, err := fm.selectAgents(req.Agents, req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	names := make([]string, len(agents))
+	for i, agent := range agents {
+		names[i] = agent.Name
+	}
+	history := map[string]any{"command": req.Command, "args": req.Args, "agents": names}
+	recordAs(c, RecordCommand, "", history)
+
+	startTime := time.Now()
+	result := FleetExecResult{ExecID: uuid.New().String(), Results: make([]FleetHostResult, len(agents))}
+	conn := requestConn(c, fm.emitter, req.SocketID)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, fm.parallel)
+	for i, agent := range agents {
+		wg.Add(1)
+		go func(i int, agent *FleetAgent) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			host := fm.run(c.Request.Context(), agent, req.CommandRequest, func(stream, data string) {
+				if conn != nil {
+					fm.emitter.Emit(conn, "fleet:output", map[string]interface{}{
+						"exec_id":   result.ExecID,
+						"agent":     agent.Name,
+						"stream":    stream,
+						"data":      data,
+						"timestamp": time.Now(),
+					})
+				}
+			})
+			result.Results[i] = host
+			if conn != nil {
+				fm.emitter.Emit(conn, "fleet:result", map[string]interface{}{
+					"exec_id":   result.ExecID,
+					"result":    host,
+					"timestamp": time.Now(),
+				})
+			}
+		}(i, agent)
+	}
+	wg.Wait()
+
+	for _, host := range result.Results {
+		if host.Success {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+	result.Duration = time.Since(startTime).String()
+	history["exec_id"], history["failed"] = result.ExecID, result.Failed
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Command ran on %d agents, %d failed", len(agents), result.Failed),
+		Data:    result,
+	})
+}
+
+// Helper functions
+
+// loadFleetAgents reads the agents file, a JSON object of agents by name
+func loadFleetAgents(path string) (map[string]*FleetAgent, error) {
+	agents := make(map[string]*FleetAgent)
+	if path == "" {
+		return agents, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fleet agents: %w", err)
+	}
+	if err := json.Unmarshal(data, &agents); err != nil {
+		return nil, fmt.Errorf("fleet agents: %s: %w", path, err)
+	}
+	for name, agent := range agents {
+		if agent == nil {
+			return nil, fmt.Errorf("fleet agents: %s: agent %q is empty", path, name)
+		}
+		agent.Name = name
+		if u, err := url.Parse(agent.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("fleet agents: %s: agent %q: url must be an http or https URL", path, name)
+		}
+		if agent.Token == "" {
+			return nil, fmt.Errorf("fleet agents: %s: agent %q: token is required", path, name)
+		}
+	}
+	return agents, nil
+}
+
+// selectAgents returns the agents named or tagged, sorted by name
+func (fm *FleetModule) selectAgents(names, tags []string) ([]*FleetAgent, error) {
+	selected := make(map[string]*FleetAgent)
+	for _, name := range names {
+		agent, exists := fm.agents[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown agent %s", name)
+		}
+		selected[name] = agent
+	}
+	for _, agent := range fm.agents {
+		for _, tag := range tags {
+			if agent.hasTag(tag) {
+				selected[agent.Name] = agent
+			}
+		}
+	}
+	if len(names) == 0 && len(tags) == 0 {
+		selected = fm.agents
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no agent has the tags %s", strings.Join(tags, ", "))
+	}
+
+	agents := make([]*FleetAgent, 0, len(selected))
+	for _, agent := range selected {
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Name < agents[j].Name
+	})
+	return agents, nil
+}
+
+// run executes a command on an agent through its /api/shell/exec, passing
+// the output to output as the agent streams it
+func (fm *FleetModule) run(ctx context.Context, agent *FleetAgent, command CommandRequest, output func(stream, data string)) FleetHostResult {
+	host := FleetHostResult{Agent: agent.Name}
+	fail := func(err error) FleetHostResult {
+		host.Code, host.Error = errorCode(err), err.Error()
+		return host
+	}
+
+	body, err := json.Marshal(command)
+	if err != nil {
+		return fail(err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(agent.URL, "/")+"/api/shell/exec?stream=true", bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+agent.Token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err := fm.client.Do(httpReq)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	// Agents without streaming, and failed requests, answer with a single
+	// response, read as the result event
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event fleetEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("agent responded with %s", resp.Status)
+			}
+			return fail(fmt.Errorf("%w: %v", errUpstream, err))
+		}
+
+		if event.Event == "output" {
+			var chunk struct {
+				Stream string `json:"stream"`
+				Data   string `json:"data"`
+			}
+			if json.Unmarshal(event.Data, &chunk) == nil {
+				output(chunk.Stream, chunk.Data)
+			}
+			continue
+		}
+
+		if len(event.Data) > 0 && string(event.Data) != "null" {
+			var commandResult CommandResult
+			if err := json.Unmarshal(event.Data, &commandResult); err == nil {
+				host.CommandResult = &commandResult
+			}
+		}
+		if !event.Success {
+			host.Code, host.Error = event.Code, event.Message
+			if host.Code == "" {
+				host.Code = ErrUpstream
+			}
+			return host
+		}
+		host.Success = host.CommandResult != nil && host.ExitCode == 0
+		return host
+	}
+}
+
+// probe checks that an agent answers its health check, /health rather than
+// /health/live so agents of older versions answer too
+func (fm *FleetModule) probe(ctx context.Context, agent *FleetAgent) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(agent.URL, "/")+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fm.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: agent responded with %s", errUpstream, resp.Status)
+	}
+	return nil
+}
+
+func (a *FleetAgent) hasTag(tag string) bool {
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package modules
+
+import (
+	"log"
+	"strings"
+
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/googollee/go-socket.io/parser"
+	"github.com/ugorji/go/codec"
+)
+
+// Encodings of the stream events, negotiated with the encoding query
+// parameter of the Socket.IO handshake
+const (
+	EncodingJSON    = "json"    // payloads as JSON, the default
+	EncodingBinary  = "binary"  // payloads as JSON, with their data sent as binary attachments
+	EncodingMsgpack = "msgpack" // payloads as one msgpack binary attachment
+)
+
+// streamEvents are the high-frequency events sent in the encoding of the
+// connection, along with their batches. Other events are always JSON.
+var streamEvents = map[string]bool{
+	"fs:change":          true,
+	"fs:transfer:chunk":  true,
+	"shell:output":       true,
+	"shell:stats":        true,
+	"net:capture:packet": true,
+	"net:port:metrics":   true,
+	"net:progress":       true,
+	"fleet:output":       true,
+}
+
+// msgpackHandle writes the current msgpack spec, with strings apart from
+// binary data and times as timestamp extensions
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// ConnEncoding returns the stream encoding a connection asked for, json
+// when it asked for none or one that isn't supported
+func ConnEncoding(conn socketio.Conn) string {
+	handshake := conn.URL()
+	switch encoding := handshake.Query().Get("encoding"); encoding {
+	case EncodingBinary, EncodingMsgpack:
+		return encoding
+	}
+	return EncodingJSON
+}
+
+// Helper functions
+
+// encodeFrame returns the arguments of an event in an encoding. Payloads of
+// other events, or that can't be encoded, are returned as they are.
+func encodeFrame(encoding, event string, args []interface{}) []interface{} {
+	if encoding == EncodingJSON || len(args) != 1 || !streamEvents[strings.TrimSuffix(event, ":batch")] {
+		return args
+	}
+
+	payload := frameValue(args[0], encoding, "")
+	if encoding == EncodingBinary {
+		return []interface{}{payload}
+	}
+	var encoded []byte
+	if err := codec.NewEncoderBytes(&encoded, msgpackHandle).Encode(payload); err != nil {
+		log.Printf("Failed to encode %s as msgpack: %v", event, err)
+		return args
+	}
+	return []interface{}{&parser.Buffer{Data: encoded}}
+}
+
+// frameValue copies the maps and slices of a payload, turning its data
+// strings into binary attachments in the binary encoding, and attachments
+// into plain bytes in msgpack. Attachments are copied, since the encoder
+// numbers them and a broadcast payload is sent to several connections.
+func frameValue(value interface{}, encoding, key string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			copied[name] = frameValue(item, encoding, name)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = frameValue(item, encoding, "")
+		}
+		return copied
+	case *parser.Buffer:
+		if encoding == EncodingMsgpack {
+			return v.Data
+		}
+		return &parser.Buffer{Data: v.Data}
+	case string:
+		if encoding == EncodingBinary && key == "data" {
+			return &parser.Buffer{Data: []byte(v)}
+		}
+	}
+	return value
+}
@@ -0,0 +1,432 @@
+package modules
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type RemoteFileRequest struct {
+	Protocol           string `json:"protocol" binding:"required,oneof=ftp ftps sftp"`
+	Host               string `json:"host" binding:"required"`
+	Port               int    `json:"port" binding:"omitempty,min=1,max=65535"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	PrivateKey         string `json:"private_key"` // PEM encoded, sftp only
+	Passphrase         string `json:"passphrase"`
+	HostKey            string `json:"host_key"` // SHA256 fingerprint, sftp only
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	RemotePath         string `json:"remote_path" binding:"required"`
+	Path               string `json:"path" binding:"required"`
+	Timeout            int    `json:"timeout"`                    // connection timeout in seconds
+	RateLimit          int64  `json:"rate_limit" binding:"min=0"` // bytes per second
+	SocketID           string `json:"socket_id"`
+}
+
+// remoteFiles is a connection to a remote file server
+type remoteFiles interface {
+	Download(path string) (io.ReadCloser, int64, error)
+	Upload(path string, r io.Reader) error
+	Close() error
+}
+
+type ftpFiles struct {
+	conn *ftp.ServerConn
+}
+
+type sftpFiles struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+// REST API Handlers
+
+// RemoteGet downloads a file from an FTP, FTPS or SFTP server
+func (nm *NetworkModule) RemoteGet(c *gin.Context) {
+	var req RemoteFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !nm.resolvePaths(c, &req.Path) {
+		return
+	}
+	recordAs(c, RecordJob, req.Path, map[string]any{"operation": req.Protocol + ":get", "host": req.Host, "remote_path": req.RemotePath})
+
+	if err := os.MkdirAll(filepath.Dir(req.Path), 0755); err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create directory: %v", err),
+		})
+		return
+	}
+
+	remote, err := nm.dialRemote(req)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to connect: %v", err),
+		})
+		return
+	}
+	defer remote.Close()
+
+	body, size, err := remote.Download(req.RemotePath)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to download file: %v", err),
+		})
+		return
+	}
+	defer body.Close()
+
+	token := RequestToken(c)
+	if size > 0 {
+		if err := nm.quotas.Check(token, req.Path, size); err != nil {
+			c.JSON(errorStatus(err), NetworkOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "%v", err),
+			})
+			return
+		}
+	}
+
+	file, err := os.Create(req.Path)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create file: %v", err),
+		})
+		return
+	}
+	defer file.Close()
+
+	task := nm.tasks.Start(c, req.Protocol+":get", req.Path, unitBytes)
+	task.ReportTo(requestConn(c, nm.emitter, req.SocketID))
+	task.SetTotal(size)
+	bytesWritten, err := io.Copy(nm.quotas.Writer(token, req.Path, file), nm.throttle.Reader(req.RateLimit, task.Reader(body)))
+	task.Finish(err)
+	if err != nil {
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			file.Close()
+			os.Remove(req.Path)
+		}
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to write file: %v", err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "File downloaded successfully"),
+		Data: map[string]interface{}{
+			"protocol":      req.Protocol,
+			"host":          req.Host,
+			"remote_path":   req.RemotePath,
+			"file_path":     req.Path,
+			"bytes_written": bytesWritten,
+			"job_id":        task.ID,
+		},
+	})
+}
+
+// RemotePut uploads a file to an FTP, FTPS or SFTP server
+func (nm *NetworkModule) RemotePut(c *gin.Context) {
+	var req RemoteFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !nm.resolvePaths(c, &req.Path) {
+		return
+	}
+	recordAs(c, RecordJob, req.Path, map[string]any{"operation": req.Protocol + ":put", "host": req.Host, "remote_path": req.RemotePath})
+
+	file, err := os.Open(req.Path)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to open file: %v", err),
+		})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("%s: %w", req.Path, syscall.EISDIR)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stat path: %v", err),
+		})
+		return
+	}
+
+	remote, err := nm.dialRemote(req)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to connect: %v", err),
+		})
+		return
+	}
+	defer remote.Close()
+
+	task := nm.tasks.Start(c, req.Protocol+":put", req.Path, unitBytes)
+	task.ReportTo(requestConn(c, nm.emitter, req.SocketID))
+	task.SetTotal(info.Size())
+	err = remote.Upload(req.RemotePath, nm.throttle.Reader(req.RateLimit, task.Reader(file)))
+	task.Finish(err)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to upload file: %v", err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "File uploaded successfully"),
+		Data: map[string]interface{}{
+			"protocol":    req.Protocol,
+			"host":        req.Host,
+			"remote_path": req.RemotePath,
+			"file_path":   req.Path,
+			"bytes":       info.Size(),
+			"job_id":      task.ID,
+		},
+	})
+}
+
+// Helper functions
+
+// dialRemote connects and logs in to the server of the request
+func (nm *NetworkModule) dialRemote(req RemoteFileRequest) (remoteFiles, error) {
+	timeout := 30 * time.Second
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+
+	port := req.Port
+	if port == 0 {
+		port = 21
+		if req.Protocol == "sftp" {
+			port = 22
+		}
+	}
+	addr := net.JoinHostPort(req.Host, strconv.Itoa(port))
+
+	if req.Protocol == "sftp" {
+		return nm.dialSFTP(req, addr, timeout)
+	}
+
+	options := []ftp.DialOption{ftp.DialWithTimeout(timeout), ftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+		return nm.outbound.DialTimeout(network, address, timeout)
+	})}
+	if req.Protocol == "ftps" {
+		options = append(options, ftp.DialWithExplicitTLS(&tls.Config{
+			ServerName:         req.Host,
+			InsecureSkipVerify: req.InsecureSkipVerify,
+		}))
+	}
+	conn, err := ftp.Dial(addr, options...)
+	if err != nil {
+		return nil, ftpError(err)
+	}
+
+	username, password := req.Username, req.Password
+	if username == "" {
+		username, password = "anonymous", "anonymous"
+	}
+	if err := conn.Login(username, password); err != nil {
+		conn.Quit()
+		return nil, ftpError(err)
+	}
+	return &ftpFiles{conn: conn}, nil
+}
+
+func (nm *NetworkModule) dialSFTP(req RemoteFileRequest, addr string, timeout time.Duration) (remoteFiles, error) {
+	var auth []ssh.AuthMethod
+	if req.PrivateKey != "" {
+		var signer ssh.Signer
+		var err error
+		if req.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(req.PrivateKey), []byte(req.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(req.PrivateKey))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid private key: %v", errInvalidRequest, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if req.Password != "" {
+		auth = append(auth, ssh.Password(req.Password))
+	}
+
+	hostKeyCallback, err := sftpHostKeyCallback(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := nm.outbound.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// The timeout also bounds the handshake
+	conn.SetDeadline(time.Now().Add(timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            req.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		conn.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", errUpstream, err)
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("%w: %v", errUpstream, err)
+	}
+	return &sftpFiles{ssh: client, sftp: sftpClient}, nil
+}
+
+// sftpHostKeyCallback verifies the server against the host_key fingerprint
+// of the request or the known_hosts file of the agent's user
+func sftpHostKeyCallback(req RemoteFileRequest) (ssh.HostKeyCallback, error) {
+	if req.HostKey != "" {
+		expected := req.HostKey
+		if !strings.HasPrefix(expected, "SHA256:") {
+			expected = "SHA256:" + expected
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != expected {
+				return fmt.Errorf("host key mismatch: got %s", fingerprint)
+			}
+			return nil
+		}, nil
+	}
+	if req.InsecureSkipVerify {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err == nil {
+		if callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts")); err == nil {
+			return callback, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: host key verification requires host_key, a known_hosts entry or insecure_skip_verify", errInvalidRequest)
+}
+
+// ftpError maps FTP reply codes to the matching errors
+func ftpError(err error) error {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return err
+	}
+	if protoErr.Code == ftp.StatusFileUnavailable {
+		return fmt.Errorf("%v: %w", err, fs.ErrNotExist)
+	}
+	return fmt.Errorf("%w: %v", errUpstream, err)
+}
+
+func (f *ftpFiles) Download(path string) (io.ReadCloser, int64, error) {
+	// Not every server supports SIZE, the download works without it
+	size, _ := f.conn.FileSize(path)
+
+	resp, err := f.conn.Retr(path)
+	if err != nil {
+		return nil, 0, ftpError(err)
+	}
+	return resp, size, nil
+}
+
+func (f *ftpFiles) Upload(path string, r io.Reader) error {
+	return ftpError(f.conn.Stor(path, r))
+}
+
+func (f *ftpFiles) Close() error {
+	return f.conn.Quit()
+}
+
+func (s *sftpFiles) Download(path string) (io.ReadCloser, int64, error) {
+	file, err := s.sftp.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (s *sftpFiles) Upload(path string, r io.Reader) error {
+	file, err := s.sftp.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.ReadFrom(r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *sftpFiles) Close() error {
+	// Closing the ssh connection first ends the sftp receive loop even when
+	// the server doesn't close the channel
+	err := s.ssh.Close()
+	s.sftp.Close()
+	return err
+}
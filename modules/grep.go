@@ -0,0 +1,403 @@
+package modules
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	// grepMaxResults is the default number of matching lines returned
+	grepMaxResults = 1000
+	// grepMaxLine caps the text returned of each matching line, in bytes
+	grepMaxLine = 500
+)
+
+type GrepRequest struct {
+	Path        string   `json:"path" binding:"required"`    // file or directory
+	Pattern     string   `json:"pattern" binding:"required"` // RE2 regular expression, matched line by line
+	Literal     bool     `json:"literal"`                    // pattern is plain text
+	IgnoreCase  bool     `json:"ignore_case"`
+	Include     []string `json:"include"`                                // globs of the files searched, every file when empty
+	Exclude     []string `json:"exclude"`                                // globs of the files and directories left out
+	MaxResults  int      `json:"max_results" binding:"min=0,max=100000"` // matching lines, 1000 when 0
+	MaxFileSize int64    `json:"max_file_size"`                          // bytes, larger files are skipped
+	NoIndex     bool     `json:"no_index"`                               // walk the tree even when the index covers it
+	WalkOptions
+}
+
+// GrepReport lists the lines matching a search, in file order
+type GrepReport struct {
+	Path      string      `json:"path"`
+	Matches   []GrepMatch `json:"matches"`
+	Files     int         `json:"files"`     // with matches
+	Scanned   int         `json:"scanned"`   // text files searched
+	Truncated bool        `json:"truncated"` // stopped at max_results
+	Indexed   bool        `json:"indexed"`   // the index picked the files searched
+	Built     *time.Time  `json:"built,omitempty"`
+}
+
+type GrepMatch struct {
+	Path   string `json:"path"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"` // byte offset of the match in the line, from 1
+	Text   string `json:"text"`   // cut past 500 bytes
+}
+
+// indexLiteral is text every match of a pattern contains, which candidate
+// files must have the trigrams of
+type indexLiteral struct {
+	text string
+	fold bool // matched ignoring case
+}
+
+// REST API Handlers
+
+// Grep searches the text files of a tree for lines matching a pattern. When
+// the search index covers the tree the files searched are picked by it,
+// otherwise the tree is walked within the walk limits.
+func (fsm *FileSystemModule) Grep(c *gin.Context) {
+	req, err := grepQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+
+	re, err := fsm.checkGrep(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	report, err := fsm.grep(req, re)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to search: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Found %d matches in %d files", len(report.Matches), report.Files),
+		Data:    report,
+	})
+}
+
+// Socket.IO Handlers
+
+// GrepFiles searches the text files of a tree like Grep
+func (fsm *FileSystemModule) GrepFiles(conn socketio.Conn, req GrepRequest) EventResult {
+	if err := fsm.paths.Resolve(&req.Path); err != nil {
+		return fsm.emitter.Fail(conn, "fs:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+			"path":    req.Path,
+		})
+	}
+	re, err := fsm.checkGrep(&req)
+	if err != nil {
+		return fsm.emitter.Fail(conn, "fs:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid request: %v", err),
+			"path":    req.Path,
+		})
+	}
+
+	report, err := fsm.grep(req, re)
+	if err != nil {
+		payload := map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to search: %v", err),
+			"path":    req.Path,
+		}
+		if details := errorDetails(err); details != nil {
+			payload["details"] = details
+		}
+		return fsm.emitter.Fail(conn, "fs:error", payload)
+	}
+	return fsm.emitter.Reply(conn, "fs:grep", map[string]interface{}{
+		"path":      report.Path,
+		"matches":   report.Matches,
+		"files":     report.Files,
+		"scanned":   report.Scanned,
+		"truncated": report.Truncated,
+		"indexed":   report.Indexed,
+		"built":     report.Built,
+	})
+}
+
+// Helper functions
+
+// grepQuery reads a search from the query parameters of a request
+func grepQuery(c *gin.Context) (GrepRequest, error) {
+	req := GrepRequest{
+		Path:        c.Query("path"),
+		Pattern:     c.Query("pattern"),
+		Literal:     c.Query("literal") == "true",
+		IgnoreCase:  c.Query("ignore_case") == "true",
+		Include:     c.QueryArray("include"),
+		Exclude:     c.QueryArray("exclude"),
+		NoIndex:     c.Query("index") == "false",
+		WalkOptions: walkOptionsQuery(c),
+	}
+	switch {
+	case req.Path == "":
+		return req, fmt.Errorf("path parameter is required")
+	case req.Pattern == "":
+		return req, fmt.Errorf("pattern parameter is required")
+	}
+	if value := c.Query("max_results"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 100000 {
+			return req, fmt.Errorf("max_results must be between 0 and 100000")
+		}
+		req.MaxResults = parsed
+	}
+	if value := c.Query("max_file_size"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return req, fmt.Errorf("invalid max_file_size: %q", value)
+		}
+		req.MaxFileSize = parsed
+	}
+	return req, nil
+}
+
+// checkGrep compiles the pattern of a search and checks its globs and file
+// size cap, defaulting the cap and the number of results
+func (fsm *FileSystemModule) checkGrep(req *GrepRequest) (*regexp.Regexp, error) {
+	re, err := compileSearch(req.Pattern, req.Literal, req.IgnoreCase, req.Include, req.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if req.MaxFileSize, err = fsm.searchMaxFileSize(req.MaxFileSize); err != nil {
+		return nil, err
+	}
+	if req.MaxResults == 0 {
+		req.MaxResults = grepMaxResults
+	}
+	return re, nil
+}
+
+// grep searches the files the index picks when it covers the path of the
+// request, or those of a walk of it
+func (fsm *FileSystemModule) grep(req GrepRequest, re *regexp.Regexp) (*GrepReport, error) {
+	report := &GrepReport{Path: req.Path, Matches: []GrepMatch{}}
+	search := func(name string, size int64) bool {
+		rel, _ := filepath.Rel(req.Path, name)
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = filepath.Base(name)
+		}
+		if matchGlobs(req.Exclude, rel) || (len(req.Include) > 0 && !matchGlobs(req.Include, rel)) || size > req.MaxFileSize {
+			return true
+		}
+		return grepFile(name, re, req.MaxResults, report)
+	}
+
+	var snapshot *indexSnapshot
+	if !req.NoIndex && !req.OneFileSystem {
+		// The index leaves out network filesystems only
+		snapshot = fsm.index.covers(req.Path)
+	}
+	if snapshot != nil {
+		report.Indexed, report.Built = true, &snapshot.built
+		for _, file := range snapshot.candidates(req.Path, searchLiterals(re)) {
+			// Excluded directories are matched by the paths below them
+			if excludedBelow(req.Path, file.path, req.Exclude) {
+				continue
+			}
+			info, err := os.Stat(file.path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if !search(file.path, info.Size()) {
+				break
+			}
+		}
+		return report, nil
+	}
+
+	boundary := newWalkBoundary(req.Path, req.WalkOptions)
+	err := newWalkLimits(fsm.config).walk(req.Path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == req.Path {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		rel, _ := filepath.Rel(req.Path, name)
+		if d.IsDir() {
+			if name != req.Path && (boundary.excludes(name, d) || matchGlobs(req.Exclude, filepath.ToSlash(rel))) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !search(name, info.Size()) {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// grepFile adds the lines of a text file matching re to a report, up to
+// max. It reports false once the report is full.
+func grepFile(name string, re *regexp.Regexp, max int, report *GrepReport) bool {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return true
+	}
+	text, ok := indexText(content)
+	if !ok {
+		return true
+	}
+
+	report.Scanned++
+	found := false
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		match := re.FindStringIndex(line)
+		if match == nil {
+			continue
+		}
+		if len(report.Matches) >= max {
+			report.Truncated = true
+			return false
+		}
+		if !found {
+			report.Files++
+			found = true
+		}
+		if len(line) > grepMaxLine {
+			line = strings.ToValidUTF8(line[:grepMaxLine], "")
+		}
+		report.Matches = append(report.Matches, GrepMatch{Path: name, Line: i + 1, Column: match[0] + 1, Text: line})
+	}
+	return true
+}
+
+// excludedBelow reports whether a directory between root and name matches
+// an exclude glob, as a walk would have skipped it
+func excludedBelow(root, name string, exclude []string) bool {
+	if len(exclude) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil || rel == "." {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		if matchGlobs(exclude, strings.Join(parts[:i+1], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchLiterals returns the literals every match of re contains, none when
+// the pattern can't be parsed again
+func searchLiterals(re *regexp.Regexp) []indexLiteral {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return requiredLiterals(parsed.Simplify())
+}
+
+// requiredLiterals walks a parsed pattern for the literal text its matches
+// must contain. Alternations and optional parts are left out, so the
+// literals found narrow the files searched down without missing any.
+func requiredLiterals(re *syntax.Regexp) []indexLiteral {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []indexLiteral{{text: string(re.Rune), fold: re.Flags&syntax.FoldCase != 0}}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals are joined, so their trigrams span them
+		var literals []indexLiteral
+		var run *indexLiteral
+		for _, sub := range re.Sub {
+			fold := sub.Flags&syntax.FoldCase != 0
+			switch {
+			case sub.Op == syntax.OpLiteral && run != nil && run.fold == fold:
+				run.text += string(sub.Rune)
+				continue
+			case run != nil:
+				literals = append(literals, *run)
+				run = nil
+			}
+			if sub.Op == syntax.OpLiteral {
+				run = &indexLiteral{text: string(sub.Rune), fold: fold}
+				continue
+			}
+			literals = append(literals, requiredLiterals(sub)...)
+		}
+		if run != nil {
+			literals = append(literals, *run)
+		}
+		return literals
+	}
+	return nil
+}
+
+// trigrams returns the trigrams of the literal to look up. Those of text
+// matched ignoring case are only looked up when ASCII lowercasing folds
+// them, which it doesn't for non-ASCII letters, nor for k and s that the
+// Kelvin sign and long s fold to.
+func (l indexLiteral) trigrams() []uint32 {
+	var trigrams []uint32
+	for i := 0; i+3 <= len(l.text); i++ {
+		if l.fold && strings.IndexFunc(l.text[i:i+3], func(r rune) bool {
+			return r >= 0x80 || r == 'k' || r == 'K' || r == 's' || r == 'S'
+		}) >= 0 {
+			continue
+		}
+		trigrams = append(trigrams, trigramOf(l.text[i:i+3]))
+	}
+	return trigrams
+}
@@ -0,0 +1,287 @@
+package modules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inotifyHeadroom is the share of the inotify limits that can be in use
+// before the agent stops being ready
+const inotifyHeadroom = 0.9
+
+// HealthModule answers the liveness and readiness probes of load balancers
+// and orchestrators
+type HealthModule struct {
+	config   *Config
+	system   *SystemModule
+	shell    *ShellModule
+	fleet    *FleetModule
+	limits   *ConnectionLimits
+	notifier *Notifier
+	failing  map[string]bool // checks failing on the last probe
+	mutex    sync.Mutex
+}
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Status  string `json:"status"` // ok or fail
+	Message string `json:"message,omitempty"`
+	Details any    `json:"details,omitempty"`
+}
+
+// DiskCheck is the free space of a directory the agent writes to
+type DiskCheck struct {
+	Path string `json:"path"`
+	Free int64  `json:"free"`
+}
+
+// InotifyCheck is the use of the inotify limits by the user of the agent
+type InotifyCheck struct {
+	Watches          int `json:"watches"`
+	MaxUserWatches   int `json:"max_user_watches"`
+	Instances        int `json:"instances"`
+	MaxUserInstances int `json:"max_user_instances"`
+}
+
+// DownstreamCheck is the reachability of a downstream agent
+type DownstreamCheck struct {
+	Agent     string `json:"agent"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+func NewHealthModule(config *Config, system *SystemModule, shell *ShellModule, fleet *FleetModule, limits *ConnectionLimits, notifier *Notifier) *HealthModule {
+	return &HealthModule{
+		config:   config,
+		system:   system,
+		shell:    shell,
+		fleet:    fleet,
+		limits:   limits,
+		notifier: notifier,
+		failing:  make(map[string]bool),
+	}
+}
+
+// REST API Handlers
+
+// Live reports that the process is up and serving requests
+func (hm *HealthModule) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "agent": hm.system.Info()})
+}
+
+// Ready runs the readiness checks and responds with 503 when any fails, so
+// the agent is taken out of rotation while it can't serve new work
+func (hm *HealthModule) Ready(c *gin.Context) {
+	checks := map[string]HealthCheck{
+		"disk":     hm.checkDisk(c),
+		"inotify":  hm.checkInotify(c),
+		"sessions": hm.checkSessions(c),
+		"socketio": hm.checkSocket(c),
+		"clients":  hm.checkClients(c),
+	}
+	if len(hm.fleet.agents) > 0 {
+		checks["downstream"] = hm.checkDownstream(c)
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+	hm.notify(checks)
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// Helper functions
+
+// notify raises a notification for each check that started failing or
+// recovered since the previous probe
+func (hm *HealthModule) notify(checks map[string]HealthCheck) {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	for name, check := range checks {
+		failing := check.Status != "ok"
+		if failing == hm.failing[name] {
+			continue
+		}
+		hm.failing[name] = failing
+		if failing {
+			hm.notifier.Notify(NotifyHealthFail, SeverityCritical, name, "Readiness check %s failed: %s", name, check.Message)
+		} else {
+			hm.notifier.Notify(NotifyHealthRecover, SeverityInfo, name, "Readiness check %s passes again", name)
+		}
+	}
+}
+
+// checkDisk checks the free space of the temporary spaces and the download
+// cache against HEALTH_MIN_FREE_DISK
+func (hm *HealthModule) checkDisk(c *gin.Context) HealthCheck {
+	paths := []string{hm.config.TmpDir}
+	if hm.config.DownloadCacheDir != "" {
+		paths = append(paths, hm.config.DownloadCacheDir)
+	}
+
+	check := HealthCheck{Status: "ok"}
+	disks := make([]DiskCheck, 0, len(paths))
+	for _, path := range paths {
+		free, err := diskFree(path)
+		if err != nil {
+			return HealthCheck{Status: "fail", Message: Localize(c, "Failed to read free disk space: %v", err)}
+		}
+		disks = append(disks, DiskCheck{Path: path, Free: free})
+		if free < hm.config.HealthMinFreeDisk {
+			check.Status = "fail"
+			check.Message = Localize(c, "Only %d bytes free in %s", free, path)
+		}
+	}
+	check.Details = disks
+	return check
+}
+
+// checkInotify checks that the user of the agent has inotify watches and
+// instances left for new watches
+func (hm *HealthModule) checkInotify(c *gin.Context) HealthCheck {
+	usage := inotifyUsage()
+	check := HealthCheck{Status: "ok", Details: usage}
+	if usage.MaxUserWatches > 0 && float64(usage.Watches) >= float64(usage.MaxUserWatches)*inotifyHeadroom ||
+		usage.MaxUserInstances > 0 && float64(usage.Instances) >= float64(usage.MaxUserInstances)*inotifyHeadroom {
+		check.Status = "fail"
+		check.Message = Localize(c, "inotify limits nearly reached")
+	}
+	return check
+}
+
+// checkSessions checks that SHELL_MAX_SESSIONS leaves room for a new session
+func (hm *HealthModule) checkSessions(c *gin.Context) HealthCheck {
+	active := hm.shell.SessionCount()
+	check := HealthCheck{Status: "ok", Details: gin.H{"active": active, "max": hm.config.ShellMaxSessions}}
+	if hm.config.ShellMaxSessions > 0 && active >= hm.config.ShellMaxSessions {
+		check.Status = "fail"
+		check.Message = Localize(c, "Shell session limit reached")
+	}
+	return check
+}
+
+// checkSocket checks that the accept loop of the Socket.IO server is running,
+// failing while it waits to restart
+func (hm *HealthModule) checkSocket(c *gin.Context) HealthCheck {
+	stats := hm.system.SocketStats()
+	check := HealthCheck{Status: "ok", Details: stats}
+	if !stats.Serving {
+		check.Status = "fail"
+		check.Message = Localize(c, "Socket.IO server is restarting")
+	}
+	return check
+}
+
+// checkClients checks that MAX_CLIENTS leaves room for a new connection,
+// reporting the requests in flight along
+func (hm *HealthModule) checkClients(c *gin.Context) HealthCheck {
+	sockets, requests := hm.limits.Usage()
+	check := HealthCheck{Status: "ok", Details: gin.H{"connections": sockets, "requests": requests}}
+	if sockets.Max > 0 && sockets.Active >= sockets.Max {
+		check.Status = "fail"
+		check.Message = Localize(c, "Connection limit reached")
+	}
+	return check
+}
+
+// checkDownstream probes the liveness of every downstream agent, failing
+// when none of them answers
+func (hm *HealthModule) checkDownstream(c *gin.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	results := make([]DownstreamCheck, 0, len(hm.fleet.agents))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, agent := range hm.fleet.agents {
+		wg.Add(1)
+		go func(agent *FleetAgent) {
+			defer wg.Done()
+			result := DownstreamCheck{Agent: agent.Name, Reachable: true}
+			if err := hm.fleet.probe(ctx, agent); err != nil {
+				result.Reachable, result.Error = false, err.Error()
+			}
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+		}(agent)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Agent < results[j].Agent })
+
+	check := HealthCheck{Status: "fail", Message: Localize(c, "No downstream agent is reachable"), Details: results}
+	for _, result := range results {
+		if result.Reachable {
+			check.Status, check.Message = "ok", ""
+		}
+	}
+	return check
+}
+
+// inotifyUsage counts the inotify instances and watches of the processes of
+// the user of the agent, which share the limits
+func inotifyUsage() InotifyCheck {
+	usage := InotifyCheck{
+		MaxUserWatches:   readProcInt("/proc/sys/fs/inotify/max_user_watches"),
+		MaxUserInstances: readProcInt("/proc/sys/fs/inotify/max_user_instances"),
+	}
+	uid := uint32(os.Getuid())
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if info, err := entry.Info(); err != nil {
+			continue
+		} else if owner, _, ok := fileOwner(info); !ok || owner != uid {
+			continue
+		}
+		fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+			if err != nil || link != "anon_inode:inotify" {
+				continue
+			}
+			usage.Instances++
+			usage.Watches += countInotifyWatches(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd.Name()))
+		}
+	}
+	return usage
+}
+
+// countInotifyWatches counts the "inotify wd:" lines of the fdinfo of an
+// inotify instance
+func countInotifyWatches(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	watches := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "inotify wd:") {
+			watches++
+		}
+	}
+	return watches
+}
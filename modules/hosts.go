@@ -0,0 +1,361 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hostnamePattern matches host names and domains made of RFC 1123 labels
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// HostsEntry is a line of the hosts file mapping an address to host names
+type HostsEntry struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+	Comment   string   `json:"comment,omitempty"`
+}
+
+type HostsRequest struct {
+	IP        string   `json:"ip" binding:"required"`
+	Hostnames []string `json:"hostnames" binding:"required,min=1"`
+	Comment   string   `json:"comment"`
+	Replace   bool     `json:"replace"` // moves host names mapped to other addresses
+}
+
+// hostsLine is a line of the hosts file, written back verbatim unless edited
+type hostsLine struct {
+	text  string
+	entry *HostsEntry // nil for comments and blank lines
+}
+
+// REST API Handlers
+
+// GetHosts lists the entries of the hosts file
+func (nm *NetworkModule) GetHosts(c *gin.Context) {
+	nm.etcMu.Lock()
+	lines, err := readHosts(nm.config.HostsFile)
+	nm.etcMu.Unlock()
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read hosts file: %v", err),
+		})
+		return
+	}
+
+	entries := []HostsEntry{}
+	for _, line := range lines {
+		if line.entry != nil {
+			entries = append(entries, *line.entry)
+		}
+	}
+	page, total, next, err := paginate(c, entries)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Hosts file retrieved"),
+		Data: map[string]interface{}{
+			"path":    nm.config.HostsFile,
+			"entries": page,
+		},
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// AddHosts maps host names to an address. Host names already mapped to the
+// address are left alone; those mapped to another one are refused unless
+// replace is set.
+func (nm *NetworkModule) AddHosts(c *gin.Context) {
+	var req HostsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", fmt.Sprintf("invalid IP address %q", req.IP)),
+		})
+		return
+	}
+	for _, hostname := range req.Hostnames {
+		if !hostnamePattern.MatchString(hostname) || len(hostname) > 253 {
+			c.JSON(http.StatusBadRequest, NetworkOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", fmt.Sprintf("invalid host name %q", hostname)),
+			})
+			return
+		}
+	}
+	if strings.ContainsAny(req.Comment, "\r\n") {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "comment must be a single line"),
+		})
+		return
+	}
+
+	nm.etcMu.Lock()
+	defer nm.etcMu.Unlock()
+
+	lines, err := readHosts(nm.config.HostsFile)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read hosts file: %v", err),
+		})
+		return
+	}
+
+	missing := make(map[string]bool)
+	for _, hostname := range req.Hostnames {
+		missing[strings.ToLower(hostname)] = true
+	}
+	changed := false
+	for i := range lines {
+		entry := lines[i].entry
+		if entry == nil {
+			continue
+		}
+		kept := entry.Hostnames[:0:0]
+		for _, hostname := range entry.Hostnames {
+			if _, wanted := missing[strings.ToLower(hostname)]; !wanted {
+				kept = append(kept, hostname)
+				continue
+			}
+			if net.ParseIP(entry.IP).Equal(ip) {
+				missing[strings.ToLower(hostname)] = false
+				kept = append(kept, hostname)
+				continue
+			}
+			if !req.Replace {
+				c.JSON(http.StatusConflict, NetworkOperation{
+					Success: false,
+					Code:    ErrConflict,
+					Message: Localize(c, "Host name %s is already mapped to %s", hostname, entry.IP),
+				})
+				return
+			}
+		}
+		if len(kept) != len(entry.Hostnames) {
+			lines[i] = editedHostsLine(HostsEntry{IP: entry.IP, Hostnames: kept, Comment: entry.Comment})
+			changed = true
+		}
+	}
+
+	added := HostsEntry{IP: ip.String(), Comment: req.Comment}
+	for _, hostname := range req.Hostnames {
+		if missing[strings.ToLower(hostname)] {
+			added.Hostnames = append(added.Hostnames, hostname)
+			missing[strings.ToLower(hostname)] = false
+		}
+	}
+	if len(added.Hostnames) > 0 {
+		lines = append(lines, editedHostsLine(added))
+		changed = true
+	}
+
+	data := map[string]interface{}{
+		"path":    nm.config.HostsFile,
+		"changed": changed,
+	}
+	if changed {
+		backup, err := writeEtcFile(nm.config.HostsFile, formatHosts(lines))
+		if err != nil {
+			c.JSON(errorStatus(err), NetworkOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to update hosts file: %v", err),
+			})
+			return
+		}
+		data["backup"] = backup
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Hosts file updated"),
+		Data:    data,
+	})
+}
+
+// RemoveHosts removes a host name, the entries of an address, or a host name
+// from the entries of an address
+func (nm *NetworkModule) RemoveHosts(c *gin.Context) {
+	hostname, address := c.Query("hostname"), c.Query("ip")
+	var ip net.IP
+	if address != "" {
+		ip = net.ParseIP(address)
+	}
+	if hostname == "" && address == "" || address != "" && ip == nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "a host name or a valid IP address is required"),
+		})
+		return
+	}
+
+	nm.etcMu.Lock()
+	defer nm.etcMu.Unlock()
+
+	lines, err := readHosts(nm.config.HostsFile)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read hosts file: %v", err),
+		})
+		return
+	}
+
+	removed := 0
+	kept := lines[:0]
+	for _, line := range lines {
+		entry := line.entry
+		if entry == nil || ip != nil && !net.ParseIP(entry.IP).Equal(ip) {
+			kept = append(kept, line)
+			continue
+		}
+		if hostname == "" {
+			removed += len(entry.Hostnames)
+			continue
+		}
+
+		hostnames := entry.Hostnames[:0:0]
+		for _, name := range entry.Hostnames {
+			if strings.EqualFold(name, hostname) {
+				removed++
+			} else {
+				hostnames = append(hostnames, name)
+			}
+		}
+		switch {
+		case len(hostnames) == 0:
+		case len(hostnames) == len(entry.Hostnames):
+			kept = append(kept, line)
+		default:
+			kept = append(kept, editedHostsLine(HostsEntry{IP: entry.IP, Hostnames: hostnames, Comment: entry.Comment}))
+		}
+	}
+
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "No matching hosts entry found"),
+		})
+		return
+	}
+
+	backup, err := writeEtcFile(nm.config.HostsFile, formatHosts(kept))
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to update hosts file: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Hosts file updated"),
+		Data: map[string]interface{}{
+			"path":    nm.config.HostsFile,
+			"backup":  backup,
+			"removed": removed,
+		},
+	})
+}
+
+// Helper functions
+
+// readHosts parses the hosts file, keeping every line to write it back
+func readHosts(path string) ([]hostsLine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []hostsLine
+	for _, text := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		line := hostsLine{text: text}
+		content, comment, _ := strings.Cut(text, "#")
+		fields := strings.Fields(content)
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			line.entry = &HostsEntry{
+				IP:        fields[0],
+				Hostnames: fields[1:],
+				Comment:   strings.TrimSpace(comment),
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func editedHostsLine(entry HostsEntry) hostsLine {
+	text := entry.IP + "\t" + strings.Join(entry.Hostnames, " ")
+	if entry.Comment != "" {
+		text += " # " + entry.Comment
+	}
+	return hostsLine{text: text, entry: &entry}
+}
+
+func formatHosts(lines []hostsLine) []byte {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line.text + "\n")
+	}
+	return []byte(b.String())
+}
+
+// writeEtcFile replaces the content of a system file, keeping the previous
+// one in a .ccw.bak file next to it. The file is rewritten in place rather
+// than renamed over, since containers bind-mount /etc/hosts and
+// /etc/resolv.conf.
+func writeEtcFile(path string, data []byte) (string, error) {
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	backup := path + ".ccw.bak"
+	if err := os.WriteFile(backup, previous, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := os.WriteFile(path, data, info.Mode().Perm()); err != nil {
+		return "", err
+	}
+	return backup, nil
+}
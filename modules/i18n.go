@@ -0,0 +1,397 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// defaultLanguage is the language messages are written in
+const defaultLanguage = "en"
+
+// messageCatalogs translates message formats, keyed by language and then by
+// the English format string. Missing entries fall back to English.
+var messageCatalogs = map[string]map[string]string{
+	"es": {
+		"A discovery scan is already running":                        "Ya hay un escaneo de descubrimiento en curso",
+		"A port scan is already running":                             "Ya hay un escaneo de puertos en curso",
+		"Access checked":                                             "Acceso comprobado",
+		"Access denied":                                              "Acceso denegado",
+		"Agent not found: %s":                                        "Agente no encontrado: %s",
+		"Agent registered":                                           "Agente registrado",
+		"Agent removed from the inventory":                           "Agente eliminado del inventario",
+		"Agents retrieved":                                           "Agentes obtenidos",
+		"Already watching this path":                                 "Esta ruta ya está siendo vigilada",
+		"Another firewall change is waiting for confirmation":        "Hay otro cambio del firewall pendiente de confirmación",
+		"Another provisioning run is in progress":                    "Ya hay un aprovisionamiento en curso",
+		"Approval not found":                                         "No se encontró la aprobación",
+		"Approval retrieved":                                         "Aprobación obtenida",
+		"Approvals retrieved":                                        "Aprobaciones obtenidas",
+		"Approving operations requires the approve permission":       "Aprobar operaciones requiere el permiso approve",
+		"Archive imported successfully":                              "Archivo importado correctamente",
+		"Bookmark created":                                           "Marcador creado",
+		"Bookmark deleted":                                           "Marcador eliminado",
+		"Bookmark updated":                                           "Marcador actualizado",
+		"Bookmarks retrieved":                                        "Marcadores obtenidos",
+		"Capabilities retrieved":                                     "Capacidades obtenidas",
+		"Capture not found":                                          "Captura no encontrada",
+		"Changes retrieved":                                          "Cambios obtenidos",
+		"Changing firewall rules requires the firewall permission":   "Cambiar las reglas del firewall requiere el permiso firewall",
+		"Changing port mappings requires the firewall permission":    "Cambiar las redirecciones de puertos requiere el permiso firewall",
+		"Channel %s not found":                                       "Canal %s no encontrado",
+		"Channels retrieved":                                         "Canales obtenidos",
+		"Command executed":                                           "Comando ejecutado",
+		"Command ran on %d agents, %d failed":                        "Comando ejecutado en %d agentes, %d fallaron",
+		"Command timed out after %d seconds":                         "El comando superó el tiempo límite de %d segundos",
+		"Connection limit reached":                                   "Límite de conexiones alcanzado",
+		"Content indexing is disabled":                               "La indexación de contenido está desactivada",
+		"Content indexing is disabled, set INDEX_PATHS to enable it": "La indexación de contenido está desactivada, define INDEX_PATHS para activarla",
+		"Current listening ports retrieved":                          "Puertos en escucha obtenidos",
+		"Daily write quota exceeded: %d of %d bytes used":            "Cuota diaria de escritura superada: %d de %d bytes usados",
+		"Directory created successfully":                             "Directorio creado correctamente",
+		"Directory listed successfully":                              "Directorio listado correctamente",
+		"Discovery completed, %d hosts found":                        "Descubrimiento completado, %d hosts encontrados",
+		"Disk report built":                                          "Informe de disco generado",
+		"Download cache is disabled":                                 "La caché de descargas está desactivada",
+		"Download cache purged":                                      "Caché de descargas vaciada",
+		"Download cache retrieved":                                   "Caché de descargas obtenida",
+		"Env file read successfully":                                 "Archivo env leído correctamente",
+		"Env file updated successfully":                              "Archivo env actualizado correctamente",
+		"Exactly one of template or template_path is required":       "Se requiere exactamente uno de template o template_path",
+		"Executed":                                       "Ejecutado",
+		"Failed to add firewall rule: %v":                "No se pudo añadir la regla del firewall: %v",
+		"Failed to add port mapping: %v":                 "No se pudo añadir la redirección de puerto: %v",
+		"Failed to allocate file: %v":                    "Error al reservar el archivo: %v",
+		"Failed to build disk report: %v":                "Error al generar el informe de disco: %v",
+		"Failed to build manifest: %v":                   "No se pudo generar el manifiesto: %v",
+		"Failed to check access: %v":                     "Error al comprobar el acceso: %v",
+		"Failed to close file: %v":                       "No se pudo cerrar el archivo: %v",
+		"Failed to connect: %v":                          "No se pudo conectar: %v",
+		"Failed to copy: %v":                             "No se pudo copiar: %v",
+		"Failed to create bookmark: %v":                  "No se pudo crear el marcador: %v",
+		"Failed to create capture file: %v":              "No se pudo crear el archivo de captura: %v",
+		"Failed to create directory: %v":                 "No se pudo crear el directorio: %v",
+		"Failed to create file: %v":                      "No se pudo crear el archivo: %v",
+		"Failed to create temporary space: %v":           "No se pudo crear el espacio temporal: %v",
+		"Failed to create tmux session: %v":              "No se pudo crear la sesión de tmux: %v",
+		"Failed to create watcher: %v":                   "No se pudo crear el observador: %v",
+		"Failed to delete bookmark: %v":                  "No se pudo eliminar el marcador: %v",
+		"Failed to delete temporary space: %v":           "No se pudo eliminar el espacio temporal: %v",
+		"Failed to delete: %v":                           "No se pudo eliminar: %v",
+		"Failed to download directory: %v":               "Error al descargar el directorio: %v",
+		"Failed to download file: %v":                    "No se pudo descargar el archivo: %v",
+		"Failed to download object: %v":                  "No se pudo descargar el objeto: %v",
+		"Failed to edit file: %v":                        "No se pudo editar el archivo: %v",
+		"Failed to extend temporary space: %v":           "No se pudo extender el espacio temporal: %v",
+		"Failed to extract archive: %v":                  "No se pudo extraer el archivo comprimido: %v",
+		"Failed to finalize file: %v":                    "No se pudo finalizar el archivo: %v",
+		"Failed to get changes: %v":                      "No se pudieron obtener los cambios: %v",
+		"Failed to import archive: %v":                   "No se pudo importar el archivo comprimido: %v",
+		"Failed to list firewall rules: %v":              "No se pudieron listar las reglas del firewall: %v",
+		"Failed to list mounts: %v":                      "No se pudieron listar los montajes: %v",
+		"Failed to list open files: %v":                  "Error al listar los archivos abiertos: %v",
+		"Failed to list port mappings: %v":               "No se pudieron listar las redirecciones de puertos: %v",
+		"Failed to list ports: %v":                       "No se pudieron listar los puertos: %v",
+		"Failed to list tmux sessions: %v":               "No se pudieron listar las sesiones de tmux: %v",
+		"Failed to load signature: %v":                   "No se pudo cargar la firma: %v",
+		"Failed to look up %s: %v":                       "No se pudo consultar %s: %v",
+		"Failed to mount: %v":                            "No se pudo montar: %v",
+		"Failed to move (copy failed): %v":               "No se pudo mover (falló la copia): %v",
+		"Failed to move (delete source failed): %v":      "No se pudo mover (falló la eliminación del origen): %v",
+		"Failed to move: %v":                             "No se pudo mover: %v",
+		"Failed to open file: %v":                        "No se pudo abrir el archivo: %v",
+		"Failed to parse template: %v":                   "No se pudo analizar la plantilla: %v",
+		"Failed to purge cache: %v":                      "No se pudo vaciar la caché: %v",
+		"Failed to read directory: %v":                   "No se pudo leer el directorio: %v",
+		"Failed to read env file: %v":                    "No se pudo leer el archivo env: %v",
+		"Failed to read file: %v":                        "No se pudo leer el archivo: %v",
+		"Failed to read free disk space: %v":             "Error al leer el espacio libre en disco: %v",
+		"Failed to read hosts file: %v":                  "No se pudo leer el archivo hosts: %v",
+		"Failed to read resolver configuration: %v":      "No se pudo leer la configuración del resolvedor: %v",
+		"Failed to read template: %v":                    "No se pudo leer la plantilla: %v",
+		"Failed to remove firewall rule: %v":             "No se pudo eliminar la regla del firewall: %v",
+		"Failed to remove port mapping: %v":              "No se pudo eliminar la redirección de puerto: %v",
+		"Failed to rename: %v":                           "No se pudo renombrar: %v",
+		"Failed to render template: %v":                  "No se pudo renderizar la plantilla: %v",
+		"Failed to replace: %v":                          "No se pudo reemplazar: %v",
+		"Failed to replicate: %v":                        "No se pudo replicar: %v",
+		"Failed to roll back firewall change: %v":        "No se pudo revertir el cambio del firewall: %v",
+		"Failed to save template: %v":                    "No se pudo guardar la plantilla: %v",
+		"Failed to scan %s: %v":                          "No se pudo escanear %s: %v",
+		"Failed to search records: %v":                   "Error al buscar registros: %v",
+		"Failed to search: %v":                           "No se pudo buscar: %v",
+		"Failed to select fields: %v":                    "No se pudieron seleccionar los campos: %v",
+		"Failed to send input: %v":                       "No se pudo enviar la entrada: %v",
+		"Failed to send password: %v":                    "No se pudo enviar la contraseña: %v",
+		"Failed to send the test notification to %s: %s": "No se pudo enviar la notificación de prueba a %s: %s",
+		"Failed to start capture: %v":                    "No se pudo iniciar la captura: %v",
+		"Failed to start discovery: %v":                  "No se pudo iniciar el descubrimiento: %v",
+		"Failed to start scan: %v":                       "No se pudo iniciar el escaneo: %v",
+		"Failed to start shell: %v":                      "No se pudo iniciar la shell: %v",
+		"Failed to stat path: %v":                        "No se pudo consultar la ruta: %v",
+		"Failed to stream media: %v":                     "No se pudo transmitir el medio: %v",
+		"Failed to unmount: %v":                          "No se pudo desmontar: %v",
+		"Failed to update bookmark: %v":                  "No se pudo actualizar el marcador: %v",
+		"Failed to update hosts file: %v":                "No se pudo actualizar el archivo hosts: %v",
+		"Failed to update resolver configuration: %v":    "No se pudo actualizar la configuración del resolvedor: %v",
+		"Failed to upload file: %v":                      "No se pudo subir el archivo: %v",
+		"Failed to upload object: %v":                    "No se pudo subir el objeto: %v",
+		"Failed to watch path: %v":                       "No se pudo vigilar la ruta: %v",
+		"Failed to write chunk: %v":                      "No se pudo escribir el fragmento: %v",
+		"Failed to write content: %v":                    "No se pudo escribir el contenido: %v",
+		"Failed to write env file: %v":                   "No se pudo escribir el archivo env: %v",
+		"Failed to write file: %v":                       "No se pudo escribir el archivo: %v",
+		"Failed: %v":                                     "Falló: %v",
+		"File created successfully":                      "Archivo creado correctamente",
+		"File downloaded successfully":                   "Archivo descargado correctamente",
+		"File edited (dry run)":                          "Archivo editado (simulación)",
+		"File edited successfully":                       "Archivo editado correctamente",
+		"File is %d bytes, over the %d byte limit for JSON reads; use /api/fs/download to stream it": "El archivo tiene %d bytes, más que el límite de %d bytes para lecturas JSON; usa /api/fs/download para transmitirlo",
+		"File is %d bytes, over the %d byte limit for structured edits":                              "El archivo tiene %d bytes, más que el límite de %d bytes para ediciones estructuradas",
+		"File read successfully":                                   "Archivo leído correctamente",
+		"File size %d exceeds the %d byte limit":                   "El tamaño de archivo %d supera el límite de %d bytes",
+		"File size exceeds the %d byte limit":                      "El tamaño del archivo supera el límite de %d bytes",
+		"File uploaded successfully":                               "Archivo subido correctamente",
+		"File written successfully":                                "Archivo escrito correctamente",
+		"File/directory copied successfully":                       "Archivo/directorio copiado correctamente",
+		"File/directory deleted successfully":                      "Archivo/directorio eliminado correctamente",
+		"File/directory moved successfully":                        "Archivo/directorio movido correctamente",
+		"File/directory renamed successfully":                      "Archivo/directorio renombrado correctamente",
+		"Firewall change confirmed":                                "Cambio del firewall confirmado",
+		"Firewall change rolled back":                              "Cambio del firewall revertido",
+		"Firewall rule %s not found":                               "No se encontró la regla del firewall %s",
+		"Firewall rule added":                                      "Regla del firewall añadida",
+		"Firewall rule removed":                                    "Regla del firewall eliminada",
+		"Firewall rules retrieved":                                 "Reglas del firewall obtenidas",
+		"Found %d matches in %d files":                             "Se encontraron %d coincidencias en %d archivos",
+		"Found %d matches in %d files (dry run)":                   "Se encontraron %d coincidencias en %d archivos (simulación)",
+		"HTTP error: %s":                                           "Error HTTP: %s",
+		"Host name %s is already mapped to %s":                     "El nombre de host %s ya está asignado a %s",
+		"Hosts file retrieved":                                     "Archivo hosts obtenido",
+		"Hosts file updated":                                       "Archivo hosts actualizado",
+		"Idempotency-Key was already used for a different request": "La Idempotency-Key ya se usó para otra petición",
+		"Index rebuild started":                                    "Reconstrucción del índice iniciada",
+		"Index status retrieved":                                   "Estado del índice obtenido",
+		"Installed":                                                "Instalado",
+		"Insufficient disk space: %d bytes free, at least %d must remain available":     "Espacio en disco insuficiente: %d bytes libres, deben quedar al menos %d disponibles",
+		"Insufficient disk space: %d bytes needed, %d available":                        "Espacio en disco insuficiente: se necesitan %d bytes, hay %d disponibles",
+		"Invalid capture filter: %s":                                                    "Filtro de captura no válido: %s",
+		"Invalid direction. Use 'pull' or 'push'":                                       "Dirección no válida. Usa 'pull' o 'push'",
+		"Invalid fields: %s":                                                            "Campos no válidos: %s",
+		"Invalid key: %q":                                                               "Clave no válida: %q",
+		"Invalid protocol. Use 'tcp', 'udp', or 'both'":                                 "Protocolo no válido. Usa 'tcp', 'udp' o 'both'",
+		"Invalid request: %v":                                                           "Petición no válida: %v",
+		"Invalid since timestamp: %v":                                                   "Marca de tiempo since no válida: %v",
+		"Inventory retrieved":                                                           "Inventario obtenido",
+		"LAN discovery is disabled, set DISCOVERY_ENABLED to enable it":                 "El descubrimiento de la LAN está desactivado, establece DISCOVERY_ENABLED para activarlo",
+		"Lookup completed":                                                              "Consulta completada",
+		"Managing mounts requires the mounts permission":                                "Gestionar montajes requiere el permiso mounts",
+		"Managing templates requires the templates permission":                          "Gestionar plantillas requiere el permiso templates",
+		"Managing the fleet requires the fleet permission":                              "Gestionar la flota requiere el permiso fleet",
+		"Manifest generated successfully":                                               "Manifiesto generado correctamente",
+		"Media streaming requires ffmpeg":                                               "El streaming de medios requiere ffmpeg",
+		"Mount management is disabled, set MOUNTS_ENABLED to enable it":                 "La gestión de montajes está desactivada, establece MOUNTS_ENABLED para activarla",
+		"Mounted %s on %s":                                                              "%s montado en %s",
+		"Mounts retrieved":                                                              "Montajes obtenidos",
+		"No downstream agent is reachable":                                              "Ningún agente downstream es accesible",
+		"No events recorded for this path":                                              "No hay eventos registrados para esta ruta",
+		"No firewall backend found, install nftables or iptables":                       "No se encontró ningún firewall, instala nftables o iptables",
+		"No firewall change %s is waiting for confirmation":                             "No hay ningún cambio del firewall %s pendiente de confirmación",
+		"No fleet agents are configured":                                                "No hay agentes de flota configurados",
+		"No matching hosts entry found":                                                 "No se encontró ninguna entrada de hosts coincidente",
+		"No matching resolver entry found":                                              "No se encontró ninguna entrada del resolvedor coincidente",
+		"No notification channels, set NOTIFY_CHANNELS to configure them":               "No hay canales de notificación, define NOTIFY_CHANNELS para configurarlos",
+		"No supported package manager found":                                            "No se encontró un gestor de paquetes compatible",
+		"Not monitoring this protocol and interface":                                    "No se están monitorizando este protocolo e interfaz",
+		"Not supported on %s":                                                           "No compatible con %s",
+		"Nothing is mounted on %s":                                                      "No hay nada montado en %s",
+		"Object downloaded successfully":                                                "Objeto descargado correctamente",
+		"Object uploaded successfully":                                                  "Objeto subido correctamente",
+		"Only %d bytes free in %s":                                                      "Solo quedan %d bytes libres en %s",
+		"Open files retrieved":                                                          "Archivos abiertos obtenidos",
+		"Operation approved":                                                            "Operación aprobada",
+		"Operation rejected":                                                            "Operación rechazada",
+		"Operations must be approved by another token than the one that requested them": "Las operaciones las tiene que aprobar un token distinto del que las pidió",
+		"Packet capture requires tcpdump":                                               "La captura de paquetes requiere tcpdump",
+		"Path is not a regular file":                                                    "La ruta no es un archivo regular",
+		"Path not being watched":                                                        "La ruta no está siendo vigilada",
+		"Payload must be a JSON object, positional arguments are not supported":         "La carga debe ser un objeto JSON, no se admiten argumentos posicionales",
+		"Permission denied: %s requires the %s permission":                              "Permiso denegado: %s requiere el permiso %s",
+		"Places retrieved":                                                              "Ubicaciones obtenidas",
+		"Port %d/%s mapped to %s:%d":                                                    "Puerto %d/%s redirigido a %s:%d",
+		"Port mapping %d/%s removed":                                                    "Redirección de puerto %d/%s eliminada",
+		"Port mappings retrieved":                                                       "Redirecciones de puertos obtenidas",
+		"Port scans require the scan permission":                                        "Los escaneos de puertos requieren el permiso scan",
+		"Profile %s not found":                                                          "Perfil %s no encontrado",
+		"Profiles retrieved":                                                            "Perfiles obtenidos",
+		"Provisioning cancelled":                                                        "Aprovisionamiento cancelado",
+		"Provisioning completed":                                                        "Aprovisionamiento completado",
+		"Provisioning failed at step %d":                                                "El aprovisionamiento falló en el paso %d",
+		"Ran: %s":                                                                       "Ejecutado: %s",
+		"Reading env files requires the env.reveal permission":                          "Leer archivos env requiere el permiso env.reveal",
+		"Recording changes is disabled":                                                 "El registro de cambios está desactivado",
+		"Records retrieved":                                                             "Registros obtenidos",
+		"Registering agents requires the fleet.register permission":                     "Registrar agentes requiere el permiso fleet.register",
+		"Registration is disabled, set FLEET_CONTROLLER to enable it":                   "El registro está desactivado, establece FLEET_CONTROLLER para activarlo",
+		"Rejecting operations requires the approve permission":                          "Rechazar operaciones requiere el permiso approve",
+		"Replaced %d matches in %d files":                                               "Se reemplazaron %d coincidencias en %d archivos",
+		"Replication completed successfully":                                            "Replicación completada correctamente",
+		"Request body exceeds the %d byte limit":                                        "El cuerpo de la petición supera el límite de %d bytes",
+		"Resolver configuration retrieved":                                              "Configuración del resolvedor obtenida",
+		"Resolver configuration updated":                                                "Configuración del resolvedor actualizada",
+		"Revealing the environment requires the env.reveal permission":                  "Revelar el entorno requiere el permiso env.reveal",
+		"Revealing values requires the env.reveal permission":                           "Mostrar los valores requiere el permiso env.reveal",
+		"Running commands on the fleet requires the fleet permission":                   "Ejecutar comandos en la flota requiere el permiso fleet",
+		"Running template %s requires one of the permissions %s":                        "Ejecutar la plantilla %s requiere uno de los permisos %s",
+		"Scan completed":                                                                "Escaneo completado",
+		"Searching the records requires the audit permission":                           "Buscar en los registros requiere el permiso audit",
+		"Sending notifications requires the notify permission":                          "Enviar notificaciones requiere el permiso notify",
+		"Services require systemctl":                                                    "Los servicios requieren systemctl",
+		"Session can't be resumed, it expired or was resumed already":                   "No se puede reanudar la sesión, caducó o ya se reanudó",
+		"Session is attached to another connection":                                     "La sesión está conectada a otra conexión",
+		"Session is not active":                                                         "La sesión no está activa",
+		"Session not found":                                                             "Sesión no encontrada",
+		"Session statistics are disabled":                                               "Las estadísticas de sesiones están desactivadas",
+		"Sessions retrieved":                                                            "Sesiones obtenidas",
+		"Shell session limit reached":                                                   "Límite de sesiones de shell alcanzado",
+		"Size mismatch: expected %d bytes, received %d":                                 "Tamaño incorrecto: se esperaban %d bytes, se recibieron %d",
+		"Skipped after a previous failure":                                              "Omitido tras un fallo anterior",
+		"Skipped after the run was cancelled":                                           "Omitido tras cancelarse la ejecución",
+		"Skipped, %s exists":                                                            "Omitido, %s existe",
+		"Skipped, unless command succeeded":                                             "Omitido, el comando unless tuvo éxito",
+		"Socket.IO server error, restarting: %v":                                        "Error del servidor Socket.IO, reiniciando: %v",
+		"Socket.IO server is restarting":                                                "El servidor Socket.IO se está reiniciando",
+		"Spawning %s requires approval, run it through POST /api/shell/exec":            "Iniciar %s requiere aprobación, ejecútalo con POST /api/shell/exec",
+		"Speed test completed":                                                          "Prueba de velocidad completada",
+		"Speed test failed: %v":                                                         "La prueba de velocidad falló: %v",
+		"Started watching directory":                                                    "Vigilando el directorio",
+		"Stopped watching directory":                                                    "Se dejó de vigilar el directorio",
+		"Task already finished":                                                         "La tarea ya terminó",
+		"Task cancellation requested":                                                   "Cancelación de la tarea solicitada",
+		"Task not found":                                                                "Tarea no encontrada",
+		"Task retrieved":                                                                "Tarea obtenida",
+		"Tasks retrieved":                                                               "Tareas obtenidas",
+		"Template %s deleted":                                                           "Plantilla %s eliminada",
+		"Template %s not found":                                                         "Plantilla %s no encontrada",
+		"Template %s saved":                                                             "Plantilla %s guardada",
+		"Template rendered (dry run)":                                                   "Plantilla renderizada (simulación)",
+		"Template rendered successfully":                                                "Plantilla renderizada correctamente",
+		"Templates retrieved":                                                           "Plantillas obtenidas",
+		"Temporary space created":                                                       "Espacio temporal creado",
+		"Temporary space deleted":                                                       "Espacio temporal eliminado",
+		"Temporary space extended":                                                      "Espacio temporal extendido",
+		"Temporary spaces retrieved":                                                    "Espacios temporales obtenidos",
+		"Test notification sent":                                                        "Notificación de prueba enviada",
+		"The agent is read-only":                                                        "El agente es de solo lectura",
+		"The agent is read-only, captures can only be written to a temporary file":      "El agente es de solo lectura, las capturas solo se pueden escribir en un archivo temporal",
+		"The approval is %s already":                                                    "La aprobación ya está %s",
+		"The download cache is disabled, set DOWNLOAD_CACHE_DIR to enable it":           "La caché de descargas está deshabilitada, define DOWNLOAD_CACHE_DIR para habilitarla",
+		"The original request with this Idempotency-Key did not complete, retry it":     "La petición original con esta Idempotency-Key no terminó, reinténtala",
+		"The record store is disabled, set STORE_PATH to enable it":                     "El almacén de registros está desactivado, defina STORE_PATH para activarlo",
+		"The terminal is echoing input, the password would be displayed":                "El terminal muestra la entrada, la contraseña se mostraría",
+		"Too many connections: %v":                                                      "Demasiadas conexiones: %v",
+		"Transfer not found":                                                            "Transferencia no encontrada",
+		"Unauthorized":                                                                  "No autorizado",
+		"Unmounted %s":                                                                  "%s desmontado",
+		"Up to date":                                                                    "Sin cambios",
+		"Upload received":                                                               "Subida recibida",
+		"Waiting for approval by another token":                                         "Esperando la aprobación de otro token",
+		"Watcher error: %v":                                                             "Error del observador: %v",
+		"Watches retrieved":                                                             "Vigilancias obtenidas",
+		"Would execute":                                                                 "Se ejecutaría",
+		"Would install":                                                                 "Se instalaría",
+		"Would run: %s":                                                                 "Se ejecutaría: %s",
+		"Would write":                                                                   "Se escribiría",
+		"Written":                                                                       "Escrito",
+		"inotify limits nearly reached":                                                 "Límites de inotify casi alcanzados",
+		"inotify limits reached, polling the directory instead: %v":                     "Se alcanzaron los límites de inotify, se sondeará el directorio en su lugar: %v",
+		"path is a directory":                                                           "la ruta es un directorio",
+		"path is required":                                                              "path es obligatorio",
+		"path parameter is required":                                                    "el parámetro path es obligatorio",
+		"target is required unless dry_run is set":                                      "target es obligatorio salvo que se indique dry_run",
+		"tmux is not installed":                                                         "tmux no está instalado",
+		"tmux session %s created":                                                       "Sesión de tmux %s creada",
+		"tmux session %s not found":                                                     "Sesión de tmux %s no encontrada",
+		"tmux sessions retrieved":                                                       "Sesiones de tmux obtenidas",
+	},
+}
+
+// Localize formats a message in the language requested by the lang query
+// parameter or the Accept-Language header of the request
+func Localize(c *gin.Context, format string, args ...interface{}) string {
+	lang := c.Query("lang")
+	if lang == "" {
+		lang = c.GetHeader("Accept-Language")
+	}
+	return localize(negotiateLanguage(lang), format, args...)
+}
+
+// Helper functions
+
+// localizeConn formats a message in the language negotiated when the
+// Socket.IO connection was established
+func localizeConn(conn socketio.Conn, format string, args ...interface{}) string {
+	url := conn.URL()
+	lang := url.Query().Get("lang")
+	if lang == "" {
+		lang = conn.RemoteHeader().Get("Accept-Language")
+	}
+	return localize(negotiateLanguage(lang), format, args...)
+}
+
+func localize(lang, format string, args ...interface{}) string {
+	if translated, ok := messageCatalogs[lang][format]; ok {
+		format = translated
+	}
+
+	for i, arg := range args {
+		// Quota errors carry their own message format
+		if quotaErr, ok := arg.(*QuotaError); ok {
+			args[i] = localize(lang, quotaErr.format, quotaErr.args...)
+		}
+	}
+
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// negotiateLanguage picks the supported language with the highest weight
+// from an Accept-Language value, such as "es-AR,es;q=0.9,en;q=0.8"
+func negotiateLanguage(acceptLanguage string) string {
+	type candidate struct {
+		lang   string
+		weight float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = parsed
+			}
+		}
+
+		if _, supported := messageCatalogs[lang]; (supported || lang == defaultLanguage) && weight > 0 {
+			candidates = append(candidates, candidate{lang, weight})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return defaultLanguage
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight > candidates[j].weight
+	})
+	return candidates[0].lang
+}
@@ -0,0 +1,172 @@
+package modules
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyMaxBody is the largest response body kept for replays
+const idempotencyMaxBody = 1 << 20
+
+// idempotencyStore remembers the responses of mutating requests sent with
+// an Idempotency-Key header so retries get the same result
+type idempotencyStore struct {
+	ttl     time.Duration
+	entries map[string]*idempotentResult
+	mutex   sync.Mutex
+}
+
+type idempotentResult struct {
+	target      string // method and URL the key was first used with
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+	done        chan struct{}
+}
+
+// captureWriter copies the response body so it can be replayed
+type captureWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+// IdempotencyMiddleware replays the stored response when a POST, PUT,
+// PATCH or DELETE request repeats an Idempotency-Key seen within ttl,
+// instead of executing it again
+func IdempotencyMiddleware(ttl time.Duration) gin.HandlerFunc {
+	store := &idempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*idempotentResult),
+	}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		// Keys are scoped per token so clients cannot see each other's results
+		scopedKey := quotaKey(RequestToken(c)) + "\x00" + key
+		target := c.Request.Method + " " + c.Request.URL.String()
+
+		result, owner := store.claim(scopedKey, target)
+		if !owner {
+			<-result.done
+			store.replay(c, result, target)
+			return
+		}
+
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				store.forget(scopedKey, result)
+				panic(recovered)
+			}
+		}()
+
+		writer := &captureWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		store.complete(scopedKey, result, writer)
+	}
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(data) > idempotencyMaxBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(data)
+		}
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Helper functions
+
+// claim returns the result stored for key, or registers a new pending one
+// and reports that the caller must execute the request
+func (s *idempotencyStore) claim(key, target string) (*idempotentResult, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for k, entry := range s.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	if result, exists := s.entries[key]; exists {
+		return result, false
+	}
+
+	result := &idempotentResult{target: target, done: make(chan struct{})}
+	s.entries[key] = result
+	return result, true
+}
+
+// complete stores the response of a finished request. Server errors and
+// responses too large to keep are forgotten so the request can be retried.
+func (s *idempotencyStore) complete(key string, result *idempotentResult, writer *captureWriter) {
+	if writer.Status() >= http.StatusInternalServerError || writer.overflow {
+		s.forget(key, result)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result.status = writer.Status()
+	result.contentType = writer.Header().Get("Content-Type")
+	result.body = writer.body.Bytes()
+	result.expires = time.Now().Add(s.ttl)
+	close(result.done)
+}
+
+// forget drops a pending result, releasing requests waiting on it
+func (s *idempotencyStore) forget(key string, result *idempotentResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.entries[key] == result {
+		delete(s.entries, key)
+	}
+	close(result.done)
+}
+
+func (s *idempotencyStore) replay(c *gin.Context, result *idempotentResult, target string) {
+	if result.target != target {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"success": false,
+			"code":    ErrInvalidRequest,
+			"message": Localize(c, "Idempotency-Key was already used for a different request"),
+		})
+		return
+	}
+
+	if result.status == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"success": false,
+			"code":    ErrConflict,
+			"message": Localize(c, "The original request with this Idempotency-Key did not complete, retry it"),
+		})
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(result.status, result.contentType, result.body)
+	c.Abort()
+}
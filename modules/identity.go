@@ -0,0 +1,188 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AgentIdentity names the agent in handshakes, status endpoints and the
+// inventory of its fleet controller
+type AgentIdentity struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Tags   []string          `json:"tags,omitempty"`
+}
+
+// AgentRegistration is the body of the registration pings sent to the fleet
+// controller
+type AgentRegistration struct {
+	AgentIdentity
+	URL       string    `json:"url,omitempty"` // the controller can reach the agent at
+	Version   string    `json:"version"`
+	Protocol  int       `json:"protocol"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Interval  int       `json:"interval"` // seconds to the next ping
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Registration pings the fleet controller of FLEET_CONTROLLER with the
+// identity and version of the agent every FLEET_REGISTER_INTERVAL, so the
+// controller keeps an inventory of its agents
+type Registration struct {
+	config   *Config
+	identity *AgentIdentity
+	client   *http.Client
+	started  time.Time
+}
+
+// LoadIdentity builds the identity of the agent from the config. Without
+// AGENT_ID, the ID is read from AGENT_ID_FILE, which is created on the first
+// start so the agent keeps its ID across restarts.
+func LoadIdentity(config *Config) (*AgentIdentity, error) {
+	identity := &AgentIdentity{
+		ID:     config.AgentID,
+		Name:   config.AgentName,
+		Labels: make(map[string]string),
+	}
+
+	if identity.ID == "" {
+		id, err := loadAgentID(config.AgentIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("agent ID: %w", err)
+		}
+		identity.ID = id
+	}
+	if identity.Name == "" {
+		identity.Name, _ = os.Hostname()
+	}
+
+	for _, label := range strings.Split(config.AgentLabels, ",") {
+		if label = strings.TrimSpace(label); label == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid label %q in AGENT_LABELS, expected key=value", label)
+		}
+		identity.Labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	for _, tag := range strings.Split(config.AgentTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			identity.Tags = append(identity.Tags, tag)
+		}
+	}
+	return identity, nil
+}
+
+func NewRegistration(config *Config, identity *AgentIdentity) *Registration {
+	return &Registration{
+		config:   config,
+		identity: identity,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+		started: time.Now(),
+	}
+}
+
+// Start pings the controller now and then every FLEET_REGISTER_INTERVAL,
+// unless FLEET_CONTROLLER is unset. Failures are logged when the controller
+// stops and starts answering, not at every ping.
+func (r *Registration) Start() {
+	if r.config.FleetController == "" {
+		return
+	}
+	interval := max(r.config.FleetRegisterInterval, time.Second)
+
+	go func() {
+		failing := false
+		for {
+			err := r.ping(interval)
+			if err != nil && !failing {
+				log.Printf("Failed to register with the fleet controller: %v", err)
+			} else if err == nil && failing {
+				log.Printf("Registered with the fleet controller again")
+			}
+			failing = err != nil
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Helper functions
+
+// ping sends a registration to the controller
+func (r *Registration) ping(interval time.Duration) error {
+	body, err := json.Marshal(AgentRegistration{
+		AgentIdentity: *r.identity,
+		URL:           r.config.FleetAdvertiseURL,
+		Version:       Version,
+		Protocol:      ProtocolVersion,
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Interval:      int(interval.Seconds()),
+		StartedAt:     r.started,
+	})
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimRight(r.config.FleetController, "/") + "/api/fleet/register"
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if r.config.FleetControllerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+r.config.FleetControllerToken)
+	}
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: controller responded with %s", errUpstream, resp.Status)
+	}
+	return nil
+}
+
+// loadAgentID reads the ID of the agent from path, saving a new one there
+// the first time
+func loadAgentID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := uuid.New().String()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,455 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SearchIndex is a trigram index of the text files below INDEX_PATHS, built
+// in the background, which narrows searches down to the files holding the
+// literals of their pattern. Files found are still read to match them, so
+// a stale index can miss files changed since it was built but never returns
+// wrong matches.
+type SearchIndex struct {
+	config  *Config
+	roots   []string
+	rebuild chan struct{}
+
+	mutex    sync.RWMutex
+	snapshot *indexSnapshot // nil until the first build
+	building bool
+	err      error // of the last build
+}
+
+// indexSnapshot is one build of the index, replaced as a whole by the next
+type indexSnapshot struct {
+	files    []indexedFile     // in walk order
+	postings map[uint32][]byte // IDs of the files with each trigram, delta varint encoded
+	bytes    int64             // of the postings
+	built    time.Time
+	duration time.Duration
+}
+
+// indexedFile is a regular file below the roots, binary and unreadable ones
+// included so changes to them are noticed too
+type indexedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	indexed bool // its trigrams are indexed
+	skipped bool // binary or unreadable, left out of searches
+}
+
+// IndexStatus describes the state of the search index
+type IndexStatus struct {
+	State    string     `json:"state"` // disabled, building, ready or failed
+	Paths    []string   `json:"paths"`
+	Files    int        `json:"files"`    // regular files found, binary ones included
+	Indexed  int        `json:"indexed"`  // files with their trigrams indexed
+	Trigrams int        `json:"trigrams"` // distinct
+	Bytes    int64      `json:"bytes"`    // of the postings
+	Built    *time.Time `json:"built,omitempty"`
+	Duration string     `json:"duration,omitempty"` // of the last build
+	Building bool       `json:"building"`           // a rebuild is running, the last build serving searches meanwhile
+	Error    string     `json:"error,omitempty"`    // of the last build
+}
+
+// NewSearchIndex returns the index of INDEX_PATHS, disabled when unset.
+// Paths that can't be resolved are logged and left out.
+func NewSearchIndex(config *Config, paths *Paths) *SearchIndex {
+	si := &SearchIndex{config: config, rebuild: make(chan struct{}, 1)}
+	for _, root := range strings.Split(config.IndexPaths, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if err := paths.Resolve(&root); err != nil {
+			log.Printf("Not indexing %s: %v", root, err)
+			continue
+		}
+		si.roots = append(si.roots, root)
+	}
+	// Roots below others would be indexed twice
+	si.roots = slices.DeleteFunc(si.roots, func(root string) bool {
+		return slices.ContainsFunc(si.roots, func(other string) bool {
+			return other != root && pathWithin(root, other)
+		})
+	})
+	return si
+}
+
+// Start builds the index in the background, then refreshes it every
+// INDEX_INTERVAL when files changed, and on rebuild requests
+func (si *SearchIndex) Start() {
+	if len(si.roots) == 0 {
+		return
+	}
+	go func() {
+		var tick <-chan time.Time
+		if si.config.IndexInterval > 0 {
+			ticker := time.NewTicker(si.config.IndexInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		si.build()
+		for {
+			select {
+			case <-si.rebuild:
+				si.build()
+			case <-tick:
+				if si.stale() {
+					si.build()
+				}
+			}
+		}
+	}()
+}
+
+// REST API Handlers
+
+// IndexStatus reports the state of the search index
+func (fsm *FileSystemModule) IndexStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Index status retrieved"),
+		Data:    fsm.index.status(),
+	})
+}
+
+// RebuildIndex starts a rebuild of the search index, queued after the
+// build running if any. The last build keeps serving searches meanwhile.
+func (fsm *FileSystemModule) RebuildIndex(c *gin.Context) {
+	if len(fsm.index.roots) == 0 {
+		c.JSON(http.StatusNotFound, FileOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Content indexing is disabled"),
+		})
+		return
+	}
+
+	select {
+	case fsm.index.rebuild <- struct{}{}:
+	default:
+		// A rebuild is already queued
+	}
+	c.JSON(http.StatusAccepted, FileOperation{
+		Success: true,
+		Message: Localize(c, "Index rebuild started"),
+		Data:    fsm.index.status(),
+	})
+}
+
+// Helper functions
+
+func (si *SearchIndex) status() IndexStatus {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	status := IndexStatus{State: "disabled", Paths: []string{}, Building: si.building}
+	if len(si.roots) == 0 {
+		return status
+	}
+	status.Paths = si.roots
+	switch {
+	case si.snapshot != nil:
+		status.State = "ready"
+	case si.err != nil:
+		status.State = "failed"
+	default:
+		status.State = "building"
+	}
+	if si.err != nil {
+		status.Error = si.err.Error()
+	}
+	if snapshot := si.snapshot; snapshot != nil {
+		status.Files = len(snapshot.files)
+		for _, file := range snapshot.files {
+			if file.indexed {
+				status.Indexed++
+			}
+		}
+		status.Trigrams = len(snapshot.postings)
+		status.Bytes = snapshot.bytes
+		status.Built = &snapshot.built
+		status.Duration = snapshot.duration.String()
+	}
+	return status
+}
+
+// build indexes the roots, replacing the snapshot once done. A failed build
+// drops the snapshot, so searches walk the tree rather than miss files.
+func (si *SearchIndex) build() {
+	si.mutex.Lock()
+	si.building = true
+	si.mutex.Unlock()
+
+	started := time.Now()
+	snapshot, err := si.index()
+
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	si.building = false
+	si.err = err
+	if err != nil {
+		log.Printf("Failed to build the search index: %v", err)
+		si.snapshot = nil
+		return
+	}
+	snapshot.built = time.Now()
+	snapshot.duration = time.Since(started)
+	si.snapshot = snapshot
+	log.Printf("Indexed %d files in %s", len(snapshot.files), snapshot.duration.Round(time.Millisecond))
+}
+
+func (si *SearchIndex) index() (*indexSnapshot, error) {
+	postings := make(map[uint32][]uint32)
+	trigrams := make(map[uint32]struct{})
+	snapshot := &indexSnapshot{}
+	err := si.walk(func(name string, info fs.FileInfo) error {
+		file := indexedFile{path: name, size: info.Size(), modTime: info.ModTime()}
+		if info.Size() <= si.config.IndexMaxFileSize {
+			text, ok := "", false
+			if content, err := os.ReadFile(name); err == nil {
+				text, ok = indexText(content)
+			}
+			if ok {
+				clear(trigrams)
+				addTrigrams(trigrams, text)
+				id := uint32(len(snapshot.files))
+				for trigram := range trigrams {
+					postings[trigram] = append(postings[trigram], id)
+				}
+			}
+			file.indexed, file.skipped = ok, !ok
+		}
+		snapshot.files = append(snapshot.files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.postings = make(map[uint32][]byte, len(postings))
+	for trigram, ids := range postings {
+		encoded := encodePostings(ids)
+		snapshot.postings[trigram] = encoded
+		snapshot.bytes += int64(len(encoded))
+	}
+	return snapshot, nil
+}
+
+// stale reports whether files were added, removed or changed below the
+// roots since the last build, by their size and modification time
+func (si *SearchIndex) stale() bool {
+	si.mutex.RLock()
+	snapshot := si.snapshot
+	si.mutex.RUnlock()
+	if snapshot == nil {
+		return true
+	}
+
+	i := 0
+	err := si.walk(func(name string, info fs.FileInfo) error {
+		if i >= len(snapshot.files) {
+			return errIndexStale
+		}
+		file := snapshot.files[i]
+		if file.path != name || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+			return errIndexStale
+		}
+		i++
+		return nil
+	})
+	return err != nil || i != len(snapshot.files)
+}
+
+// errIndexStale stops the walk of stale once a change is found
+var errIndexStale = errors.New("index is stale")
+
+// walk calls fn with the regular files below the roots, in a stable order.
+// Network filesystems are left out, and walks past INDEX_MAX_FILES fail.
+func (si *SearchIndex) walk(fn func(name string, info fs.FileInfo) error) error {
+	files := 0
+	for _, root := range si.roots {
+		boundary := newWalkBoundary(root, WalkOptions{SkipNetwork: true})
+		err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if name == root {
+					return err
+				}
+				if d != nil && d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				if name != root && boundary.excludes(name, d) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			files++
+			if max := si.config.IndexMaxFiles; max > 0 && files > max {
+				return fmt.Errorf("%w: more than INDEX_MAX_FILES, %d files at %s", errWalkLimit, max, name)
+			}
+			return fn(name, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// covers returns the snapshot of the index when it's ready and path is
+// below one of its roots
+func (si *SearchIndex) covers(path string) *indexSnapshot {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+	if si.snapshot == nil {
+		return nil
+	}
+	for _, root := range si.roots {
+		if pathWithin(path, root) {
+			return si.snapshot
+		}
+	}
+	return nil
+}
+
+// candidates returns the files below path that may hold every literal,
+// in walk order. Files not indexed are always candidates.
+func (s *indexSnapshot) candidates(path string, literals []indexLiteral) []indexedFile {
+	var ids []uint32
+	narrowed := false
+	for _, literal := range literals {
+		for _, trigram := range literal.trigrams() {
+			list := decodePostings(s.postings[trigram])
+			if narrowed {
+				list = intersectPostings(ids, list)
+			}
+			ids, narrowed = list, true
+			if len(ids) == 0 {
+				break
+			}
+		}
+	}
+
+	var files []indexedFile
+	next := 0
+	for id, file := range s.files {
+		if file.skipped {
+			continue
+		}
+		if narrowed && file.indexed {
+			for next < len(ids) && int(ids[next]) < id {
+				next++
+			}
+			if next >= len(ids) || int(ids[next]) != id {
+				continue
+			}
+		}
+		if pathWithin(file.path, path) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// indexText decodes the content of a file as text without its byte order
+// mark, reporting false for binary files
+func indexText(content []byte) (string, bool) {
+	encoding := detectEncoding(content)
+	if !strings.HasPrefix(encoding, "utf-16") && bytes.IndexByte(content[:min(len(content), 8000)], 0) >= 0 {
+		return "", false
+	}
+	text, err := decodeText(content, encoding)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimPrefix(text, byteOrderMark), true
+}
+
+// addTrigrams adds the trigrams of text, with ASCII letters lowercased, to
+// a set
+func addTrigrams(set map[uint32]struct{}, text string) {
+	for i := 0; i+3 <= len(text); i++ {
+		set[trigramOf(text[i:i+3])] = struct{}{}
+	}
+}
+
+func trigramOf(s string) uint32 {
+	return uint32(lowerASCII(s[0]))<<16 | uint32(lowerASCII(s[1]))<<8 | uint32(lowerASCII(s[2]))
+}
+
+func lowerASCII(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// encodePostings encodes ascending file IDs as varint deltas
+func encodePostings(ids []uint32) []byte {
+	encoded := make([]byte, 0, len(ids))
+	previous := uint32(0)
+	for _, id := range ids {
+		encoded = binary.AppendUvarint(encoded, uint64(id-previous))
+		previous = id
+	}
+	return encoded
+}
+
+func decodePostings(encoded []byte) []uint32 {
+	var ids []uint32
+	id := uint32(0)
+	for len(encoded) > 0 {
+		delta, n := binary.Uvarint(encoded)
+		if n <= 0 {
+			break
+		}
+		id += uint32(delta)
+		ids = append(ids, id)
+		encoded = encoded[n:]
+	}
+	return ids
+}
+
+func intersectPostings(a, b []uint32) []uint32 {
+	var ids []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	return ids
+}
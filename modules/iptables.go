@@ -0,0 +1,173 @@
+package modules
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// iptablesBackend applies rules with iptables and ip6tables, in ccw-input,
+// ccw-forward and ccw-output chains jumped to first from the built-in ones
+type iptablesBackend struct{}
+
+func (b *iptablesBackend) name() string {
+	return "iptables"
+}
+
+// rules lists the rules of the agent's chains. Rules applying to both IP
+// versions are listed once.
+func (b *iptablesBackend) rules() ([]FirewallRule, error) {
+	var rules []FirewallRule
+	seen := make(map[string]bool)
+	for _, tool := range iptablesTools() {
+		output, err := exec.Command(tool+"-save", "-t", "filter").Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s-save: %v", tool, err)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			rule, ok := parseIptablesRule(line)
+			if ok && !seen[rule.ID] {
+				seen[rule.ID] = true
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (b *iptablesBackend) render(rules []FirewallRule) []string {
+	var lines []string
+	for _, tool := range iptablesTools() {
+		for _, rule := range rules {
+			if appliesTo(rule, tool) {
+				lines = append(lines, tool+" "+strings.Join(iptablesRuleArgs(rule), " "))
+			}
+		}
+	}
+	return lines
+}
+
+// apply replaces the rules of the agent's chains with iptables-restore, which
+// commits each table at once, then makes sure the built-in chains jump to them
+func (b *iptablesBackend) apply(rules []FirewallRule) error {
+	for _, tool := range iptablesTools() {
+		var script strings.Builder
+		script.WriteString("*filter\n")
+		// Declaring a chain flushes it, even with --noflush
+		for _, chain := range firewallChains {
+			fmt.Fprintf(&script, ":ccw-%s - [0:0]\n", chain)
+		}
+		for _, rule := range rules {
+			if appliesTo(rule, tool) {
+				script.WriteString(strings.Join(iptablesRuleArgs(rule), " ") + "\n")
+			}
+		}
+		script.WriteString("COMMIT\n")
+
+		cmd := exec.Command(tool+"-restore", "--noflush")
+		cmd.Stdin = strings.NewReader(script.String())
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s-restore: %v: %s", tool, err, strings.TrimSpace(string(output)))
+		}
+
+		for _, chain := range firewallChains {
+			builtin, target := strings.ToUpper(chain), "ccw-"+chain
+			if exec.Command(tool, "-C", builtin, "-j", target).Run() == nil {
+				continue
+			}
+			if err := runCommand(tool, "-I", builtin, "1", "-j", target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Helper functions
+
+// iptablesTools returns iptables, and ip6tables when installed
+func iptablesTools() []string {
+	tools := []string{"iptables"}
+	if _, err := exec.LookPath("ip6tables-restore"); err == nil {
+		tools = append(tools, "ip6tables")
+	}
+	return tools
+}
+
+// appliesTo reports whether rule belongs in the tables of tool
+func appliesTo(rule FirewallRule, tool string) bool {
+	switch rule.family() {
+	case 4:
+		return tool == "iptables"
+	case 6:
+		return tool == "ip6tables"
+	}
+	return true
+}
+
+// iptablesRuleArgs writes a rule as iptables arguments, tagged with its ID
+func iptablesRuleArgs(rule FirewallRule) []string {
+	args := []string{"-A", "ccw-" + rule.Chain}
+	if rule.Interface != "" {
+		flag := "-i"
+		if rule.Chain == "output" {
+			flag = "-o"
+		}
+		args = append(args, flag, rule.Interface)
+	}
+	if rule.Source != "" {
+		args = append(args, "-s", rule.Source)
+	}
+	if rule.Destination != "" {
+		args = append(args, "-d", rule.Destination)
+	}
+	switch rule.Protocol {
+	case "":
+	case "icmpv6":
+		args = append(args, "-p", "ipv6-icmp")
+	default:
+		args = append(args, "-p", rule.Protocol)
+	}
+	if rule.Port != "" {
+		args = append(args, "-m", rule.Protocol, "--dport", strings.Replace(rule.Port, "-", ":", 1))
+	}
+	args = append(args, "-m", "comment", "--comment", "ccw:"+rule.ID, "-j", strings.ToUpper(rule.Action))
+	return args
+}
+
+// parseIptablesRule reads a line of iptables-save written by
+// iptablesRuleArgs back into a rule
+func parseIptablesRule(line string) (FirewallRule, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "-A" || !strings.HasPrefix(fields[1], "ccw-") {
+		return FirewallRule{}, false
+	}
+
+	rule := FirewallRule{Chain: strings.TrimPrefix(fields[1], "ccw-")}
+	for i := 2; i+1 < len(fields); i++ {
+		value := strings.Trim(fields[i+1], `"`)
+		switch fields[i] {
+		case "-i", "-o":
+			rule.Interface = value
+		case "-s":
+			rule.Source, _ = normalizeAddress(value)
+		case "-d":
+			rule.Destination, _ = normalizeAddress(value)
+		case "-p":
+			rule.Protocol = value
+			if value == "ipv6-icmp" || value == "icmpv6" {
+				rule.Protocol = "icmpv6"
+			}
+		case "--dport":
+			rule.Port = strings.Replace(value, ":", "-", 1)
+		case "--comment":
+			rule.ID = strings.TrimPrefix(value, "ccw:")
+		case "-j":
+			rule.Action = strings.ToLower(value)
+		default:
+			continue
+		}
+		i++
+	}
+	return rule, rule.ID != ""
+}
@@ -0,0 +1,349 @@
+package modules
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// watchJournals records fs:change events per watched path so clients
+// can replay what they missed while disconnected
+type watchJournals struct {
+	window    time.Duration
+	maxEvents int
+	config    *Config
+	journals  map[string]*watchJournal
+	mutex     sync.Mutex
+}
+
+type watchJournal struct {
+	path    string
+	watcher *watchStream
+	events  []WatchEvent
+	seq     uint64 // sequence number of the last recorded event, counted from 1
+	started time.Time
+	pruned  time.Time // timestamp of the newest discarded event
+	clients int
+	expiry  *time.Timer
+	mutex   sync.Mutex
+}
+
+// WatchChanges is a page of the recorded changes of a path
+type WatchChanges struct {
+	Path     string       `json:"path"`
+	Events   []WatchEvent `json:"events"`
+	Count    int          `json:"count"`
+	Cursor   string       `json:"cursor"`   // to pass as since to get the next changes
+	Complete bool         `json:"complete"` // no change was discarded since the previous cursor
+	More     bool         `json:"more"`     // more changes are recorded after this page
+}
+
+func newWatchJournals(config *Config) *watchJournals {
+	return &watchJournals{
+		window:    config.WatchReplayWindow,
+		maxEvents: config.WatchReplayMaxEvents,
+		config:    config,
+		journals:  make(map[string]*watchJournal),
+	}
+}
+
+// REST API Handlers
+
+// Changes returns the changes of a path recorded after the since cursor,
+// for clients that poll instead of holding a socket. The first request
+// starts recording the path, and each request keeps it recorded for
+// WATCH_REPLAY_WINDOW seconds.
+func (fsm *FileSystemModule) Changes(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+	if fsm.journals.window <= 0 {
+		c.JSON(http.StatusNotFound, FileOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Recording changes is disabled"),
+		})
+		return
+	}
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, FileOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", fmt.Errorf("invalid limit: %q", value)),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	changes, err := fsm.journals.changes(path, walkOptionsQuery(c), c.Query("since"), limit)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to get changes: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Changes retrieved"),
+		Data:    changes,
+	})
+}
+
+// Socket.IO Handlers
+
+// ReplayWatchEvents sends the recorded events of a path newer than since
+func (fsm *FileSystemModule) ReplayWatchEvents(conn socketio.Conn, path, since string) {
+	if err := fsm.paths.Resolve(&path); err != nil {
+		fsm.emitter.Emit(conn, "fs:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+			"path":    path,
+		})
+		return
+	}
+	sinceTime, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		fsm.emitter.Emit(conn, "fs:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid since timestamp: %v", err),
+			"path":    path,
+		})
+		return
+	}
+
+	events, complete, ok := fsm.journals.replay(path, sinceTime)
+	if !ok {
+		fsm.emitter.Emit(conn, "fs:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "No events recorded for this path"),
+			"path":    path,
+		})
+		return
+	}
+
+	fsm.emitter.Emit(conn, "fs:replay", map[string]interface{}{
+		"path":     path,
+		"since":    sinceTime,
+		"events":   events,
+		"count":    len(events),
+		"complete": complete,
+	})
+}
+
+// Helper functions
+
+// acquire starts or reuses the recorder of a path, walking it with the
+// options of the first client
+func (wj *watchJournals) acquire(path string, options WalkOptions) error {
+	if wj.window <= 0 {
+		return nil
+	}
+
+	wj.mutex.Lock()
+	defer wj.mutex.Unlock()
+
+	if journal, exists := wj.journals[path]; exists {
+		journal.mutex.Lock()
+		journal.clients++
+		if journal.expiry != nil {
+			journal.expiry.Stop()
+			journal.expiry = nil
+		}
+		journal.mutex.Unlock()
+		return nil
+	}
+
+	watcher, err := newWatchStream(path, options, wj.config)
+	if err != nil {
+		return err
+	}
+
+	journal := &watchJournal{
+		path:    path,
+		watcher: watcher,
+		started: time.Now(),
+		clients: 1,
+	}
+	wj.journals[path] = journal
+
+	go wj.record(journal)
+	return nil
+}
+
+// release keeps the recorder alive for the replay window after the last
+// client stops watching, so reconnecting clients can catch up
+func (wj *watchJournals) release(path string) {
+	wj.mutex.Lock()
+	defer wj.mutex.Unlock()
+
+	journal, exists := wj.journals[path]
+	if !exists {
+		return
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.clients--
+	if journal.clients > 0 {
+		return
+	}
+
+	journal.expiry = time.AfterFunc(wj.window, func() {
+		wj.mutex.Lock()
+		defer wj.mutex.Unlock()
+
+		journal.mutex.Lock()
+		idle := journal.clients <= 0
+		journal.mutex.Unlock()
+
+		if idle && wj.journals[path] == journal {
+			journal.watcher.Close()
+			delete(wj.journals, path)
+		}
+	})
+}
+
+func (wj *watchJournals) record(journal *watchJournal) {
+	for {
+		select {
+		case event, ok := <-journal.watcher.Events:
+			if !ok {
+				return
+			}
+
+			journal.mutex.Lock()
+			journal.events = append(journal.events, event)
+			journal.seq++
+			journal.prune(wj.window, wj.maxEvents)
+			journal.mutex.Unlock()
+
+		case <-journal.watcher.Errors:
+		}
+	}
+}
+
+// replay returns the events after since, and whether the journal still
+// holds everything since then
+func (wj *watchJournals) replay(path string, since time.Time) ([]WatchEvent, bool, bool) {
+	wj.mutex.Lock()
+	journal, exists := wj.journals[path]
+	wj.mutex.Unlock()
+
+	if !exists {
+		return nil, false, false
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.prune(wj.window, wj.maxEvents)
+
+	events := []WatchEvent{}
+	for _, event := range journal.events {
+		if event.Timestamp.After(since) {
+			events = append(events, event)
+		}
+	}
+
+	complete := !since.Before(journal.started) && !since.Before(journal.pruned)
+	return events, complete, true
+}
+
+// changes returns the page of events recorded after a cursor, starting the
+// recorder of the path if needed and keeping it for the replay window. A
+// cursor of a previous recorder of the path starts over from the oldest
+// event, as incomplete.
+func (wj *watchJournals) changes(path string, options WalkOptions, cursor string, limit int) (*WatchChanges, error) {
+	if err := wj.acquire(path, options); err != nil {
+		return nil, err
+	}
+	wj.mutex.Lock()
+	journal := wj.journals[path]
+	wj.mutex.Unlock()
+	defer wj.release(path)
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.prune(wj.window, wj.maxEvents)
+	first := journal.seq - uint64(len(journal.events)) // sequence number before the oldest event
+	generation := strconv.FormatInt(journal.started.UnixNano(), 36)
+
+	after, complete := first, first == 0
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor", errInvalidRequest)
+		}
+		cursorGeneration, seq, found := strings.Cut(string(decoded), ":")
+		parsed, err := strconv.ParseUint(seq, 10, 64)
+		if !found || err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor", errInvalidRequest)
+		}
+		complete = false
+		if cursorGeneration == generation {
+			if parsed > journal.seq {
+				return nil, fmt.Errorf("%w: invalid cursor", errInvalidRequest)
+			}
+			after, complete = max(parsed, first), parsed >= first
+		}
+	}
+
+	events := journal.events[after-first:]
+	more := limit > 0 && len(events) > limit
+	if more {
+		events = events[:limit]
+	}
+	next := after + uint64(len(events))
+
+	return &WatchChanges{
+		Path:     path,
+		Events:   append([]WatchEvent{}, events...),
+		Count:    len(events),
+		Cursor:   base64.RawURLEncoding.EncodeToString([]byte(generation + ":" + strconv.FormatUint(next, 10))),
+		Complete: complete,
+		More:     more,
+	}, nil
+}
+
+func (j *watchJournal) prune(window time.Duration, maxEvents int) {
+	cutoff := time.Now().Add(-window)
+
+	start := 0
+	for start < len(j.events) && j.events[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	if len(j.events)-start > maxEvents {
+		start = len(j.events) - maxEvents
+	}
+
+	if start > 0 {
+		j.pruned = j.events[start-1].Timestamp
+		j.events = append([]WatchEvent(nil), j.events[start:]...)
+	}
+}
@@ -0,0 +1,166 @@
+package modules
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// ConnectionLimits caps the Socket.IO connections and the REST requests in
+// flight, per token and overall, so one leaky client can't exhaust the file
+// descriptors of the agent
+type ConnectionLimits struct {
+	config   *Config
+	clients  map[string]string // token name, by connection ID
+	sockets  map[string]int    // open connections, by token name
+	requests map[string]int    // requests in flight, by token name
+	mutex    sync.Mutex
+}
+
+// LimitUsage is the use of a connection or request limit. It is reported
+// without authentication, so the tokens aren't named.
+type LimitUsage struct {
+	Active      int `json:"active"`
+	Max         int `json:"max"` // 0 for no limit
+	MaxPerToken int `json:"max_per_token"`
+}
+
+func NewConnectionLimits(config *Config) *ConnectionLimits {
+	return &ConnectionLimits{
+		config:   config,
+		clients:  make(map[string]string),
+		sockets:  make(map[string]int),
+		requests: make(map[string]int),
+	}
+}
+
+// Connect counts a new Socket.IO connection of a token, failing when the
+// token or the agent has no connection left
+func (cl *ConnectionLimits) Connect(conn socketio.Conn, token *Token) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if err := cl.check(cl.sockets, token, cl.config.MaxClients, cl.config.MaxClientsPerToken, "connections"); err != nil {
+		return err
+	}
+	cl.clients[conn.ID()] = token.Name
+	cl.sockets[token.Name]++
+	return nil
+}
+
+// Disconnect releases the connection of a client, if it was counted
+func (cl *ConnectionLimits) Disconnect(clientID string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	name, exists := cl.clients[clientID]
+	if !exists {
+		return
+	}
+	delete(cl.clients, clientID)
+	if cl.sockets[name]--; cl.sockets[name] == 0 {
+		delete(cl.sockets, name)
+	}
+}
+
+// Usage returns the open connections and requests in flight
+func (cl *ConnectionLimits) Usage() (LimitUsage, LimitUsage) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return limitUsage(cl.sockets, cl.config.MaxClients, cl.config.MaxClientsPerToken),
+		limitUsage(cl.requests, cl.config.MaxRequests, cl.config.MaxRequestsPerToken)
+}
+
+// RequestMiddleware counts the REST requests in flight of the token of each
+// request, rejecting the ones past the limits with ERR_CONNECTION_LIMIT. It
+// runs after authentication.
+func (cl *ConnectionLimits) RequestMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := RequestToken(c)
+		if token == nil {
+			c.Next()
+			return
+		}
+
+		cl.mutex.Lock()
+		err := cl.check(cl.requests, token, cl.config.MaxRequests, cl.config.MaxRequestsPerToken, "requests in flight")
+		if err == nil {
+			cl.requests[token.Name]++
+		}
+		cl.mutex.Unlock()
+		if err != nil {
+			abortLimited(c, err)
+			return
+		}
+
+		defer func() {
+			cl.mutex.Lock()
+			if cl.requests[token.Name]--; cl.requests[token.Name] == 0 {
+				delete(cl.requests, token.Name)
+			}
+			cl.mutex.Unlock()
+		}()
+		c.Next()
+	}
+}
+
+// HandshakeMiddleware rejects Socket.IO handshakes of tokens without a
+// connection left with ERR_CONNECTION_LIMIT, so clients get a structured
+// error instead of a connection closed right after it opens. Requests of
+// established sessions, which carry a sid, are let through.
+func (cl *ConnectionLimits) HandshakeMiddleware(tokens *Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := tokens.Lookup(c.Query("auth"))
+		if c.Query("sid") != "" || token == nil {
+			c.Next()
+			return
+		}
+
+		cl.mutex.Lock()
+		err := cl.check(cl.sockets, token, cl.config.MaxClients, cl.config.MaxClientsPerToken, "connections")
+		cl.mutex.Unlock()
+		if err != nil {
+			abortLimited(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Helper functions
+
+// check fails when a token has reached its limit in counts, or every token
+// together the global one. The caller holds the mutex.
+func (cl *ConnectionLimits) check(counts map[string]int, token *Token, limit, perToken int, what string) error {
+	if perToken > 0 && counts[token.Name] >= perToken {
+		return fmt.Errorf("%w: at most %d %s per token", errConnectionLimit, perToken, what)
+	}
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if limit > 0 && total >= limit {
+		return fmt.Errorf("%w: at most %d %s", errConnectionLimit, limit, what)
+	}
+	return nil
+}
+
+// abortLimited responds to a request refused by a limit
+func abortLimited(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(errorStatus(err), gin.H{
+		"success": false,
+		"code":    errorCode(err),
+		"message": Localize(c, "Too many connections: %v", err),
+	})
+}
+
+func limitUsage(counts map[string]int, limit, perToken int) LimitUsage {
+	result := LimitUsage{Max: limit, MaxPerToken: perToken}
+	for _, count := range counts {
+		result.Active += count
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package modules
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper functions
+
+// paginate returns the page of items selected by the limit and cursor query
+// parameters, the total number of items and the cursor of the next page.
+// Without a limit every item is returned. Items must be in a stable order.
+func paginate[T any](c *gin.Context, items []T) ([]T, int, string, error) {
+	total := len(items)
+
+	offset := 0
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, total, "", fmt.Errorf("invalid cursor")
+		}
+		offset, err = strconv.Atoi(string(decoded))
+		if err != nil || offset < 0 {
+			return nil, total, "", fmt.Errorf("invalid cursor")
+		}
+	}
+
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return nil, total, "", fmt.Errorf("invalid limit: %q", value)
+		}
+		limit = parsed
+	}
+
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+
+	next := ""
+	if end < total {
+		next = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(end)))
+	}
+	return items[offset:end], total, next, nil
+}
+
+// selectFields keeps only the JSON fields listed in the fields query
+// parameter, applied to each element of a list or to a single object
+func selectFields(c *gin.Context, value interface{}) (interface{}, error) {
+	fields := c.Query("fields")
+	if fields == "" {
+		return value, nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			wanted[field] = true
+		}
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(encoded, &generic); err != nil {
+		return nil, err
+	}
+
+	switch typed := generic.(type) {
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = pickFields(item, wanted)
+		}
+		return typed, nil
+	default:
+		return pickFields(typed, wanted), nil
+	}
+}
+
+func pickFields(value interface{}, wanted map[string]bool) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	for key := range object {
+		if !wanted[key] {
+			delete(object, key)
+		}
+	}
+	return object
+}
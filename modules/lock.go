@@ -0,0 +1,95 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// InstanceLock is a pid file held for the lifetime of the process, so two
+// agents can't run with the same port or pid file
+type InstanceLock struct {
+	path string
+}
+
+// LockPath returns the pid file used as lock, defaulting to one per port in
+// the temporary directory
+func LockPath(pidFile, port string) string {
+	if pidFile != "" {
+		return pidFile
+	}
+	return filepath.Join(os.TempDir(), "ccw-"+port+".pid")
+}
+
+// AcquireLock creates the pid file at path. Locks left behind by a process
+// that is no longer running are reclaimed; takeover also reclaims locks whose
+// process still appears to run, e.g. when its PID was reused after a crash.
+func AcquireLock(path string, takeover bool) (*InstanceLock, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &InstanceLock{path: path}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		pid, running := lockOwner(path)
+		if running && !takeover {
+			return nil, fmt.Errorf("another ccw instance (pid %d) holds the lock %s; stop it or start with --takeover if the lock is stale", pid, path)
+		}
+
+		log.Printf("Taking over stale lock %s (pid %d)", path, pid)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("lock %s was acquired by another instance", path)
+}
+
+// Release removes the pid file
+func (l *InstanceLock) Release() {
+	os.Remove(l.path)
+}
+
+// Listen opens the listening socket, reporting a clear error when the port
+// is already in use
+func Listen(port string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("port %s is already in use by another process; set PORT to a free port", port)
+	}
+	return listener, err
+}
+
+// Helper functions
+
+// lockOwner returns the PID recorded in a lock and whether it is running
+func lockOwner(path string) (int, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	if pid == os.Getpid() {
+		return pid, false
+	}
+	return pid, processRunning(pid)
+}
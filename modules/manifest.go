@@ -0,0 +1,174 @@
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// hashCache remembers file digests keyed by path, invalidated by size and mtime
+type hashCache struct {
+	entries map[string]cachedHash
+	mutex   sync.Mutex
+}
+
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// REST API Handlers
+
+// Manifest returns a deterministic listing of every entry under a path with
+// its size, mode and sha256, plus a tree hash usable as an ETag
+func (fsm *FileSystemModule) Manifest(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+
+	useCache := c.DefaultQuery("cache", "true") != "false"
+	boundary := newWalkBoundary(path, walkOptionsQuery(c))
+
+	var entries []ManifestEntry
+	err := newWalkLimits(fsm.config).walk(path, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if boundary.excludes(walkPath, d) {
+			return fs.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, walkPath)
+		if err != nil {
+			return err
+		}
+
+		entry := ManifestEntry{
+			Path: filepath.ToSlash(rel),
+			Size: info.Size(),
+			Mode: info.Mode().String(),
+		}
+
+		if info.IsDir() {
+			entry.Size = 0
+		} else if info.Mode().IsRegular() {
+			sum, err := fsm.hashes.fileSum(walkPath, info, useCache)
+			if err != nil {
+				return err
+			}
+			entry.SHA256 = sum
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to build manifest: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	// The tree hash covers every field so any drift changes it
+	tree := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(tree, "%s\x00%d\x00%s\x00%s\n", entry.Path, entry.Size, entry.Mode, entry.SHA256)
+	}
+	treeHash := hex.EncodeToString(tree.Sum(nil))
+	if notModified(c, `"`+treeHash+`"`, time.Time{}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Manifest generated successfully"),
+		Data: map[string]interface{}{
+			"path":      path,
+			"tree_hash": treeHash,
+			"count":     len(entries),
+			"entries":   entries,
+		},
+	})
+}
+
+// Helper functions
+
+func newHashCache() *hashCache {
+	return &hashCache{entries: make(map[string]cachedHash)}
+}
+
+func (hc *hashCache) fileSum(path string, info fs.FileInfo, useCache bool) (string, error) {
+	if useCache {
+		hc.mutex.Lock()
+		cached, exists := hc.entries[path]
+		hc.mutex.Unlock()
+
+		if exists && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+			return cached.sum, nil
+		}
+	}
+
+	sum, err := sha256File(path)
+	if err != nil {
+		return "", err
+	}
+
+	hc.mutex.Lock()
+	hc.entries[path] = cachedHash{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	hc.mutex.Unlock()
+
+	return sum, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
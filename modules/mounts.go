@@ -0,0 +1,319 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mountTypePattern matches filesystem types, e.g. ext4, nfs4 or fuse.sshfs
+var mountTypePattern = regexp.MustCompile(`^[a-z0-9_.]{1,32}$`)
+
+// mountSecretOption matches the mount options whose values are never returned
+var mountSecretOption = regexp.MustCompile(`\b(password|pass|passwd|secret)=[^,\s"']*`)
+
+// errMountFailed marks mount and umount failures that have no better code
+var errMountFailed = errors.New("mount failed")
+
+// mountError is a failed mount or umount, with the output of the command.
+// Its message is the first line of the output, err classifies it.
+type mountError struct {
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+	err      error
+}
+
+type MountRequest struct {
+	Source  string   `json:"source" binding:"required"`       // device, host:/export or //server/share
+	Target  string   `json:"target" binding:"required"`       // absolute path of the mount point
+	Type    string   `json:"type"`                            // e.g. ext4, nfs or cifs, detected when empty
+	Options []string `json:"options"`                         // e.g. ro, vers=4.1, credentials=/root/.smb
+	Mkdir   bool     `json:"mkdir"`                           // create the mount point if missing
+	Timeout int      `json:"timeout" binding:"min=0,max=600"` // seconds, 30 by default
+}
+
+func (e *mountError) Error() string {
+	if e.Output == "" || errors.Is(e.err, context.DeadlineExceeded) {
+		return e.err.Error()
+	}
+	line, _, _ := strings.Cut(e.Output, "\n")
+	return line
+}
+
+func (e *mountError) Unwrap() error {
+	return e.err
+}
+
+// REST API Handlers
+
+// ListMounts lists the filesystems mounted on the host, without the values
+// of password options
+func (fsm *FileSystemModule) ListMounts(c *gin.Context) {
+	mounts, err := readMountTable()
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to list mounts: %v", err),
+		})
+		return
+	}
+	if fsType := c.Query("type"); fsType != "" {
+		filtered := mounts[:0]
+		for _, mount := range mounts {
+			if mount.Type == fsType {
+				filtered = append(filtered, mount)
+			}
+		}
+		mounts = filtered
+	}
+	for i := range mounts {
+		mounts[i].Options = redactMountOptions(mounts[i].Options)
+	}
+
+	page, total, next, err := paginate(c, mounts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success:    true,
+		Message:    Localize(c, "Mounts retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// Mount mounts a device or network share with the mount command, which runs
+// the helpers of NFS and CIFS
+func (fsm *FileSystemModule) Mount(c *gin.Context) {
+	if !fsm.mountsAuthorized(c) {
+		return
+	}
+	var req MountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Target) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	if req.Mkdir {
+		if err := os.MkdirAll(req.Target, 0755); err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to mount: %v", err),
+			})
+			return
+		}
+	}
+
+	args := []string{}
+	if req.Type != "" {
+		args = append(args, "-t", req.Type)
+	}
+	if len(req.Options) > 0 {
+		args = append(args, "-o", strings.Join(req.Options, ","))
+	}
+	args = append(args, "--", req.Source, req.Target)
+	timeout := req.Timeout
+	if timeout == 0 {
+		timeout = 30
+	}
+	if err := runMountCommand("mount", args, timeout); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to mount: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	mount, _ := findMount(req.Target)
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Mounted %s on %s", req.Source, req.Target),
+		Data:    mount,
+	})
+}
+
+// Unmount unmounts the filesystem mounted on a path; lazy detaches it while
+// busy, force aborts pending requests to unreachable network servers
+func (fsm *FileSystemModule) Unmount(c *gin.Context) {
+	if !fsm.mountsAuthorized(c) {
+		return
+	}
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+	if _, mounted := findMount(filepath.Clean(path)); !mounted {
+		c.JSON(http.StatusNotFound, FileOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Nothing is mounted on %s", path),
+		})
+		return
+	}
+
+	args := []string{}
+	if c.Query("lazy") == "true" {
+		args = append(args, "-l")
+	}
+	if c.Query("force") == "true" {
+		args = append(args, "-f")
+	}
+	args = append(args, "--", path)
+	if err := runMountCommand("umount", args, 30); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to unmount: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Unmounted %s", path),
+	})
+}
+
+// Helper functions
+
+func (fsm *FileSystemModule) mountsAuthorized(c *gin.Context) bool {
+	if !fsm.config.MountsEnabled {
+		c.JSON(http.StatusForbidden, FileOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Mount management is disabled, set MOUNTS_ENABLED to enable it"),
+		})
+		return false
+	}
+	if !RequestToken(c).HasScope(ScopeMounts) {
+		c.JSON(http.StatusForbidden, FileOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Managing mounts requires the mounts permission"),
+		})
+		return false
+	}
+	return true
+}
+
+func (r *MountRequest) validate() error {
+	if strings.HasPrefix(r.Source, "-") {
+		return fmt.Errorf("invalid source %q", r.Source)
+	}
+	if !filepath.IsAbs(r.Target) {
+		return fmt.Errorf("target must be an absolute path")
+	}
+	r.Target = filepath.Clean(r.Target)
+	if r.Type != "" && !mountTypePattern.MatchString(r.Type) {
+		return fmt.Errorf("invalid filesystem type %q", r.Type)
+	}
+	for _, option := range r.Options {
+		if option == "" || strings.ContainsAny(option, ", \t\n") {
+			return fmt.Errorf("invalid option %q, pass each option separately", option)
+		}
+	}
+	return nil
+}
+
+// runMountCommand runs mount or umount, turning its failures into a
+// *mountError classified from the exit code and the message
+func runMountCommand(name string, args []string, timeout int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	mountErr := &mountError{ExitCode: -1, Output: redactMountOptions(strings.TrimSpace(string(output))), err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		mountErr.ExitCode = exitErr.ExitCode()
+	}
+
+	message := strings.ToLower(mountErr.Output)
+	switch {
+	case ctx.Err() != nil:
+		mountErr.err = fmt.Errorf("%s timed out after %d seconds: %w", name, timeout, ctx.Err())
+	case strings.Contains(message, "does not exist"), strings.Contains(message, "no such file"), strings.Contains(message, "can't find"):
+		mountErr.err = fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	case strings.Contains(message, "permission denied"), strings.Contains(message, "must be superuser"), strings.Contains(message, "only root"):
+		mountErr.err = fmt.Errorf("%s: %w", name, fs.ErrPermission)
+	case strings.Contains(message, "already mounted"), strings.Contains(message, "busy"):
+		mountErr.err = fmt.Errorf("%s: %w", name, syscall.EBUSY)
+	case strings.Contains(message, "wrong fs type"), strings.Contains(message, "unknown filesystem type"), strings.Contains(message, "bad option"):
+		mountErr.err = fmt.Errorf("%s: %w", name, errInvalidRequest)
+	case strings.Contains(message, "not mounted"):
+		mountErr.err = fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	default:
+		mountErr.err = fmt.Errorf("%w: %s exited with code %d", errMountFailed, name, mountErr.ExitCode)
+	}
+	return mountErr
+}
+
+// findMount returns the filesystem mounted last on a path
+func findMount(target string) (MountEntry, bool) {
+	mounts, err := readMountTable()
+	if err != nil {
+		return MountEntry{}, false
+	}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].Target == target {
+			mounts[i].Options = redactMountOptions(mounts[i].Options)
+			return mounts[i], true
+		}
+	}
+	return MountEntry{}, false
+}
+
+// redactMountOptions hides the values of password options in a list of
+// options, or a message quoting them
+func redactMountOptions(options string) string {
+	return mountSecretOption.ReplaceAllString(options, "${1}=********")
+}
@@ -0,0 +1,200 @@
+package modules
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// natpmpLease is the lifetime of mappings requested without one, as
+// recommended by RFC 6886
+const natpmpLease = 7200
+
+// natpmpResults are the result codes of RFC 6886
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// natpmpMapper manages port mappings through NAT-PMP. The protocol can't
+// list mappings, so those made by the agent are remembered until they
+// expire.
+type natpmpMapper struct {
+	host   string
+	mapped map[string]natpmpMapping // by protocol and external port
+	mutex  sync.Mutex
+}
+
+type natpmpMapping struct {
+	PortMapping
+	expires time.Time
+}
+
+// discoverNATPMP checks that the gateway, the default route unless given,
+// answers NAT-PMP requests
+func discoverNATPMP(gateway string) (*natpmpMapper, error) {
+	if gateway == "" {
+		ip, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		gateway = ip.String()
+	}
+
+	mapper := &natpmpMapper{host: gateway, mapped: make(map[string]natpmpMapping)}
+	if _, err := mapper.externalIP(); err != nil {
+		return nil, err
+	}
+	return mapper, nil
+}
+
+func (n *natpmpMapper) name() string {
+	return "natpmp"
+}
+
+func (n *natpmpMapper) gateway() string {
+	return n.host
+}
+
+func (n *natpmpMapper) externalIP() (string, error) {
+	resp, err := n.request([]byte{0, 0}, 12)
+	if err != nil {
+		return "", err
+	}
+	return net.IP(resp[8:12]).String(), nil
+}
+
+func (n *natpmpMapper) mappings() ([]PortMapping, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	mappings := []PortMapping{}
+	for key, mapping := range n.mapped {
+		left := int(time.Until(mapping.expires).Seconds())
+		if left <= 0 {
+			delete(n.mapped, key)
+			continue
+		}
+		mapping.Lease = left
+		mappings = append(mappings, mapping.PortMapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].ExternalPort != mappings[j].ExternalPort {
+			return mappings[i].ExternalPort < mappings[j].ExternalPort
+		}
+		return mappings[i].Protocol < mappings[j].Protocol
+	})
+	return mappings, nil
+}
+
+// add requests a mapping to the agent itself, the only client NAT-PMP maps
+// ports to. The gateway may grant another external port or lifetime.
+func (n *natpmpMapper) add(mapping PortMapping) (PortMapping, error) {
+	local, err := localAddressTowards(n.host)
+	if err != nil {
+		return mapping, err
+	}
+	if mapping.InternalClient != local {
+		return mapping, fmt.Errorf("%w: NAT-PMP only maps ports to the agent, %s", errInvalidRequest, local)
+	}
+	if mapping.Lease == 0 {
+		mapping.Lease = natpmpLease
+	}
+
+	resp, err := n.request(natpmpMapRequest(mapping.Protocol, mapping.InternalPort, mapping.ExternalPort, mapping.Lease), 16)
+	if err != nil {
+		return mapping, err
+	}
+	mapping.ExternalPort = int(binary.BigEndian.Uint16(resp[10:12]))
+	mapping.Lease = int(binary.BigEndian.Uint32(resp[12:16]))
+
+	n.mutex.Lock()
+	n.mapped[fmt.Sprintf("%s/%d", mapping.Protocol, mapping.ExternalPort)] = natpmpMapping{
+		PortMapping: mapping,
+		expires:     time.Now().Add(time.Duration(mapping.Lease) * time.Second),
+	}
+	n.mutex.Unlock()
+	return mapping, nil
+}
+
+// remove deletes a mapping made by the agent. NAT-PMP deletes mappings by
+// internal port, so others can't be removed.
+func (n *natpmpMapper) remove(protocol string, externalPort int) error {
+	key := fmt.Sprintf("%s/%d", protocol, externalPort)
+	n.mutex.Lock()
+	mapping, ok := n.mapped[key]
+	n.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s wasn't mapped by the agent", errMappingNotFound, key)
+	}
+
+	if _, err := n.request(natpmpMapRequest(protocol, mapping.InternalPort, 0, 0), 16); err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	delete(n.mapped, key)
+	n.mutex.Unlock()
+	return nil
+}
+
+// Helper functions
+
+// request sends a request to the gateway, retrying with a doubling timeout
+// from 250ms as RFC 6886 describes, and returns a successful response of at
+// least size bytes
+func (n *natpmpMapper) request(req []byte, size int) ([]byte, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(n.host, "5351"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	opcode := req[1]
+	timeout := 250 * time.Millisecond
+	resp := make([]byte, 16)
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		length, err := conn.Read(resp)
+		if err != nil {
+			if attempt < 3 && os.IsTimeout(err) {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if length < size || resp[0] != 0 || resp[1] != 128+opcode {
+			if attempt < 3 {
+				continue
+			}
+			return nil, fmt.Errorf("%w: invalid NAT-PMP response", errUpstream)
+		}
+
+		if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+			return nil, fmt.Errorf("%w: NAT-PMP result %d, %s", errUpstream, result, natpmpResults[result])
+		}
+		return resp[:length], nil
+	}
+}
+
+// natpmpMapRequest builds a mapping request; a lifetime of 0 deletes it
+func natpmpMapRequest(protocol string, internalPort, externalPort, lifetime int) []byte {
+	req := make([]byte, 12)
+	req[1] = 2 // map TCP
+	if protocol == "udp" {
+		req[1] = 1
+	}
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime))
+	return req
+}
@@ -1,12 +1,12 @@
 package modules
 
 import (
-	"bufio"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,45 +18,112 @@ import (
 
 type NetworkModule struct {
 	server    *socketio.Server
+	emitter   *Emitter
+	quotas    *Quotas
+	throttle  *Throttle
+	outbound  *OutboundPolicy
+	cache     *DownloadCache
+	tasks     *Tasks
+	paths     *Paths
+	config    *Config
+	ports     portBackend
 	monitors  map[string]*PortMonitor
 	monitorMu sync.RWMutex
+	etcMu     sync.Mutex // serializes edits of the hosts file and resolv.conf
+	captures  map[string]*PacketCapture
+	captureMu sync.Mutex
+
+	discoverMu  sync.Mutex // one discovery scan at a time
+	scanMu      sync.Mutex // one port scan at a time
+	portmap     portMapper // gateway found by the last port mapping request
+	portmapMu   sync.Mutex
+	vendorsOnce sync.Once
+	vendors     map[string]string // MAC vendors by OUI, loaded on the first scan
 }
 
 type DownloadRequest struct {
-	URL  string `json:"url" binding:"required"`
-	Path string `json:"path" binding:"required"`
+	URL          string   `json:"url" binding:"required_without=Mirrors"`
+	Mirrors      []string `json:"mirrors"`                         // tried in order after url
+	Checksum     string   `json:"checksum"`                        // "<algorithm>:<hex>", sha256 when the algorithm is omitted
+	SHA256       string   `json:"sha256"`                          // hex
+	MD5          string   `json:"md5"`                             // hex
+	SignatureURL string   `json:"signature_url"`                   // detached OpenPGP signature, armored or binary
+	Keyring      string   `json:"keyring"`                         // path of the keyring on the agent
+	PublicKey    string   `json:"public_key"`                      // armored public key, instead of keyring
+	RateLimit    int64    `json:"rate_limit" binding:"min=0"`      // bytes per second
+	Segments     int      `json:"segments" binding:"min=0,max=16"` // parallel ranges, defaults to DOWNLOAD_SEGMENTS
+	Proxy        string   `json:"proxy"`                           // overrides HTTP_PROXY and HTTPS_PROXY
+	Path         string   `json:"path" binding:"required"`
+
+	// Unpacks tar, tar.gz and zip archives once downloaded and verified
+	Extract         bool   `json:"extract"`
+	StripComponents int    `json:"strip_components" binding:"min=0"`
+	Destination     string `json:"destination"` // defaults to the directory of path
 }
 
 type NetworkOperation struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Data    any    `json:"data,omitempty"`
+	Success    bool   `json:"success"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	Data       any    `json:"data,omitempty"`
+	Total      *int   `json:"total,omitempty"`       // list size before pagination
+	NextCursor string `json:"next_cursor,omitempty"` // cursor of the next page, if any
 }
 
+// PortMonitor polls listening ports for one protocol and interface and sends
+// changes to every subscribed connection, filtered by its PortFilter
 type PortMonitor struct {
-	conn     socketio.Conn
-	protocol string
-	iface    string
-	interval int
-	previous map[int]bool
-	stop     chan bool
-	running  bool
-	mu       sync.RWMutex
+	room        string
+	protocol    string
+	iface       string
+	interval    int
+	previous    map[int]portSocket
+	owners      map[int]*ProcessInfo   // processes of the open ports, resolved as they open
+	subscribers map[string]*PortFilter // by connection ID
+	stop        chan bool
+	running     bool
+	mu          sync.RWMutex
 }
 
 type PortChange struct {
-	Port      int    `json:"port"`
-	Status    string `json:"status"` // "opened" or "closed"
-	Protocol  string `json:"protocol"`
-	Interface string `json:"interface"`
-	Timestamp int64  `json:"timestamp"`
+	Port      int          `json:"port"`
+	Status    string       `json:"status"` // "opened" or "closed"
+	Protocol  string       `json:"protocol"`
+	Interface string       `json:"interface"`
+	Process   *ProcessInfo `json:"process,omitempty"` // that opened the port, or held it until closed
+	Timestamp int64        `json:"timestamp"`
 }
 
-func NewNetworkModule(server *socketio.Server) *NetworkModule {
-	return &NetworkModule{
+// PortFilter selects the port changes sent to a subscriber. Ports in the
+// watch list are always reported; otherwise a port must be in one of the
+// ranges, if any, and below EphemeralMin in alert only mode.
+type PortFilter struct {
+	Ports        []int    `json:"ports,omitempty" binding:"omitempty,dive,min=1,max=65535"`
+	Ranges       []string `json:"ranges,omitempty"` // "8000-8999" or a single port
+	AlertOnly    bool     `json:"alert_only,omitempty"`
+	EphemeralMin int      `json:"ephemeral_min,omitempty" binding:"omitempty,min=1,max=65535"` // defaults to 32768
+	Metrics      bool     `json:"metrics,omitempty"`                                           // also sends net:port:metrics every interval
+
+	ranges [][2]int
+}
+
+func NewNetworkModule(server *socketio.Server, emitter *Emitter, config *Config, quotas *Quotas, throttle *Throttle, outbound *OutboundPolicy, cache *DownloadCache, tasks *Tasks, paths *Paths) *NetworkModule {
+	nm := &NetworkModule{
 		server:   server,
+		emitter:  emitter,
+		config:   config,
+		quotas:   quotas,
+		throttle: throttle,
+		outbound: outbound,
+		cache:    cache,
+		tasks:    tasks,
+		paths:    paths,
 		monitors: make(map[string]*PortMonitor),
+		captures: make(map[string]*PacketCapture),
 	}
+
+	nm.ports = newPortBackend(config)
+	return nm
 }
 
 // REST API Handlers
@@ -67,69 +134,132 @@ func (nm *NetworkModule) DownloadFile(c *gin.Context) {
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, NetworkOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
 		})
 		return
 	}
-
-	// Create directory if it doesn't exist
-	dir := filepath.Dir(req.Path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, NetworkOperation{
-			Success: false,
-			Message: fmt.Sprintf("Failed to create directory: %v", err),
-		})
+	if !nm.resolvePaths(c, &req.Path, &req.Destination, &req.Keyring) {
 		return
 	}
+	job := map[string]any{"operation": "download", "url": redactURL(req.URL)}
+	if req.URL == "" && len(req.Mirrors) > 0 {
+		job["url"] = redactURL(req.Mirrors[0])
+	}
+	recordAs(c, RecordJob, req.Path, job)
 
-	// Download the file
-	resp, err := http.Get(req.URL)
+	checksums, err := parseChecksums(req)
+	var client *http.Client
+	if err == nil {
+		client, err = nm.outbound.Client(req.Proxy)
+	}
+	if err == nil && req.URL == "" && len(req.Mirrors) == 0 {
+		err = fmt.Errorf("url or mirrors is required")
+	}
+	if err == nil && req.SignatureURL != "" && req.Keyring == "" && req.PublicKey == "" {
+		err = fmt.Errorf("signature_url requires keyring or public_key")
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, NetworkOperation{
+		c.JSON(http.StatusBadRequest, NetworkOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to download file: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
 		})
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		c.JSON(http.StatusInternalServerError, NetworkOperation{
+	signature, keyring, err := loadSignature(client, req)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
 			Success: false,
-			Message: fmt.Sprintf("HTTP error: %s", resp.Status),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to load signature: %v", err),
 		})
 		return
 	}
+	var verifier *downloadVerifier
+	if len(checksums) > 0 || signature != nil {
+		verifier = &downloadVerifier{checksums: checksums, signature: signature, keyring: keyring}
+	}
 
-	// Create the destination file
-	file, err := os.Create(req.Path)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, NetworkOperation{
+	// Create directory if it doesn't exist
+	dir := filepath.Dir(req.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to create file: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create directory: %v", err),
 		})
 		return
 	}
-	defer file.Close()
 
-	// Copy the content
-	bytesWritten, err := io.Copy(file, resp.Body)
+	urls := req.Mirrors
+	if req.URL != "" {
+		urls = append([]string{req.URL}, req.Mirrors...)
+	}
+
+	// Artifacts with a known checksum are served from the cache without any request
+	token := RequestToken(c)
+	var attempts []MirrorAttempt
+	task := nm.tasks.Start(c, "download", req.Path, unitBytes)
+	result := nm.restoreChecksum(token, req.Path, verifier)
+	if result == nil {
+		result, attempts, err = nm.fetchMirrors(client, token, urls, req, verifier, task)
+	}
+	task.Finish(err)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, NetworkOperation{
+		c.JSON(errorStatus(err), NetworkOperation{
 			Success: false,
-			Message: fmt.Sprintf("Failed to write file: %v", err),
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to download file: %v", err),
+			Data:    map[string]interface{}{"attempts": attempts},
 		})
 		return
 	}
 
+	data := map[string]interface{}{
+		"bytes_written": result.bytesWritten,
+		"content_type":  result.contentType,
+		"file_path":     req.Path,
+		"url":           result.url,
+	}
+	if result.verification != nil {
+		data["verification"] = result.verification
+	}
+	if result.segments > 0 {
+		data["segments"] = result.segments
+	}
+	if len(attempts) > 0 {
+		data["attempts"] = attempts
+	}
+	if result.cached {
+		data["cached"] = true
+	} else {
+		nm.cacheDownload(req.Path, verifier, result)
+	}
+
+	if req.Extract {
+		destination := req.Destination
+		if destination == "" {
+			destination = dir
+		}
+		extraction, err := nm.extractArchive(token, req.Path, destination, req.StripComponents)
+		if err != nil {
+			c.JSON(errorStatus(err), NetworkOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to extract archive: %v", err),
+				Data:    data,
+			})
+			return
+		}
+		data["extracted"] = extraction
+	}
+
 	c.JSON(http.StatusOK, NetworkOperation{
 		Success: true,
-		Message: "File downloaded successfully",
-		Data: map[string]interface{}{
-			"bytes_written": bytesWritten,
-			"content_type":  resp.Header.Get("Content-Type"),
-			"file_path":     req.Path,
-		},
+		Message: Localize(c, "File downloaded successfully"),
+		Data:    data,
 	})
 }
 
@@ -149,44 +279,72 @@ func (nm *NetworkModule) GetCurrentPorts(c *gin.Context) {
 	default:
 		c.JSON(http.StatusBadRequest, NetworkOperation{
 			Success: false,
-			Message: "Invalid protocol. Use 'tcp', 'udp', or 'both'",
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid protocol. Use 'tcp', 'udp', or 'both'"),
 		})
 		return
 	}
 
-	ports := nm.getListeningPorts(protocols, iface)
+	ports, err := nm.ports.listening(protocols, iface)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to list ports: %v", err),
+		})
+		return
+	}
 
 	var portList []int
 	for port := range ports {
 		portList = append(portList, port)
 	}
+	sort.Ints(portList)
+
+	page, total, next, err := paginate(c, portList)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	data, err := selectFields(c, map[string]interface{}{
+		"ports":     page,
+		"protocol":  protocol,
+		"interface": iface,
+		"count":     len(page),
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to select fields: %v", err),
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, NetworkOperation{
-		Success: true,
-		Message: "Current listening ports retrieved",
-		Data: map[string]interface{}{
-			"ports":     portList,
-			"protocol":  protocol,
-			"interface": iface,
-			"count":     len(portList),
-		},
+		Success:    true,
+		Message:    Localize(c, "Current listening ports retrieved"),
+		Data:       data,
+		Total:      &total,
+		NextCursor: next,
 	})
 }
 
 // Socket.IO Handlers
 
-// StartPortMonitoring starts monitoring port changes for a connection
-func (nm *NetworkModule) StartPortMonitoring(conn socketio.Conn, protocol, iface string, interval int) {
-	monitorID := fmt.Sprintf("%s_%s_%s", conn.ID(), protocol, iface)
+// StartPortMonitoring subscribes a connection to port changes, sharing a
+// single monitor between all connections watching the same protocol and interface
+func (nm *NetworkModule) StartPortMonitoring(conn socketio.Conn, protocol, iface string, interval int, filter PortFilter) EventResult {
+	monitorID := fmt.Sprintf("%s_%s", protocol, iface)
 
 	nm.monitorMu.Lock()
 	defer nm.monitorMu.Unlock()
 
-	// Stop existing monitor if any
-	if existingMonitor, exists := nm.monitors[monitorID]; exists {
-		existingMonitor.Stop()
-	}
-
 	// Validate parameters
 	var protocols []string
 	switch protocol {
@@ -197,78 +355,233 @@ func (nm *NetworkModule) StartPortMonitoring(conn socketio.Conn, protocol, iface
 	case "both":
 		protocols = []string{"tcp", "udp"}
 	default:
-		conn.Emit("net:error", map[string]interface{}{
-			"message": "Invalid protocol. Use 'tcp', 'udp', or 'both'",
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid protocol. Use 'tcp', 'udp', or 'both'"),
+		})
+	}
+
+	if err := filter.parse(); err != nil {
+		return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Invalid request: %v", err),
 		})
-		return
 	}
 
 	if interval < 1 {
 		interval = 2 // Default to 2 seconds
 	}
 
-	// Create new monitor
-	monitor := &PortMonitor{
-		conn:     conn,
-		protocol: protocol,
-		iface:    iface,
-		interval: interval,
-		stop:     make(chan bool, 1),
-		running:  true,
-		previous: nm.getListeningPorts(protocols, iface),
-	}
+	// Join the running monitor, keeping its interval
+	monitor, shared := nm.monitors[monitorID]
+	if !shared {
+		previous, err := nm.ports.listening(protocols, iface)
+		if err != nil {
+			return nm.emitter.Fail(conn, "net:error", map[string]interface{}{
+				"code":    errorCode(err),
+				"message": localizeConn(conn, "Failed to list ports: %v", err),
+			})
+		}
+		open := make([]int, 0, len(previous))
+		for port := range previous {
+			open = append(open, port)
+		}
 
-	nm.monitors[monitorID] = monitor
+		monitor = &PortMonitor{
+			room:        "net:ports:" + monitorID,
+			protocol:    protocol,
+			iface:       iface,
+			interval:    interval,
+			subscribers: make(map[string]*PortFilter),
+			stop:        make(chan bool, 1),
+			running:     true,
+			previous:    previous,
+			owners:      nm.ports.owners(previous, open),
+		}
+		nm.monitors[monitorID] = monitor
 
-	// Start monitoring in goroutine
-	go nm.runPortMonitor(monitor, protocols)
+		// Start monitoring in goroutine
+		go nm.runPortMonitor(monitor, protocols)
+	}
 
-	conn.Emit("net:monitor:started", map[string]interface{}{
-		"protocol":  protocol,
-		"interface": iface,
-		"interval":  interval,
-		"timestamp": time.Now().Unix(),
+	// Starting again replaces the filter of the connection
+	monitor.subscribers[conn.ID()] = &filter
+	conn.Join(monitor.room)
+
+	return nm.emitter.Reply(conn, "net:monitor:started", map[string]interface{}{
+		"protocol":    protocol,
+		"interface":   iface,
+		"interval":    monitor.interval,
+		"filter":      filter,
+		"shared":      shared,
+		"subscribers": len(monitor.subscribers),
+		"timestamp":   time.Now().Unix(),
 	})
 }
 
 // StopPortMonitoring stops monitoring for a connection
-func (nm *NetworkModule) StopPortMonitoring(conn socketio.Conn, protocol, iface string) {
-	monitorID := fmt.Sprintf("%s_%s_%s", conn.ID(), protocol, iface)
+func (nm *NetworkModule) StopPortMonitoring(conn socketio.Conn, protocol, iface string) EventResult {
+	monitorID := fmt.Sprintf("%s_%s", protocol, iface)
 
 	nm.monitorMu.Lock()
 	defer nm.monitorMu.Unlock()
 
-	if monitor, exists := nm.monitors[monitorID]; exists {
-		monitor.Stop()
-		delete(nm.monitors, monitorID)
+	if monitor, exists := nm.monitors[monitorID]; exists && monitor.subscribers[conn.ID()] != nil {
+		conn.Leave(monitor.room)
+		nm.unsubscribe(monitorID, monitor, conn.ID())
 
-		conn.Emit("net:monitor:stopped", map[string]interface{}{
+		return nm.emitter.Reply(conn, "net:monitor:stopped", map[string]interface{}{
 			"protocol":  protocol,
 			"interface": iface,
 			"timestamp": time.Now().Unix(),
 		})
 	}
+
+	return EventResult{
+		Success: false,
+		Code:    ErrNotFound,
+		Message: localizeConn(conn, "Not monitoring this protocol and interface"),
+	}
+}
+
+// Subscriptions returns the port monitors a connection is subscribed to
+func (nm *NetworkModule) Subscriptions(connectionID string) []map[string]interface{} {
+	nm.monitorMu.RLock()
+	defer nm.monitorMu.RUnlock()
+
+	monitors := []map[string]interface{}{}
+	for _, monitor := range nm.monitors {
+		if filter := monitor.subscribers[connectionID]; filter != nil {
+			monitors = append(monitors, map[string]interface{}{
+				"protocol":    monitor.protocol,
+				"interface":   monitor.iface,
+				"interval":    monitor.interval,
+				"filter":      filter,
+				"subscribers": len(monitor.subscribers),
+			})
+		}
+	}
+
+	return monitors
 }
 
 // CleanupConnection cleans up all monitors for a disconnected connection
 func (nm *NetworkModule) CleanupConnection(connectionID string) {
+	nm.stopCaptures(connectionID)
+
 	nm.monitorMu.Lock()
 	defer nm.monitorMu.Unlock()
 
-	toDelete := []string{}
+	// Rooms are left by the Socket.IO server itself on disconnect
 	for monitorID, monitor := range nm.monitors {
-		if strings.HasPrefix(monitorID, connectionID+"_") {
-			monitor.Stop()
-			toDelete = append(toDelete, monitorID)
+		if monitor.subscribers[connectionID] != nil {
+			nm.unsubscribe(monitorID, monitor, connectionID)
 		}
 	}
+}
+
+// Helper functions
 
-	for _, id := range toDelete {
-		delete(nm.monitors, id)
+// resolvePaths normalizes the paths of a request in place, answering with
+// the error when one is invalid or outside the root
+func (nm *NetworkModule) resolvePaths(c *gin.Context, paths ...*string) bool {
+	if err := nm.paths.Resolve(paths...); err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
+		})
+		return false
 	}
+	return true
 }
 
-// Helper functions
+// unsubscribe removes a connection from a monitor, stopping it once nobody
+// is left. Callers must hold monitorMu.
+func (nm *NetworkModule) unsubscribe(monitorID string, monitor *PortMonitor, connectionID string) {
+	delete(monitor.subscribers, connectionID)
+	if len(monitor.subscribers) == 0 {
+		monitor.Stop()
+		delete(nm.monitors, monitorID)
+	}
+}
+
+// sendPortChanges sends every subscriber of monitor the changes passing its
+// filter, if any
+func (nm *NetworkModule) sendPortChanges(monitor *PortMonitor, changes []PortChange, timestamp int64) {
+	nm.monitorMu.RLock()
+	defer nm.monitorMu.RUnlock()
+
+	for connectionID, filter := range monitor.subscribers {
+		conn := nm.emitter.Lookup(connectionID)
+		if conn == nil {
+			continue
+		}
+
+		matched := []PortChange{}
+		for _, change := range changes {
+			if filter.match(change.Port) {
+				matched = append(matched, change)
+			}
+		}
+		if len(matched) > 0 {
+			nm.emitter.Emit(conn, "net:port:changes", map[string]interface{}{
+				"changes":   matched,
+				"timestamp": timestamp,
+			})
+		}
+	}
+}
+
+// parse validates the ranges of the filter
+func (f *PortFilter) parse() error {
+	for _, value := range f.Ranges {
+		first, last, found := strings.Cut(value, "-")
+		if !found {
+			last = first
+		}
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return fmt.Errorf("invalid port range %q", value)
+		}
+		end, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil || start < 1 || end > 65535 || start > end {
+			return fmt.Errorf("invalid port range %q", value)
+		}
+		f.ranges = append(f.ranges, [2]int{start, end})
+	}
+	return nil
+}
+
+func (f *PortFilter) match(port int) bool {
+	for _, watched := range f.Ports {
+		if port == watched {
+			return true
+		}
+	}
+	if len(f.Ports) > 0 && len(f.ranges) == 0 {
+		return false
+	}
+
+	if len(f.ranges) > 0 {
+		inRange := false
+		for _, r := range f.ranges {
+			if port >= r[0] && port <= r[1] {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	ephemeralMin := f.EphemeralMin
+	if ephemeralMin == 0 {
+		ephemeralMin = 32768
+	}
+	return !f.AlertOnly || port < ephemeralMin
+}
 
 func (pm *PortMonitor) Stop() {
 	pm.mu.Lock()
@@ -284,10 +597,31 @@ func (nm *NetworkModule) runPortMonitor(monitor *PortMonitor, protocols []string
 	ticker := time.NewTicker(time.Duration(monitor.interval) * time.Second)
 	defer ticker.Stop()
 
+	// Backends like netlink list the listeners more often than the interval
+	// and rescan as soon as the kernel destroys a socket of a monitored port
+	var scan <-chan time.Time
+	destroyed := make(chan int, 64)
+	watcher, fast := nm.ports.(portWatcher)
+	if fast {
+		ticker := time.NewTicker(watcher.scanInterval())
+		defer ticker.Stop()
+		scan = ticker.C
+
+		if err := watcher.watchClosed(protocols, destroyed, monitor.stop); err != nil {
+			log.Printf("Port monitor detects closed ports by polling, socket events are unavailable: %v", err)
+		}
+	}
+
 	for {
 		select {
 		case <-monitor.stop:
 			return
+		case <-scan:
+			nm.checkPorts(monitor, protocols)
+		case port := <-destroyed:
+			if _, monitored := monitor.previous[port]; monitored {
+				nm.checkPorts(monitor, protocols)
+			}
 		case <-ticker.C:
 			monitor.mu.RLock()
 			if !monitor.running {
@@ -296,137 +630,76 @@ func (nm *NetworkModule) runPortMonitor(monitor *PortMonitor, protocols []string
 			}
 			monitor.mu.RUnlock()
 
-			current := nm.getListeningPorts(protocols, monitor.iface)
-			opened, closed := nm.diffPorts(monitor.previous, current)
-
-			if len(opened) > 0 || len(closed) > 0 {
-				changes := []PortChange{}
-				timestamp := time.Now().Unix()
-
-				for _, port := range opened {
-					changes = append(changes, PortChange{
-						Port:      port,
-						Status:    "opened",
-						Protocol:  monitor.protocol,
-						Interface: monitor.iface,
-						Timestamp: timestamp,
-					})
-				}
-
-				for _, port := range closed {
-					changes = append(changes, PortChange{
-						Port:      port,
-						Status:    "closed",
-						Protocol:  monitor.protocol,
-						Interface: monitor.iface,
-						Timestamp: timestamp,
-					})
-				}
-
-				monitor.conn.Emit("net:port:changes", map[string]interface{}{
-					"changes":   changes,
-					"timestamp": timestamp,
-				})
+			if !fast {
+				nm.checkPorts(monitor, protocols)
 			}
-
-			monitor.previous = current
+			nm.sendPortMetrics(monitor, protocols, monitor.previous, time.Now().Unix())
 		}
 	}
 }
 
-func (nm *NetworkModule) parsePortsFile(file string, iface string) map[int]bool {
-	ports := make(map[int]bool)
-	f, err := os.Open(file)
+// checkPorts lists the ports of monitor, sending the changes since the last
+// check to its subscribers
+func (nm *NetworkModule) checkPorts(monitor *PortMonitor, protocols []string) {
+	current, err := nm.ports.listening(protocols, monitor.iface)
 	if err != nil {
-		return ports
+		return
 	}
-	defer f.Close()
+	opened, closed := nm.diffPorts(monitor.previous, current)
 
-	scanner := bufio.NewScanner(f)
-	scanner.Scan() // skip header
+	if len(opened) > 0 || len(closed) > 0 {
+		changes := []PortChange{}
+		timestamp := time.Now().Unix()
 
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) < 2 {
-			continue
-		}
-
-		localAddress := fields[1]
-		ipPort := strings.Split(localAddress, ":")
-		if len(ipPort) != 2 {
-			continue
+		// The process is looked up while it holds the port, it may be gone once closed
+		for port, owner := range nm.ports.owners(current, opened) {
+			monitor.owners[port] = owner
 		}
 
-		ipHex := ipPort[0]
-		portHex := ipPort[1]
-		ip := nm.parseHexIP(ipHex)
-
-		if iface != "any" && iface != ip {
-			continue
+		for _, port := range opened {
+			changes = append(changes, PortChange{
+				Port:      port,
+				Status:    "opened",
+				Protocol:  monitor.protocol,
+				Interface: monitor.iface,
+				Process:   monitor.owners[port],
+				Timestamp: timestamp,
+			})
 		}
 
-		port, err := strconv.ParseInt(portHex, 16, 32)
-		if err == nil {
-			ports[int(port)] = true
+		for _, port := range closed {
+			changes = append(changes, PortChange{
+				Port:      port,
+				Status:    "closed",
+				Protocol:  monitor.protocol,
+				Interface: monitor.iface,
+				Process:   monitor.owners[port],
+				Timestamp: timestamp,
+			})
+			delete(monitor.owners, port)
 		}
-	}
-
-	return ports
-}
-
-func (nm *NetworkModule) parseHexIP(hexIP string) string {
-	if len(hexIP) != 8 {
-		return ""
-	}
-
-	ipBytes := []string{
-		hexIP[6:8],
-		hexIP[4:6],
-		hexIP[2:4],
-		hexIP[0:2],
-	}
 
-	parts := make([]string, 4)
-	for i, b := range ipBytes {
-		val, _ := strconv.ParseUint(b, 16, 8)
-		parts[i] = fmt.Sprintf("%d", val)
-	}
-
-	return strings.Join(parts, ".")
-}
-
-func (nm *NetworkModule) getListeningPorts(protocols []string, iface string) map[int]bool {
-	files := map[string]string{
-		"tcp": "/proc/net/tcp",
-		"udp": "/proc/net/udp",
-	}
-
-	ports := make(map[int]bool)
-	for _, proto := range protocols {
-		path, ok := files[proto]
-		if !ok {
-			continue
-		}
-		for port := range nm.parsePortsFile(path, iface) {
-			ports[port] = true
-		}
+		nm.sendPortChanges(monitor, changes, timestamp)
 	}
 
-	return ports
+	monitor.previous = current
 }
 
-func (nm *NetworkModule) diffPorts(old, current map[int]bool) (opened, closed []int) {
+func (nm *NetworkModule) diffPorts(old, current map[int]portSocket) (opened, closed []int) {
 	for port := range current {
-		if !old[port] {
+		if _, ok := old[port]; !ok {
 			opened = append(opened, port)
 		}
 	}
 
 	for port := range old {
-		if !current[port] {
+		if _, ok := current[port]; !ok {
 			closed = append(closed, port)
 		}
 	}
 
+	// Changes are sent in port order, not in the order of the maps
+	sort.Ints(opened)
+	sort.Ints(closed)
 	return
 }
@@ -0,0 +1,235 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// nftTable is the table holding the agent's rules. Its chains hook in just
+// before the usual filter priority, and accept what their rules don't drop.
+const nftTable = "ccw"
+
+// nftBackend applies rules with nftables
+type nftBackend struct{}
+
+// nftRule is a rule of `nft -j list`
+type nftRule struct {
+	Chain   string                       `json:"chain"`
+	Comment string                       `json:"comment"`
+	Expr    []map[string]json.RawMessage `json:"expr"`
+}
+
+// nftMatch is a match expression of `nft -j list`
+type nftMatch struct {
+	Left struct {
+		Meta *struct {
+			Key string `json:"key"`
+		} `json:"meta"`
+		Payload *struct {
+			Protocol string `json:"protocol"`
+			Field    string `json:"field"`
+		} `json:"payload"`
+	} `json:"left"`
+	Right json.RawMessage `json:"right"`
+}
+
+func (b *nftBackend) name() string {
+	return "nftables"
+}
+
+// rules lists the rules of the agent's table, none if it doesn't exist yet
+func (b *nftBackend) rules() ([]FirewallRule, error) {
+	output, err := exec.Command("nft", "-j", "list", "table", "inet", nftTable).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr := strings.TrimSpace(string(exitErr.Stderr))
+			if strings.Contains(stderr, "No such file or directory") {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("nft: %v: %s", err, stderr)
+		}
+		return nil, fmt.Errorf("nft: %v", err)
+	}
+
+	var ruleset struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}
+	if err := json.Unmarshal(output, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %v", err)
+	}
+
+	var rules []FirewallRule
+	for _, object := range ruleset.Nftables {
+		raw, ok := object["rule"]
+		if !ok {
+			continue
+		}
+		var rule nftRule
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return nil, fmt.Errorf("failed to parse nft output: %v", err)
+		}
+		id, ok := strings.CutPrefix(rule.Comment, "ccw:")
+		if !ok {
+			continue
+		}
+
+		parsed := FirewallRule{ID: id, Chain: rule.Chain}
+		for _, expr := range rule.Expr {
+			parseNftExpr(&parsed, expr)
+		}
+		rules = append(rules, parsed)
+	}
+	return rules, nil
+}
+
+func (b *nftBackend) render(rules []FirewallRule) []string {
+	lines := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		lines = append(lines, fmt.Sprintf("add rule inet %s %s %s", nftTable, rule.Chain, nftRuleLine(rule)))
+	}
+	return lines
+}
+
+// apply replaces the agent's table in a single transaction, so the rules
+// never apply half way. Without rules the table is removed.
+func (b *nftBackend) apply(rules []FirewallRule) error {
+	var script strings.Builder
+	// Declaring the table first lets the delete succeed when it doesn't exist
+	fmt.Fprintf(&script, "table inet %s\ndelete table inet %s\n", nftTable, nftTable)
+	if len(rules) > 0 {
+		fmt.Fprintf(&script, "table inet %s {\n", nftTable)
+		for _, chain := range firewallChains {
+			fmt.Fprintf(&script, "\tchain %s {\n\t\ttype filter hook %s priority -1; policy accept;\n", chain, chain)
+			for _, rule := range rules {
+				if rule.Chain == chain {
+					fmt.Fprintf(&script, "\t\t%s\n", nftRuleLine(rule))
+				}
+			}
+			script.WriteString("\t}\n")
+		}
+		script.WriteString("}\n")
+	}
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Helper functions
+
+// nftRuleLine writes a rule in nft syntax, tagged with its ID
+func nftRuleLine(rule FirewallRule) string {
+	var parts []string
+	if rule.Interface != "" {
+		key := "iifname"
+		if rule.Chain == "output" {
+			key = "oifname"
+		}
+		parts = append(parts, fmt.Sprintf("%s %q", key, rule.Interface))
+	}
+
+	family := "ip"
+	if rule.family() == 6 {
+		family = "ip6"
+	}
+	if rule.Source != "" {
+		parts = append(parts, family+" saddr "+rule.Source)
+	}
+	if rule.Destination != "" {
+		parts = append(parts, family+" daddr "+rule.Destination)
+	}
+
+	switch {
+	case rule.Port != "":
+		parts = append(parts, rule.Protocol+" dport "+rule.Port)
+	case rule.Protocol == "icmpv6":
+		parts = append(parts, "meta l4proto ipv6-icmp")
+	case rule.Protocol != "":
+		parts = append(parts, "meta l4proto "+rule.Protocol)
+	}
+
+	parts = append(parts, "counter", rule.Action, fmt.Sprintf("comment %q", "ccw:"+rule.ID))
+	return strings.Join(parts, " ")
+}
+
+// parseNftExpr reads the expressions nftRuleLine writes back into rule
+func parseNftExpr(rule *FirewallRule, expr map[string]json.RawMessage) {
+	for _, verdict := range []string{"accept", "drop", "reject"} {
+		if _, ok := expr[verdict]; ok {
+			rule.Action = verdict
+			return
+		}
+	}
+
+	raw, ok := expr["match"]
+	if !ok {
+		return
+	}
+	var match nftMatch
+	if err := json.Unmarshal(raw, &match); err != nil {
+		return
+	}
+	value := nftValue(match.Right)
+
+	switch {
+	case match.Left.Meta != nil:
+		switch match.Left.Meta.Key {
+		case "iifname", "oifname":
+			rule.Interface = value
+		case "l4proto":
+			rule.Protocol = value
+			if value == "ipv6-icmp" {
+				rule.Protocol = "icmpv6"
+			}
+		}
+	case match.Left.Payload != nil:
+		switch match.Left.Payload.Field {
+		case "saddr":
+			rule.Source = value
+		case "daddr":
+			rule.Destination = value
+		case "dport":
+			rule.Protocol = match.Left.Payload.Protocol
+			rule.Port = value
+		}
+	}
+}
+
+// nftValue formats the right side of a match: a string, a number, a prefix
+// or a range
+func nftValue(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var number int
+	if json.Unmarshal(raw, &number) == nil {
+		return strconv.Itoa(number)
+	}
+
+	var value struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Range []json.RawMessage `json:"range"`
+	}
+	if json.Unmarshal(raw, &value) != nil {
+		return ""
+	}
+	switch {
+	case value.Prefix != nil:
+		return fmt.Sprintf("%s/%d", value.Prefix.Addr, value.Prefix.Len)
+	case len(value.Range) == 2:
+		return nftValue(value.Range[0]) + "-" + nftValue(value.Range[1])
+	}
+	return ""
+}
@@ -0,0 +1,482 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Events raised through the notifier
+const (
+	NotifyAuthFailure     = "auth.failure"     // a request or connection with a missing or unknown token
+	NotifyHealthFail      = "health.fail"      // a readiness check started failing
+	NotifyHealthRecover   = "health.recover"   // a failing readiness check passed again
+	NotifyDiskLow         = "disk.low"         // a write was refused by QUOTA_MIN_FREE_DISK
+	NotifyApprovalPending = "approval.pending" // an operation waits for approval
+)
+
+// Severities of notifications, in increasing order
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+var severityRank = map[string]int{SeverityInfo: 0, SeverityWarning: 1, SeverityCritical: 2}
+
+// notifyTimeout bounds the delivery of a notification to one channel
+const notifyTimeout = 15 * time.Second
+
+// channelTypes builds the sender of each type of channel
+var channelTypes = map[string]func(channel *NotifyChannel, client *http.Client) (notifySender, error){
+	"email":    newEmailSender,
+	"slack":    newSlackSender,
+	"telegram": newTelegramSender,
+	"webhook":  newWebhookSender,
+}
+
+// Notification is an alert raised by a module for the humans watching the
+// agent
+type Notification struct {
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"`
+	Subject  string    `json:"subject,omitempty"` // what it's about, e.g. a client address or a check
+	Message  string    `json:"message"`
+	Agent    string    `json:"agent"`
+	Time     time.Time `json:"time"`
+}
+
+// NotifyChannel is a destination of notifications configured by the
+// operator. The fields past Type are those of its type.
+type NotifyChannel struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Events      []string `json:"events,omitempty"`       // events, or prefixes ending with *, sent to the channel; all when empty
+	MinSeverity string   `json:"min_severity,omitempty"` // defaults to info
+
+	SMTPHost string   `json:"smtp_host,omitempty"` // host:port of the mail server, email
+	Username string   `json:"username,omitempty"`  // email
+	Password string   `json:"password,omitempty"`  // email
+	From     string   `json:"from,omitempty"`      // email
+	To       []string `json:"to,omitempty"`        // email
+
+	WebhookURL string `json:"webhook_url,omitempty"` // slack
+	BotToken   string `json:"bot_token,omitempty"`   // telegram
+	ChatID     string `json:"chat_id,omitempty"`     // telegram
+	URL        string `json:"url,omitempty"`         // webhook
+
+	sender notifySender
+}
+
+// notifySender delivers notifications to a channel
+type notifySender interface {
+	send(ctx context.Context, notification Notification) error
+}
+
+// Notifier sends the notifications raised by the modules to the channels of
+// the NOTIFY_CHANNELS file. The same event about the same subject is sent
+// once per NOTIFY_COOLDOWN, so a flood of failures makes a single alert.
+type Notifier struct {
+	agent    string
+	cooldown time.Duration
+	channels []*NotifyChannel // by name
+	sent     map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// NotifyRequest selects the channel a test notification is sent to
+type NotifyRequest struct {
+	Channel string `json:"channel"` // all channels when empty
+}
+
+// NotifyResult is the delivery of a test notification to a channel
+type NotifyResult struct {
+	Channel string `json:"channel"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type NotifyOperation struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func NewNotifier(config *Config, identity *AgentIdentity) (*Notifier, error) {
+	channels, err := loadNotifyChannels(config.NotifyChannels)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		agent:    identity.Name,
+		cooldown: config.NotifyCooldown,
+		channels: channels,
+		sent:     make(map[string]time.Time),
+	}, nil
+}
+
+// Notify raises a notification, sent in the background to the channels
+// subscribed to the event
+func (n *Notifier) Notify(event, severity, subject, format string, args ...interface{}) {
+	if len(n.channels) == 0 {
+		return
+	}
+
+	now := time.Now()
+	key := event + "\x00" + subject
+	n.mutex.Lock()
+	if last, exists := n.sent[key]; exists && now.Sub(last) < n.cooldown {
+		n.mutex.Unlock()
+		return
+	}
+	n.sent[key] = now
+	for key, last := range n.sent {
+		if now.Sub(last) >= n.cooldown {
+			delete(n.sent, key)
+		}
+	}
+	n.mutex.Unlock()
+
+	notification := Notification{
+		Event:    event,
+		Severity: severity,
+		Subject:  subject,
+		Message:  fmt.Sprintf(format, args...),
+		Agent:    n.agent,
+		Time:     now,
+	}
+	for _, channel := range n.channels {
+		if !channel.accepts(notification) {
+			continue
+		}
+		go func(channel *NotifyChannel) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := channel.sender.send(ctx, notification); err != nil {
+				log.Printf("Failed to send %s notification to %s: %v", event, channel.Name, err)
+			}
+		}(channel)
+	}
+}
+
+// REST API Handlers
+
+// ListChannels lists the notification channels, without their addresses
+// and credentials
+func (n *Notifier) ListChannels(c *gin.Context) {
+	channels := make([]map[string]interface{}, 0, len(n.channels))
+	for _, channel := range n.channels {
+		channels = append(channels, map[string]interface{}{
+			"name":         channel.Name,
+			"type":         channel.Type,
+			"events":       channel.Events,
+			"min_severity": channel.MinSeverity,
+		})
+	}
+
+	c.JSON(http.StatusOK, NotifyOperation{
+		Success: true,
+		Message: Localize(c, "Channels retrieved"),
+		Data:    channels,
+	})
+}
+
+// TestChannels sends a test notification to a channel, or to every channel,
+// and reports how each delivery went
+func (n *Notifier) TestChannels(c *gin.Context) {
+	if !RequestToken(c).HasScope(ScopeNotify) {
+		c.JSON(http.StatusForbidden, NotifyOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Sending notifications requires the notify permission"),
+		})
+		return
+	}
+
+	var req NotifyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, NotifyOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", err),
+			})
+			return
+		}
+	}
+
+	channels := n.channels
+	if req.Channel != "" {
+		channels = nil
+		for _, channel := range n.channels {
+			if channel.Name == req.Channel {
+				channels = []*NotifyChannel{channel}
+			}
+		}
+		if channels == nil {
+			c.JSON(http.StatusNotFound, NotifyOperation{
+				Success: false,
+				Code:    ErrNotFound,
+				Message: Localize(c, "Channel %s not found", req.Channel),
+			})
+			return
+		}
+	}
+
+	notification := Notification{
+		Event:    "test",
+		Severity: SeverityInfo,
+		Message:  fmt.Sprintf("Test notification sent by %s", RequestToken(c).Name),
+		Agent:    n.agent,
+		Time:     time.Now(),
+	}
+	results := make([]NotifyResult, len(channels))
+	var wg sync.WaitGroup
+	for i, channel := range channels {
+		wg.Add(1)
+		go func(i int, channel *NotifyChannel) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Request.Context(), notifyTimeout)
+			defer cancel()
+			results[i] = NotifyResult{Channel: channel.Name, Success: true}
+			if err := channel.sender.send(ctx, notification); err != nil {
+				results[i] = NotifyResult{Channel: channel.Name, Error: err.Error()}
+			}
+		}(i, channel)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if !result.Success {
+			c.JSON(http.StatusBadGateway, NotifyOperation{
+				Success: false,
+				Code:    ErrUpstream,
+				Message: Localize(c, "Failed to send the test notification to %s: %s", result.Channel, result.Error),
+				Data:    results,
+			})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, NotifyOperation{
+		Success: true,
+		Message: Localize(c, "Test notification sent"),
+		Data:    results,
+	})
+}
+
+// Helper functions
+
+// loadNotifyChannels reads the channels file, a JSON object of channels by
+// name. No file means no notifications.
+func loadNotifyChannels(path string) ([]*NotifyChannel, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("notification channels: %w", err)
+	}
+	byName := make(map[string]*NotifyChannel)
+	if err := json.Unmarshal(data, &byName); err != nil {
+		return nil, fmt.Errorf("notification channels: %s: %w", path, err)
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	channels := make([]*NotifyChannel, 0, len(byName))
+	for name, channel := range byName {
+		if channel == nil {
+			return nil, fmt.Errorf("notification channels: %s: channel %q is empty", path, name)
+		}
+		channel.Name = name
+		if channel.Events == nil {
+			channel.Events = []string{}
+		}
+		if channel.MinSeverity == "" {
+			channel.MinSeverity = SeverityInfo
+		}
+		if _, known := severityRank[channel.MinSeverity]; !known {
+			return nil, fmt.Errorf("notification channels: %s: channel %q: unknown severity %q", path, name, channel.MinSeverity)
+		}
+		build, known := channelTypes[channel.Type]
+		if !known {
+			return nil, fmt.Errorf("notification channels: %s: channel %q: unknown type %q", path, name, channel.Type)
+		}
+		if channel.sender, err = build(channel, client); err != nil {
+			return nil, fmt.Errorf("notification channels: %s: channel %q: %w", path, name, err)
+		}
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels, nil
+}
+
+// accepts reports whether a notification is sent to the channel
+func (channel *NotifyChannel) accepts(notification Notification) bool {
+	if severityRank[notification.Severity] < severityRank[channel.MinSeverity] {
+		return false
+	}
+	if len(channel.Events) == 0 {
+		return true
+	}
+	for _, event := range channel.Events {
+		if event == notification.Event {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(event, "*"); ok && strings.HasPrefix(notification.Event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// text renders a notification as a chat message
+func (notification Notification) text() string {
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(notification.Severity), notification.Agent, notification.Message)
+}
+
+// emailSender mails notifications, with STARTTLS when the server offers it
+type emailSender struct {
+	host string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func newEmailSender(channel *NotifyChannel, _ *http.Client) (notifySender, error) {
+	if channel.SMTPHost == "" || channel.From == "" || len(channel.To) == 0 {
+		return nil, fmt.Errorf("email channels require smtp_host, from and to")
+	}
+	host, _, err := net.SplitHostPort(channel.SMTPHost)
+	if err != nil {
+		return nil, fmt.Errorf("smtp_host: %w", err)
+	}
+	sender := &emailSender{host: channel.SMTPHost, from: channel.From, to: channel.To}
+	if channel.Username != "" {
+		sender.auth = smtp.PlainAuth("", channel.Username, channel.Password, host)
+	}
+	return sender, nil
+}
+
+func (s *emailSender) send(ctx context.Context, notification Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [%s] %s: %s\r\n", notification.Severity, notification.Agent, notification.Event)
+	fmt.Fprintf(&msg, "Date: %s\r\n", notification.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nEvent: %s\r\nSeverity: %s\r\n", notification.Message, notification.Event, notification.Severity)
+	if notification.Subject != "" {
+		fmt.Fprintf(&msg, "Subject: %s\r\n", notification.Subject)
+	}
+	fmt.Fprintf(&msg, "Agent: %s\r\nTime: %s\r\n", notification.Agent, notification.Time.Format(time.RFC3339))
+
+	// net/smtp takes no context, so the delivery is abandoned on timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.host, s.auth, s.from, s.to, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// slackSender posts notifications to a Slack incoming webhook
+type slackSender struct {
+	client *http.Client
+	url    string
+}
+
+func newSlackSender(channel *NotifyChannel, client *http.Client) (notifySender, error) {
+	if channel.WebhookURL == "" {
+		return nil, fmt.Errorf("slack channels require webhook_url")
+	}
+	return &slackSender{client: client, url: channel.WebhookURL}, nil
+}
+
+func (s *slackSender) send(ctx context.Context, notification Notification) error {
+	return postJSON(ctx, s.client, s.url, map[string]string{"text": notification.text()})
+}
+
+// telegramSender sends notifications to a Telegram chat through a bot
+type telegramSender struct {
+	client *http.Client
+	url    string
+	chatID string
+}
+
+func newTelegramSender(channel *NotifyChannel, client *http.Client) (notifySender, error) {
+	if channel.BotToken == "" || channel.ChatID == "" {
+		return nil, fmt.Errorf("telegram channels require bot_token and chat_id")
+	}
+	return &telegramSender{
+		client: client,
+		url:    "https://api.telegram.org/bot" + channel.BotToken + "/sendMessage",
+		chatID: channel.ChatID,
+	}, nil
+}
+
+func (s *telegramSender) send(ctx context.Context, notification Notification) error {
+	return postJSON(ctx, s.client, s.url, map[string]string{"chat_id": s.chatID, "text": notification.text()})
+}
+
+// webhookSender posts notifications as JSON to any URL
+type webhookSender struct {
+	client *http.Client
+	url    string
+}
+
+func newWebhookSender(channel *NotifyChannel, client *http.Client) (notifySender, error) {
+	if channel.URL == "" {
+		return nil, fmt.Errorf("webhook channels require url")
+	}
+	return &webhookSender{client: client, url: channel.URL}, nil
+}
+
+func (s *webhookSender) send(ctx context.Context, notification Notification) error {
+	return postJSON(ctx, s.client, s.url, notification)
+}
+
+// postJSON posts a JSON body, failing on responses other than 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL of Telegram holds the bot token, keep it out of the logs
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenFile is a file held open by a process, or its working directory, root
+// directory, executable or a mapped library
+type OpenFile struct {
+	ProcessInfo
+	FD      string `json:"fd"` // descriptor number, or cwd, root, exe or mem
+	Path    string `json:"path"`
+	Deleted bool   `json:"deleted"` // removed while still open, its space not freed yet
+}
+
+// REST API Handlers
+
+// OpenBy lists the processes holding a file, or anything below a directory,
+// open, as found in /proc/<pid>. Processes of other users are only visible
+// to root.
+func (fsm *FileSystemModule) OpenBy(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+
+	files, err := openFiles(path)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to list open files: %v", err),
+		})
+		return
+	}
+
+	page, total, next, err := paginate(c, files)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success:    true,
+		Message:    Localize(c, "Open files retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// Helper functions
+
+// openFiles finds the open files at or below path, by process and then
+// descriptor. A path that no longer exists still matches the deleted files
+// once held at it.
+func openFiles(path string) ([]OpenFile, error) {
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved // /proc links are resolved
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	files := make([]OpenFile, 0)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		var process *ProcessInfo
+		found := func(fd, link string) {
+			link, deleted := strings.CutSuffix(link, " (deleted)")
+			if !pathWithin(link, target) {
+				return
+			}
+			if process == nil {
+				process = readProcess(pid)
+			}
+			files = append(files, OpenFile{ProcessInfo: *process, FD: fd, Path: link, Deleted: deleted})
+		}
+
+		for _, name := range []string{"cwd", "root", "exe"} {
+			if link, err := os.Readlink(fmt.Sprintf("/proc/%d/%s", pid, name)); err == nil {
+				found(name, link)
+			}
+		}
+		if fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
+			sort.Slice(fds, func(i, j int) bool {
+				a, _ := strconv.Atoi(fds[i].Name())
+				b, _ := strconv.Atoi(fds[j].Name())
+				return a < b
+			})
+			for _, fd := range fds {
+				if link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name())); err == nil {
+					found(fd.Name(), link)
+				}
+			}
+		}
+		for _, mapped := range mappedFiles(pid) {
+			found("mem", mapped)
+		}
+	}
+	return files, nil
+}
+
+// mappedFiles returns the files mapped in the memory of a process, such as
+// its libraries, once each
+func mappedFiles(pid int) []string {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var paths []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address perms offset dev inode path
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		path := strings.TrimLeft(fields[5], " ")
+		if !strings.HasPrefix(path, "/") || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// pathWithin reports whether path is root or below it
+func pathWithin(path, root string) bool {
+	if path == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, root)
+}
@@ -0,0 +1,191 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultOutboundDeny blocks link-local addresses and the cloud metadata
+// services, which hand out instance credentials to anything that asks
+const defaultOutboundDeny = "169.254.0.0/16,fe80::/10,fd00:ec2::254/128,100.100.100.200/32,metadata.google.internal"
+
+// OutboundPolicy decides which hosts the agent may contact on behalf of a
+// request, so a token can't use the agent as a proxy into the internal network
+type OutboundPolicy struct {
+	allowHosts []string // host names, "*.example.com" also matches subdomains
+	allowNets  []*net.IPNet
+	denyHosts  []string
+	denyNets   []*net.IPNet
+	client     *http.Client
+}
+
+// policyTransport checks the host of every request, including redirects,
+// before sending it
+type policyTransport struct {
+	policy    *OutboundPolicy
+	transport *http.Transport
+}
+
+// NewOutboundPolicy parses OUTBOUND_ALLOW and OUTBOUND_DENY
+func NewOutboundPolicy(config *Config) (*OutboundPolicy, error) {
+	policy := &OutboundPolicy{}
+
+	var err error
+	if policy.allowHosts, policy.allowNets, err = parseHostList(config.OutboundAllow); err != nil {
+		return nil, fmt.Errorf("invalid OUTBOUND_ALLOW: %v", err)
+	}
+	if policy.denyHosts, policy.denyNets, err = parseHostList(config.OutboundDeny); err != nil {
+		return nil, fmt.Errorf("invalid OUTBOUND_DENY: %v", err)
+	}
+
+	policy.client = &http.Client{Transport: policy.wrap(policy.transport())}
+	return policy, nil
+}
+
+// Dial connects to addr if the policy allows it
+func (p *OutboundPolicy) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return p.dialer(addr).DialContext(ctx, network, addr)
+}
+
+// DialTimeout is Dial with a connection timeout
+func (p *OutboundPolicy) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := p.dialer(addr)
+	dialer.Timeout = timeout
+	return dialer.Dial(network, addr)
+}
+
+// Helper functions
+
+// parseHostList splits a comma-separated list of host names and CIDRs;
+// single IP addresses are accepted as CIDRs of one address
+func parseHostList(list string) ([]string, []*net.IPNet, error) {
+	var hosts []string
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, ipNet)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			hosts = append(hosts, strings.TrimSuffix(entry, "."))
+		}
+	}
+	return hosts, nets, nil
+}
+
+// checkHost decides on a host before connecting. Host names allowed by name
+// are only checked against the denied networks once resolved; other names
+// must resolve into the allowed networks. Without resolving them locally,
+// e.g. through a proxy, names must be allowed by name.
+func (p *OutboundPolicy) checkHost(host string, resolved bool) (allowedByName bool, err error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return false, p.checkIP(ip, false)
+	}
+	if matchHost(p.denyHosts, host) {
+		return false, fmt.Errorf("%w: %s", errHostNotAllowed, host)
+	}
+	if len(p.allowHosts) == 0 && len(p.allowNets) == 0 || matchHost(p.allowHosts, host) {
+		return true, nil
+	}
+	if resolved && len(p.allowNets) > 0 {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: %s", errHostNotAllowed, host)
+}
+
+// checkIP decides on a resolved address
+func (p *OutboundPolicy) checkIP(ip net.IP, allowedByName bool) error {
+	for _, ipNet := range p.denyNets {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("%w: %s", errHostNotAllowed, ip)
+		}
+	}
+	if allowedByName || len(p.allowHosts) == 0 && len(p.allowNets) == 0 {
+		return nil
+	}
+	for _, ipNet := range p.allowNets {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errHostNotAllowed, ip)
+}
+
+// dialer returns a dialer checking every address addr resolves to right
+// before connecting, so DNS rebinding can't sneak in a denied address
+func (p *OutboundPolicy) dialer(addr string) *net.Dialer {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			allowedByName, err := p.checkHost(host, true)
+			if err != nil {
+				return err
+			}
+			ipString, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return p.checkIP(net.ParseIP(ipString), allowedByName)
+		},
+	}
+}
+
+// transport returns an HTTP transport connecting through the policy
+func (p *OutboundPolicy) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = p.Dial
+	return transport
+}
+
+func (p *OutboundPolicy) wrap(transport *http.Transport) http.RoundTripper {
+	return &policyTransport{policy: p, transport: transport}
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Names sent to a proxy are resolved there, out of reach of the dialer
+	proxyURL, err := t.transport.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.policy.checkHost(req.URL.Hostname(), proxyURL == nil); err != nil {
+		return nil, err
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
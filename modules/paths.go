@@ -0,0 +1,158 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Paths normalizes the paths sent by clients before any module uses them:
+// cleaning them, expanding ~ against FS_HOME, resolving relative paths
+// from it, rejecting NUL bytes and, with FS_ROOT, keeping them inside the
+// sandbox root
+type Paths struct {
+	home      string
+	root      string // empty for no sandbox
+	bookmarks []Place
+}
+
+// NewPaths resolves the home and root directories of the config. Without
+// FS_HOME, the home is the root when there's one, the home of the user of
+// the agent otherwise.
+func NewPaths(config *Config) (*Paths, error) {
+	p := &Paths{home: config.FSHome}
+	if config.FSRoot != "" {
+		root, err := filepath.Abs(config.FSRoot)
+		if err != nil {
+			return nil, err
+		}
+		// Symlinks are resolved so paths are compared with the real root
+		if p.root, err = filepath.EvalSymlinks(root); err != nil {
+			return nil, fmt.Errorf("FS_ROOT: %w", err)
+		}
+		if p.home == "" {
+			p.home = p.root
+		}
+	}
+	if p.home == "" {
+		p.home, _ = os.UserHomeDir()
+	}
+	if p.home != "" {
+		home, err := filepath.Abs(p.home)
+		if err != nil {
+			return nil, err
+		}
+		p.home = home
+	}
+
+	for _, bookmark := range strings.Split(config.FSBookmarks, ",") {
+		if bookmark = strings.TrimSpace(bookmark); bookmark == "" {
+			continue
+		}
+		name, path, named := strings.Cut(bookmark, "=")
+		if !named {
+			path = name
+		}
+		path, err := p.resolve(strings.TrimSpace(path))
+		if err != nil {
+			return nil, fmt.Errorf("FS_BOOKMARKS: %w", err)
+		}
+		if name = strings.TrimSpace(name); !named || name == "" {
+			name = filepath.Base(path)
+		}
+		p.bookmarks = append(p.bookmarks, Place{Name: name, Path: path, Kind: "bookmark"})
+	}
+	return p, nil
+}
+
+// Resolve normalizes paths in place, leaving empty ones empty, and fails on
+// the first invalid one or one outside the root
+func (p *Paths) Resolve(paths ...*string) error {
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		resolved, err := p.resolve(*path)
+		if err != nil {
+			return err
+		}
+		*path = resolved
+	}
+	return nil
+}
+
+// Home is the directory ~ stands for
+func (p *Paths) Home() string {
+	return p.home
+}
+
+// Root is the sandbox root, empty when paths aren't confined
+func (p *Paths) Root() string {
+	return p.root
+}
+
+// Bookmarks are the places configured with FS_BOOKMARKS
+func (p *Paths) Bookmarks() []Place {
+	return p.bookmarks
+}
+
+// Helper functions
+
+func (p *Paths) resolve(path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", fmt.Errorf("%w: %q contains a NUL byte", errInvalidPath, path)
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		if p.home == "" {
+			return "", fmt.Errorf("%w: %s: no home directory to expand ~ against", errInvalidPath, path)
+		}
+		path = filepath.Join(p.home, path[1:])
+	} else if !filepath.IsAbs(path) {
+		if p.home == "" {
+			return "", fmt.Errorf("%w: %s: relative path without a home directory", errInvalidPath, path)
+		}
+		path = filepath.Join(p.home, path)
+	}
+	path = filepath.Clean(path)
+
+	if p.root != "" {
+		if !within(p.root, path) {
+			return "", fmt.Errorf("%w: %s", errOutsideRoot, path)
+		}
+		// Symlinks inside the root may point out of it
+		if real, err := realPath(path); err != nil || !within(p.root, real) {
+			return "", fmt.Errorf("%w: %s", errOutsideRoot, path)
+		}
+	}
+	return path, nil
+}
+
+// realPath resolves the symlinks of path, of its longest existing ancestor
+// when it doesn't exist yet
+func realPath(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return real, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	real, err = realPath(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(real, filepath.Base(path)), nil
+}
+
+// within tells whether path is dir or inside it, both clean and absolute
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
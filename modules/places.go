@@ -0,0 +1,181 @@
+package modules
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Place is a well-known location file browsers can start from
+type Place struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Kind string `json:"kind"` // home, root, temp, xdg, mount or bookmark
+}
+
+// xdgUserDirs are the keys of user-dirs.dirs with their default directory
+// below the home, in the order they're listed
+var xdgUserDirs = []struct{ key, name string }{
+	{"XDG_DESKTOP_DIR", "Desktop"},
+	{"XDG_DOCUMENTS_DIR", "Documents"},
+	{"XDG_DOWNLOAD_DIR", "Downloads"},
+	{"XDG_MUSIC_DIR", "Music"},
+	{"XDG_PICTURES_DIR", "Pictures"},
+	{"XDG_VIDEOS_DIR", "Videos"},
+	{"XDG_PUBLICSHARE_DIR", "Public"},
+	{"XDG_TEMPLATES_DIR", "Templates"},
+}
+
+// REST API Handlers
+
+// ListPlaces returns the home and temporary directories, the XDG user and
+// base directories, the mounted filesystems, and the configured bookmarks
+// followed by those of the token. Only existing directories inside FS_ROOT
+// are listed.
+func (fsm *FileSystemModule) ListPlaces(c *gin.Context) {
+	home := fsm.paths.Home()
+	places := []Place{{Name: "Home", Path: home, Kind: "home"}}
+	if root := fsm.paths.Root(); root != "" && root != home {
+		places = append(places, Place{Name: "Root", Path: root, Kind: "root"})
+	}
+	places = append(places, Place{Name: "Temp", Path: os.TempDir(), Kind: "temp"})
+	places = append(places, xdgPlaces()...)
+
+	var listed []Place
+	for _, place := range places {
+		if fsm.paths.Resolve(&place.Path) != nil {
+			continue
+		}
+		if info, err := os.Stat(place.Path); err == nil && info.IsDir() {
+			listed = append(listed, place)
+		}
+	}
+	// Mount points aren't checked with stat, which hangs on unresponsive
+	// network mounts
+	for _, place := range mountPlaces() {
+		if fsm.paths.Resolve(&place.Path) == nil {
+			listed = append(listed, place)
+		}
+	}
+	listed = append(listed, fsm.paths.Bookmarks()...)
+	for _, bookmark := range fsm.bookmarks.list(tokenName(RequestToken(c))) {
+		listed = append(listed, Place{Name: bookmark.Name, Path: bookmark.Path, Kind: "bookmark"})
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Places retrieved"),
+		Data:    listed,
+	})
+}
+
+// Helper functions
+
+// xdgPlaces returns the XDG user directories of user-dirs.dirs, or their
+// defaults, and the XDG base directories of the user running the agent
+func xdgPlaces() []Place {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	configDir := xdgDir("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	userDirs := readUserDirs(filepath.Join(configDir, "user-dirs.dirs"), home)
+	var places []Place
+	for _, dir := range xdgUserDirs {
+		path, ok := userDirs[dir.key]
+		if !ok {
+			path = filepath.Join(home, dir.name)
+		}
+		// A user directory set to the home itself is disabled
+		if filepath.Clean(path) != filepath.Clean(home) {
+			places = append(places, Place{Name: dir.name, Path: path, Kind: "xdg"})
+		}
+	}
+
+	if dir, err := os.UserConfigDir(); err == nil {
+		configDir = dir
+	}
+	cacheDir := xdgDir("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+	if dir, err := os.UserCacheDir(); err == nil {
+		cacheDir = dir
+	}
+	return append(places,
+		Place{Name: "Config", Path: configDir, Kind: "xdg"},
+		Place{Name: "Data", Path: xdgDir("XDG_DATA_HOME", filepath.Join(home, ".local", "share")), Kind: "xdg"},
+		Place{Name: "State", Path: xdgDir("XDG_STATE_HOME", filepath.Join(home, ".local", "state")), Kind: "xdg"},
+		Place{Name: "Cache", Path: cacheDir, Kind: "xdg"},
+	)
+}
+
+// xdgDir returns the directory of an XDG base directory variable, which
+// must be absolute to be used
+func xdgDir(name, fallback string) string {
+	if dir := os.Getenv(name); filepath.IsAbs(dir) {
+		return dir
+	}
+	return fallback
+}
+
+// readUserDirs reads the XDG_*_DIR="$HOME/..." lines of user-dirs.dirs
+func readUserDirs(path, home string) map[string]string {
+	dirs := make(map[string]string)
+	file, err := os.Open(path)
+	if err != nil {
+		return dirs
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if rest, found := strings.CutPrefix(value, "$HOME"); found {
+			value = home + rest
+		}
+		if filepath.IsAbs(value) {
+			dirs[key] = value
+		}
+	}
+	return dirs
+}
+
+// mountPlaces returns the mount points of block devices and network
+// filesystems, leaving out pseudo filesystems, loop devices and files bind
+// mounted by container runtimes
+func mountPlaces() []Place {
+	mounts, err := readMountTable()
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var places []Place
+	for _, mount := range mounts {
+		if seen[mount.Target] {
+			continue
+		}
+		if !mount.Network {
+			if !strings.HasPrefix(mount.Source, "/dev/") || strings.HasPrefix(mount.Source, "/dev/loop") {
+				continue
+			}
+			if info, err := os.Stat(mount.Target); err != nil || !info.IsDir() {
+				continue
+			}
+		}
+		seen[mount.Target] = true
+		name := filepath.Base(mount.Target)
+		if mount.Target == "/" {
+			name = "/"
+		}
+		places = append(places, Place{Name: name, Path: mount.Target, Kind: "mount"})
+	}
+	return places
+}
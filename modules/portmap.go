@@ -0,0 +1,316 @@
+package modules
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errNoGateway marks networks without a UPnP or NAT-PMP gateway
+var errNoGateway = errors.New("no UPnP or NAT-PMP gateway found")
+
+// errMappingNotFound marks external ports without a mapping to remove
+var errMappingNotFound = errors.New("no such port mapping")
+
+// errMappingConflict marks external ports the gateway already maps elsewhere
+var errMappingConflict = errors.New("external port already mapped")
+
+// PortMapping forwards an external port of the gateway to a LAN address
+type PortMapping struct {
+	Protocol       string `json:"protocol"` // tcp or udp
+	ExternalPort   int    `json:"external_port"`
+	InternalClient string `json:"internal_client"`
+	InternalPort   int    `json:"internal_port"`
+	RemoteHost     string `json:"remote_host,omitempty"` // only this host may connect, UPnP only
+	Description    string `json:"description,omitempty"`
+	Enabled        bool   `json:"enabled"`
+	Lease          int    `json:"lease"` // seconds left, 0 for permanent
+}
+
+type PortMappingRequest struct {
+	Protocol       string `json:"protocol" binding:"required,oneof=tcp udp"`
+	InternalPort   int    `json:"internal_port" binding:"required,min=1,max=65535"`
+	ExternalPort   int    `json:"external_port" binding:"min=0,max=65535"` // defaults to internal_port
+	InternalClient string `json:"internal_client"`                         // defaults to the agent's address towards the gateway
+	Description    string `json:"description"`
+	Lease          int    `json:"lease" binding:"min=0"` // seconds, 0 for permanent on UPnP and 7200 on NAT-PMP
+}
+
+// portMapper manages the port mappings of a gateway
+type portMapper interface {
+	name() string
+	gateway() string
+	externalIP() (string, error)
+	mappings() ([]PortMapping, error)
+	add(mapping PortMapping) (PortMapping, error) // returns the mapping granted
+	remove(protocol string, externalPort int) error
+}
+
+// REST API Handlers
+
+// ListPortMappings lists the port mappings of the gateway. NAT-PMP can't
+// list mappings, so only those made by the agent are returned.
+func (nm *NetworkModule) ListPortMappings(c *gin.Context) {
+	mapper, err := nm.portMapper()
+	var external string
+	var mappings []PortMapping
+	if err == nil {
+		if external, err = mapper.externalIP(); err == nil {
+			mappings, err = mapper.mappings()
+		}
+	}
+	if err != nil {
+		nm.portMappingFailed(c, err, "Failed to list port mappings: %v")
+		return
+	}
+
+	page, total, next, err := paginate(c, mappings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Port mappings retrieved"),
+		Data: map[string]interface{}{
+			"protocol":    mapper.name(),
+			"gateway":     mapper.gateway(),
+			"external_ip": external,
+			"mappings":    page,
+		},
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// AddPortMapping forwards an external port of the gateway to a LAN address
+func (nm *NetworkModule) AddPortMapping(c *gin.Context) {
+	if !nm.portMappingAuthorized(c) {
+		return
+	}
+	var req PortMappingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if req.InternalClient != "" && net.ParseIP(req.InternalClient).To4() == nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", fmt.Sprintf("invalid IPv4 address %q", req.InternalClient)),
+		})
+		return
+	}
+	if strings.ContainsAny(req.Description, "<>&\r\n") {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "description must be a single line of text"),
+		})
+		return
+	}
+
+	mapper, err := nm.portMapper()
+	if err != nil {
+		nm.portMappingFailed(c, err, "Failed to add port mapping: %v")
+		return
+	}
+	mapping := PortMapping{
+		Protocol:       req.Protocol,
+		ExternalPort:   req.ExternalPort,
+		InternalClient: req.InternalClient,
+		InternalPort:   req.InternalPort,
+		Description:    req.Description,
+		Enabled:        true,
+		Lease:          req.Lease,
+	}
+	if mapping.ExternalPort == 0 {
+		mapping.ExternalPort = mapping.InternalPort
+	}
+	if mapping.Description == "" {
+		mapping.Description = "ccw"
+	}
+	if mapping.InternalClient == "" {
+		if mapping.InternalClient, err = localAddressTowards(mapper.gateway()); err != nil {
+			nm.portMappingFailed(c, err, "Failed to add port mapping: %v")
+			return
+		}
+	}
+
+	if mapping, err = mapper.add(mapping); err != nil {
+		nm.portMappingFailed(c, err, "Failed to add port mapping: %v")
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Port %d/%s mapped to %s:%d", mapping.ExternalPort, mapping.Protocol, mapping.InternalClient, mapping.InternalPort),
+		Data:    mapping,
+	})
+}
+
+// RemovePortMapping deletes the mapping of an external port, given by the
+// protocol and external_port query parameters
+func (nm *NetworkModule) RemovePortMapping(c *gin.Context) {
+	if !nm.portMappingAuthorized(c) {
+		return
+	}
+	protocol := c.Query("protocol")
+	port, err := strconv.Atoi(c.Query("external_port"))
+	if protocol != "tcp" && protocol != "udp" || err != nil || port < 1 || port > 65535 {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "protocol must be tcp or udp and external_port a port number"),
+		})
+		return
+	}
+
+	mapper, err := nm.portMapper()
+	if err == nil {
+		err = mapper.remove(protocol, port)
+	}
+	if err != nil {
+		nm.portMappingFailed(c, err, "Failed to remove port mapping: %v")
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Port mapping %d/%s removed", port, protocol),
+	})
+}
+
+// Helper functions
+
+// portMapper returns the gateway found last, or looks for one: a UPnP
+// Internet Gateway Device, then a NAT-PMP gateway at the default route
+func (nm *NetworkModule) portMapper() (portMapper, error) {
+	nm.portmapMu.Lock()
+	defer nm.portmapMu.Unlock()
+	if nm.portmap != nil {
+		return nm.portmap, nil
+	}
+
+	backend := nm.config.PortmapBackend
+	var failures []string
+	if backend != "natpmp" {
+		mapper, err := discoverUPnP(nm.outbound.client, nm.config.UPnPLocation)
+		if err == nil {
+			nm.portmap = mapper
+			return mapper, nil
+		}
+		failures = append(failures, fmt.Sprintf("UPnP: %v", err))
+	}
+	if backend != "upnp" {
+		mapper, err := discoverNATPMP(nm.config.NATPMPGateway)
+		if err == nil {
+			nm.portmap = mapper
+			return mapper, nil
+		}
+		failures = append(failures, fmt.Sprintf("NAT-PMP: %v", err))
+	}
+	return nil, fmt.Errorf("%w (%s)", errNoGateway, strings.Join(failures, "; "))
+}
+
+func (nm *NetworkModule) portMappingAuthorized(c *gin.Context) bool {
+	if !RequestToken(c).HasScope(ScopeFirewall) {
+		c.JSON(http.StatusForbidden, NetworkOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Changing port mappings requires the firewall permission"),
+		})
+		return false
+	}
+	return true
+}
+
+// portMappingFailed responds to a failed gateway request. A gateway that
+// stopped answering is looked for again on the next request.
+func (nm *NetworkModule) portMappingFailed(c *gin.Context, err error, message string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoGateway):
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, message, err),
+		})
+		return
+	case errors.Is(err, errMappingNotFound):
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, message, err),
+		})
+		return
+	case errors.Is(err, errMappingConflict):
+		c.JSON(http.StatusConflict, NetworkOperation{
+			Success: false,
+			Code:    ErrConflict,
+			Message: Localize(c, message, err),
+		})
+		return
+	case errors.As(err, &netErr):
+		nm.portmapMu.Lock()
+		nm.portmap = nil
+		nm.portmapMu.Unlock()
+	}
+	c.JSON(errorStatus(err), NetworkOperation{
+		Success: false,
+		Code:    errorCode(err),
+		Message: Localize(c, message, err),
+	})
+}
+
+// localAddressTowards returns the local address the agent reaches host from
+func localAddressTowards(host string) (string, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(host, "9"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// defaultGateway reads the IPv4 default route from the routing table
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Iface, Destination, Gateway, Flags, ... in little-endian hex
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 || binary.LittleEndian.Uint32(gateway) == 0 {
+			continue
+		}
+		return net.IPv4(gateway[3], gateway[2], gateway[1], gateway[0]), nil
+	}
+	return nil, errors.New("no default route")
+}
@@ -0,0 +1,78 @@
+package modules
+
+import (
+	"fmt"
+	"time"
+)
+
+// portBackend lists the listening sockets and TCP connections of the host,
+// with the platform's own interface: /proc or sock_diag on Linux, lsof on
+// macOS, sockstat on FreeBSD, netstat on the other BSDs and iphlpapi on
+// Windows
+type portBackend interface {
+	name() string
+	listening(protocols []string, iface string) (map[int]portSocket, error)
+	owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo
+	connections() ([]portConnection, error) // TCP connections not listening
+}
+
+// portWatcher is a portBackend that lists ports cheaply enough to scan
+// often, and is told by the kernel of closed sockets
+type portWatcher interface {
+	scanInterval() time.Duration
+	watchClosed(protocols []string, ports chan<- int, stop <-chan bool) error
+}
+
+// portSocket is a listening socket. On Linux it is identified by its inode,
+// matched against the descriptors of processes; on Windows by the PID of its
+// process; other backends know its owner as they list it.
+type portSocket struct {
+	inode uint64
+	uid   int
+	pid   int
+	owner *ProcessInfo
+}
+
+// portConnection is a TCP connection on a local port, in one of the states
+// named after /proc/net/tcp
+type portConnection struct {
+	port  int
+	state string
+}
+
+// errPortsUnsupported is the error of port listing on platforms without a
+// backend
+var errPortsUnsupported = fmt.Errorf("%w: listing ports", errUnsupported)
+
+// Helper functions
+
+// socketOwners returns the owners the backend found while listing, for the
+// backends that don't look them up afterwards
+func socketOwners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	owners := make(map[int]*ProcessInfo)
+	for _, port := range ports {
+		if owner := sockets[port].owner; owner != nil {
+			owners[port] = owner
+		}
+	}
+	return owners
+}
+
+// unsupportedPorts is the backend of platforms ports can't be listed on
+type unsupportedPorts struct{}
+
+func (unsupportedPorts) name() string {
+	return "none"
+}
+
+func (unsupportedPorts) listening([]string, string) (map[int]portSocket, error) {
+	return nil, errPortsUnsupported
+}
+
+func (unsupportedPorts) owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	return socketOwners(sockets, ports)
+}
+
+func (unsupportedPorts) connections() ([]portConnection, error) {
+	return nil, errPortsUnsupported
+}
@@ -0,0 +1,8 @@
+//go:build openbsd || netbsd
+
+package modules
+
+// newPortBackend lists the sockets with netstat, without their processes
+func newPortBackend(config *Config) portBackend {
+	return netstatPorts{}
+}
@@ -0,0 +1,69 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// newPortBackend lists the sockets with netstat and their processes with
+// lsof, both shipped with macOS
+func newPortBackend(config *Config) portBackend {
+	return lsofPorts{}
+}
+
+// lsofPorts finds the processes owning ports with lsof, which reads them
+// through libproc. Processes of other users are only visible to root.
+type lsofPorts struct {
+	netstatPorts
+}
+
+func (lsofPorts) name() string {
+	return "lsof"
+}
+
+func (lsofPorts) owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	owners := make(map[int]*ProcessInfo)
+	if len(ports) == 0 {
+		return owners
+	}
+	wanted := make(map[int]bool)
+	for _, port := range ports {
+		wanted[port] = true
+	}
+
+	// One record per process (p, c and u lines) then per file (n lines)
+	output, _ := portCommand("lsof", "-nP", "-F", "pcun", "-iTCP", "-sTCP:LISTEN", "-iUDP")
+	var process *ProcessInfo
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		switch value := line[1:]; line[0] {
+		case 'p':
+			pid, _ := strconv.Atoi(value)
+			process = &ProcessInfo{PID: pid}
+		case 'c':
+			if process != nil {
+				process.Name = value
+			}
+		case 'u':
+			if process != nil {
+				uid, _ := strconv.Atoi(value)
+				process.User = userName(uid)
+			}
+		case 'n':
+			// Connected UDP sockets are named local->remote
+			local, _, _ := strings.Cut(value, "->")
+			colon := strings.LastIndex(local, ":")
+			port, err := strconv.Atoi(local[colon+1:])
+			if err == nil && process != nil && wanted[port] && owners[port] == nil {
+				owners[port] = process
+			}
+		}
+	}
+	return owners
+}
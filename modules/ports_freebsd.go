@@ -0,0 +1,53 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// newPortBackend lists the sockets with netstat and their processes with
+// sockstat, both in the base system
+func newPortBackend(config *Config) portBackend {
+	return sockstatPorts{}
+}
+
+// sockstatPorts finds the processes owning ports with sockstat
+type sockstatPorts struct {
+	netstatPorts
+}
+
+func (sockstatPorts) name() string {
+	return "sockstat"
+}
+
+func (sockstatPorts) owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	owners := make(map[int]*ProcessInfo)
+	if len(ports) == 0 {
+		return owners
+	}
+	wanted := make(map[int]bool)
+	for _, port := range ports {
+		wanted[port] = true
+	}
+
+	output, _ := portCommand("sockstat", "-46l", "-P", "tcp,udp")
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		// USER COMMAND PID FD PROTO LOCAL-ADDRESS FOREIGN-ADDRESS
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		colon := strings.LastIndex(fields[5], ":")
+		port, err := strconv.Atoi(fields[5][colon+1:])
+		if err != nil || !wanted[port] || owners[port] != nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(fields[2])
+		owners[port] = &ProcessInfo{PID: pid, Name: fields[1], User: fields[0]}
+	}
+	return owners
+}
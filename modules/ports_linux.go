@@ -0,0 +1,243 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tcpStates names the socket states of /proc/net/tcp
+var tcpStates = map[string]string{
+	"01": "established",
+	"02": "syn_sent",
+	"03": "syn_recv",
+	"04": "fin_wait1",
+	"05": "fin_wait2",
+	"06": "time_wait",
+	"07": "close",
+	"08": "close_wait",
+	"09": "last_ack",
+	"0B": "closing",
+}
+
+// newPortBackend picks sock_diag unless PORT_MONITOR_BACKEND is proc or the
+// kernel doesn't answer it, /proc otherwise
+func newPortBackend(config *Config) portBackend {
+	if config.PortMonitorBackend == "proc" {
+		return procPorts{}
+	}
+	if sockDiagSupported() {
+		return netlinkPorts{}
+	}
+	if config.PortMonitorBackend == "netlink" {
+		log.Printf("sock_diag is unavailable, port monitoring falls back to polling /proc")
+	}
+	return procPorts{}
+}
+
+// procPorts reads the sockets of /proc/net/tcp and /proc/net/udp
+type procPorts struct{}
+
+func (procPorts) name() string {
+	return "proc"
+}
+
+func (procPorts) listening(protocols []string, iface string) (map[int]portSocket, error) {
+	files := map[string]string{
+		"tcp": "/proc/net/tcp",
+		"udp": "/proc/net/udp",
+	}
+
+	ports := make(map[int]portSocket)
+	for _, proto := range protocols {
+		path, ok := files[proto]
+		if !ok {
+			continue
+		}
+		for port, socket := range parsePortsFile(path, iface) {
+			if _, seen := ports[port]; !seen {
+				ports[port] = socket
+			}
+		}
+	}
+	return ports, nil
+}
+
+// owners finds the processes owning the sockets of ports by matching their
+// inodes to the file descriptors in /proc/<pid>/fd. Processes of other users
+// are only visible to root; for those only the user is known.
+func (procPorts) owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	wanted := make(map[uint64]int) // port by inode
+	for _, port := range ports {
+		if inode := sockets[port].inode; inode != 0 {
+			wanted[inode] = port
+		}
+	}
+
+	owners := make(map[int]*ProcessInfo)
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		if len(owners) == len(wanted) {
+			break
+		}
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if port, ok := wanted[inode]; ok && owners[port] == nil {
+				owners[port] = readProcess(pid)
+			}
+		}
+	}
+
+	for _, port := range ports {
+		if owners[port] == nil {
+			owners[port] = &ProcessInfo{User: userName(sockets[port].uid)}
+		}
+	}
+	return owners
+}
+
+// connections reads the TCP connections of /proc/net/tcp and
+// /proc/net/tcp6, IPv4 and IPv6
+func (procPorts) connections() ([]portConnection, error) {
+	var connections []portConnection
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // skip header
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 {
+				continue
+			}
+			state, ok := tcpStates[fields[3]]
+			if !ok {
+				continue
+			}
+			colon := strings.LastIndex(fields[1], ":")
+			port, err := strconv.ParseInt(fields[1][colon+1:], 16, 32)
+			if err != nil {
+				continue
+			}
+			connections = append(connections, portConnection{port: int(port), state: state})
+		}
+		f.Close()
+	}
+	return connections, nil
+}
+
+// netlinkPorts lists the listening sockets through sock_diag, falling back
+// to /proc when a dump fails
+type netlinkPorts struct {
+	procPorts
+}
+
+func (netlinkPorts) name() string {
+	return "netlink"
+}
+
+func (b netlinkPorts) listening(protocols []string, iface string) (map[int]portSocket, error) {
+	if ports, err := sockDiagPorts(protocols, iface); err == nil {
+		return ports, nil
+	}
+	return b.procPorts.listening(protocols, iface)
+}
+
+func (netlinkPorts) scanInterval() time.Duration {
+	return sockDiagInterval
+}
+
+func (netlinkPorts) watchClosed(protocols []string, ports chan<- int, stop <-chan bool) error {
+	return watchSocketDestroy(protocols, ports, stop)
+}
+
+// Helper functions
+
+func parsePortsFile(file string, iface string) map[int]portSocket {
+	ports := make(map[int]portSocket)
+	f, err := os.Open(file)
+	if err != nil {
+		return ports
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip header
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		localAddress := fields[1]
+		ipPort := strings.Split(localAddress, ":")
+		if len(ipPort) != 2 {
+			continue
+		}
+
+		ipHex := ipPort[0]
+		portHex := ipPort[1]
+		ip := parseHexIP(ipHex)
+
+		if iface != "any" && iface != ip {
+			continue
+		}
+
+		port, err := strconv.ParseInt(portHex, 16, 32)
+		if err != nil {
+			continue
+		}
+		// Keep the first socket of ports bound several times, e.g. on IPv4 and IPv6
+		if _, seen := ports[int(port)]; !seen {
+			uid, _ := strconv.Atoi(fields[7])
+			inode, _ := strconv.ParseUint(fields[9], 10, 64)
+			ports[int(port)] = portSocket{inode: inode, uid: uid}
+		}
+	}
+
+	return ports
+}
+
+func parseHexIP(hexIP string) string {
+	if len(hexIP) != 8 {
+		return ""
+	}
+
+	ipBytes := []string{
+		hexIP[6:8],
+		hexIP[4:6],
+		hexIP[2:4],
+		hexIP[0:2],
+	}
+
+	parts := make([]string, 4)
+	for i, b := range ipBytes {
+		val, _ := strconv.ParseUint(b, 16, 8)
+		parts[i] = fmt.Sprintf("%d", val)
+	}
+
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,144 @@
+//go:build darwin || freebsd || openbsd || netbsd
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// netstatStates names the TCP states printed by netstat like the ones of
+// /proc/net/tcp
+var netstatStates = map[string]string{
+	"ESTABLISHED": "established",
+	"SYN_SENT":    "syn_sent",
+	"SYN_RCVD":    "syn_recv",
+	"FIN_WAIT_1":  "fin_wait1",
+	"FIN_WAIT_2":  "fin_wait2",
+	"TIME_WAIT":   "time_wait",
+	"CLOSED":      "close",
+	"CLOSE_WAIT":  "close_wait",
+	"LAST_ACK":    "last_ack",
+	"CLOSING":     "closing",
+}
+
+// portCommandTimeout bounds the commands listing sockets
+const portCommandTimeout = 10 * time.Second
+
+// netstatPorts lists the sockets with netstat, which reads the protocol
+// control blocks through sysctl and sees the sockets of every user, but
+// not their processes
+type netstatPorts struct{}
+
+func (netstatPorts) name() string {
+	return "netstat"
+}
+
+func (netstatPorts) listening(protocols []string, iface string) (map[int]portSocket, error) {
+	ports := make(map[int]portSocket)
+	for _, protocol := range protocols {
+		sockets, err := netstatSockets(protocol)
+		if err != nil {
+			return nil, err
+		}
+		for _, socket := range sockets {
+			// UDP has no listening state, every bound socket is listed
+			if protocol == "tcp" && socket.state != "LISTEN" {
+				continue
+			}
+			if iface != "any" && iface != socket.ip {
+				continue
+			}
+			if _, seen := ports[socket.port]; !seen {
+				ports[socket.port] = portSocket{}
+			}
+		}
+	}
+	return ports, nil
+}
+
+func (netstatPorts) owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	return socketOwners(sockets, ports)
+}
+
+func (netstatPorts) connections() ([]portConnection, error) {
+	sockets, err := netstatSockets("tcp")
+	if err != nil {
+		return nil, err
+	}
+	var connections []portConnection
+	for _, socket := range sockets {
+		if state, ok := netstatStates[socket.state]; ok {
+			connections = append(connections, portConnection{port: socket.port, state: state})
+		}
+	}
+	return connections, nil
+}
+
+// Helper functions
+
+// netstatSocket is a line of netstat -an
+type netstatSocket struct {
+	ip    string // 0.0.0.0 for any address, like /proc
+	port  int
+	state string // empty for UDP
+}
+
+// netstatSockets lists the sockets of a protocol, IPv4 and IPv6
+func netstatSockets(protocol string) ([]netstatSocket, error) {
+	output, err := portCommand("netstat", "-an", "-p", protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	var sockets []netstatSocket
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// Proto Recv-Q Send-Q Local-Address Foreign-Address (state)
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], protocol) {
+			continue
+		}
+		ip, port, ok := splitNetstatAddress(fields[3])
+		if !ok {
+			continue
+		}
+		socket := netstatSocket{ip: ip, port: port}
+		if len(fields) > 5 {
+			socket.state = fields[5]
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets, nil
+}
+
+// splitNetstatAddress splits the address.port of netstat, *.port standing
+// for any address
+func splitNetstatAddress(address string) (string, int, bool) {
+	dot := strings.LastIndex(address, ".")
+	if dot < 0 {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(address[dot+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	ip := address[:dot]
+	if ip == "*" {
+		ip = "0.0.0.0"
+	}
+	return ip, port, true
+}
+
+// portCommand runs a command listing sockets and returns its output
+func portCommand(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), portCommandTimeout)
+	defer cancel()
+
+	return exec.CommandContext(ctx, name, args...).Output()
+}
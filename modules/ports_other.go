@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !windows
+
+package modules
+
+// newPortBackend fails to list ports, the platform has no backend
+func newPortBackend(config *Config) portBackend {
+	return unsupportedPorts{}
+}
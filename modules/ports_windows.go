@@ -0,0 +1,203 @@
+package modules
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Table classes of GetExtendedTcpTable and GetExtendedUdpTable
+const (
+	tcpTableOwnerPidAll = 5
+	udpTableOwnerPid    = 1
+)
+
+// mibTCPStates names the MIB_TCP_STATE values like the states of
+// /proc/net/tcp
+var mibTCPStates = map[uint32]string{
+	1:  "close",
+	3:  "syn_sent",
+	4:  "syn_recv",
+	5:  "established",
+	6:  "fin_wait1",
+	7:  "fin_wait2",
+	8:  "close_wait",
+	9:  "closing",
+	10: "last_ack",
+	11: "time_wait",
+}
+
+// mibTCPListen is the MIB_TCP_STATE of listening sockets
+const mibTCPListen = 2
+
+var (
+	iphlpapi                = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedTcpTable = iphlpapi.NewProc("GetExtendedTcpTable")
+	procGetExtendedUdpTable = iphlpapi.NewProc("GetExtendedUdpTable")
+)
+
+// newPortBackend lists the sockets with the IP Helper API
+func newPortBackend(config *Config) portBackend {
+	return iphlpapiPorts{}
+}
+
+// iphlpapiPorts reads the TCP and UDP tables of the IP Helper API, which
+// list the sockets of every user with the PID of their process
+type iphlpapiPorts struct{}
+
+func (iphlpapiPorts) name() string {
+	return "iphlpapi"
+}
+
+func (iphlpapiPorts) listening(protocols []string, iface string) (map[int]portSocket, error) {
+	ports := make(map[int]portSocket)
+	for _, protocol := range protocols {
+		sockets, err := iphlpapiSockets(protocol)
+		if err != nil {
+			return nil, err
+		}
+		for _, socket := range sockets {
+			// UDP has no listening state, every bound socket is listed
+			if protocol == "tcp" && socket.state != mibTCPListen {
+				continue
+			}
+			if iface != "any" && iface != socket.ip {
+				continue
+			}
+			if _, seen := ports[socket.port]; !seen {
+				ports[socket.port] = portSocket{pid: socket.pid}
+			}
+		}
+	}
+	return ports, nil
+}
+
+// owners describes the processes of the PIDs listed with the sockets
+func (iphlpapiPorts) owners(sockets map[int]portSocket, ports []int) map[int]*ProcessInfo {
+	owners := make(map[int]*ProcessInfo)
+	for _, port := range ports {
+		if socket, ok := sockets[port]; ok && socket.pid != 0 {
+			owners[port] = readProcess(socket.pid)
+		}
+	}
+	return owners
+}
+
+func (iphlpapiPorts) connections() ([]portConnection, error) {
+	sockets, err := iphlpapiSockets("tcp")
+	if err != nil {
+		return nil, err
+	}
+	var connections []portConnection
+	for _, socket := range sockets {
+		if state, ok := mibTCPStates[socket.state]; ok {
+			connections = append(connections, portConnection{port: socket.port, state: state})
+		}
+	}
+	return connections, nil
+}
+
+// Helper functions
+
+// iphlpapiSocket is a row of a TCP or UDP table
+type iphlpapiSocket struct {
+	ip    string // 0.0.0.0 or :: for any address
+	port  int
+	state uint32 // 0 for UDP
+	pid   int
+}
+
+// iphlpapiSockets lists the sockets of a protocol, IPv4 and IPv6
+func iphlpapiSockets(protocol string) ([]iphlpapiSocket, error) {
+	var sockets []iphlpapiSocket
+	for _, family := range []uint32{windows.AF_INET, windows.AF_INET6} {
+		var table []byte
+		var err error
+		if protocol == "tcp" {
+			table, err = extendedTable(procGetExtendedTcpTable, family, tcpTableOwnerPidAll)
+		} else {
+			table, err = extendedTable(procGetExtendedUdpTable, family, udpTableOwnerPid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sockets = append(sockets, parseExtendedTable(table, protocol, family)...)
+	}
+	return sockets, nil
+}
+
+// extendedTable calls GetExtendedTcpTable or GetExtendedUdpTable, growing the
+// buffer while the table grows between calls
+func extendedTable(proc *windows.LazyProc, family, class uint32) ([]byte, error) {
+	if err := proc.Find(); err != nil {
+		return nil, err
+	}
+	size := uint32(4096)
+	for {
+		table := make([]byte, size)
+		ret, _, _ := proc.Call(
+			uintptr(unsafe.Pointer(&table[0])),
+			uintptr(unsafe.Pointer(&size)),
+			0, // unsorted
+			uintptr(family),
+			uintptr(class),
+			0,
+		)
+		switch windows.Errno(ret) {
+		case 0:
+			return table[:size], nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		default:
+			return nil, windows.Errno(ret)
+		}
+	}
+}
+
+// parseExtendedTable parses the rows of a MIB_TCPTABLE_OWNER_PID,
+// MIB_TCP6TABLE_OWNER_PID, MIB_UDPTABLE_OWNER_PID or MIB_UDP6TABLE_OWNER_PID,
+// a count of rows followed by the rows
+func parseExtendedTable(table []byte, protocol string, family uint32) []iphlpapiSocket {
+	// Offsets of the local address, local port, state and PID in a row,
+	// -1 for fields the row doesn't have
+	rowSize, addr, port, state, pid := 0, 0, 0, -1, 0
+	switch {
+	case protocol == "tcp" && family == windows.AF_INET:
+		rowSize, addr, port, state, pid = 24, 4, 8, 0, 20
+	case protocol == "tcp":
+		rowSize, addr, port, state, pid = 56, 0, 20, 48, 52
+	case family == windows.AF_INET:
+		rowSize, addr, port, pid = 12, 0, 4, 8
+	default:
+		rowSize, addr, port, pid = 28, 0, 20, 24
+	}
+	addrSize := net.IPv4len
+	if family == windows.AF_INET6 {
+		addrSize = net.IPv6len
+	}
+
+	if len(table) < 4 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint32(table))
+	var sockets []iphlpapiSocket
+	for i := 0; i < count; i++ {
+		row := table[4+i*rowSize:]
+		if len(row) < rowSize {
+			break
+		}
+		socket := iphlpapiSocket{
+			ip: net.IP(row[addr : addr+addrSize]).String(),
+			// The port is in network byte order in the low 16 bits
+			port: int(binary.BigEndian.Uint16(row[port : port+2])),
+			pid:  int(binary.LittleEndian.Uint32(row[pid:])),
+		}
+		if state >= 0 {
+			socket.state = binary.LittleEndian.Uint32(row[state:])
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
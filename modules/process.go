@@ -0,0 +1,24 @@
+package modules
+
+import (
+	"os/user"
+	"strconv"
+)
+
+// ProcessInfo identifies the process owning a port
+type ProcessInfo struct {
+	PID     int    `json:"pid,omitempty"`
+	Name    string `json:"name,omitempty"`
+	User    string `json:"user"`
+	Cmdline string `json:"cmdline,omitempty"`
+}
+
+// Helper functions
+
+// userName returns the name of uid, or the uid itself if it has none
+func userName(uid int) string {
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
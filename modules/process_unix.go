@@ -0,0 +1,39 @@
+//go:build !windows
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// readProcess describes the process pid from /proc
+func readProcess(pid int) *ProcessInfo {
+	info := &ProcessInfo{PID: pid}
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		info.Name = strings.TrimSpace(string(comm))
+	}
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		info.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if stat, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+		if uid, _, ok := fileOwner(stat); ok {
+			info.User = userName(int(uid))
+		}
+	}
+	return info
+}
+
+// processRunning reports whether the process pid exists. Signal 0 only
+// checks that; EPERM means it exists but belongs to another user.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,58 @@
+package modules
+
+import (
+	"errors"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// readProcess describes the process pid from its image and token. Processes
+// of other users can only be opened by administrators; for those only the
+// PID is known.
+func readProcess(pid int) *ProcessInfo {
+	info := &ProcessInfo{PID: pid}
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return info
+	}
+	defer windows.CloseHandle(process)
+
+	buffer := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buffer))
+	if err := windows.QueryFullProcessImageName(process, 0, &buffer[0], &size); err == nil {
+		info.Cmdline = windows.UTF16ToString(buffer[:size])
+		info.Name = filepath.Base(info.Cmdline)
+	}
+
+	var token windows.Token
+	if err := windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token); err == nil {
+		defer token.Close()
+		if owner, err := token.GetTokenUser(); err == nil {
+			if account, domain, _, err := owner.User.Sid.LookupAccount(""); err == nil {
+				info.User = domain + `\` + account
+			}
+		}
+	}
+	return info
+}
+
+// stillActive is the exit code of a process that hasn't exited yet
+const stillActive = 259
+
+// processRunning reports whether the process pid exists and hasn't exited.
+// os.Process.Signal can't probe a process on Windows; a process of another
+// user can't be opened without administrator rights but still exists.
+func processRunning(pid int) bool {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return errors.Is(err, windows.ERROR_ACCESS_DENIED)
+	}
+	defer windows.CloseHandle(process)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(process, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
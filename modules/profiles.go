@@ -0,0 +1,213 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Restart backoff of keepalive sessions: the delay doubles while the process
+// keeps exiting soon after starting
+const (
+	profileRestartDelay    = time.Second
+	profileRestartMaxDelay = 30 * time.Second
+	profileStableAfter     = 10 * time.Second
+)
+
+// ShellProfile is a named shell configured by the operator, e.g. an
+// application or database console
+type ShellProfile struct {
+	Name        string            `json:"name"`
+	Command     string            `json:"command"` // defaults to /bin/bash
+	Args        []string          `json:"args,omitempty"`
+	Cwd         string            `json:"cwd,omitempty"` // defaults to the home of user, or /
+	Env         map[string]string `json:"env,omitempty"`
+	User        string            `json:"user,omitempty"`         // runs as this user, requires root
+	Keepalive   bool              `json:"keepalive,omitempty"`    // restarts the process when it exits
+	MaxRestarts int               `json:"max_restarts,omitempty"` // 0 for unlimited
+	DisconnectPolicy
+}
+
+// REST API Handlers
+
+// GetProfiles lists the shell profiles. Only the names of their environment
+// variables are listed, as values may be secrets.
+func (sm *ShellModule) GetProfiles(c *gin.Context) {
+	profiles := make([]map[string]interface{}, 0, len(sm.profiles))
+	for _, profile := range sm.profiles {
+		env := make([]string, 0, len(profile.Env))
+		for key := range profile.Env {
+			env = append(env, key)
+		}
+		sort.Strings(env)
+		profiles = append(profiles, map[string]interface{}{
+			"name":          profile.Name,
+			"command":       profile.Command,
+			"args":          profile.Args,
+			"cwd":           profile.Cwd,
+			"env":           env,
+			"user":          profile.User,
+			"keepalive":     profile.Keepalive,
+			"max_restarts":  profile.MaxRestarts,
+			"on_disconnect": profile.OnDisconnect,
+			"detach_ttl":    profile.DetachTTL,
+		})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i]["name"].(string) < profiles[j]["name"].(string)
+	})
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Profiles retrieved"),
+		Data:    profiles,
+	})
+}
+
+// Socket.IO Handlers
+
+// SpawnProfile spawns an interactive session from a shell profile; the
+// policy given overrides the one of the profile
+func (sm *ShellModule) SpawnProfile(conn socketio.Conn, name string, policy DisconnectPolicy) EventResult {
+	profile, exists := sm.profiles[name]
+	if !exists {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "Profile %s not found", name),
+		})
+	}
+	return sm.spawn(conn, profile, policy)
+}
+
+// Helper functions
+
+// loadShellProfiles reads the profiles file, a JSON object of profiles by
+// name. No file means no profiles.
+func loadShellProfiles(path string) (map[string]*ShellProfile, error) {
+	profiles := make(map[string]*ShellProfile)
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("shell profiles: %w", err)
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("shell profiles: %s: %w", path, err)
+	}
+	for name, profile := range profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("shell profiles: %s: profile %q is empty", path, name)
+		}
+		if err := profile.DisconnectPolicy.validate(); err != nil {
+			return nil, fmt.Errorf("shell profiles: %s: profile %q: %w", path, name, err)
+		}
+		profile.Name = name
+		if profile.Command == "" {
+			profile.Command = "/bin/bash"
+		}
+	}
+	return profiles, nil
+}
+
+// command builds the process of a profile, with the credentials and
+// environment of its user
+func (p *ShellProfile) command() (*exec.Cmd, error) {
+	cmd := exec.Command(p.Command, p.Args...)
+	cmd.Dir = p.Cwd
+	cmd.Env = os.Environ()
+
+	if p.User != "" {
+		account, err := user.Lookup(p.User)
+		if err != nil {
+			return nil, err
+		}
+		if err := runAs(cmd, account); err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, "HOME="+account.HomeDir, "USER="+account.Username, "LOGNAME="+account.Username)
+		if cmd.Dir == "" {
+			cmd.Dir = "/"
+			if info, err := os.Stat(account.HomeDir); err == nil && info.IsDir() {
+				cmd.Dir = account.HomeDir
+			}
+		}
+	}
+
+	for key, value := range p.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	return cmd, nil
+}
+
+// restartDelay returns how long to wait before restarting a session whose
+// process exited after running for ran, or false if it stays down
+func (sm *ShellModule) restartDelay(session *ShellSession, ran time.Duration) (time.Duration, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	profile := session.profile
+	if !profile.Keepalive || !session.Active || sm.sessions[session.ID] != session {
+		return 0, false
+	}
+	if profile.MaxRestarts > 0 && session.Restarts >= profile.MaxRestarts {
+		return 0, false
+	}
+
+	if ran >= profileStableAfter || session.restartDelay == 0 {
+		session.restartDelay = profileRestartDelay
+	} else {
+		session.restartDelay = min(2*session.restartDelay, profileRestartMaxDelay)
+	}
+	return session.restartDelay, true
+}
+
+// restart starts the process of a session again, unless it was killed while
+// waiting to restart
+func (sm *ShellModule) restart(session *ShellSession) (bool, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if !session.Active || sm.sessions[session.ID] != session {
+		return false, nil
+	}
+	cmd, ptmx, err := startShell(session.profile)
+	if err != nil {
+		return false, err
+	}
+	session.Command = cmd
+	session.PTY = ptmx
+	session.Restarts++
+	return true, nil
+}
+
+// broadcastState tells the viewers of a profile session that its process
+// is "running", "restarting", "failed" or "stopped"
+func (sm *ShellModule) broadcastState(session *ShellSession, state string, details map[string]interface{}) {
+	if session.Profile == "" {
+		return
+	}
+	sm.mutex.RLock()
+	restarts := session.Restarts
+	sm.mutex.RUnlock()
+
+	event := map[string]interface{}{
+		"session_id": session.ID,
+		"profile":    session.Profile,
+		"state":      state,
+		"restarts":   restarts,
+		"timestamp":  time.Now(),
+	}
+	for key, value := range details {
+		event[key] = value
+	}
+	sm.emitter.Broadcast(sm.server, sessionRoom(session.ID), "shell:state", event)
+}
@@ -0,0 +1,473 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProvisionModule applies declarative host specs: packages, files, services
+// and commands. Every step checks the current state first, so applying the
+// same spec again only changes what drifted.
+type ProvisionModule struct {
+	tasks  *Tasks
+	paths  *Paths
+	quotas *Quotas
+	mutex  sync.Mutex // one run at a time
+}
+
+type ProvisionRequest struct {
+	Packages []string           `json:"packages"`
+	Files    []ProvisionFile    `json:"files" binding:"dive"`
+	Services []ProvisionService `json:"services" binding:"dive"`
+	Commands []ProvisionCommand `json:"commands" binding:"dive"`
+	DryRun   bool               `json:"dry_run"`
+}
+
+type ProvisionFile struct {
+	Path    string `json:"path" binding:"required"`
+	Content string `json:"content"`
+	Mode    string `json:"mode"` // octal, default "0644"
+}
+
+type ProvisionService struct {
+	Name    string `json:"name" binding:"required"`
+	Enabled *bool  `json:"enabled"`
+	State   string `json:"state" binding:"omitempty,oneof=started stopped"`
+}
+
+type ProvisionCommand struct {
+	Command string `json:"command" binding:"required"`
+	WorkDir string `json:"workdir"`
+	Creates string `json:"creates"` // skipped when this path exists
+	Unless  string `json:"unless"`  // skipped when this command succeeds
+	Timeout int    `json:"timeout"` // in seconds
+}
+
+type ProvisionStep struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"` // package, file, service, command
+	Name     string `json:"name"`
+	Status   string `json:"status"` // running, ok, changed, skipped, failed
+	Message  string `json:"message,omitempty"`
+	Output   string `json:"output,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type ProvisionResult struct {
+	Steps    []ProvisionStep `json:"steps"`
+	Changed  int             `json:"changed"`
+	Failed   int             `json:"failed"`
+	DryRun   bool            `json:"dry_run"`
+	Duration string          `json:"duration"`
+}
+
+// provisionTask is a step waiting to be applied
+type provisionTask struct {
+	step  ProvisionStep
+	apply func(dryRun bool) (status, message, output string, err error)
+}
+
+// packageManager knows how to query and install packages on a distribution
+type packageManager struct {
+	name      string
+	installed func(pkg string) []string
+	install   func(pkg string) []string
+}
+
+var packageManagers = []packageManager{
+	{"apt-get", func(pkg string) []string { return []string{"dpkg", "-s", pkg} }, func(pkg string) []string { return []string{"apt-get", "install", "-y", pkg} }},
+	{"dnf", func(pkg string) []string { return []string{"rpm", "-q", pkg} }, func(pkg string) []string { return []string{"dnf", "install", "-y", pkg} }},
+	{"yum", func(pkg string) []string { return []string{"rpm", "-q", pkg} }, func(pkg string) []string { return []string{"yum", "install", "-y", pkg} }},
+	{"zypper", func(pkg string) []string { return []string{"rpm", "-q", pkg} }, func(pkg string) []string { return []string{"zypper", "--non-interactive", "install", pkg} }},
+	{"apk", func(pkg string) []string { return []string{"apk", "info", "-e", pkg} }, func(pkg string) []string { return []string{"apk", "add", pkg} }},
+	{"pacman", func(pkg string) []string { return []string{"pacman", "-Q", pkg} }, func(pkg string) []string { return []string{"pacman", "-S", "--noconfirm", "--needed", pkg} }},
+	{"brew", func(pkg string) []string { return []string{"brew", "list", pkg} }, func(pkg string) []string { return []string{"brew", "install", pkg} }},
+}
+
+func NewProvisionModule(tasks *Tasks, paths *Paths, quotas *Quotas) *ProvisionModule {
+	return &ProvisionModule{tasks: tasks, paths: paths, quotas: quotas}
+}
+
+// REST API Handlers
+
+// Apply provisions the host from a spec, in order: packages, files,
+// services, then commands. With stream=true (or an application/x-ndjson
+// Accept header) progress is streamed as one JSON object per line.
+func (pm *ProvisionModule) Apply(c *gin.Context) {
+	var req ProvisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	var paths []*string
+	for i := range req.Files {
+		paths = append(paths, &req.Files[i].Path)
+	}
+	for i := range req.Commands {
+		paths = append(paths, &req.Commands[i].WorkDir, &req.Commands[i].Creates)
+	}
+	if err := pm.paths.Resolve(paths...); err != nil {
+		c.JSON(errorStatus(err), ShellOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
+		})
+		return
+	}
+
+	recordAs(c, RecordJob, "", map[string]any{"operation": "provision"})
+
+	tasks, err := pm.plan(c, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	if !pm.mutex.TryLock() {
+		c.JSON(http.StatusConflict, ShellOperation{
+			Success: false,
+			Code:    ErrConflict,
+			Message: Localize(c, "Another provisioning run is in progress"),
+		})
+		return
+	}
+	defer pm.mutex.Unlock()
+
+	stream := c.Query("stream") == "true" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+	var encoder *json.Encoder
+	if stream {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder = json.NewEncoder(c.Writer)
+	}
+	progress := func(step ProvisionStep) {
+		if stream {
+			encoder.Encode(gin.H{"event": "step", "data": step})
+			c.Writer.Flush()
+		}
+	}
+
+	run := pm.tasks.Start(c, "provision", "", unitSteps)
+	run.SetTotal(int64(len(tasks)))
+	startTime := time.Now()
+	result := ProvisionResult{Steps: make([]ProvisionStep, 0, len(tasks)), DryRun: req.DryRun}
+	failedAt := -1
+	cancelled := false
+
+	for _, task := range tasks {
+		step := task.step
+		cancelled = cancelled || failedAt < 0 && run.Err() != nil
+		if failedAt >= 0 || cancelled {
+			step.Status = "skipped"
+			step.Message = Localize(c, "Skipped after a previous failure")
+			if cancelled {
+				step.Message = Localize(c, "Skipped after the run was cancelled")
+			}
+			result.Steps = append(result.Steps, step)
+			progress(step)
+			continue
+		}
+
+		step.Status = "running"
+		progress(step)
+
+		stepStart := time.Now()
+		status, message, output, err := task.apply(req.DryRun)
+		step.Duration = time.Since(stepStart).String()
+		step.Status, step.Message, step.Output = status, message, output
+		if err != nil {
+			step.Status = "failed"
+			step.Message = Localize(c, "Failed: %v", err)
+			failedAt = step.Index
+			result.Failed++
+		} else if status == "changed" {
+			result.Changed++
+		}
+
+		result.Steps = append(result.Steps, step)
+		progress(step)
+		run.Add(1)
+	}
+	result.Duration = time.Since(startTime).String()
+
+	response := ShellOperation{Success: true, Message: Localize(c, "Provisioning completed"), Data: result}
+	status := http.StatusOK
+	switch {
+	case cancelled:
+		run.Finish(run.Err())
+		response = ShellOperation{
+			Success: false,
+			Code:    ErrCancelled,
+			Message: Localize(c, "Provisioning cancelled"),
+			Data:    result,
+		}
+		status = http.StatusConflict
+	case failedAt >= 0:
+		run.Finish(fmt.Errorf("%w: step %d failed", errProvisionFailed, failedAt))
+		response = ShellOperation{
+			Success: false,
+			Code:    ErrProvisionFailed,
+			Message: Localize(c, "Provisioning failed at step %d", failedAt),
+			Data:    result,
+		}
+		status = http.StatusUnprocessableEntity
+	default:
+		run.Finish(nil)
+	}
+
+	if stream {
+		encoder.Encode(struct {
+			Event string `json:"event"`
+			ShellOperation
+		}{"result", response})
+		c.Writer.Flush()
+		return
+	}
+	c.JSON(status, response)
+}
+
+// Helper functions
+
+// plan turns the spec into the ordered list of steps to apply
+func (pm *ProvisionModule) plan(c *gin.Context, req ProvisionRequest) ([]provisionTask, error) {
+	var tasks []provisionTask
+	add := func(stepType, name string, apply func(dryRun bool) (string, string, string, error)) {
+		tasks = append(tasks, provisionTask{
+			step:  ProvisionStep{Index: len(tasks), Type: stepType, Name: name},
+			apply: apply,
+		})
+	}
+
+	if len(req.Packages) > 0 {
+		manager, err := detectPackageManager()
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range req.Packages {
+			pkg := pkg
+			add("package", pkg, func(dryRun bool) (string, string, string, error) {
+				return applyPackage(c, manager, pkg, dryRun)
+			})
+		}
+	}
+
+	for _, file := range req.Files {
+		file := file
+		mode := os.FileMode(0644)
+		if file.Mode != "" {
+			parsed, err := strconv.ParseUint(file.Mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mode %q for %s", file.Mode, file.Path)
+			}
+			mode = os.FileMode(parsed)
+		}
+		add("file", file.Path, func(dryRun bool) (string, string, string, error) {
+			return pm.applyFile(c, file, mode, dryRun)
+		})
+	}
+
+	for _, service := range req.Services {
+		service := service
+		add("service", service.Name, func(dryRun bool) (string, string, string, error) {
+			return applyService(c, service, dryRun)
+		})
+	}
+
+	for _, command := range req.Commands {
+		command := command
+		add("command", command.Command, func(dryRun bool) (string, string, string, error) {
+			return applyCommand(c, command, dryRun)
+		})
+	}
+
+	return tasks, nil
+}
+
+func detectPackageManager() (packageManager, error) {
+	for _, manager := range packageManagers {
+		if _, err := exec.LookPath(manager.name); err == nil {
+			return manager, nil
+		}
+	}
+	return packageManager{}, fmt.Errorf("no supported package manager found")
+}
+
+func applyPackage(c *gin.Context, manager packageManager, pkg string, dryRun bool) (string, string, string, error) {
+	if _, err := runProvisionCommand(manager.installed(pkg), "", 0); err == nil {
+		return "ok", Localize(c, "Up to date"), "", nil
+	}
+	if dryRun {
+		return "changed", Localize(c, "Would install"), "", nil
+	}
+
+	output, err := runProvisionCommand(manager.install(pkg), "", 0)
+	if err != nil {
+		return "failed", "", output, err
+	}
+	return "changed", Localize(c, "Installed"), output, nil
+}
+
+func (pm *ProvisionModule) applyFile(c *gin.Context, file ProvisionFile, mode os.FileMode, dryRun bool) (string, string, string, error) {
+	info, err := os.Stat(file.Path)
+	if err == nil && info.IsDir() {
+		return "failed", "", "", fmt.Errorf("%s: %w", file.Path, syscall.EISDIR)
+	}
+	if err == nil && info.Mode().Perm() == mode.Perm() {
+		if current, err := os.ReadFile(file.Path); err == nil && bytes.Equal(current, []byte(file.Content)) {
+			return "ok", Localize(c, "Up to date"), "", nil
+		}
+	}
+	if dryRun {
+		return "changed", Localize(c, "Would write"), "", nil
+	}
+	token := RequestToken(c)
+	if err := pm.quotas.Check(token, file.Path, int64(len(file.Content))); err != nil {
+		return "failed", "", "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return "failed", "", "", err
+	}
+
+	// Write next to the target and rename, so the file is never half written
+	tmp, err := os.CreateTemp(filepath.Dir(file.Path), "."+filepath.Base(file.Path)+".ccw-*")
+	if err != nil {
+		return "failed", "", "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(file.Content); err != nil {
+		tmp.Close()
+		return "failed", "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "failed", "", "", err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return "failed", "", "", err
+	}
+	if err := os.Rename(tmp.Name(), file.Path); err != nil {
+		return "failed", "", "", err
+	}
+	pm.quotas.Record(token, int64(len(file.Content)))
+	return "changed", Localize(c, "Written"), "", nil
+}
+
+func applyService(c *gin.Context, service ProvisionService, dryRun bool) (string, string, string, error) {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return "failed", "", "", fmt.Errorf("systemctl not found")
+	}
+
+	var actions [][]string
+	if service.Enabled != nil {
+		output, _ := runProvisionCommand([]string{"systemctl", "is-enabled", service.Name}, "", 0)
+		enabled := strings.TrimSpace(output) == "enabled"
+		if *service.Enabled && !enabled {
+			actions = append(actions, []string{"enable", service.Name})
+		} else if !*service.Enabled && enabled {
+			actions = append(actions, []string{"disable", service.Name})
+		}
+	}
+	if service.State != "" {
+		_, err := runProvisionCommand([]string{"systemctl", "is-active", "--quiet", service.Name}, "", 0)
+		active := err == nil
+		if service.State == "started" && !active {
+			actions = append(actions, []string{"start", service.Name})
+		} else if service.State == "stopped" && active {
+			actions = append(actions, []string{"stop", service.Name})
+		}
+	}
+
+	if len(actions) == 0 {
+		return "ok", Localize(c, "Up to date"), "", nil
+	}
+
+	names := make([]string, len(actions))
+	for i, action := range actions {
+		names[i] = action[0]
+	}
+	if dryRun {
+		return "changed", Localize(c, "Would run: %s", strings.Join(names, ", ")), "", nil
+	}
+
+	var outputs []string
+	for _, action := range actions {
+		output, err := runProvisionCommand(append([]string{"systemctl"}, action...), "", 0)
+		if output != "" {
+			outputs = append(outputs, output)
+		}
+		if err != nil {
+			return "failed", "", strings.Join(outputs, "\n"), err
+		}
+	}
+	return "changed", Localize(c, "Ran: %s", strings.Join(names, ", ")), strings.Join(outputs, "\n"), nil
+}
+
+func applyCommand(c *gin.Context, command ProvisionCommand, dryRun bool) (string, string, string, error) {
+	if command.Creates != "" {
+		if _, err := os.Stat(command.Creates); err == nil {
+			return "skipped", Localize(c, "Skipped, %s exists", command.Creates), "", nil
+		}
+	}
+	if command.Unless != "" {
+		if _, err := runProvisionCommand([]string{"sh", "-c", command.Unless}, command.WorkDir, command.Timeout); err == nil {
+			return "skipped", Localize(c, "Skipped, unless command succeeded"), "", nil
+		}
+	}
+	if dryRun {
+		return "changed", Localize(c, "Would execute"), "", nil
+	}
+
+	output, err := runProvisionCommand([]string{"sh", "-c", command.Command}, command.WorkDir, command.Timeout)
+	if err != nil {
+		return "failed", "", output, err
+	}
+	return "changed", Localize(c, "Executed"), output, nil
+}
+
+// runProvisionCommand runs a command non-interactively, returning its
+// combined output
+func runProvisionCommand(args []string, workDir string, timeout int) (string, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = fmt.Errorf("exit code %d", exitErr.ExitCode())
+	}
+	return string(output), err
+}
@@ -0,0 +1,208 @@
+package modules
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Quotas limits how much data tokens can write: the size of a single file,
+// the bytes written per token per day, and the free disk space to keep
+type Quotas struct {
+	maxFileSize  int64
+	dailyBytes   int64
+	minFreeBytes int64
+	notifier     *Notifier
+	usage        map[string]*quotaUsage // token name -> bytes written today
+	mutex        sync.Mutex
+}
+
+type quotaUsage struct {
+	day   string
+	bytes int64
+}
+
+// QuotaError is returned when an operation would exceed a quota
+type QuotaError struct {
+	Status  int
+	Code    string
+	Message string
+	format  string // untranslated message format and arguments
+	args    []interface{}
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// quotaWriter enforces the quotas on every write as data streams in
+type quotaWriter struct {
+	quotas  *Quotas
+	token   *Token
+	path    string
+	maxSize int64
+	written int64
+	w       io.Writer
+}
+
+func NewQuotas(config *Config, notifier *Notifier) *Quotas {
+	return &Quotas{
+		maxFileSize:  config.QuotaMaxFileSize,
+		dailyBytes:   config.QuotaDailyBytes,
+		minFreeBytes: config.QuotaMinFreeDisk,
+		notifier:     notifier,
+		usage:        make(map[string]*quotaUsage),
+	}
+}
+
+// Check reports whether writing size bytes to path is within the quotas,
+// without counting them yet
+func (q *Quotas) Check(token *Token, path string, size int64) error {
+	if q.maxFileSize > 0 && size > q.maxFileSize {
+		return newQuotaError(http.StatusRequestEntityTooLarge, ErrTooLarge, "File size %d exceeds the %d byte limit", size, q.maxFileSize)
+	}
+
+	return q.checkBudget(token, path, size)
+}
+
+// Record counts bytes written by a token towards its daily quota
+func (q *Quotas) Record(token *Token, bytes int64) {
+	if q.dailyBytes <= 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.usedToday(token)
+	q.usage[quotaKey(token)].bytes += bytes
+}
+
+// Writer wraps w so each write to the file at path is checked against the
+// quotas and counted as it happens, for streams of unknown size
+func (q *Quotas) Writer(token *Token, path string, w io.Writer) io.Writer {
+	return &quotaWriter{quotas: q, token: token, path: path, maxSize: q.maxFileSize, w: w}
+}
+
+// StreamWriter is like Writer for streams holding several files, such as
+// archives, where the single file size limit does not apply
+func (q *Quotas) StreamWriter(token *Token, path string, w io.Writer) io.Writer {
+	return &quotaWriter{quotas: q, token: token, path: path, w: w}
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	size := int64(len(p))
+	if qw.maxSize > 0 && qw.written+size > qw.maxSize {
+		return 0, newQuotaError(http.StatusRequestEntityTooLarge, ErrTooLarge, "File size exceeds the %d byte limit", qw.maxSize)
+	}
+
+	if err := qw.quotas.checkBudget(qw.token, qw.path, size); err != nil {
+		return 0, err
+	}
+
+	n, err := qw.w.Write(p)
+	qw.written += int64(n)
+	qw.quotas.Record(qw.token, int64(n))
+	return n, err
+}
+
+// CheckSpace reports whether the filesystem holding path has room for size
+// more bytes, keeping the free disk threshold
+func (q *Quotas) CheckSpace(path string, size int64) error {
+	return q.checkFreeDisk(path, size)
+}
+
+// Helper functions
+
+func newQuotaError(status int, code, format string, args ...interface{}) *QuotaError {
+	return &QuotaError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		format:  format,
+		args:    args,
+	}
+}
+
+// checkBudget checks the daily quota of the token and the free disk space
+func (q *Quotas) checkBudget(token *Token, path string, size int64) error {
+	if q.dailyBytes > 0 {
+		q.mutex.Lock()
+		used := q.usedToday(token)
+		q.mutex.Unlock()
+
+		if used+size > q.dailyBytes {
+			return newQuotaError(http.StatusInsufficientStorage, ErrQuotaExceeded, "Daily write quota exceeded: %d of %d bytes used", used, q.dailyBytes)
+		}
+	}
+
+	return q.checkFreeDisk(path, size)
+}
+
+func (q *Quotas) checkFreeDisk(path string, size int64) error {
+	if q.minFreeBytes <= 0 && size <= 0 {
+		return nil
+	}
+
+	free, err := diskFree(path)
+	if err != nil {
+		return nil
+	}
+
+	if size > free {
+		return newQuotaError(http.StatusInsufficientStorage, ErrNoSpace, "Insufficient disk space: %d bytes needed, %d available", size, free)
+	}
+
+	if q.minFreeBytes > 0 && free-size < q.minFreeBytes {
+		q.notifier.Notify(NotifyDiskLow, SeverityCritical, "", "Refused to write %s: %d bytes free, QUOTA_MIN_FREE_DISK is %d", path, free, q.minFreeBytes)
+		return newQuotaError(http.StatusInsufficientStorage, ErrNoSpace, "Insufficient disk space: %d bytes free, at least %d must remain available", free, q.minFreeBytes)
+	}
+	return nil
+}
+
+// usedToday returns the bytes the token wrote today, resetting the counter
+// on the first call of a new day. The caller must hold the mutex.
+func (q *Quotas) usedToday(token *Token) int64 {
+	key := quotaKey(token)
+	today := time.Now().Format("2006-01-02")
+
+	usage, exists := q.usage[key]
+	if !exists || usage.day != today {
+		usage = &quotaUsage{day: today}
+		q.usage[key] = usage
+	}
+	return usage.bytes
+}
+
+func quotaKey(token *Token) string {
+	if token == nil {
+		return ""
+	}
+	return token.Name
+}
+
+// diskFree returns the bytes available to unprivileged users on the
+// filesystem holding path, which does not need to exist yet
+func diskFree(path string) (int64, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return statfsFree(dir)
+}
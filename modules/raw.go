@@ -0,0 +1,115 @@
+package modules
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// REST API Handlers
+
+// ServeRaw serves a file as is for inline viewing, with the content type of
+// its extension or sniffed from its content, and byte ranges so media can
+// be seeked. Scripts of HTML and SVG files never run in the client's origin.
+func (fsm *FileSystemModule) ServeRaw(c *gin.Context) {
+	disposition := "inline"
+	if c.Query("download") == "true" {
+		disposition = "attachment"
+	}
+	fsm.serveFile(c, disposition, "")
+}
+
+// DownloadFile streams a file as an attachment straight from disk, so large
+// logs and archives are fetched without being held in memory. Byte ranges
+// let interrupted downloads resume.
+func (fsm *FileSystemModule) DownloadFile(c *gin.Context) {
+	fsm.serveFile(c, "attachment", filepath.Base(c.Query("name")))
+}
+
+// Helper functions
+
+// serveFile streams the file of the path parameter with a disposition,
+// under its own name unless another is given
+func (fsm *FileSystemModule) serveFile(c *gin.Context, disposition, name string) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) || !fsm.envReadable(c, path) {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
+		})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		c.JSON(http.StatusConflict, FileOperation{
+			Success: false,
+			Code:    ErrIsDirectory,
+			Message: Localize(c, "path is a directory"),
+		})
+		return
+	}
+	var contentType string
+	if err == nil {
+		contentType, err = rawContentType(file, path)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
+		})
+		return
+	}
+
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		name = filepath.Base(path)
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("%s; filename*=UTF-8''%s", disposition, url.PathEscape(name)))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+
+	// Answers Range, If-Range and the conditional headers
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
+}
+
+// rawContentType returns the content type of a file from its extension, or
+// sniffed from its first 512 bytes when the extension is unknown, leaving
+// the file at its start
+func rawContentType(file *os.File, path string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType, nil
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
@@ -0,0 +1,51 @@
+package modules
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readOnlyRoutes are the REST routes other than GET that stay available in
+// read-only mode, since they only read the host or change the state of the
+// agent itself
+var readOnlyRoutes = map[string]bool{
+	"POST /api/fs/bookmarks":          true,
+	"PUT /api/fs/bookmarks/:id":       true,
+	"DELETE /api/fs/bookmarks/:id":    true,
+	"POST /api/fs/index/rebuild":      true,
+	"POST /api/net/speedtest":         true,
+	"POST /api/net/speedtest/upload":  true,
+	"POST /api/net/discover":          true,
+	"POST /api/net/scan":              true,
+	"DELETE /api/tasks/:id":           true,
+	"POST /api/fleet/register":        true,
+	"DELETE /api/fleet/inventory/:id": true,
+	"POST /api/notifications/test":    true,
+}
+
+// mutatingEvents are the Socket.IO events refused in read-only mode
+var mutatingEvents = map[string]bool{
+	"fs:transfer:upload": true,
+	"shell:spawn":        true,
+	"shell:input":        true,
+	"shell:password":     true,
+	"shell:kill":         true,
+}
+
+// ReadOnlyMiddleware refuses the REST requests that would change the host,
+// for agents started with READ_ONLY
+func ReadOnlyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || readOnlyRoutes[method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"code":    ErrReadOnly,
+			"message": Localize(c, "The agent is read-only"),
+		})
+	}
+}
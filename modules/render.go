@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RenderRequest struct {
+	Template     string                 `json:"template"`
+	TemplatePath string                 `json:"template_path"`
+	Variables    map[string]interface{} `json:"variables"`
+	Target       string                 `json:"target"`
+	DryRun       bool                   `json:"dry_run"`
+}
+
+// REST API Handlers
+
+// RenderTemplate renders a Go template with the given variables and writes
+// the output to the target path, or returns it when dry_run is set
+func (fsm *FileSystemModule) RenderTemplate(c *gin.Context) {
+	var req RenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.TemplatePath, &req.Target) {
+		return
+	}
+
+	if (req.Template == "") == (req.TemplatePath == "") {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Exactly one of template or template_path is required"),
+		})
+		return
+	}
+
+	if req.Target == "" && !req.DryRun {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "target is required unless dry_run is set"),
+		})
+		return
+	}
+
+	source := req.Template
+	if req.TemplatePath != "" {
+		content, err := os.ReadFile(req.TemplatePath)
+		if err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to read template: %v", err),
+			})
+			return
+		}
+		source = string(content)
+	}
+
+	// Missing variables are an error rather than a silent "<no value>"
+	tmpl, err := template.New("render").Option("missingkey=error").Parse(source)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Failed to parse template: %v", err),
+		})
+		return
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, req.Variables); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Failed to render template: %v", err),
+		})
+		return
+	}
+
+	// Report whether the target would change
+	changed := true
+	if req.Target != "" {
+		if existing, err := os.ReadFile(req.Target); err == nil {
+			changed = !bytes.Equal(existing, rendered.Bytes())
+		}
+	}
+
+	if req.DryRun {
+		c.JSON(http.StatusOK, FileOperation{
+			Success: true,
+			Message: Localize(c, "Template rendered (dry run)"),
+			Data: map[string]interface{}{
+				"content": rendered.String(),
+				"target":  req.Target,
+				"changed": changed,
+			},
+		})
+		return
+	}
+
+	if changed {
+		token := RequestToken(c)
+		if err := fsm.quotas.Check(token, req.Target, int64(rendered.Len())); err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "%v", err),
+			})
+			return
+		}
+
+		if err := os.MkdirAll(filepath.Dir(req.Target), 0755); err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to create directory: %v", err),
+			})
+			return
+		}
+
+		if err := os.WriteFile(req.Target, rendered.Bytes(), 0644); err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to write file: %v", err),
+			})
+			return
+		}
+		fsm.quotas.Record(token, int64(rendered.Len()))
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Template rendered successfully"),
+		Data: map[string]interface{}{
+			"target":  req.Target,
+			"bytes":   rendered.Len(),
+			"changed": changed,
+		},
+	})
+}
@@ -0,0 +1,411 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// replaceMaxFileSize is the default size of the largest file replaced in
+	replaceMaxFileSize = 1 << 20
+	// replaceMaxPreview caps the diffs of a dry run, past which they're left
+	// out
+	replaceMaxPreview = 4 << 20
+)
+
+type ReplaceRequest struct {
+	Path        string   `json:"path" binding:"required"`    // file or directory
+	Pattern     string   `json:"pattern" binding:"required"` // RE2 regular expression
+	Replacement string   `json:"replacement"`                // with $1 or ${name} for the groups of the pattern
+	Literal     bool     `json:"literal"`                    // pattern and replacement are plain text
+	IgnoreCase  bool     `json:"ignore_case"`
+	Include     []string `json:"include"`       // globs of the files replaced in, every file when empty
+	Exclude     []string `json:"exclude"`       // globs of the files and directories left out
+	MaxFileSize int64    `json:"max_file_size"` // bytes, larger files are skipped
+	DryRun      bool     `json:"dry_run"`
+	WalkOptions
+}
+
+// ReplaceReport sums up a search and replace, listing the files with
+// matches and those that couldn't be replaced in
+type ReplaceReport struct {
+	Path      string          `json:"path"`
+	Files     []ReplaceResult `json:"files"`
+	Scanned   int             `json:"scanned"`   // text files searched
+	Changed   int             `json:"changed"`   // files with matches
+	Matches   int             `json:"matches"`   // in every file
+	Binary    int             `json:"binary"`    // files skipped as binary
+	Truncated bool            `json:"truncated"` // diffs left out past the preview cap
+	DryRun    bool            `json:"dry_run"`
+}
+
+type ReplaceResult struct {
+	Path    string `json:"path"`
+	Matches int    `json:"matches"`
+	Diff    string `json:"diff,omitempty"` // of dry runs, unified without context lines
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"` // why the file was skipped or left as it was
+}
+
+// REST API Handlers
+
+// Replace replaces the matches of a regular expression in the text files of
+// a tree, within the walk limits. Dry runs return the diff each file would
+// get instead of writing it. Files keep their encoding, and a file changed
+// while it's replaced in is left as it is.
+func (fsm *FileSystemModule) Replace(c *gin.Context) {
+	var req ReplaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+
+	re, err := fsm.checkReplace(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	task := fsm.tasks.Start(c, "replace", req.Path, unitSteps)
+	report, err := fsm.replaceTree(RequestToken(c), req, re, task)
+	task.Finish(err)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to replace: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	message := Localize(c, "Replaced %d matches in %d files", report.Matches, report.Changed)
+	if req.DryRun {
+		message = Localize(c, "Found %d matches in %d files (dry run)", report.Matches, report.Changed)
+	}
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: message,
+		Data:    report,
+	})
+}
+
+// Helper functions
+
+// checkReplace compiles the pattern of a replace request and checks its
+// globs and file size cap, defaulting the cap
+func (fsm *FileSystemModule) checkReplace(req *ReplaceRequest) (*regexp.Regexp, error) {
+	re, err := compileSearch(req.Pattern, req.Literal, req.IgnoreCase, req.Include, req.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if req.MaxFileSize, err = fsm.searchMaxFileSize(req.MaxFileSize); err != nil {
+		return nil, err
+	}
+	return re, nil
+}
+
+// compileSearch compiles the pattern of a search, checking its globs
+func compileSearch(pattern string, literal, ignoreCase bool, include, exclude []string) (*regexp.Regexp, error) {
+	if literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, glob := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q", glob)
+		}
+	}
+	return re, nil
+}
+
+// searchMaxFileSize checks the size of the largest file a search reads,
+// defaulting it to 1 MiB within READ_MAX_SIZE
+func (fsm *FileSystemModule) searchMaxFileSize(size int64) (int64, error) {
+	max := fsm.config.ReadMaxSize
+	switch {
+	case size < 0:
+		return 0, fmt.Errorf("max_file_size must be positive")
+	case max > 0 && size > max:
+		return 0, fmt.Errorf("max_file_size must be at most READ_MAX_SIZE, %d", max)
+	case size == 0:
+		size = replaceMaxFileSize
+		if max > 0 {
+			size = min(size, max)
+		}
+	}
+	return size, nil
+}
+
+// replaceTree replaces in the files of the tree of a request, counting each
+// file as a step of the task and each file written against the quotas of
+// token
+func (fsm *FileSystemModule) replaceTree(token *Token, req ReplaceRequest, re *regexp.Regexp, task *Task) (*ReplaceReport, error) {
+	report := &ReplaceReport{Path: req.Path, Files: []ReplaceResult{}, DryRun: req.DryRun}
+	boundary := newWalkBoundary(req.Path, req.WalkOptions)
+	preview := 0
+	err := newWalkLimits(fsm.config).walk(req.Path, func(name string, d fs.DirEntry, err error) error {
+		if err := task.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			if name == req.Path {
+				return err
+			}
+			report.Files = append(report.Files, ReplaceResult{Path: name, Code: errorCode(err), Error: err.Error()})
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		rel, _ := filepath.Rel(req.Path, name)
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = filepath.Base(name)
+		}
+		if d.IsDir() {
+			if name != req.Path && (boundary.excludes(name, d) || matchGlobs(req.Exclude, rel)) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || matchGlobs(req.Exclude, rel) || (len(req.Include) > 0 && !matchGlobs(req.Include, rel)) {
+			return nil
+		}
+
+		task.Add(1)
+		result, binary := fsm.replaceInFile(token, name, re, req, preview < replaceMaxPreview)
+		switch {
+		case binary:
+			report.Binary++
+			return nil
+		case result.Error == "":
+			report.Scanned++
+		}
+		if result.Matches > 0 && result.Error == "" {
+			report.Changed++
+			report.Matches += result.Matches
+			preview += len(result.Diff)
+			report.Truncated = report.Truncated || (req.DryRun && result.Diff == "")
+		}
+		if result.Matches > 0 || result.Error != "" {
+			report.Files = append(report.Files, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// replaceInFile replaces in a text file, or only diffs it in dry runs. Binary
+// files are reported and left out.
+func (fsm *FileSystemModule) replaceInFile(token *Token, name string, re *regexp.Regexp, req ReplaceRequest, preview bool) (result ReplaceResult, binary bool) {
+	result.Path = name
+	fail := func(err error) (ReplaceResult, bool) {
+		result.Code, result.Error = errorCode(err), err.Error()
+		return result, false
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return fail(err)
+	}
+	if info.Size() > req.MaxFileSize {
+		return fail(fmt.Errorf("%w: %d bytes, over the max_file_size of %d", errFileTooLarge, info.Size(), req.MaxFileSize))
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Files with NUL bytes are binary, unless they're UTF-16 text
+	encoding := detectEncoding(content)
+	if !strings.HasPrefix(encoding, "utf-16") && bytes.IndexByte(content[:min(len(content), 8000)], 0) >= 0 {
+		return result, true
+	}
+	text, err := decodeText(content, encoding)
+	if err != nil {
+		return fail(err)
+	}
+
+	replaced, matches, diff := replaceText(text, re, req.Replacement, req.Literal, req.DryRun && preview)
+	result.Matches = matches
+	if matches == 0 {
+		return result, false
+	}
+	if req.DryRun {
+		if diff != "" {
+			result.Diff = "--- " + name + "\n+++ " + name + "\n" + diff
+		}
+		return result, false
+	}
+
+	encoded, err := encodeText(replaced, encoding)
+	if err != nil {
+		return fail(err)
+	}
+	if current, err := os.Stat(name); err != nil || !current.ModTime().Equal(info.ModTime()) || current.Size() != info.Size() {
+		return fail(fmt.Errorf("%w: %s changed while replacing, left as it is", os.ErrExist, name))
+	}
+	if err := fsm.quotas.Check(token, name, int64(len(encoded))); err != nil {
+		return fail(err)
+	}
+	if err := os.WriteFile(name, encoded, info.Mode().Perm()); err != nil {
+		return fail(err)
+	}
+	fsm.quotas.Record(token, int64(len(encoded)))
+	return result, false
+}
+
+// replaceText replaces the matches of re in text, returning the text
+// replaced, the number of matches and, with preview, a unified diff of the
+// lines changed without context lines
+func replaceText(text string, re *regexp.Regexp, replacement string, literal, preview bool) (string, int, string) {
+	matches := re.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, 0, ""
+	}
+
+	var replaced, diff strings.Builder
+	done, line, counted, delta := 0, 1, 0, 0
+	for i := 0; i < len(matches); {
+		// A hunk takes the whole lines of the matches sharing lines
+		start := strings.LastIndexByte(text[:matches[i][0]], '\n') + 1
+		end := lineAfter(text, matches[i])
+		j := i + 1
+		for ; j < len(matches) && matches[j][0] < end; j++ {
+			end = max(end, lineAfter(text, matches[j]))
+		}
+
+		var hunk []byte
+		previous := start
+		for _, match := range matches[i:j] {
+			hunk = append(hunk, text[previous:match[0]]...)
+			if literal {
+				hunk = append(hunk, replacement...)
+			} else {
+				hunk = re.ExpandString(hunk, replacement, text, match)
+			}
+			previous = match[1]
+		}
+		hunk = append(hunk, text[previous:end]...)
+		replaced.WriteString(text[done:start])
+		replaced.Write(hunk)
+		done = end
+
+		if preview {
+			line += strings.Count(text[counted:start], "\n")
+			counted = start
+			before, after := diffLinesOf(text[start:end]), diffLinesOf(string(hunk))
+			newLine := line + delta
+			if len(after) == 0 {
+				newLine--
+			}
+			fmt.Fprintf(&diff, "@@ -%d,%d +%d,%d @@\n", line, len(before), newLine, len(after))
+			for _, l := range before {
+				diff.WriteString("-" + l + "\n")
+			}
+			for _, l := range after {
+				diff.WriteString("+" + l + "\n")
+			}
+			delta += len(after) - len(before)
+		}
+		i = j
+	}
+	replaced.WriteString(text[done:])
+	return replaced.String(), len(matches), diff.String()
+}
+
+// lineAfter returns the index after the line a match ends on, its line
+// break included
+func lineAfter(text string, match []int) int {
+	last := max(match[1]-1, match[0])
+	if last >= len(text) {
+		return len(text)
+	}
+	if i := strings.IndexByte(text[last:], '\n'); i >= 0 {
+		return last + i + 1
+	}
+	return len(text)
+}
+
+// diffLinesOf splits whole lines for a diff, without their line breaks
+func diffLinesOf(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// matchGlobs reports whether a slash separated path below a walked
+// directory matches a glob. Globs without a slash match the name of the
+// file or directory, and ** matches any number of directories.
+func matchGlobs(globs []string, rel string) bool {
+	for _, glob := range globs {
+		if !strings.Contains(glob, "/") {
+			if ok, _ := path.Match(glob, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(strings.Split(strings.TrimPrefix(glob, "/"), "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(glob, parts []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchGlob(glob[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], parts[0]); !ok {
+			return false
+		}
+		glob, parts = glob[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
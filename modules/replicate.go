@@ -0,0 +1,289 @@
+package modules
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReplicateRequest struct {
+	AgentURL    string `json:"agent_url" binding:"required"`
+	AgentToken  string `json:"agent_token" binding:"required"`
+	Direction   string `json:"direction" binding:"required"` // "pull" or "push"
+	Source      string `json:"source" binding:"required"`
+	Destination string `json:"destination" binding:"required"`
+}
+
+type ReplicateResult struct {
+	Direction string `json:"direction"`
+	AgentURL  string `json:"agent_url"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// REST API Handlers
+
+// Replicate pulls a path from another agent or pushes a local path to it,
+// streaming a tar archive directly between the two agents
+func (fsm *FileSystemModule) Replicate(c *gin.Context) {
+	var req ReplicateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	// Only the end of the replication on this agent is a local path
+	local := &req.Source
+	if req.Direction == "pull" {
+		local = &req.Destination
+	}
+	if !fsm.resolvePaths(c, local) {
+		return
+	}
+
+	var result ReplicateResult
+	var err error
+	switch req.Direction {
+	case "pull":
+		result, err = pullFromAgent(fsm.outbound.client, fsm.quotas, RequestToken(c), req)
+	case "push":
+		result, err = pushToAgent(fsm.outbound.client, req)
+	default:
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid direction. Use 'pull' or 'push'"),
+		})
+		return
+	}
+
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to replicate: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Replication completed successfully"),
+		Data:    result,
+	})
+}
+
+// ExportArchive streams a file or directory as a tar archive for a peer agent
+func (fsm *FileSystemModule) ExportArchive(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stat path: %v", err),
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-tar")
+	c.Status(http.StatusOK)
+
+	// Headers are already sent, errors can only abort the stream
+	if _, _, err := writeTree(c.Writer, path); err != nil {
+		c.Error(err)
+	}
+}
+
+// ImportArchive extracts a tar archive sent by a peer agent into path
+func (fsm *FileSystemModule) ImportArchive(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+
+	// Entries are never written outside path, and count against the quotas
+	// of the token as they arrive
+	extractor, err := newArchiveExtractor(fsm.quotas, RequestToken(c), path, 0)
+	if err == nil {
+		err = extractor.extractTar(c.Request.Body)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to import archive: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Archive imported successfully"),
+		Data: map[string]interface{}{
+			"files": extractor.result.Files,
+			"bytes": extractor.result.Bytes,
+		},
+	})
+}
+
+// Helper functions
+
+func pullFromAgent(client *http.Client, quotas *Quotas, token *Token, req ReplicateRequest) (ReplicateResult, error) {
+	result := ReplicateResult{Direction: req.Direction, AgentURL: req.AgentURL}
+
+	httpReq, err := http.NewRequest(http.MethodGet, agentEndpoint(req.AgentURL, "/api/fs/replicate/export", req.Source), nil)
+	if err != nil {
+		return result, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.AgentToken)
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("%w: agent responded with %s", errUpstream, resp.Status)
+	}
+
+	extractor, err := newArchiveExtractor(quotas, token, req.Destination, 0)
+	if err != nil {
+		return result, err
+	}
+	err = extractor.extractTar(resp.Body)
+	result.Files, result.Bytes = extractor.result.Files, extractor.result.Bytes
+	return result, err
+}
+
+func pushToAgent(client *http.Client, req ReplicateRequest) (ReplicateResult, error) {
+	result := ReplicateResult{Direction: req.Direction, AgentURL: req.AgentURL}
+
+	if _, err := os.Stat(req.Source); err != nil {
+		return result, err
+	}
+
+	// Stream the archive straight into the request body
+	reader, writer := io.Pipe()
+	done := make(chan ReplicateResult, 1)
+	go func() {
+		files, bytes, err := writeTree(writer, req.Source)
+		writer.CloseWithError(err)
+		done <- ReplicateResult{Files: files, Bytes: bytes}
+	}()
+
+	httpReq, err := http.NewRequest(http.MethodPut, agentEndpoint(req.AgentURL, "/api/fs/replicate/import", req.Destination), reader)
+	if err != nil {
+		reader.Close()
+		return result, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.AgentToken)
+	httpReq.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return result, fmt.Errorf("%w: agent responded with %s: %s", errUpstream, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	sent := <-done
+	result.Files, result.Bytes = sent.Files, sent.Bytes
+	return result, nil
+}
+
+func agentEndpoint(agentURL, endpoint, path string) string {
+	return strings.TrimRight(agentURL, "/") + endpoint + "?path=" + url.QueryEscape(path)
+}
+
+// writeTree archives root into w with entry names relative to root,
+// so a single file is stored as "."
+func writeTree(w io.Writer, root string) (files int, bytes int64, err error) {
+	tw := tar.NewWriter(w)
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		// Only regular files and directories are replicated
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		n, err := io.Copy(tw, file)
+		bytes += n
+		files++
+		return err
+	})
+	if err != nil {
+		return files, bytes, err
+	}
+
+	return files, bytes, tw.Close()
+}
@@ -0,0 +1,164 @@
+package modules
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reportMaxTop is the most entries of each list of a disk report
+const reportMaxTop = 100
+
+// DiskReport summarizes what takes up the space below a path, for cleanups
+type DiskReport struct {
+	Path        string        `json:"path"`
+	Size        int64         `json:"size"` // of every file, in bytes
+	Files       int           `json:"files"`
+	Directories int           `json:"directories"`
+	Skipped     int           `json:"skipped"` // unreadable directories
+	Largest     []ReportEntry `json:"largest"`
+	Oldest      []ReportEntry `json:"oldest"`  // by modification time
+	Biggest     []ReportEntry `json:"biggest"` // directories, by the size of everything below them
+}
+
+// ReportEntry is a file or directory of a disk report
+type ReportEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// REST API Handlers
+
+// Report walks a path within the walk limits and returns its largest and
+// oldest files and its biggest directories
+func (fsm *FileSystemModule) Report(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+	top := 10
+	if value := c.Query("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > reportMaxTop {
+			c.JSON(http.StatusBadRequest, FileOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", fmt.Errorf("top must be between 1 and %d", reportMaxTop)),
+			})
+			return
+		}
+		top = parsed
+	}
+
+	report, err := diskReport(path, top, newWalkBoundary(path, walkOptionsQuery(c)), newWalkLimits(fsm.config))
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to build disk report: %v", err),
+			Data:    errorDetails(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Disk report built"),
+		Data:    report,
+	})
+}
+
+// Helper functions
+
+// diskReport walks root and keeps the top entries of each list. The size of
+// a directory adds up the files below it; unreadable directories are
+// skipped and counted.
+func diskReport(root string, top int, boundary *walkBoundary, limits *walkLimits) (*DiskReport, error) {
+	report := &DiskReport{Path: root, Largest: []ReportEntry{}, Oldest: []ReportEntry{}, Biggest: []ReportEntry{}}
+	directories := make(map[string]*ReportEntry)
+	err := limits.walk(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && path != root {
+				report.Skipped++
+				return fs.SkipDir
+			}
+			return err
+		}
+		if boundary.excludes(path, d) {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if d.IsDir() {
+			report.Directories++
+			directories[path] = &ReportEntry{Path: path, Modified: info.ModTime()}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		report.Files++
+		report.Size += info.Size()
+		for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+			if entry := directories[dir]; entry != nil {
+				entry.Size += info.Size()
+			}
+			if dir == root || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+
+		entry := ReportEntry{Path: path, Size: info.Size(), Modified: info.ModTime()}
+		report.Largest = keepTop(report.Largest, entry, top, func(a, b ReportEntry) bool { return a.Size > b.Size })
+		report.Oldest = keepTop(report.Oldest, entry, top, func(a, b ReportEntry) bool { return a.Modified.Before(b.Modified) })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for path, entry := range directories {
+		if path != root {
+			report.Biggest = keepTop(report.Biggest, *entry, top, func(a, b ReportEntry) bool {
+				if a.Size != b.Size {
+					return a.Size > b.Size
+				}
+				return a.Path < b.Path
+			})
+		}
+	}
+	return report, nil
+}
+
+// keepTop inserts an entry into a list sorted by less, keeping its first n
+// entries
+func keepTop(entries []ReportEntry, entry ReportEntry, n int, less func(a, b ReportEntry) bool) []ReportEntry {
+	if len(entries) == n && !less(entry, entries[n-1]) {
+		return entries
+	}
+	i := sort.Search(len(entries), func(i int) bool { return less(entry, entries[i]) })
+	if len(entries) < n {
+		entries = append(entries, ReportEntry{})
+	}
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	return entries
+}
@@ -0,0 +1,306 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxNameservers is how many nameservers the resolver uses, MAXNS in resolv.h;
+// the rest are ignored
+const maxNameservers = 3
+
+// resolverOptionPattern matches resolv.conf options such as rotate or ndots:2
+var resolverOptionPattern = regexp.MustCompile(`^[a-z0-9-]+(:[0-9]+)?$`)
+
+// errResolverUnchanged marks removals matching nothing in resolv.conf
+var errResolverUnchanged = errors.New("no matching resolver entry found")
+
+// ResolverConfig is the DNS resolver configuration of resolv.conf
+type ResolverConfig struct {
+	Nameservers []string `json:"nameservers"`
+	Search      []string `json:"search"`
+	Options     []string `json:"options"`
+}
+
+// REST API Handlers
+
+// GetResolver reads the nameservers, search domains and options of resolv.conf
+func (nm *NetworkModule) GetResolver(c *gin.Context) {
+	nm.etcMu.Lock()
+	data, err := os.ReadFile(nm.config.ResolvConf)
+	nm.etcMu.Unlock()
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read resolver configuration: %v", err),
+		})
+		return
+	}
+
+	config := parseResolvConf(strings.Split(string(data), "\n"))
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Resolver configuration retrieved"),
+		Data: map[string]interface{}{
+			"path":        nm.config.ResolvConf,
+			"nameservers": config.Nameservers,
+			"search":      config.Search,
+			"options":     config.Options,
+		},
+	})
+}
+
+// AddResolver adds nameservers, search domains and options to resolv.conf,
+// skipping those already there
+func (nm *NetworkModule) AddResolver(c *gin.Context) {
+	var req ResolverConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	nm.editResolver(c, func(lines []string, config ResolverConfig) ([]string, error) {
+		// Nameservers go after the last one, in the order the resolver tries them
+		last := len(lines)
+		for i, line := range lines {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "nameserver" {
+				last = i + 1
+			}
+		}
+		var added []string
+		for _, nameserver := range req.Nameservers {
+			if !containsFold(config.Nameservers, nameserver) && !containsFold(added, nameserver) {
+				added = append(added, "nameserver "+nameserver)
+			}
+		}
+		if len(added) > 0 && len(config.Nameservers)+len(added) > maxNameservers {
+			return nil, fmt.Errorf("%w: resolv.conf takes at most %d nameservers", errInvalidRequest, maxNameservers)
+		}
+		lines = append(lines[:last:last], append(added, lines[last:]...)...)
+
+		lines = appendResolverValues(lines, []string{"search", "domain"}, "search", config.Search, req.Search)
+		return appendResolverValues(lines, []string{"options"}, "options", config.Options, req.Options), nil
+	})
+}
+
+// RemoveResolver removes the nameservers, search domains and options given as
+// query parameters from resolv.conf
+func (nm *NetworkModule) RemoveResolver(c *gin.Context) {
+	req := ResolverConfig{
+		Nameservers: c.QueryArray("nameserver"),
+		Search:      c.QueryArray("search"),
+		Options:     c.QueryArray("option"),
+	}
+	if len(req.Nameservers)+len(req.Search)+len(req.Options) == 0 {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "a nameserver, search domain or option is required"),
+		})
+		return
+	}
+
+	nm.editResolver(c, func(lines []string, config ResolverConfig) ([]string, error) {
+		var kept []string
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				kept = append(kept, line)
+				continue
+			}
+
+			var removed []string
+			switch fields[0] {
+			case "nameserver":
+				removed = req.Nameservers
+			case "search", "domain":
+				removed = req.Search
+			case "options":
+				removed = req.Options
+			default:
+				kept = append(kept, line)
+				continue
+			}
+
+			values := fields[1:][:0:0]
+			for _, value := range fields[1:] {
+				if !containsFold(removed, value) {
+					values = append(values, value)
+				}
+			}
+			switch {
+			case len(values) == 0:
+			case len(values) == len(fields)-1:
+				kept = append(kept, line)
+			default:
+				kept = append(kept, fields[0]+" "+strings.Join(values, " "))
+			}
+		}
+
+		if strings.Join(kept, "\n") == strings.Join(lines, "\n") {
+			return nil, errResolverUnchanged
+		}
+		return kept, nil
+	})
+}
+
+// Helper functions
+
+// editResolver rewrites resolv.conf with the lines edit returns, responding
+// with the resulting configuration
+func (nm *NetworkModule) editResolver(c *gin.Context, edit func(lines []string, config ResolverConfig) ([]string, error)) {
+	nm.etcMu.Lock()
+	defer nm.etcMu.Unlock()
+
+	data, err := os.ReadFile(nm.config.ResolvConf)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read resolver configuration: %v", err),
+		})
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	lines, err = edit(lines, parseResolvConf(lines))
+	if errors.Is(err, errResolverUnchanged) {
+		c.JSON(http.StatusNotFound, NetworkOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "No matching resolver entry found"),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to update resolver configuration: %v", err),
+		})
+		return
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	response := map[string]interface{}{"path": nm.config.ResolvConf, "changed": false}
+	if content != string(data) {
+		backup, err := writeEtcFile(nm.config.ResolvConf, []byte(content))
+		if err != nil {
+			c.JSON(errorStatus(err), NetworkOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to update resolver configuration: %v", err),
+			})
+			return
+		}
+		response["changed"] = true
+		response["backup"] = backup
+	}
+
+	config := parseResolvConf(lines)
+	response["nameservers"] = config.Nameservers
+	response["search"] = config.Search
+	response["options"] = config.Options
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Resolver configuration updated"),
+		Data:    response,
+	})
+}
+
+// validate checks the values to add to resolv.conf
+func (r *ResolverConfig) validate() error {
+	if len(r.Nameservers)+len(r.Search)+len(r.Options) == 0 {
+		return fmt.Errorf("a nameserver, search domain or option is required")
+	}
+	for _, nameserver := range r.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("invalid nameserver %q", nameserver)
+		}
+	}
+	for _, domain := range r.Search {
+		if !hostnamePattern.MatchString(domain) || len(domain) > 253 {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	for _, option := range r.Options {
+		if !resolverOptionPattern.MatchString(option) {
+			return fmt.Errorf("invalid option %q", option)
+		}
+	}
+	return nil
+}
+
+// parseResolvConf reads the settings of resolv.conf lines. As for the
+// resolver, the last search or domain line wins, and options add up.
+func parseResolvConf(lines []string) ResolverConfig {
+	config := ResolverConfig{Nameservers: []string{}, Search: []string{}, Options: []string{}}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			config.Nameservers = append(config.Nameservers, fields[1])
+		case "search", "domain":
+			config.Search = fields[1:]
+		case "options":
+			config.Options = append(config.Options, fields[1:]...)
+		}
+	}
+	return config
+}
+
+// appendResolverValues adds the values not in current to the last line
+// starting with one of keywords, or to a new line starting with keyword. A
+// domain line is turned into a search line.
+func appendResolverValues(lines []string, keywords []string, keyword string, current, values []string) []string {
+	var added []string
+	for _, value := range values {
+		if !containsFold(current, value) && !containsFold(added, value) {
+			added = append(added, value)
+		}
+	}
+	if len(added) == 0 {
+		return lines
+	}
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		fields := strings.Fields(lines[i])
+		if len(fields) > 0 && containsFold(keywords, fields[0]) {
+			lines[i] = keyword + " " + strings.Join(append(fields[1:], added...), " ")
+			return lines
+		}
+	}
+	return append(lines, keyword+" "+strings.Join(added, " "))
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
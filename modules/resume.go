@@ -0,0 +1,320 @@
+package modules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// transportClosed is the reason Socket.IO gives when the transport of a
+// connection closed, because it dropped or was reaped. Clients leaving the
+// namespace on purpose disconnect with another, and can't be resumed.
+const transportClosed = "client namespace disconnect"
+
+// Resumptions lets a reconnecting client resume the subscriptions of its
+// previous connection. Each connection gets a resume token; when it drops,
+// what it was subscribed to is kept for RESUME_WINDOW and restored on the
+// first connection of the same token presenting it.
+type Resumptions struct {
+	config   *Config
+	emitter  *Emitter
+	fs       *FileSystemModule
+	net      *NetworkModule
+	shell    *ShellModule
+	tasks    *Tasks
+	entries  map[string]*resumable // by resume token
+	byClient map[string]string     // resume token of each connected client
+	mutex    sync.Mutex
+}
+
+// resumable is the logical session of a connection, connected or kept for
+// resumption after it dropped
+type resumable struct {
+	token    string        // name of the token of the connection
+	clientID string        // of the last connection
+	conn     socketio.Conn // nil once disconnected
+	state    *ResumeState  // captured on disconnect
+	timer    *time.Timer   // forgets the session at the end of the window
+}
+
+// ResumeState is what a connection was subscribed to
+type ResumeState struct {
+	Watches  []WatchRequest   `json:"watches"`
+	Monitors []MonitorRequest `json:"monitors"`
+	Shells   []string         `json:"shells"`  // sessions owned
+	Viewing  []string         `json:"viewing"` // sessions joined without owning them
+	Stats    bool             `json:"stats"`   // streaming shell:stats
+	Tasks    bool             `json:"tasks"`   // subscribed to task events
+}
+
+func NewResumptions(config *Config, emitter *Emitter, fs *FileSystemModule, net *NetworkModule, shell *ShellModule, tasks *Tasks) *Resumptions {
+	return &Resumptions{
+		config:   config,
+		emitter:  emitter,
+		fs:       fs,
+		net:      net,
+		shell:    shell,
+		tasks:    tasks,
+		entries:  make(map[string]*resumable),
+		byClient: make(map[string]string),
+	}
+}
+
+// Socket.IO Handlers
+
+// Issue returns the resume token of a new connection, empty when
+// resumption is disabled
+func (r *Resumptions) Issue(conn socketio.Conn) string {
+	token := ConnToken(conn)
+	if r.config.ResumeWindow <= 0 || token == nil {
+		return ""
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Failed to issue a resume token: %v", err)
+		return ""
+	}
+	resumeToken := hex.EncodeToString(buf)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries[resumeToken] = &resumable{token: token.Name, clientID: conn.ID(), conn: conn}
+	r.byClient[conn.ID()] = resumeToken
+	return resumeToken
+}
+
+// Suspend captures the subscriptions of a dropped connection, before the
+// modules clean them up, and keeps them for RESUME_WINDOW. Owned shells are
+// detached rather than killed meanwhile, those killed on disconnect until
+// the window ends.
+func (r *Resumptions) Suspend(conn socketio.Conn, reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	resumeToken, exists := r.byClient[conn.ID()]
+	if !exists {
+		return
+	}
+	delete(r.byClient, conn.ID())
+	entry := r.entries[resumeToken]
+	if reason != transportClosed {
+		delete(r.entries, resumeToken)
+		return
+	}
+
+	entry.conn = nil
+	entry.state = r.capture(conn.ID())
+	entry.timer = time.AfterFunc(r.config.ResumeWindow, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.entries[resumeToken] == entry {
+			delete(r.entries, resumeToken)
+		}
+	})
+}
+
+// Resume restores the subscriptions of the session named by the resume
+// query parameter of a new connection, taking them over from the previous
+// connection if the agent didn't notice it dropped yet. Resume tokens are
+// used once; the connection has one of its own to resume it in turn.
+func (r *Resumptions) Resume(conn socketio.Conn) {
+	handshake := conn.URL()
+	resumeToken := handshake.Query().Get("resume")
+	if resumeToken == "" {
+		return
+	}
+
+	r.mutex.Lock()
+	entry, exists := r.entries[resumeToken]
+	token := ConnToken(conn)
+	if !exists || token == nil || entry.token != token.Name {
+		r.mutex.Unlock()
+		r.emitter.Emit(conn, "sys:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "Session can't be resumed, it expired or was resumed already"),
+		})
+		return
+	}
+	delete(r.entries, resumeToken)
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	previous := entry.conn
+	if previous != nil {
+		delete(r.byClient, entry.clientID)
+		entry.state = r.capture(entry.clientID)
+	}
+	r.mutex.Unlock()
+
+	if previous != nil {
+		log.Printf("Closing connection %s, resumed by %s", entry.clientID, conn.ID())
+		previous.Close()
+	}
+	r.restore(conn, entry.clientID, entry.state)
+}
+
+// Helper functions
+
+// capture reads the subscriptions of a client and holds its shells. The
+// caller holds the mutex.
+func (r *Resumptions) capture(clientID string) *ResumeState {
+	state := &ResumeState{
+		Watches:  r.fs.resumableWatches(clientID),
+		Monitors: r.net.resumableMonitors(clientID),
+		Tasks:    r.tasks.subscribed(clientID),
+	}
+	state.Shells, state.Viewing, state.Stats = r.shell.holdSessions(clientID, r.config.ResumeWindow)
+	return state
+}
+
+// restore subscribes a connection like the state it resumes, reporting
+// what was restored and what failed with sys:resumed
+func (r *Resumptions) restore(conn socketio.Conn, previous string, state *ResumeState) {
+	restored := &ResumeState{Watches: []WatchRequest{}, Monitors: []MonitorRequest{}, Shells: []string{}, Viewing: []string{}}
+	failed := []map[string]interface{}{}
+	fail := func(kind, target string, result EventResult) {
+		failed = append(failed, map[string]interface{}{
+			"kind":    kind,
+			"target":  target,
+			"code":    result.Code,
+			"message": result.Message,
+		})
+	}
+
+	for _, watch := range state.Watches {
+		if result := r.fs.WatchFiles(conn, watch.Path, watch.Checksum, watch.WalkOptions); result.Success {
+			restored.Watches = append(restored.Watches, watch)
+		} else {
+			fail("watch", watch.Path, result)
+		}
+	}
+	for _, monitor := range state.Monitors {
+		if result := r.net.StartPortMonitoring(conn, monitor.Protocol, monitor.Interface, monitor.Interval, monitor.PortFilter); result.Success {
+			restored.Monitors = append(restored.Monitors, monitor)
+		} else {
+			fail("monitor", monitor.Protocol+"_"+monitor.Interface, result)
+		}
+	}
+	for _, sessionID := range state.Shells {
+		if result := r.shell.AttachSession(conn, sessionID); result.Success {
+			restored.Shells = append(restored.Shells, sessionID)
+		} else {
+			fail("shell", sessionID, result)
+		}
+	}
+	for _, sessionID := range state.Viewing {
+		if result := r.shell.JoinSession(conn, sessionID); result.Success {
+			restored.Viewing = append(restored.Viewing, sessionID)
+		} else {
+			fail("shell", sessionID, result)
+		}
+	}
+	if state.Stats {
+		if result := r.shell.StartStats(conn); result.Success {
+			restored.Stats = true
+		} else {
+			fail("stats", "", result)
+		}
+	}
+	if state.Tasks {
+		r.tasks.Subscribe(conn)
+		restored.Tasks = true
+	}
+
+	log.Printf("Connection %s resumed the session of %s", conn.ID(), previous)
+	r.emitter.Emit(conn, "sys:resumed", map[string]interface{}{
+		"previous_id": previous,
+		"restored":    restored,
+		"failed":      failed,
+		"timestamp":   time.Now(),
+	})
+}
+
+// resumableWatches returns the watches of a client, with the options they
+// were started with
+func (fsm *FileSystemModule) resumableWatches(clientID string) []WatchRequest {
+	fsm.mutex.RLock()
+	defer fsm.mutex.RUnlock()
+
+	watches := []WatchRequest{}
+	for path, key := range fsm.clients[clientID] {
+		checksum := false
+		if watch := fsm.watches[key]; watch != nil {
+			watch.mutex.Lock()
+			subscriber := watch.subscribers[clientID]
+			checksum = subscriber != nil && subscriber.checksums != nil
+			watch.mutex.Unlock()
+		}
+		watches = append(watches, WatchRequest{Path: path, Checksum: checksum, WalkOptions: key.options})
+	}
+	sort.Slice(watches, func(i, j int) bool { return watches[i].Path < watches[j].Path })
+	return watches
+}
+
+// resumableMonitors returns the port monitors of a connection, with its
+// filters
+func (nm *NetworkModule) resumableMonitors(connectionID string) []MonitorRequest {
+	nm.monitorMu.RLock()
+	defer nm.monitorMu.RUnlock()
+
+	monitors := []MonitorRequest{}
+	for _, monitor := range nm.monitors {
+		if filter := monitor.subscribers[connectionID]; filter != nil {
+			monitors = append(monitors, MonitorRequest{
+				Protocol:   monitor.protocol,
+				Interface:  monitor.iface,
+				Interval:   monitor.interval,
+				PortFilter: *filter,
+			})
+		}
+	}
+	return monitors
+}
+
+// holdSessions detaches the sessions a client owns so they outlive it until
+// it resumes, killing those killed on disconnect at the end of ttl. It
+// returns the sessions owned and joined, and whether it streamed stats.
+func (sm *ShellModule) holdSessions(clientID string, ttl time.Duration) (owned, viewing []string, stats bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	owned, viewing = []string{}, []string{}
+	for _, sessionID := range sm.clients[clientID] {
+		session, exists := sm.sessions[sessionID]
+		if !exists || !session.Active {
+			continue
+		}
+		if session.OnDisconnect != "detach" {
+			policy := session.DetachTTL
+			session.DetachTTL = ttl
+			sm.detach(session)
+			session.DetachTTL = policy
+		} else {
+			sm.detach(session)
+		}
+		owned = append(owned, sessionID)
+	}
+	delete(sm.clients, clientID)
+
+	for _, sessionID := range sm.viewers[clientID] {
+		if session, exists := sm.sessions[sessionID]; exists && session.Active && !slices.Contains(owned, sessionID) {
+			viewing = append(viewing, sessionID)
+		}
+	}
+	return owned, viewing, sm.statsClients[clientID]
+}
+
+// subscribed reports whether a client is subscribed to task events
+func (t *Tasks) subscribed(clientID string) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	_, exists := t.subscribers[clientID]
+	return exists
+}
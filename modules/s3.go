@@ -0,0 +1,564 @@
+package modules
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// S3 limits multipart uploads to 10000 parts of at least 5 MiB
+const (
+	s3MinPartSize = 5 << 20
+	s3MaxParts    = 10000
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3Request struct {
+	Endpoint     string `json:"endpoint"` // defaults to S3_ENDPOINT, then AWS
+	Region       string `json:"region"`
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+	PathStyle    *bool  `json:"path_style"` // default true for custom endpoints
+	Bucket       string `json:"bucket" binding:"required"`
+	Key          string `json:"key" binding:"required"`
+	Path         string `json:"path" binding:"required"`
+	ContentType  string `json:"content_type"`
+	SocketID     string `json:"socket_id"`                  // connection receiving net:progress events
+	RateLimit    int64  `json:"rate_limit" binding:"min=0"` // bytes per second
+	Proxy        string `json:"proxy"`                      // overrides HTTP_PROXY and HTTPS_PROXY
+}
+
+// s3Client signs requests to an S3-compatible endpoint with AWS Signature
+// Version 4. Without an access key requests are sent anonymously.
+type s3Client struct {
+	client       *http.Client
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	bucket       string
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// REST API Handlers
+
+// S3Get downloads an object to a local path
+func (nm *NetworkModule) S3Get(c *gin.Context) {
+	var req S3Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !nm.resolvePaths(c, &req.Path) {
+		return
+	}
+	recordAs(c, RecordJob, req.Path, map[string]any{"operation": "s3:get", "bucket": req.Bucket, "key": req.Key})
+
+	client, err := nm.s3Client(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(req.Path), 0755); err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create directory: %v", err),
+		})
+		return
+	}
+
+	resp, err := client.do(http.MethodGet, req.Key, nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to download object: %v", err),
+		})
+		return
+	}
+	defer resp.Body.Close()
+
+	token := RequestToken(c)
+	if resp.ContentLength > 0 {
+		if err := nm.quotas.Check(token, req.Path, resp.ContentLength); err != nil {
+			c.JSON(errorStatus(err), NetworkOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "%v", err),
+			})
+			return
+		}
+	}
+
+	file, err := os.Create(req.Path)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create file: %v", err),
+		})
+		return
+	}
+	defer file.Close()
+
+	task := nm.tasks.Start(c, "s3:get", req.Path, unitBytes)
+	task.ReportTo(requestConn(c, nm.emitter, req.SocketID))
+	task.SetTotal(resp.ContentLength)
+	bytesWritten, err := io.Copy(nm.quotas.Writer(token, req.Path, file), nm.throttle.Reader(req.RateLimit, task.Reader(resp.Body)))
+	task.Finish(err)
+	if err != nil {
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			file.Close()
+			os.Remove(req.Path)
+		}
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to write file: %v", err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Object downloaded successfully"),
+		Data: map[string]interface{}{
+			"bucket":        req.Bucket,
+			"key":           req.Key,
+			"file_path":     req.Path,
+			"bytes_written": bytesWritten,
+			"content_type":  resp.Header.Get("Content-Type"),
+			"etag":          resp.Header.Get("ETag"),
+			"job_id":        task.ID,
+		},
+	})
+}
+
+// S3Put uploads a local file as an object, using a multipart upload for
+// files larger than the part size
+func (nm *NetworkModule) S3Put(c *gin.Context) {
+	var req S3Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !nm.resolvePaths(c, &req.Path) {
+		return
+	}
+	recordAs(c, RecordJob, req.Path, map[string]any{"operation": "s3:put", "bucket": req.Bucket, "key": req.Key})
+
+	client, err := nm.s3Client(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	file, err := os.Open(req.Path)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to open file: %v", err),
+		})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("%s: %w", req.Path, syscall.EISDIR)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stat path: %v", err),
+		})
+		return
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	size := info.Size()
+	task := nm.tasks.Start(c, "s3:put", req.Path, unitBytes)
+	task.ReportTo(requestConn(c, nm.emitter, req.SocketID))
+	task.SetTotal(size)
+
+	// The parts of a multipart upload share the rate limit of the job
+	limiters := nm.throttle.limiters(req.RateLimit)
+	body := func(r io.Reader) io.Reader {
+		return &throttledReader{reader: task.Reader(r), limiters: limiters}
+	}
+
+	var etag string
+	parts := 1
+	if size <= nm.s3PartSize(size) {
+		etag, err = client.putObject(req.Key, body(file), size, contentType)
+	} else {
+		etag, parts, err = client.multipartUpload(req.Key, file, size, nm.s3PartSize(size), contentType, body)
+	}
+	task.Finish(err)
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to upload object: %v", err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Object uploaded successfully"),
+		Data: map[string]interface{}{
+			"bucket":    req.Bucket,
+			"key":       req.Key,
+			"file_path": req.Path,
+			"bytes":     size,
+			"etag":      etag,
+			"parts":     parts,
+			"job_id":    task.ID,
+		},
+	})
+}
+
+// Helper functions
+
+// s3Client builds a client from the request, falling back to the configured
+// endpoint and credentials. Configured credentials are never sent to an
+// endpoint chosen by the request.
+func (nm *NetworkModule) s3Client(req S3Request) (*s3Client, error) {
+	client := &s3Client{
+		region:       req.Region,
+		accessKey:    req.AccessKey,
+		secretKey:    req.SecretKey,
+		sessionToken: req.SessionToken,
+		bucket:       req.Bucket,
+	}
+
+	endpoint := req.Endpoint
+	if endpoint == "" || endpoint == nm.config.S3Endpoint {
+		endpoint = nm.config.S3Endpoint
+		if client.accessKey == "" {
+			client.accessKey, client.secretKey = nm.config.S3AccessKey, nm.config.S3SecretKey
+		}
+		if client.region == "" {
+			client.region = nm.config.S3Region
+		}
+	}
+	if client.region == "" {
+		client.region = "us-east-1"
+	}
+	if client.accessKey != "" && client.secretKey == "" {
+		return nil, fmt.Errorf("secret_key is required with access_key")
+	}
+
+	pathStyle := endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + client.region + ".amazonaws.com"
+	}
+	if req.PathStyle != nil {
+		pathStyle = *req.PathStyle
+	}
+	client.pathStyle = pathStyle
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %q", endpoint)
+	}
+	client.endpoint = parsed
+
+	if client.client, err = nm.outbound.Client(req.Proxy); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// s3PartSize returns the part size for a multipart upload of size bytes
+func (nm *NetworkModule) s3PartSize(size int64) int64 {
+	partSize := nm.config.S3PartSize
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	if size > partSize*s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	return partSize
+}
+
+func (s *s3Client) putObject(key string, body io.Reader, size int64, contentType string) (string, error) {
+	resp, err := s.do(http.MethodPut, key, nil, body, size, "UNSIGNED-PAYLOAD", map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Client) multipartUpload(key string, file *os.File, size, partSize int64, contentType string, wrap func(io.Reader) io.Reader) (string, int, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, emptyPayloadHash, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return "", 0, err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil || initiate.UploadID == "" {
+		return "", 0, fmt.Errorf("%w: invalid multipart upload response", errUpstream)
+	}
+	uploadID := url.Values{"uploadId": {initiate.UploadID}}
+
+	complete := s3CompleteUpload{}
+	for offset := int64(0); offset < size; offset += partSize {
+		length := min(partSize, size-offset)
+		number := len(complete.Parts) + 1
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiate.UploadID}}
+		section := wrap(io.NewSectionReader(file, offset, length))
+		resp, err := s.do(http.MethodPut, key, query, section, length, "UNSIGNED-PAYLOAD", nil)
+		if err != nil {
+			s.abortUpload(key, uploadID)
+			return "", 0, err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		s.abortUpload(key, uploadID)
+		return "", 0, err
+	}
+	hash := sha256.Sum256(body)
+	resp, err = s.do(http.MethodPost, key, uploadID, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(hash[:]), map[string]string{"Content-Type": "application/xml"})
+	if err != nil {
+		s.abortUpload(key, uploadID)
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	// Completion can fail after the 200 status was sent
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	var result struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		s3ErrorResponse
+	}
+	if err := xml.Unmarshal(content, &result); err != nil {
+		return "", 0, fmt.Errorf("%w: invalid multipart completion response", errUpstream)
+	}
+	if result.XMLName.Local == "Error" {
+		s.abortUpload(key, uploadID)
+		return "", 0, fmt.Errorf("%w: %s: %s", errUpstream, result.Code, result.Message)
+	}
+	return result.ETag, len(complete.Parts), nil
+}
+
+// abortUpload discards the parts of a failed multipart upload
+func (s *s3Client) abortUpload(key string, uploadID url.Values) {
+	if resp, err := s.do(http.MethodDelete, key, uploadID, nil, 0, emptyPayloadHash, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do sends a signed request for an object, returning an error for non-2xx
+// responses
+func (s *s3Client) do(method, key string, query url.Values, body io.Reader, length int64, payloadHash string, headers map[string]string) (*http.Response, error) {
+	target := *s.endpoint
+	path := strings.TrimSuffix(target.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket + "/" + key
+	} else {
+		target.Host = s.bucket + "." + target.Host
+		path += "/" + key
+	}
+	target.Path = path
+	target.RawPath = s3Escape(path, false)
+	target.RawQuery = s3CanonicalQuery(query)
+
+	if length == 0 {
+		body = nil
+	}
+	httpReq, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.ContentLength = length
+	for name, value := range headers {
+		httpReq.Header.Set(name, value)
+	}
+	s.sign(httpReq, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err s3ErrorResponse
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err)
+		if s3Err.Code == "" {
+			s3Err.Code = resp.Status
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s/%s: %s: %w", s.bucket, key, s3Err.Code, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("%w: %s: %s", errUpstream, s3Err.Code, s3Err.Message)
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization to a request
+func (s *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	if s.accessKey == "" {
+		return
+	}
+
+	// Sign the host and every x-amz-* header
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, keeping
+// slashes unless encodeSlash is set
+func s3Escape(value string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name, as signed
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,283 @@
+package modules
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ScanRequest struct {
+	Hosts       []string `json:"hosts" binding:"required,min=1"` // host names, addresses or IPv4 CIDRs
+	Ports       []int    `json:"ports,omitempty" binding:"omitempty,dive,min=1,max=65535"`
+	Ranges      []string `json:"ranges,omitempty"`                  // "8000-8999" or a single port
+	Concurrency int      `json:"concurrency" binding:"min=0"`       // connections in flight, default and at most SCAN_MAX_CONCURRENCY
+	Timeout     int      `json:"timeout" binding:"min=0,max=10000"` // connection timeout in milliseconds, default 1000
+	Closed      bool     `json:"closed"`                            // also reports closed and filtered ports
+}
+
+// ScanTarget is a scanned address and its open ports
+type ScanTarget struct {
+	Host     string `json:"host"`
+	IP       string `json:"ip"`
+	Open     []int  `json:"open"`
+	Closed   int    `json:"closed"`
+	Filtered int    `json:"filtered"` // timed out or unreachable
+}
+
+// ScanPort is the state of a scanned port, "open", "closed" or "filtered"
+type ScanPort struct {
+	Host  string  `json:"host"`
+	IP    string  `json:"ip"`
+	Port  int     `json:"port"`
+	State string  `json:"state"`
+	RTT   float64 `json:"rtt_ms,omitempty"`
+}
+
+// REST API Handlers
+
+// Scan connects to ports of remote hosts and reports which are open. Scans
+// require the scan permission, are bounded by SCAN_MAX_PROBES connections
+// and run one at a time. With stream=true (or an application/x-ndjson Accept
+// header) ports are streamed as they are found, one JSON object per line.
+func (nm *NetworkModule) Scan(c *gin.Context) {
+	if !RequestToken(c).HasScope(ScopeScan) {
+		c.JSON(http.StatusForbidden, NetworkOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Port scans require the scan permission"),
+		})
+		return
+	}
+
+	var req ScanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	ports, err := scanPortList(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	targets, err := nm.scanTargets(c.Request.Context(), req.Hosts, len(ports))
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to start scan: %v", err),
+		})
+		return
+	}
+
+	if !nm.scanMu.TryLock() {
+		c.JSON(http.StatusConflict, NetworkOperation{
+			Success: false,
+			Code:    ErrConflict,
+			Message: Localize(c, "A port scan is already running"),
+		})
+		return
+	}
+	defer nm.scanMu.Unlock()
+
+	concurrency := nm.config.ScanMaxConcurrency
+	if req.Concurrency > 0 && req.Concurrency < concurrency {
+		concurrency = req.Concurrency
+	}
+	timeout := time.Second
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	stream := c.Query("stream") == "true" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+	var encoder *json.Encoder
+	if stream {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder = json.NewEncoder(c.Writer)
+	}
+
+	started := time.Now()
+	var mutex sync.Mutex
+	nm.connectScan(c.Request.Context(), targets, ports, concurrency, timeout, func(i int, result ScanPort) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch result.State {
+		case "open":
+			targets[i].Open = append(targets[i].Open, result.Port)
+		case "closed":
+			targets[i].Closed++
+		default:
+			targets[i].Filtered++
+		}
+		if stream && (result.State == "open" || req.Closed) {
+			encoder.Encode(gin.H{"event": "port", "data": result})
+			c.Writer.Flush()
+		}
+	})
+	for i := range targets {
+		sort.Ints(targets[i].Open)
+	}
+
+	response := NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Scan completed"),
+		Data: map[string]interface{}{
+			"targets":     targets,
+			"probed":      len(targets) * len(ports),
+			"duration_ms": time.Since(started).Milliseconds(),
+		},
+	}
+	if stream {
+		encoder.Encode(struct {
+			Event string `json:"event"`
+			NetworkOperation
+		}{"result", response})
+		c.Writer.Flush()
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Helper functions
+
+// scanPortList lists the ports of a scan, without duplicates
+func scanPortList(req ScanRequest) ([]int, error) {
+	filter := PortFilter{Ranges: req.Ranges}
+	if err := filter.parse(); err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	var ports []int
+	add := func(port int) {
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	for _, port := range req.Ports {
+		add(port)
+	}
+	for _, r := range filter.ranges {
+		for port := r[0]; port <= r[1]; port++ {
+			add(port)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("ports or ranges are required")
+	}
+	return ports, nil
+}
+
+// scanTargets resolves the hosts of a scan, expanding CIDRs, and checks them
+// against the outbound policy and SCAN_MAX_PROBES
+func (nm *NetworkModule) scanTargets(ctx context.Context, hosts []string, ports int) ([]ScanTarget, error) {
+	var targets []ScanTarget
+	limit := nm.config.ScanMaxProbes
+	add := func(host string, ip net.IP, allowedByName bool) error {
+		if err := nm.outbound.checkIP(ip, allowedByName); err != nil {
+			return err
+		}
+		if limit > 0 && (len(targets)+1)*ports > limit {
+			return fmt.Errorf("%w: scans are limited to %d connections", errInvalidRequest, limit)
+		}
+		targets = append(targets, ScanTarget{Host: host, IP: ip.String(), Open: []int{}})
+		return nil
+	}
+
+	for _, host := range hosts {
+		if _, ipNet, err := net.ParseCIDR(host); err == nil {
+			ones, bits := ipNet.Mask.Size()
+			if ipNet.IP.To4() == nil || bits-ones > 16 {
+				return nil, fmt.Errorf("%w: only IPv4 networks of up to a /16 can be scanned", errInvalidRequest)
+			}
+			first := binary.BigEndian.Uint32(ipNet.IP.To4())
+			for n := uint32(0); n < 1<<(bits-ones); n++ {
+				ip := make(net.IP, 4)
+				binary.BigEndian.PutUint32(ip, first+n)
+				if err := add(ip.String(), ip, false); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			if err := add(host, ip, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !hostnamePattern.MatchString(host) {
+			return nil, fmt.Errorf("%w: invalid host %q", errInvalidRequest, host)
+		}
+		allowedByName, err := nm.outbound.checkHost(host, true)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(host, ips[0], allowedByName); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// connectScan connects to every port of every target, with at most
+// concurrency connections in flight, until done or ctx is canceled
+func (nm *NetworkModule) connectScan(ctx context.Context, targets []ScanTarget, ports []int, concurrency int, timeout time.Duration, report func(int, ScanPort)) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, port := range ports {
+		for i, target := range targets {
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(i int, target ScanTarget, port int) {
+				defer func() { <-slots; wg.Done() }()
+				result := ScanPort{Host: target.Host, IP: target.IP, Port: port, State: "filtered"}
+				started := time.Now()
+				conn, err := nm.outbound.DialTimeout("tcp", net.JoinHostPort(target.Host, strconv.Itoa(port)), timeout)
+				switch {
+				case err == nil:
+					conn.Close()
+					result.State = "open"
+					result.RTT = float64(time.Since(started).Microseconds()) / 1000
+				case errors.Is(err, syscall.ECONNREFUSED):
+					result.State = "closed"
+				}
+				report(i, result)
+			}(i, target, port)
+		}
+	}
+}
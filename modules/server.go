@@ -0,0 +1,103 @@
+package modules
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Classes of request bodies, each with its own size limit
+const (
+	bodyJSON   = "json"   // requests describing an operation
+	bodyWrite  = "write"  // file content sent as JSON
+	bodyUpload = "upload" // raw streams
+	bodyExec   = "exec"   // commands to run
+)
+
+// bodyClasses are the classes of the routes whose bodies aren't generic
+// JSON, by route
+var bodyClasses = map[string]string{
+	"/api/fs/create":                 bodyWrite,
+	"/api/fs/write":                  bodyWrite,
+	"/api/fs/env":                    bodyWrite,
+	"/api/fs/edit-structured":        bodyWrite,
+	"/api/fs/render":                 bodyWrite,
+	"/api/provision":                 bodyWrite,
+	"/api/fs/replicate/import":       bodyUpload,
+	"/api/net/speedtest/upload":      bodyUpload,
+	"/api/shell/exec":                bodyExec,
+	"/api/shell/templates/:name/run": bodyExec,
+	"/api/fleet/exec":                bodyExec,
+}
+
+// NewHTTPServer builds the HTTP server of the agent with the timeouts and
+// header limit of the config, so slow clients can't hold connections open
+// forever
+func NewHTTPServer(config *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       config.HTTPReadTimeout,
+		ReadHeaderTimeout: config.HTTPReadHeaderTimeout,
+		WriteTimeout:      config.HTTPWriteTimeout,
+		IdleTimeout:       config.HTTPIdleTimeout,
+		MaxHeaderBytes:    config.HTTPMaxHeaderBytes,
+	}
+}
+
+// BodyLimitMiddleware refuses request bodies larger than max bytes with 413
+// and ERR_TOO_LARGE. Bodies announcing their length are refused up front;
+// others fail while they're read, past the limit.
+func BodyLimitMiddleware(max int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limitBody(c, max)
+	}
+}
+
+// BodyClassMiddleware limits request bodies to the limit of the class of
+// their route: BODY_LIMIT_WRITE, BODY_LIMIT_UPLOAD, BODY_LIMIT_EXEC, or
+// BODY_LIMIT_JSON for the others. MAX_BODY_SIZE still applies on top.
+func BodyClassMiddleware(config *Config) gin.HandlerFunc {
+	limits := map[string]int64{
+		bodyJSON:   config.BodyLimitJSON,
+		bodyWrite:  config.BodyLimitWrite,
+		bodyUpload: config.BodyLimitUpload,
+		bodyExec:   config.BodyLimitExec,
+	}
+	return func(c *gin.Context) {
+		class, ok := bodyClasses[c.FullPath()]
+		if !ok {
+			class = bodyJSON
+		}
+		limitBody(c, limits[class])
+	}
+}
+
+// Helper functions
+
+// bodyLimit is the size bodies of a class are limited to, the smaller of its
+// limit and MAX_BODY_SIZE, 0 for no limit
+func bodyLimit(config *Config, limit int64) int64 {
+	if limit <= 0 || config.MaxBodySize > 0 && config.MaxBodySize < limit {
+		return max(config.MaxBodySize, 0)
+	}
+	return limit
+}
+
+// limitBody refuses the request when its body is larger than max bytes, 0
+// for no limit, and otherwise stops reading it past max
+func limitBody(c *gin.Context, max int64) {
+	if max <= 0 || c.Request.Body == nil {
+		c.Next()
+		return
+	}
+	if c.Request.ContentLength > max {
+		c.AbortWithStatusJSON(errorStatus(errBodyTooLarge), gin.H{
+			"success": false,
+			"code":    errorCode(errBodyTooLarge),
+			"message": Localize(c, "Request body exceeds the %d byte limit", max),
+		})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+	c.Next()
+}
@@ -0,0 +1,392 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ServiceOptions describes how the agent is registered as a system service
+type ServiceOptions struct {
+	Name    string
+	User    string
+	PidFile string
+	LogFile string
+	Debug   bool
+	DryRun  bool // print the generated files instead of installing them
+}
+
+// configEnvVars lists the environment variables read at startup, which are
+// copied into the service definition so it runs with the current config
+var configEnvVars = []string{
+	"AUTH_TOKEN",
+	"AUTH_TOKENS",
+	"SOCKET_SCOPES",
+	"READ_ONLY",
+	"APPROVAL_DELETE_FILES",
+	"APPROVAL_EXEC",
+	"APPROVAL_EXEC_ALLOWLIST",
+	"APPROVAL_TTL",
+	"NOTIFY_CHANNELS",
+	"NOTIFY_COOLDOWN",
+	"PORT",
+	"EMIT_QUEUE_SIZE",
+	"EMIT_BATCH_WINDOW_MS",
+	"HTTP_READ_TIMEOUT",
+	"HTTP_READ_HEADER_TIMEOUT",
+	"HTTP_WRITE_TIMEOUT",
+	"HTTP_IDLE_TIMEOUT",
+	"HTTP_MAX_HEADER_BYTES",
+	"MAX_BODY_SIZE",
+	"BODY_LIMIT_JSON",
+	"BODY_LIMIT_WRITE",
+	"BODY_LIMIT_UPLOAD",
+	"BODY_LIMIT_EXEC",
+	"WATCH_REPLAY_WINDOW",
+	"WATCH_REPLAY_MAX_EVENTS",
+	"WATCH_POLL_INTERVAL",
+	"HEARTBEAT_INTERVAL",
+	"HEARTBEAT_TIMEOUT",
+	"RESUME_WINDOW",
+	"COMPRESS_MIN_SIZE",
+	"FS_HOME",
+	"FS_ROOT",
+	"FS_BOOKMARKS",
+	"BOOKMARKS_FILE",
+	"READ_MAX_SIZE",
+	"INDEX_PATHS",
+	"INDEX_MAX_FILE_SIZE",
+	"INDEX_MAX_FILES",
+	"INDEX_INTERVAL",
+	"WALK_MAX_DEPTH",
+	"WALK_MAX_ENTRIES",
+	"WALK_MAX_DURATION",
+	"TMP_DIR",
+	"TMP_DEFAULT_TTL",
+	"TMP_MAX_TTL",
+	"STREAM_MAX_JOBS",
+	"QUOTA_MAX_FILE_SIZE",
+	"QUOTA_DAILY_BYTES",
+	"QUOTA_MIN_FREE_DISK",
+	"IDEMPOTENCY_TTL",
+	"S3_ENDPOINT",
+	"S3_REGION",
+	"S3_ACCESS_KEY",
+	"S3_SECRET_KEY",
+	"S3_PART_SIZE",
+	"DOWNLOAD_SEGMENTS",
+	"DOWNLOAD_SEGMENT_MIN_SIZE",
+	"DOWNLOAD_CACHE_DIR",
+	"DOWNLOAD_CACHE_MAX_SIZE",
+	"RATE_LIMIT",
+	"RATE_LIMIT_JOB",
+	"OUTBOUND_ALLOW",
+	"OUTBOUND_DENY",
+	"HTTP_PROXY",
+	"HTTPS_PROXY",
+	"NO_PROXY",
+	"PORT_MONITOR_BACKEND",
+	"HOSTS_FILE",
+	"RESOLV_CONF",
+	"RDAP_URL",
+	"WHOIS_SERVER",
+	"DNSBL_ZONES",
+	"DISCOVERY_ENABLED",
+	"MOUNTS_ENABLED",
+	"DISCOVERY_RATE",
+	"OUI_FILE",
+	"SCAN_MAX_PROBES",
+	"SCAN_MAX_CONCURRENCY",
+	"PORTMAP_BACKEND",
+	"UPNP_LOCATION",
+	"NATPMP_GATEWAY",
+	"FIREWALL_BACKEND",
+	"FIREWALL_ROLLBACK_TIMEOUT",
+	"SHELL_PROFILES",
+	"SHELL_STATS_INTERVAL",
+	"SHELL_ON_DISCONNECT",
+	"SHELL_DETACH_TTL",
+	"SHELL_TEMPLATES",
+	"SHELL_MAX_SESSIONS",
+	"FLEET_AGENTS",
+	"FLEET_PARALLEL",
+	"AGENT_ID",
+	"AGENT_ID_FILE",
+	"AGENT_NAME",
+	"AGENT_LABELS",
+	"AGENT_TAGS",
+	"FLEET_CONTROLLER",
+	"FLEET_CONTROLLER_TOKEN",
+	"FLEET_ADVERTISE_URL",
+	"FLEET_REGISTER_INTERVAL",
+	"HEALTH_MIN_FREE_DISK",
+	"MAX_CLIENTS",
+	"MAX_CLIENTS_PER_TOKEN",
+	"MAX_REQUESTS",
+	"MAX_REQUESTS_PER_TOKEN",
+	"STORE_PATH",
+	"STORE_RETENTION_DAYS",
+}
+
+var systemdUnit = template.Must(template.New("systemd").Parse(`[Unit]
+Description=ccw remote management agent
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{.ExecStart}}
+EnvironmentFile={{.EnvFile}}
+Restart=on-failure
+RestartSec=5
+{{- if .User}}
+User={{.User}}
+{{- end}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var launchdPlist = template.Must(template.New("launchd").Funcs(template.FuncMap{"xml": html.EscapeString}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args}}
+		<string>{{xml .}}</string>
+{{- end}}
+	</array>
+	<key>EnvironmentVariables</key>
+	<dict>
+{{- range .Env}}
+		<key>{{xml .Name}}</key>
+		<string>{{xml .Value}}</string>
+{{- end}}
+	</dict>
+{{- if .User}}
+	<key>UserName</key>
+	<string>{{xml .User}}</string>
+{{- end}}
+{{- if .LogFile}}
+	<key>StandardOutPath</key>
+	<string>{{xml .LogFile}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogFile}}</string>
+{{- end}}
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`))
+
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// InstallService registers the running executable as a service started at
+// boot, using systemd on Linux and launchd on macOS
+func InstallService(opts ServiceOptions) error {
+	if os.Getenv("AUTH_TOKEN") == "" {
+		return fmt.Errorf("AUTH_TOKEN environment variable is required")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %v", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("failed to locate executable: %v", err)
+	}
+
+	args := []string{executable}
+	if opts.Debug {
+		args = append(args, "--debug")
+	}
+	if opts.PidFile != "" {
+		args = append(args, "--pidfile", opts.PidFile)
+	}
+	if opts.LogFile != "" && runtime.GOOS != "darwin" {
+		args = append(args, "--log-file", opts.LogFile)
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		return installSystemd(opts, args)
+	case "darwin":
+		return installLaunchd(opts, args)
+	default:
+		return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+	}
+}
+
+// UninstallService stops the service and removes its definition
+func UninstallService(opts ServiceOptions) error {
+	switch runtime.GOOS {
+	case "linux":
+		unitPath, envPath := systemdPaths(opts.Name)
+		if opts.DryRun {
+			fmt.Printf("systemctl disable --now %s\nrm %s %s\nsystemctl daemon-reload\n", opts.Name, unitPath, envPath)
+			return nil
+		}
+		if _, err := os.Stat(unitPath); err != nil {
+			return fmt.Errorf("service %s is not installed: %v", opts.Name, err)
+		}
+		// The service may already be stopped
+		runCommand("systemctl", "disable", "--now", opts.Name)
+		for _, path := range []string{unitPath, envPath} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return runCommand("systemctl", "daemon-reload")
+
+	case "darwin":
+		plistPath := launchdPath(opts.Name)
+		if opts.DryRun {
+			fmt.Printf("launchctl unload -w %s\nrm %s\n", plistPath, plistPath)
+			return nil
+		}
+		if _, err := os.Stat(plistPath); err != nil {
+			return fmt.Errorf("service %s is not installed: %v", opts.Name, err)
+		}
+		runCommand("launchctl", "unload", "-w", plistPath)
+		return os.Remove(plistPath)
+
+	default:
+		return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+	}
+}
+
+// Helper functions
+
+func installSystemd(opts ServiceOptions, args []string) error {
+	unitPath, envPath := systemdPaths(opts.Name)
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+
+	var unit bytes.Buffer
+	err := systemdUnit.Execute(&unit, map[string]interface{}{
+		"ExecStart": strings.Join(quoted, " "),
+		"EnvFile":   envPath,
+		"User":      opts.User,
+	})
+	if err != nil {
+		return err
+	}
+
+	var env bytes.Buffer
+	for _, variable := range serviceEnv() {
+		fmt.Fprintf(&env, "%s=%s\n", variable.Name, strconv.Quote(variable.Value))
+	}
+
+	if opts.DryRun {
+		fmt.Printf("# %s\n%s\n# %s (mode 0600)\n%s", unitPath, unit.String(), envPath, redactEnv(env.String()))
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(envPath), 0755); err != nil {
+		return err
+	}
+	// The environment holds the auth tokens
+	if err := os.WriteFile(envPath, env.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(unitPath, unit.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := runCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runCommand("systemctl", "enable", "--now", opts.Name)
+}
+
+func installLaunchd(opts ServiceOptions, args []string) error {
+	plistPath := launchdPath(opts.Name)
+
+	var plist bytes.Buffer
+	err := launchdPlist.Execute(&plist, map[string]interface{}{
+		"Label":   launchdLabel(opts.Name),
+		"Args":    args,
+		"Env":     serviceEnv(),
+		"User":    opts.User,
+		"LogFile": opts.LogFile,
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Printf("# %s (mode 0600)\n%s", plistPath, redactEnv(plist.String()))
+		return nil
+	}
+
+	// The environment holds the auth tokens
+	if err := os.WriteFile(plistPath, plist.Bytes(), 0600); err != nil {
+		return err
+	}
+	return runCommand("launchctl", "load", "-w", plistPath)
+}
+
+func systemdPaths(name string) (string, string) {
+	return filepath.Join("/etc/systemd/system", name+".service"), filepath.Join("/etc/ccw", name+".env")
+}
+
+func launchdLabel(name string) string {
+	return "com.sammwyy." + name
+}
+
+func launchdPath(name string) string {
+	return filepath.Join("/Library/LaunchDaemons", launchdLabel(name)+".plist")
+}
+
+// serviceEnv returns the configuration variables set in the current
+// environment, sorted by name
+func serviceEnv() []envVar {
+	var env []envVar
+	for _, name := range configEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, envVar{Name: name, Value: value})
+		}
+	}
+	sort.Slice(env, func(i, j int) bool {
+		return env[i].Name < env[j].Name
+	})
+	return env
+}
+
+// redactEnv hides the secrets from dry run output
+func redactEnv(content string) string {
+	for _, name := range []string{"AUTH_TOKEN", "AUTH_TOKENS", "S3_SECRET_KEY", "FLEET_CONTROLLER_TOKEN"} {
+		if value := os.Getenv(name); value != "" {
+			content = strings.ReplaceAll(content, value, "********")
+			content = strings.ReplaceAll(content, html.EscapeString(value), "********")
+		}
+	}
+	return content
+}
+
+func runCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
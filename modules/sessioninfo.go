@@ -0,0 +1,219 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// cwdCheckDelay is how long after a burst of output the working directory
+// of a session is checked, so a prompt printed after cd is caught
+const cwdCheckDelay = 100 * time.Millisecond
+
+// REST API Handlers
+
+// GetSessions lists the interactive sessions of the connections of the
+// request's token, with their working directory. With env=true the
+// environment is included, which requires the env.reveal scope.
+func (sm *ShellModule) GetSessions(c *gin.Context) {
+	withEnv := c.Query("env") == "true"
+	token := RequestToken(c)
+	if withEnv && !token.HasScope(ScopeEnvReveal) {
+		c.JSON(http.StatusForbidden, ShellOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Revealing the environment requires the env.reveal permission"),
+		})
+		return
+	}
+
+	sm.mutex.RLock()
+	var owned []*ShellSession
+	for _, session := range sm.sessions {
+		if session.Active && token != nil && session.Token == token.Name {
+			owned = append(owned, session)
+		}
+	}
+	sm.mutex.RUnlock()
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].Started.Before(owned[j].Started)
+	})
+
+	sessions := make([]map[string]interface{}, 0, len(owned))
+	for _, session := range owned {
+		sessions = append(sessions, sm.sessionInfo(session, withEnv))
+	}
+	page, total, next, err := paginate(c, sessions)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success:    true,
+		Message:    Localize(c, "Sessions retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// Socket.IO Handlers
+
+// SessionInfo returns the process, working directory and, with env, the
+// environment of a session. Viewers may inspect a session too, but the
+// environment requires the env.reveal scope.
+func (sm *ShellModule) SessionInfo(conn socketio.Conn, sessionID string, withEnv bool) EventResult {
+	sm.mutex.RLock()
+	session, exists := sm.sessions[sessionID]
+	sm.mutex.RUnlock()
+
+	if !exists || !session.Active {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Session not found"),
+			"session_id": sessionID,
+		})
+	}
+	if session.ClientID != conn.ID() && !inRoom(conn, sessionRoom(sessionID)) {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Access denied"),
+			"session_id": sessionID,
+		})
+	}
+	if withEnv && !ConnToken(conn).HasScope(ScopeEnvReveal) {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Revealing the environment requires the env.reveal permission"),
+			"session_id": sessionID,
+		})
+	}
+
+	info := sm.sessionInfo(session, withEnv)
+	info["timestamp"] = time.Now()
+	return sm.emitter.Reply(conn, "shell:info", info)
+}
+
+// Helper functions
+
+// sessionInfo describes a session. The process inspected is the foreground
+// job of the terminal, e.g. a nested shell, or the shell itself.
+func (sm *ShellModule) sessionInfo(session *ShellSession, withEnv bool) map[string]interface{} {
+	sm.mutex.RLock()
+	cmd, restarts, usage := session.Command, session.Restarts, session.usage
+	detached := session.Detached
+	sm.mutex.RUnlock()
+
+	pid := sm.sessionProcess(session)
+	info := map[string]interface{}{
+		"session_id": session.ID,
+		"command":    cmd.Args[0],
+		"pid":        cmd.Process.Pid,
+		"foreground": pid,
+		"started_at": session.Started,
+		"viewers":    sm.server.RoomLen("/", sessionRoom(session.ID)),
+		"usage":      usage,
+		"detached":   !detached.IsZero(),
+	}
+	if !detached.IsZero() {
+		info["detached_at"] = detached
+	}
+	if session.Profile != "" {
+		info["profile"] = session.Profile
+		info["restarts"] = restarts
+	}
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err == nil {
+		info["cwd"] = cwd
+	}
+	if withEnv {
+		info["env"] = readEnviron(pid)
+	}
+	return info
+}
+
+// scheduleCwdCheck checks the working directory of a session shortly after
+// output, once per burst
+func (sm *ShellModule) scheduleCwdCheck(session *ShellSession) {
+	if session.cwdPending.Swap(true) {
+		return
+	}
+	time.AfterFunc(cwdCheckDelay, func() {
+		session.cwdPending.Store(false)
+		sm.checkCwd(session)
+	})
+}
+
+// checkCwd broadcasts shell:cwd when the working directory of a session
+// changed since the last check
+func (sm *ShellModule) checkCwd(session *ShellSession) {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", sm.sessionProcess(session)))
+	if err != nil {
+		return
+	}
+
+	sm.mutex.Lock()
+	previous := session.cwd
+	active := session.Active
+	session.cwd = cwd
+	sm.mutex.Unlock()
+	if !active || cwd == previous {
+		return
+	}
+
+	sm.emitter.Broadcast(sm.server, sessionRoom(session.ID), "shell:cwd", map[string]interface{}{
+		"session_id": session.ID,
+		"cwd":        cwd,
+		"previous":   previous,
+		"timestamp":  time.Now(),
+	})
+}
+
+// sessionProcess returns the foreground process group of the terminal of a
+// session, or the shell when it can't be read
+func (sm *ShellModule) sessionProcess(session *ShellSession) int {
+	sm.mutex.RLock()
+	pid, ptmx := session.Command.Process.Pid, session.PTY
+	sm.mutex.RUnlock()
+
+	if pgrp := foregroundProcessGroup(ptmx); pgrp > 0 {
+		return pgrp
+	}
+	return pid
+}
+
+// readEnviron reads the environment a process was started with; variables
+// exported later by a shell only show in the processes it starts
+func readEnviron(pid int) map[string]string {
+	env := make(map[string]string)
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return env
+	}
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if key, value, ok := strings.Cut(string(entry), "="); ok && key != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+func inRoom(conn socketio.Conn, room string) bool {
+	for _, joined := range conn.Rooms() {
+		if joined == room {
+			return true
+		}
+	}
+	return false
+}
@@ -2,14 +2,19 @@ package modules
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
 	"github.com/gin-gonic/gin"
@@ -18,21 +23,47 @@ import (
 )
 
 type ShellModule struct {
-	server   *socketio.Server
-	sessions map[string]*ShellSession
-	clients  map[string][]string // clientID -> sessionIDs
-	mutex    sync.RWMutex
+	server       *socketio.Server
+	emitter      *Emitter
+	config       *Config
+	paths        *Paths
+	profiles     map[string]*ShellProfile
+	sessions     map[string]*ShellSession
+	clients      map[string][]string // clientID -> sessionIDs
+	statsClients map[string]bool     // connections streaming shell:stats
+	viewers      map[string][]string // clientID -> sessionIDs joined, for resumption
+	mutex        sync.RWMutex
+
+	templates   map[string]*CommandTemplate
+	templatesMu sync.Mutex
 }
 
 type ShellSession struct {
 	ID       string
 	ClientID string
+	Token    string // name of the token of the owner
 	Command  *exec.Cmd
 	PTY      *os.File
 	Input    io.WriteCloser
 	Output   io.ReadCloser
 	Done     chan bool
 	Active   bool
+	Started  time.Time
+	Profile  string // name of the profile spawned, if any
+	Restarts int
+
+	OnDisconnect string        // "kill" or "detach" when the owner disconnects
+	DetachTTL    time.Duration // how long a detached session waits to be attached, 0 forever
+	Detached     time.Time     // when the owner disconnected, zero while attached
+	detachTimer  *time.Timer
+
+	profile      *ShellProfile
+	restartDelay time.Duration
+	cwd          string // working directory seen last
+	cwdPending   atomic.Bool
+	usage        *SessionUsage // sampled last
+	usageRoot    int           // shell the usage was sampled for
+	cpuTicks     uint64
 }
 
 type CommandRequest struct {
@@ -41,12 +72,18 @@ type CommandRequest struct {
 	Env     map[string]string `json:"env"`
 	WorkDir string            `json:"workdir"`
 	Timeout int               `json:"timeout"` // in seconds
+	// SudoPassword is written to the standard input, for sudo -S, instead
+	// of embedding it in the command
+	SudoPassword string `json:"sudo_password"`
 }
 
 type ShellOperation struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Data    any    `json:"data,omitempty"`
+	Success    bool   `json:"success"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	Data       any    `json:"data,omitempty"`
+	Total      *int   `json:"total,omitempty"`       // list size before pagination
+	NextCursor string `json:"next_cursor,omitempty"` // cursor of the next page, if any
 }
 
 type CommandResult struct {
@@ -58,26 +95,55 @@ type CommandResult struct {
 	Terminated bool   `json:"terminated"`
 }
 
-func NewShellModule(server *socketio.Server) *ShellModule {
-	return &ShellModule{
-		server:   server,
-		sessions: make(map[string]*ShellSession),
-		clients:  make(map[string][]string),
+func NewShellModule(server *socketio.Server, emitter *Emitter, config *Config, paths *Paths) (*ShellModule, error) {
+	if err := (DisconnectPolicy{OnDisconnect: config.ShellOnDisconnect}).validate(); err != nil {
+		return nil, fmt.Errorf("SHELL_ON_DISCONNECT: %w", err)
+	}
+	profiles, err := loadShellProfiles(config.ShellProfiles)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := loadCommandTemplates(config.ShellTemplates)
+	if err != nil {
+		return nil, err
 	}
+
+	return &ShellModule{
+		server:       server,
+		emitter:      emitter,
+		config:       config,
+		paths:        paths,
+		profiles:     profiles,
+		sessions:     make(map[string]*ShellSession),
+		clients:      make(map[string][]string),
+		statsClients: make(map[string]bool),
+		viewers:      make(map[string][]string),
+		templates:    templates,
+	}, nil
 }
 
 // REST API Handlers
 
-// ExecuteCommand executes a command and returns the output
+// ExecuteCommand executes a command and returns the output. With stream=true
+// (or an application/x-ndjson Accept header) the output is also streamed as
+// it's printed, one JSON object per line, before the result.
 func (sm *ShellModule) ExecuteCommand(c *gin.Context) {
 	var req CommandRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, ShellOperation{
 			Success: false,
-			Message: fmt.Sprintf("Invalid request: %v", err),
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
 		})
 		return
 	}
+	if !sm.resolvePaths(c, &req.WorkDir) {
+		return
+	}
+
+	// The environment and password are left out, they may hold secrets
+	history := map[string]any{"command": req.Command, "args": req.Args, "workdir": req.WorkDir}
+	recordAs(c, RecordCommand, "", history)
 
 	startTime := time.Now()
 
@@ -103,19 +169,23 @@ func (sm *ShellModule) ExecuteCommand(c *gin.Context) {
 		cmd.Env = env
 	}
 
-	// Setup timeout if specified
-	if req.Timeout > 0 {
-		go func() {
-			time.Sleep(time.Duration(req.Timeout) * time.Second)
-			if cmd.Process != nil {
-				cmd.Process.Kill()
-			}
-		}()
+	if req.SudoPassword != "" {
+		cmd.Stdin = strings.NewReader(req.SudoPassword + "\n")
+	}
+
+	var stream *outputStream
+	if c.Query("stream") == "true" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson") {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		stream = &outputStream{encoder: json.NewEncoder(c.Writer), writer: c.Writer}
+		cmd.Stdout = stream.Writer("stdout")
+		cmd.Stderr = stream.Writer("stderr")
 	}
 
 	// Execute command
-	stdout, stderr, exitCode, terminated := sm.executeCommand(cmd)
+	stdout, stderr, exitCode, terminated, timedOut := sm.executeWithTimeout(cmd, req.Timeout)
 	duration := time.Since(startTime)
+	history["exit_code"] = exitCode
 
 	result := CommandResult{
 		Command:    req.Command,
@@ -126,102 +196,35 @@ func (sm *ShellModule) ExecuteCommand(c *gin.Context) {
 		Terminated: terminated,
 	}
 
-	c.JSON(http.StatusOK, ShellOperation{
-		Success: true,
-		Message: "Command executed",
-		Data:    result,
-	})
+	response := ShellOperation{Success: true, Message: Localize(c, "Command executed"), Data: result}
+	status := http.StatusOK
+	if timedOut {
+		response = ShellOperation{
+			Success: false,
+			Code:    ErrTimeout,
+			Message: Localize(c, "Command timed out after %d seconds", req.Timeout),
+			Data:    result,
+		}
+		status = http.StatusGatewayTimeout
+	}
+
+	if stream != nil {
+		stream.Result(response)
+		return
+	}
+	c.JSON(status, response)
 }
 
 // Socket.IO Handlers
 
 // SpawnInteractiveShell spawns an interactive shell session
-func (sm *ShellModule) SpawnInteractiveShell(conn socketio.Conn, command string) {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
-	clientID := conn.ID()
-	sessionID := uuid.New().String()
-
+func (sm *ShellModule) SpawnInteractiveShell(conn socketio.Conn, command string, policy DisconnectPolicy) EventResult {
 	// Default to bash if no command specified
 	if command == "" {
 		command = "/bin/bash"
 	}
 
-	// Create command
-	cmd := exec.Command(command)
-	cmd.Env = os.Environ()
-
-	// Start the command with a PTY
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message": fmt.Sprintf("Failed to start shell: %v", err),
-		})
-		return
-	}
-
-	// Create session
-	session := &ShellSession{
-		ID:       sessionID,
-		ClientID: clientID,
-		Command:  cmd,
-		PTY:      ptmx,
-		Done:     make(chan bool),
-		Active:   true,
-	}
-
-	// Store session
-	sm.sessions[sessionID] = session
-	if sm.clients[clientID] == nil {
-		sm.clients[clientID] = make([]string, 0)
-	}
-	sm.clients[clientID] = append(sm.clients[clientID], sessionID)
-
-	// Start reading output in a goroutine
-	go func() {
-		defer func() {
-			sm.mutex.Lock()
-			session.Active = false
-			close(session.Done)
-			ptmx.Close()
-			sm.mutex.Unlock()
-		}()
-
-		scanner := bufio.NewScanner(ptmx)
-		for scanner.Scan() {
-			line := scanner.Text()
-			conn.Emit("shell:output", map[string]interface{}{
-				"session_id": sessionID,
-				"data":       line + "\n",
-				"type":       "stdout",
-				"timestamp":  time.Now(),
-			})
-		}
-
-		// Check if command finished
-		if err := cmd.Wait(); err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				conn.Emit("shell:exit", map[string]interface{}{
-					"session_id": sessionID,
-					"exit_code":  exitError.ExitCode(),
-					"timestamp":  time.Now(),
-				})
-			}
-		} else {
-			conn.Emit("shell:exit", map[string]interface{}{
-				"session_id": sessionID,
-				"exit_code":  0,
-				"timestamp":  time.Now(),
-			})
-		}
-	}()
-
-	conn.Emit("shell:spawned", map[string]interface{}{
-		"session_id": sessionID,
-		"command":    command,
-		"timestamp":  time.Now(),
-	})
+	return sm.spawn(conn, &ShellProfile{Command: command}, policy)
 }
 
 // SendInput sends input to an interactive shell session
@@ -231,8 +234,9 @@ func (sm *ShellModule) SendInput(conn socketio.Conn, sessionID, input string) {
 	sm.mutex.RUnlock()
 
 	if !exists {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message":    "Session not found",
+		sm.emitter.Emit(conn, "shell:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Session not found"),
 			"session_id": sessionID,
 		})
 		return
@@ -240,26 +244,32 @@ func (sm *ShellModule) SendInput(conn socketio.Conn, sessionID, input string) {
 
 	// Verify client owns this session
 	if session.ClientID != conn.ID() {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message":    "Access denied",
+		sm.emitter.Emit(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Access denied"),
 			"session_id": sessionID,
 		})
 		return
 	}
 
 	if !session.Active {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message":    "Session is not active",
+		sm.emitter.Emit(conn, "shell:error", map[string]interface{}{
+			"code":       ErrConflict,
+			"message":    localizeConn(conn, "Session is not active"),
 			"session_id": sessionID,
 		})
 		return
 	}
 
-	// Send input to PTY
-	_, err := session.PTY.Write([]byte(input))
+	// Send input to PTY, replaced when a keepalive session restarts
+	sm.mutex.RLock()
+	ptmx := session.PTY
+	sm.mutex.RUnlock()
+	_, err := ptmx.Write([]byte(input))
 	if err != nil {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message":    fmt.Sprintf("Failed to send input: %v", err),
+		sm.emitter.Emit(conn, "shell:error", map[string]interface{}{
+			"code":       errorCode(err),
+			"message":    localizeConn(conn, "Failed to send input: %v", err),
 			"session_id": sessionID,
 		})
 		return
@@ -267,26 +277,26 @@ func (sm *ShellModule) SendInput(conn socketio.Conn, sessionID, input string) {
 }
 
 // KillSession terminates a shell session
-func (sm *ShellModule) KillSession(conn socketio.Conn, sessionID string) {
+func (sm *ShellModule) KillSession(conn socketio.Conn, sessionID string) EventResult {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
 	session, exists := sm.sessions[sessionID]
 	if !exists {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message":    "Session not found",
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Session not found"),
 			"session_id": sessionID,
 		})
-		return
 	}
 
 	// Verify client owns this session
 	if session.ClientID != conn.ID() {
-		conn.Emit("shell:error", map[string]interface{}{
-			"message":    "Access denied",
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Access denied"),
 			"session_id": sessionID,
 		})
-		return
 	}
 
 	// Kill the process
@@ -312,14 +322,69 @@ func (sm *ShellModule) KillSession(conn socketio.Conn, sessionID string) {
 		}
 	}
 
-	conn.Emit("shell:killed", map[string]interface{}{
+	killed := map[string]interface{}{
+		"session_id": sessionID,
+		"timestamp":  time.Now(),
+	}
+	sm.emitter.Broadcast(sm.server, sessionRoom(sessionID), "shell:killed", killed)
+	return EventResult{Success: true, Data: killed}
+}
+
+// JoinSession subscribes a connection to the output of another client's
+// session of the same token as a read-only viewer, or of any session with
+// the audit permission
+func (sm *ShellModule) JoinSession(conn socketio.Conn, sessionID string) EventResult {
+	sm.mutex.RLock()
+	session, exists := sm.sessions[sessionID]
+	sm.mutex.RUnlock()
+
+	if !exists || !session.Active {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Session not found"),
+			"session_id": sessionID,
+		})
+	}
+	if token := ConnToken(conn); session.ClientID != conn.ID() && !session.visibleTo(token) {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Access denied"),
+			"session_id": sessionID,
+		})
+	}
+
+	room := sessionRoom(sessionID)
+	conn.Join(room)
+	sm.mutex.Lock()
+	if !slices.Contains(sm.viewers[conn.ID()], sessionID) {
+		sm.viewers[conn.ID()] = append(sm.viewers[conn.ID()], sessionID)
+	}
+	sm.mutex.Unlock()
+
+	return sm.emitter.Reply(conn, "shell:joined", map[string]interface{}{
+		"session_id": sessionID,
+		"owner":      session.ClientID == conn.ID(),
+		"viewers":    sm.server.RoomLen("/", room),
+		"timestamp":  time.Now(),
+	})
+}
+
+// LeaveSession stops receiving the output of a session
+func (sm *ShellModule) LeaveSession(conn socketio.Conn, sessionID string) EventResult {
+	conn.Leave(sessionRoom(sessionID))
+	sm.mutex.Lock()
+	sm.viewers[conn.ID()] = slices.DeleteFunc(sm.viewers[conn.ID()], func(id string) bool { return id == sessionID })
+	sm.mutex.Unlock()
+
+	return sm.emitter.Reply(conn, "shell:left", map[string]interface{}{
 		"session_id": sessionID,
 		"timestamp":  time.Now(),
 	})
 }
 
-// ListSessions lists all active sessions for a client
-func (sm *ShellModule) ListSessions(conn socketio.Conn) {
+// ListSessions lists all active sessions for a client, with their usage
+// when sampled
+func (sm *ShellModule) ListSessions(conn socketio.Conn) EventResult {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
@@ -329,31 +394,63 @@ func (sm *ShellModule) ListSessions(conn socketio.Conn) {
 		sessionIDs = []string{}
 	}
 
-	var sessions []map[string]interface{}
+	sessions := []map[string]interface{}{}
 	for _, sessionID := range sessionIDs {
 		if session, exists := sm.sessions[sessionID]; exists && session.Active {
 			sessions = append(sessions, map[string]interface{}{
 				"session_id": sessionID,
 				"active":     session.Active,
 				"command":    session.Command.Args[0],
+				"usage":      session.usage,
 			})
 		}
 	}
 
-	conn.Emit("shell:sessions", map[string]interface{}{
+	return sm.emitter.Reply(conn, "shell:sessions", map[string]interface{}{
 		"sessions": sessions,
 		"count":    len(sessions),
 	})
 }
 
+// Subscriptions returns the sessions a connection owns or watches
+func (sm *ShellModule) Subscriptions(conn socketio.Conn) []map[string]interface{} {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	shells := []map[string]interface{}{}
+	for _, room := range conn.Rooms() {
+		sessionID, ok := strings.CutPrefix(room, "shell:")
+		if !ok {
+			continue
+		}
+
+		if session, exists := sm.sessions[sessionID]; exists {
+			shells = append(shells, map[string]interface{}{
+				"session_id": sessionID,
+				"command":    session.Command.Args[0],
+				"active":     session.Active,
+				"owner":      session.ClientID == conn.ID(),
+			})
+		}
+	}
+
+	return shells
+}
+
 // CleanupConnection cleans up all sessions for a disconnected client
 func (sm *ShellModule) CleanupConnection(clientID string) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
+	delete(sm.statsClients, clientID)
+	delete(sm.viewers, clientID)
 	if sessionIDs, exists := sm.clients[clientID]; exists {
 		for _, sessionID := range sessionIDs {
 			if session, exists := sm.sessions[sessionID]; exists {
+				if session.OnDisconnect == "detach" && session.Active {
+					sm.detach(session)
+					continue
+				}
 				// Kill the process
 				if session.Command.Process != nil {
 					session.Command.Process.Kill()
@@ -366,16 +463,236 @@ func (sm *ShellModule) CleanupConnection(clientID string) {
 	}
 }
 
+// SessionCount returns the number of open sessions, detached ones included
+func (sm *ShellModule) SessionCount() int {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return len(sm.sessions)
+}
+
 // Helper functions
 
+// visibleTo reports whether a token can watch a session: one of its own
+// connections', or any with the audit permission
+func (session *ShellSession) visibleTo(token *Token) bool {
+	return token != nil && (session.Token == token.Name || token.HasScope(ScopeAudit))
+}
+
+// resolvePaths normalizes the paths of a request in place, answering with
+// the error when one is invalid or outside the root
+func (sm *ShellModule) resolvePaths(c *gin.Context, paths ...*string) bool {
+	if err := sm.paths.Resolve(paths...); err != nil {
+		c.JSON(errorStatus(err), ShellOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "%v", err),
+		})
+		return false
+	}
+	return true
+}
+
+// spawn starts the process of a profile, or of an unnamed profile wrapping a
+// command, as a session owned by conn
+func (sm *ShellModule) spawn(conn socketio.Conn, profile *ShellProfile, policy DisconnectPolicy) EventResult {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	clientID := conn.ID()
+	sessionID := uuid.New().String()
+
+	if limit := sm.config.ShellMaxSessions; limit > 0 && len(sm.sessions) >= limit {
+		err := fmt.Errorf("%w: at most %d sessions can be open", errSessionLimit, limit)
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to start shell: %v", err),
+		})
+	}
+
+	// Start the command with a PTY
+	cmd, ptmx, err := startShell(profile)
+	if err != nil {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to start shell: %v", err),
+		})
+	}
+
+	// Create session
+	session := &ShellSession{
+		ID:       sessionID,
+		ClientID: clientID,
+		Command:  cmd,
+		PTY:      ptmx,
+		Done:     make(chan bool),
+		Active:   true,
+		Started:  time.Now(),
+		Profile:  profile.Name,
+		profile:  profile,
+	}
+	session.OnDisconnect, session.DetachTTL = sm.disconnectPolicy(profile.DisconnectPolicy, policy)
+	if token := ConnToken(conn); token != nil {
+		session.Token = token.Name
+	}
+
+	// Store session
+	sm.sessions[sessionID] = session
+	if sm.clients[clientID] == nil {
+		sm.clients[clientID] = make([]string, 0)
+	}
+	sm.clients[clientID] = append(sm.clients[clientID], sessionID)
+
+	// Output is broadcast to the session room so other clients can watch
+	conn.Join(sessionRoom(sessionID))
+
+	// Start reading output in a goroutine
+	go sm.run(session)
+
+	spawned := map[string]interface{}{
+		"session_id":    sessionID,
+		"command":       profile.Command,
+		"on_disconnect": session.OnDisconnect,
+		"timestamp":     time.Now(),
+	}
+	if session.OnDisconnect == "detach" {
+		spawned["detach_ttl"] = session.DetachTTL.Seconds()
+	}
+	if profile.Name != "" {
+		spawned["profile"] = profile.Name
+		spawned["keepalive"] = profile.Keepalive
+	}
+	return sm.emitter.Reply(conn, "shell:spawned", spawned)
+}
+
+// run broadcasts the output of a session until its process exits, and
+// restarts it while its profile keeps it alive
+func (sm *ShellModule) run(session *ShellSession) {
+	room := sessionRoom(session.ID)
+	defer func() {
+		sm.mutex.Lock()
+		session.Active = false
+		close(session.Done)
+		// Nobody is left to kill a detached session
+		if session.ClientID == "" && sm.sessions[session.ID] == session {
+			delete(sm.sessions, session.ID)
+			if session.detachTimer != nil {
+				session.detachTimer.Stop()
+			}
+		}
+		sm.mutex.Unlock()
+		sm.server.ClearRoom("/", room)
+	}()
+
+	for {
+		sm.mutex.RLock()
+		cmd, ptmx := session.Command, session.PTY
+		sm.mutex.RUnlock()
+		started := time.Now()
+
+		scanner := bufio.NewScanner(ptmx)
+		for scanner.Scan() {
+			line := scanner.Text()
+			sm.emitter.Broadcast(sm.server, room, "shell:output", map[string]interface{}{
+				"session_id": session.ID,
+				"data":       line + "\n",
+				"type":       "stdout",
+				"timestamp":  time.Now(),
+			})
+			sm.scheduleCwdCheck(session)
+		}
+
+		// Check if command finished
+		exitCode := 0
+		if err := cmd.Wait(); err != nil {
+			exitError, ok := err.(*exec.ExitError)
+			if !ok {
+				ptmx.Close()
+				sm.broadcastState(session, "stopped", nil)
+				return
+			}
+			exitCode = exitError.ExitCode()
+		}
+		ptmx.Close()
+		sm.emitter.Broadcast(sm.server, room, "shell:exit", map[string]interface{}{
+			"session_id": session.ID,
+			"exit_code":  exitCode,
+			"timestamp":  time.Now(),
+		})
+
+		delay, ok := sm.restartDelay(session, time.Since(started))
+		if !ok {
+			sm.broadcastState(session, "stopped", map[string]interface{}{"exit_code": exitCode})
+			return
+		}
+		sm.broadcastState(session, "restarting", map[string]interface{}{
+			"exit_code": exitCode,
+			"delay_ms":  delay.Milliseconds(),
+		})
+		time.Sleep(delay)
+
+		restarted, err := sm.restart(session)
+		if err != nil {
+			sm.broadcastState(session, "failed", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if !restarted {
+			sm.broadcastState(session, "stopped", nil)
+			return
+		}
+		sm.broadcastState(session, "running", nil)
+	}
+}
+
+// startShell starts the process of a profile on a new terminal
+func startShell(profile *ShellProfile) (*exec.Cmd, *os.File, error) {
+	cmd, err := profile.command()
+	if err != nil {
+		return nil, nil, err
+	}
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, ptmx, nil
+}
+
+func sessionRoom(sessionID string) string {
+	return "shell:" + sessionID
+}
+
+// executeWithTimeout executes a command, killing it after timeout seconds
+// unless 0
+func (sm *ShellModule) executeWithTimeout(cmd *exec.Cmd, timeout int) (stdout, stderr string, exitCode int, terminated, timedOut bool) {
+	var killed atomic.Bool
+	if timeout > 0 {
+		go func() {
+			time.Sleep(time.Duration(timeout) * time.Second)
+			if cmd.Process != nil && cmd.Process.Kill() == nil {
+				killed.Store(true)
+			}
+		}()
+	}
+
+	stdout, stderr, exitCode, terminated = sm.executeCommand(cmd)
+	return stdout, stderr, exitCode, terminated, killed.Load()
+}
+
 // executeCommand executes a command and captures output
 func (sm *ShellModule) executeCommand(cmd *exec.Cmd) (stdout, stderr string, exitCode int, terminated bool) {
 	var stdoutBuf, stderrBuf []byte
 	var err error
 
-	// Capture stdout and stderr
-	cmd.Stdout = &stdoutCapture{&stdoutBuf}
-	cmd.Stderr = &stderrCapture{&stderrBuf}
+	// Capture stdout and stderr, as well as passing them on to writers
+	// already set, e.g. to stream them
+	var stdoutWriter io.Writer = &stdoutCapture{&stdoutBuf}
+	var stderrWriter io.Writer = &stderrCapture{&stderrBuf}
+	if cmd.Stdout != nil {
+		stdoutWriter = io.MultiWriter(stdoutWriter, cmd.Stdout)
+	}
+	if cmd.Stderr != nil {
+		stderrWriter = io.MultiWriter(stderrWriter, cmd.Stderr)
+	}
+	cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
 
 	// Start command
 	err = cmd.Start()
@@ -421,3 +738,60 @@ func (sc *stderrCapture) Write(p []byte) (n int, err error) {
 	*sc.data = append(*sc.data, p...)
 	return len(p), nil
 }
+
+// outputStream writes the output of a command as NDJSON "output" events,
+// followed by a "result" event
+type outputStream struct {
+	encoder *json.Encoder
+	writer  gin.ResponseWriter
+	mutex   sync.Mutex
+}
+
+// outputStreamWriter streams one of the outputs of a command
+type outputStreamWriter struct {
+	stream  *outputStream
+	name    string
+	pending []byte // start of a character split between writes
+}
+
+// Writer returns the writer streaming the output name, stdout or stderr
+func (o *outputStream) Writer(name string) io.Writer {
+	return &outputStreamWriter{stream: o, name: name}
+}
+
+// Result writes the final event, the response of the request
+func (o *outputStream) Result(response ShellOperation) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.encoder.Encode(struct {
+		Event string `json:"event"`
+		ShellOperation
+	}{"result", response})
+	o.writer.Flush()
+}
+
+func (w *outputStreamWriter) Write(p []byte) (int, error) {
+	// Hold back a character split between writes, so every event is valid
+	// UTF-8
+	data := append(w.pending, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	w.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return len(p), nil
+	}
+
+	w.stream.mutex.Lock()
+	defer w.stream.mutex.Unlock()
+	// The client going away mustn't stop the command, only the stream
+	w.stream.encoder.Encode(gin.H{"event": "output", "data": gin.H{"stream": w.name, "data": string(data[:cut])}})
+	w.stream.writer.Flush()
+	return len(p), nil
+}
@@ -0,0 +1,210 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc, fixed at 100 on
+// Linux whatever the kernel tick rate
+const clockTicks = 100
+
+// SessionUsage is the resource usage of the processes of a session
+type SessionUsage struct {
+	CPU       float64   `json:"cpu_percent"` // of one core, over the last interval
+	Memory    int64     `json:"memory_bytes"`
+	Processes int       `json:"processes"`
+	SampledAt time.Time `json:"sampled_at"`
+}
+
+// procStat is the part of /proc/<pid>/stat used to attribute usage
+type procStat struct {
+	ppid    int
+	session int
+	ticks   uint64 // CPU time of the process and its reaped children
+	rss     int64  // pages
+}
+
+// Socket.IO Handlers
+
+// StartStats streams the usage of the sessions a connection owns or watches
+// as shell:stats events, every SHELL_STATS_INTERVAL
+func (sm *ShellModule) StartStats(conn socketio.Conn) EventResult {
+	if sm.config.ShellStatsInterval <= 0 {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":    ErrPermission,
+			"message": localizeConn(conn, "Session statistics are disabled"),
+		})
+	}
+
+	sm.mutex.Lock()
+	sm.statsClients[conn.ID()] = true
+	sm.mutex.Unlock()
+
+	return sm.emitter.Reply(conn, "shell:stats:started", map[string]interface{}{
+		"interval":  sm.config.ShellStatsInterval.Seconds(),
+		"timestamp": time.Now(),
+	})
+}
+
+// StopStats stops the shell:stats stream of a connection
+func (sm *ShellModule) StopStats(conn socketio.Conn) EventResult {
+	sm.mutex.Lock()
+	delete(sm.statsClients, conn.ID())
+	sm.mutex.Unlock()
+
+	return sm.emitter.Reply(conn, "shell:stats:stopped", map[string]interface{}{
+		"timestamp": time.Now(),
+	})
+}
+
+// StartSampler periodically samples the usage of every session and
+// streams it to the connections that asked for it
+func (sm *ShellModule) StartSampler() {
+	if sm.config.ShellStatsInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(sm.config.ShellStatsInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			sm.sample()
+			sm.emitStats()
+		}
+	}()
+}
+
+// Helper functions
+
+// sample reads the processes once and updates the usage of every session.
+// The processes of a session are the descendants of its shell and anything
+// left in the terminal session the shell leads.
+func (sm *ShellModule) sample() {
+	sm.mutex.RLock()
+	empty := len(sm.sessions) == 0
+	sm.mutex.RUnlock()
+	if empty {
+		return
+	}
+
+	stats := readProcStats()
+	children := make(map[int][]int)
+	for pid, stat := range stats {
+		children[stat.ppid] = append(children[stat.ppid], pid)
+	}
+	now := time.Now()
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	for _, session := range sm.sessions {
+		if !session.Active || session.Command.Process == nil {
+			continue
+		}
+		root := session.Command.Process.Pid
+
+		members := make(map[int]bool)
+		queue := []int{root}
+		for len(queue) > 0 {
+			pid := queue[0]
+			queue = queue[1:]
+			if _, exists := stats[pid]; exists && !members[pid] {
+				members[pid] = true
+				queue = append(queue, children[pid]...)
+			}
+		}
+		for pid, stat := range stats {
+			if stat.session == root {
+				members[pid] = true
+			}
+		}
+
+		usage := &SessionUsage{Processes: len(members), SampledAt: now}
+		var ticks uint64
+		for pid := range members {
+			ticks += stats[pid].ticks
+			usage.Memory += stats[pid].rss * int64(os.Getpagesize())
+		}
+		// Processes leaving the session take their time with them, so
+		// the total may drop; that interval counts as idle
+		if previous := session.usage; previous != nil && session.usageRoot == root && ticks > session.cpuTicks {
+			elapsed := now.Sub(previous.SampledAt).Seconds()
+			usage.CPU = math.Round(float64(ticks-session.cpuTicks)/clockTicks/elapsed*1000) / 10
+		}
+		session.usage = usage
+		session.usageRoot = root
+		session.cpuTicks = ticks
+	}
+}
+
+// emitStats sends each connection streaming stats the usage of the sessions
+// it owns or watches
+func (sm *ShellModule) emitStats() {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	for clientID := range sm.statsClients {
+		conn := sm.emitter.Lookup(clientID)
+		if conn == nil {
+			continue
+		}
+		sessions := []map[string]interface{}{}
+		for _, session := range sm.sessions {
+			if session.usage == nil || session.ClientID != clientID && !inRoom(conn, sessionRoom(session.ID)) {
+				continue
+			}
+			sessions = append(sessions, map[string]interface{}{
+				"session_id": session.ID,
+				"usage":      session.usage,
+			})
+		}
+		sm.emitter.Emit(conn, "shell:stats", map[string]interface{}{
+			"sessions":  sessions,
+			"timestamp": time.Now(),
+		})
+	}
+}
+
+// readProcStats reads /proc/<pid>/stat of every process
+func readProcStats() map[int]procStat {
+	stats := make(map[int]procStat)
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces and parentheses, the fields
+		// after it start with the state (field 3)
+		end := bytes.LastIndexByte(data, ')')
+		if end < 0 {
+			continue
+		}
+		fields := bytes.Fields(data[end+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		field := func(n int) int64 {
+			value, _ := strconv.ParseInt(string(fields[n-3]), 10, 64)
+			return value
+		}
+		stats[pid] = procStat{
+			ppid:    int(field(4)),
+			session: int(field(6)),
+			ticks:   uint64(field(14) + field(15) + field(16) + field(17)),
+			rss:     field(24),
+		}
+	}
+	return stats
+}
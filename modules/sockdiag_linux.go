@@ -0,0 +1,226 @@
+package modules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// sock_diag (linux/sock_diag.h and linux/inet_diag.h) lists sockets through
+// netlink with the filtering done by the kernel, and multicasts the sockets
+// being destroyed to listeners with CAP_NET_ADMIN
+const (
+	sockDiagByFamily = 20 // SOCK_DIAG_BY_FAMILY
+	tcpListen        = 10 // TCP_LISTEN
+
+	sockDiagRequestSize = 56 // struct inet_diag_req_v2
+	sockDiagMessageSize = 72 // struct inet_diag_msg
+
+	// Multicast groups of destroyed sockets, SKNLGRP_INET_TCP_DESTROY and so on
+	sockDiagTCPDestroy  = 1 << 0
+	sockDiagUDPDestroy  = 1 << 1
+	sockDiagTCP6Destroy = 1 << 2
+	sockDiagUDP6Destroy = 1 << 3
+)
+
+// sockDiagInterval is how often the netlink backend lists listening sockets.
+// Dumps of listeners only are cheap enough to catch short-lived ones.
+const sockDiagInterval = 250 * time.Millisecond
+
+// sockDiagEntry is a socket listed by sock_diag
+type sockDiagEntry struct {
+	ip     net.IP
+	port   int
+	uid    int
+	inode  uint64
+	family uint8
+}
+
+// Helper functions
+
+// sockDiagSupported reports whether the kernel answers sock_diag requests,
+// which sandboxes and some containers don't
+func sockDiagSupported() bool {
+	_, err := sockDiagDump(syscall.AF_INET, syscall.IPPROTO_TCP, 1<<tcpListen)
+	return err == nil
+}
+
+// sockDiagPorts lists the listening ports of protocols on iface, like the
+// /proc backend. TCP sockets are only listed while listening; UDP has no
+// listening state, so every bound UDP socket is listed.
+func sockDiagPorts(protocols []string, iface string) (map[int]portSocket, error) {
+	ports := make(map[int]portSocket)
+	for _, protocol := range protocols {
+		number, states := uint8(syscall.IPPROTO_TCP), uint32(1<<tcpListen)
+		if protocol == "udp" {
+			number, states = syscall.IPPROTO_UDP, ^uint32(0)
+		}
+
+		for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+			entries, err := sockDiagDump(family, number, states)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if iface != "any" && iface != entry.ip.String() {
+					continue
+				}
+				if _, seen := ports[entry.port]; !seen {
+					ports[entry.port] = portSocket{inode: entry.inode, uid: entry.uid}
+				}
+			}
+		}
+	}
+	return ports, nil
+}
+
+// sockDiagDump lists the sockets of a family and protocol in states, a bit
+// mask of TCP states
+func sockDiagDump(family, protocol uint8, states uint32) ([]sockDiagEntry, error) {
+	fd, err := sockDiagSocket(0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	request := make([]byte, syscall.NLMSG_HDRLEN+sockDiagRequestSize)
+	binary.NativeEndian.PutUint32(request[0:4], uint32(len(request)))
+	binary.NativeEndian.PutUint16(request[4:6], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(request[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(request[8:12], 1)
+	body := request[syscall.NLMSG_HDRLEN:]
+	body[0] = family
+	body[1] = protocol
+	binary.NativeEndian.PutUint32(body[4:8], states)
+
+	if err := syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var entries []sockDiagEntry
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			switch message.Header.Type {
+			case syscall.NLMSG_DONE:
+				return entries, nil
+			case syscall.NLMSG_ERROR:
+				if len(message.Data) >= 4 {
+					if errno := -int32(binary.NativeEndian.Uint32(message.Data[0:4])); errno != 0 {
+						return nil, syscall.Errno(errno)
+					}
+				}
+				return nil, errors.New("sock_diag request failed")
+			case sockDiagByFamily:
+				if entry, ok := parseSockDiag(message.Data); ok {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+}
+
+// watchSocketDestroy sends the local ports of the sockets of protocols the
+// kernel destroys to ports until stop is closed. Ports are dropped while the
+// receiver is busy, it rescans anyway. It fails without CAP_NET_ADMIN.
+func watchSocketDestroy(protocols []string, ports chan<- int, stop <-chan bool) error {
+	groups := uint32(0)
+	for _, protocol := range protocols {
+		if protocol == "udp" {
+			groups |= sockDiagUDPDestroy | sockDiagUDP6Destroy
+		} else {
+			groups |= sockDiagTCPDestroy | sockDiagTCP6Destroy
+		}
+	}
+
+	fd, err := sockDiagSocket(groups)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+
+		buf := make([]byte, 64<<10)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			// The receive timeout wakes the loop up to notice stop
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				continue
+			}
+			messages, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, message := range messages {
+				entry, ok := parseSockDiag(message.Data)
+				if !ok {
+					continue
+				}
+				select {
+				case ports <- entry.port:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// sockDiagSocket opens a sock_diag netlink socket joined to groups
+func sockDiagSocket(groups uint32) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return -1, err
+	}
+	timeout := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("sock_diag: %w", err)
+	}
+	return fd, nil
+}
+
+// parseSockDiag decodes a struct inet_diag_msg
+func parseSockDiag(data []byte) (sockDiagEntry, bool) {
+	if len(data) < sockDiagMessageSize {
+		return sockDiagEntry{}, false
+	}
+
+	entry := sockDiagEntry{
+		family: data[0],
+		port:   int(binary.BigEndian.Uint16(data[4:6])),
+		uid:    int(binary.NativeEndian.Uint32(data[64:68])),
+		inode:  uint64(binary.NativeEndian.Uint32(data[68:72])),
+	}
+	switch entry.family {
+	case syscall.AF_INET:
+		entry.ip = net.IP(append([]byte(nil), data[8:12]...))
+	case syscall.AF_INET6:
+		entry.ip = net.IP(append([]byte(nil), data[8:24]...))
+	default:
+		return sockDiagEntry{}, false
+	}
+	return entry, true
+}
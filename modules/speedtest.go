@@ -0,0 +1,377 @@
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// speedtestLatencySamples is how many round trips latency is measured over,
+// after one opening the connection
+const speedtestLatencySamples = 5
+
+// speedtestPeerSize is the size requested from peer agents, large enough to
+// last the whole test
+const speedtestPeerSize = 1 << 40
+
+// speedtestData is the random, incompressible data sent by speed tests
+var speedtestData = sync.OnceValue(func() []byte {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	return data
+})
+
+type SpeedtestRequest struct {
+	DownloadURL string `json:"download_url"` // file downloaded from a test server
+	UploadURL   string `json:"upload_url"`   // test server URL accepting POST bodies
+	AgentURL    string `json:"agent_url"`    // another ccw agent to test against instead
+	AgentToken  string `json:"agent_token"`
+	Duration    int    `json:"duration" binding:"min=0,max=60"` // seconds per direction, default 10
+	Streams     int    `json:"streams" binding:"min=0,max=16"`  // parallel connections, default 4
+	Proxy       string `json:"proxy"`
+}
+
+type SpeedtestResult struct {
+	Latency  *LatencyResult    `json:"latency,omitempty"`
+	Download *ThroughputResult `json:"download,omitempty"`
+	Upload   *ThroughputResult `json:"upload,omitempty"`
+}
+
+// LatencyResult holds HTTP round trip times in milliseconds
+type LatencyResult struct {
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min_ms"`
+	Avg     float64 `json:"avg_ms"`
+	Max     float64 `json:"max_ms"`
+	Jitter  float64 `json:"jitter_ms"` // mean difference between consecutive samples
+}
+
+type ThroughputResult struct {
+	Bytes         int64   `json:"bytes"`
+	Seconds       float64 `json:"seconds"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+	Streams       int     `json:"streams"`
+}
+
+// REST API Handlers
+
+// Speedtest measures latency and download and upload throughput against a
+// test server or another agent. Speed tests aren't subject to rate limits.
+func (nm *NetworkModule) Speedtest(c *gin.Context) {
+	var req SpeedtestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	downloadURL, uploadURL := req.DownloadURL, req.UploadURL
+	header := http.Header{}
+	switch {
+	case req.AgentURL != "" && (downloadURL != "" || uploadURL != ""):
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "use agent_url or download_url and upload_url, not both"),
+		})
+		return
+	case req.AgentURL != "":
+		if req.AgentToken == "" {
+			c.JSON(http.StatusBadRequest, NetworkOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", "agent_token is required with agent_url"),
+			})
+			return
+		}
+		base := strings.TrimRight(req.AgentURL, "/") + "/api/net/speedtest"
+		downloadURL = base + "/download?size=" + strconv.Itoa(speedtestPeerSize)
+		uploadURL = base + "/upload"
+		header.Set("Authorization", "Bearer "+req.AgentToken)
+	case downloadURL == "" && uploadURL == "":
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "agent_url, download_url or upload_url is required"),
+		})
+		return
+	}
+
+	client, err := nm.outbound.Client(req.Proxy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	duration := time.Duration(req.Duration) * time.Second
+	if duration == 0 {
+		duration = 10 * time.Second
+	}
+	streams := req.Streams
+	if streams == 0 {
+		streams = 4
+	}
+
+	var result SpeedtestResult
+	// Latency is timed with HEAD requests to test servers, and empty downloads from agents
+	method, latencyURL := http.MethodHead, downloadURL
+	if latencyURL == "" {
+		latencyURL = uploadURL
+	}
+	if req.AgentURL != "" {
+		method, latencyURL = http.MethodGet, strings.TrimRight(req.AgentURL, "/")+"/api/net/speedtest/download?size=0"
+	}
+	result.Latency, err = measureLatency(c.Request.Context(), client, method, latencyURL, header)
+	if err == nil && downloadURL != "" {
+		result.Download, err = measureDownload(c.Request.Context(), client, downloadURL, header, duration, streams)
+	}
+	if err == nil && uploadURL != "" {
+		result.Upload, err = measureUpload(c.Request.Context(), client, uploadURL, header, duration, streams)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Speed test failed: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Speed test completed"),
+		Data:    result,
+	})
+}
+
+// SpeedtestDownload serves size bytes of random data to a peer agent's speed
+// test
+func (nm *NetworkModule) SpeedtestDownload(c *gin.Context) {
+	size, err := strconv.ParseInt(c.DefaultQuery("size", "104857600"), 10, 64)
+	if err != nil || size < 0 {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "size must be a positive number of bytes"),
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	data := speedtestData()
+	for size > 0 {
+		n, err := c.Writer.Write(data[:min(int64(len(data)), size)])
+		if err != nil {
+			return
+		}
+		size -= int64(n)
+	}
+}
+
+// SpeedtestUpload discards the body sent by a peer agent's speed test
+func (nm *NetworkModule) SpeedtestUpload(c *gin.Context) {
+	bytes, err := io.Copy(io.Discard, c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Upload received"),
+		Data:    map[string]interface{}{"bytes": bytes},
+	})
+}
+
+// Helper functions
+
+// measureLatency times requests to target over a connection opened by a
+// first, untimed one
+func measureLatency(ctx context.Context, client *http.Client, method, target string, header http.Header) (*LatencyResult, error) {
+	var samples []float64
+	for i := 0; i <= speedtestLatencySamples; i++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		elapsed := time.Since(start)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return nil, fmt.Errorf("%w: server responded with %s", errUpstream, resp.Status)
+		}
+		if i > 0 {
+			samples = append(samples, float64(elapsed.Microseconds())/1000)
+		}
+	}
+
+	result := &LatencyResult{Samples: len(samples), Min: math.Inf(1)}
+	for i, sample := range samples {
+		result.Min = math.Min(result.Min, sample)
+		result.Max = math.Max(result.Max, sample)
+		result.Avg += sample / float64(len(samples))
+		if i > 0 {
+			result.Jitter += math.Abs(sample-samples[i-1]) / float64(len(samples)-1)
+		}
+	}
+	// Microseconds are as precise as timing HTTP requests gets
+	result.Avg = math.Round(result.Avg*1000) / 1000
+	result.Jitter = math.Round(result.Jitter*1000) / 1000
+	return result, nil
+}
+
+// measureDownload downloads target over streams connections for duration,
+// starting over when a download completes early
+func measureDownload(ctx context.Context, client *http.Client, target string, header http.Header, duration time.Duration, streams int) (*ThroughputResult, error) {
+	return measureThroughput(ctx, duration, streams, func(ctx context.Context, counter *atomic.Int64) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		req.Header = header.Clone()
+		// Compressed responses would measure the compression ratio
+		req.Header.Set("Accept-Encoding", "identity")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%w: server responded with %s", errUpstream, resp.Status)
+		}
+		_, err = io.Copy(io.Discard, &countingReader{reader: resp.Body, counter: counter})
+		return err
+	})
+}
+
+// measureUpload posts random data to target over streams connections for
+// duration
+func measureUpload(ctx context.Context, client *http.Client, target string, header http.Header, duration time.Duration, streams int) (*ThroughputResult, error) {
+	return measureThroughput(ctx, duration, streams, func(ctx context.Context, counter *atomic.Int64) error {
+		body := &countingReader{reader: &speedtestReader{ctx: ctx}, counter: counter}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+		if err != nil {
+			return err
+		}
+		req.Header = header.Clone()
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%w: server responded with %s", errUpstream, resp.Status)
+		}
+		return nil
+	})
+}
+
+// measureThroughput runs transfer on streams goroutines, over and over, until
+// duration elapses, counting the bytes transferred. Transfers interrupted by
+// the end of the test aren't errors.
+func measureThroughput(ctx context.Context, duration time.Duration, streams int, transfer func(context.Context, *atomic.Int64) error) (*ThroughputResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var counter atomic.Int64
+	errs := make(chan error, streams)
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		go func() {
+			for ctx.Err() == nil {
+				if err := transfer(ctx, &counter); err != nil && ctx.Err() == nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	var firstErr error
+	for i := 0; i < streams; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	elapsed := time.Since(start).Seconds()
+	bytes := counter.Load()
+	return &ThroughputResult{
+		Bytes:         bytes,
+		Seconds:       elapsed,
+		BitsPerSecond: float64(bytes) * 8 / elapsed,
+		Streams:       streams,
+	}, nil
+}
+
+// countingReader adds the bytes read to counter
+type countingReader struct {
+	reader  io.Reader
+	counter *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.counter.Add(int64(n))
+	return n, err
+}
+
+// speedtestReader reads random data until ctx is done
+type speedtestReader struct {
+	ctx    context.Context
+	offset int
+}
+
+func (r *speedtestReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	data := speedtestData()
+	n := copy(p, data[r.offset:])
+	r.offset = (r.offset + n) % len(data)
+	return n, nil
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package modules
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the user and group owning a file
+func fileOwner(info fs.FileInfo) (uint32, uint32, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid, stat.Gid, true
+	}
+	return 0, 0, false
+}
+
+func fileDevice(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
+
+func fileInode(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,19 @@
+package modules
+
+import "io/fs"
+
+// fileOwner is unknown, Windows files have security descriptors instead of
+// user and group IDs
+func fileOwner(info fs.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
+
+// fileDevice is 0 for every file, so walks don't stop at mount points
+func fileDevice(info fs.FileInfo) uint64 {
+	return 0
+}
+
+// fileInode is 0 for every file, so renames aren't matched by inode
+func fileInode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,13 @@
+package modules
+
+import "golang.org/x/sys/unix"
+
+// statfsFree returns the bytes available to unprivileged users on the
+// filesystem holding dir, with statvfs since NetBSD has no statfs
+func statfsFree(dir string) (int64, error) {
+	var stat unix.Statvfs_t
+	if err := unix.Statvfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Frsize), nil
+}
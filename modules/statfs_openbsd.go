@@ -0,0 +1,13 @@
+package modules
+
+import "syscall"
+
+// statfsFree returns the bytes available to unprivileged users on the
+// filesystem holding dir
+func statfsFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.F_bavail * int64(stat.F_bsize), nil
+}
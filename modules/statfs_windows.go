@@ -0,0 +1,17 @@
+package modules
+
+import "golang.org/x/sys/windows"
+
+// statfsFree returns the bytes available to the user of the agent on the
+// volume holding dir, which accounts for their quota
+func statfsFree(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
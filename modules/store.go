@@ -0,0 +1,424 @@
+package modules
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// Kinds of records
+const (
+	RecordRequest    = "request"    // REST request
+	RecordJob        = "job"        // transfer or provisioning run
+	RecordCommand    = "command"    // command run through the API
+	RecordConnection = "connection" // Socket.IO connection, accepted or refused
+)
+
+const (
+	// storeQueueSize is how many records can wait to be written before new
+	// ones are dropped
+	storeQueueSize = 1024
+	// storeBatchSize is the most records written in one transaction
+	storeBatchSize = 100
+	// storeMaxLimit is the largest page of a record query
+	storeMaxLimit = 1000
+)
+
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	time     INTEGER NOT NULL,
+	kind     TEXT NOT NULL,
+	token    TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	target   TEXT NOT NULL,
+	status   INTEGER NOT NULL,
+	duration INTEGER NOT NULL,
+	client   TEXT NOT NULL,
+	details  TEXT
+);
+CREATE INDEX IF NOT EXISTS records_time ON records (time);
+CREATE INDEX IF NOT EXISTS records_kind ON records (kind, time);
+CREATE INDEX IF NOT EXISTS records_token ON records (token, time);
+`
+
+// Store keeps the jobs, audit events and command history of the agent in an
+// embedded SQLite database, so they can be searched remotely. A nil store is
+// valid and records nothing, for agents without STORE_PATH.
+type Store struct {
+	db        *sql.DB
+	retention time.Duration
+	records   chan Record
+}
+
+// Record is an entry of the store
+type Record struct {
+	ID       int64          `json:"id"`
+	Time     time.Time      `json:"time"`
+	Kind     string         `json:"kind"`   // request, job, command or connection
+	Token    string         `json:"token"`  // name of the token
+	Action   string         `json:"action"` // e.g. POST /api/fs/write or socket:connect
+	Target   string         `json:"target,omitempty"`
+	Status   int            `json:"status"` // HTTP status
+	Duration int64          `json:"duration_ms"`
+	Client   string         `json:"client,omitempty"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+// RecordFilter selects records, newest first
+type RecordFilter struct {
+	Kind   string
+	Token  string
+	Action string // exact, or a prefix when it ends with *
+	From   time.Time
+	To     time.Time
+	Before int64 // ID, to resume after a page
+	Limit  int
+}
+
+type StoreOperation struct {
+	Success    bool   `json:"success"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	Data       any    `json:"data,omitempty"`
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// NewStore opens the database at STORE_PATH, creating it if needed. It
+// returns nil without STORE_PATH.
+func NewStore(config *Config) (*Store, error) {
+	if config.StorePath == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(config.StorePath), 0700); err != nil {
+		return nil, fmt.Errorf("STORE_PATH: %w", err)
+	}
+	db, err := sql.Open("sqlite", config.StorePath+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("STORE_PATH: %w", err)
+	}
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("STORE_PATH: %w", err)
+	}
+
+	store := &Store{
+		db:        db,
+		retention: config.StoreRetention,
+		records:   make(chan Record, storeQueueSize),
+	}
+	go store.run()
+	return store, nil
+}
+
+// Record queues a record to be written without blocking the caller,
+// dropping it when the queue is full
+func (s *Store) Record(record Record) {
+	if s == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	select {
+	case s.records <- record:
+	default:
+		log.Printf("Store queue full, dropping %s record of %s", record.Kind, record.Action)
+	}
+}
+
+// Query returns a page of the records matching a filter, newest first, with
+// the number of records matching it
+func (s *Store) Query(filter RecordFilter) ([]Record, int, error) {
+	var where []string
+	var args []any
+	if filter.Kind != "" {
+		where, args = append(where, "kind = ?"), append(args, filter.Kind)
+	}
+	if filter.Token != "" {
+		where, args = append(where, "token = ?"), append(args, filter.Token)
+	}
+	if prefix, ok := strings.CutSuffix(filter.Action, "*"); ok {
+		where, args = append(where, "substr(action, 1, ?) = ?"), append(args, len(prefix), prefix)
+	} else if filter.Action != "" {
+		where, args = append(where, "action = ?"), append(args, filter.Action)
+	}
+	if !filter.From.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, filter.From.UnixMilli())
+	}
+	if !filter.To.IsZero() {
+		where, args = append(where, "time < ?"), append(args, filter.To.UnixMilli())
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM records"+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if filter.Before > 0 {
+		if clause == "" {
+			clause = " WHERE id < ?"
+		} else {
+			clause += " AND id < ?"
+		}
+		args = append(args, filter.Before)
+	}
+	rows, err := s.db.Query("SELECT id, time, kind, token, action, target, status, duration, client, details FROM records"+
+		clause+" ORDER BY id DESC LIMIT ?", append(args, filter.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		var record Record
+		var millis int64
+		var details sql.NullString
+		if err := rows.Scan(&record.ID, &millis, &record.Kind, &record.Token, &record.Action, &record.Target,
+			&record.Status, &record.Duration, &record.Client, &details); err != nil {
+			return nil, 0, err
+		}
+		record.Time = time.UnixMilli(millis)
+		if details.Valid {
+			json.Unmarshal([]byte(details.String), &record.Details)
+		}
+		records = append(records, record)
+	}
+	return records, total, rows.Err()
+}
+
+// Middleware records every REST request once it's served. Handlers running
+// jobs or commands set the kind and details of the record with recordAs.
+func (s *Store) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+		c.Next()
+
+		record := Record{
+			Time:     started,
+			Kind:     RecordRequest,
+			Action:   c.Request.Method + " " + c.FullPath(),
+			Target:   c.Query("path"),
+			Status:   c.Writer.Status(),
+			Duration: time.Since(started).Milliseconds(),
+			Client:   c.ClientIP(),
+		}
+		if token := RequestToken(c); token != nil {
+			record.Token = token.Name
+		}
+		if value, exists := c.Get("record"); exists {
+			annotation := value.(recordAnnotation)
+			record.Kind, record.Details = annotation.kind, annotation.details
+			if annotation.target != "" {
+				record.Target = annotation.target
+			}
+		}
+		s.Record(record)
+	}
+}
+
+// REST API Handlers
+
+// ListRecords searches the records by kind, token, action and time range,
+// newest first
+func (s *Store) ListRecords(c *gin.Context) {
+	if s == nil {
+		c.JSON(http.StatusForbidden, StoreOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "The record store is disabled, set STORE_PATH to enable it"),
+		})
+		return
+	}
+	if !RequestToken(c).HasScope(ScopeAudit) {
+		c.JSON(http.StatusForbidden, StoreOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Searching the records requires the audit permission"),
+		})
+		return
+	}
+
+	filter, err := recordFilterQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, StoreOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	records, total, err := s.Query(filter)
+	if err != nil {
+		c.JSON(errorStatus(err), StoreOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to search records: %v", err),
+		})
+		return
+	}
+
+	next := ""
+	if len(records) == filter.Limit {
+		next = base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(records[len(records)-1].ID, 10)))
+	}
+	c.JSON(http.StatusOK, StoreOperation{
+		Success:    true,
+		Message:    Localize(c, "Records retrieved"),
+		Data:       records,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// Helper functions
+
+// recordAnnotation is what a handler adds to the record of its request
+type recordAnnotation struct {
+	kind    string
+	target  string
+	details map[string]any
+}
+
+// recordAs sets the kind, target and details of the record of a request,
+// keeping the path query parameter as target when target is empty
+func recordAs(c *gin.Context, kind, target string, details map[string]any) {
+	c.Set("record", recordAnnotation{kind: kind, target: target, details: details})
+}
+
+// redactURL drops the credentials and query of a URL, which may hold
+// secrets
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	parsed.User, parsed.RawQuery, parsed.Fragment = nil, "", ""
+	return parsed.String()
+}
+
+// recordFilterQuery reads a record filter from the kind, token, action,
+// from, to, limit and cursor query parameters
+func recordFilterQuery(c *gin.Context) (RecordFilter, error) {
+	filter := RecordFilter{
+		Kind:   c.Query("kind"),
+		Token:  c.Query("token"),
+		Action: c.Query("action"),
+		Limit:  100,
+	}
+	for name, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if raw := c.Query(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time: %q", name, raw)
+			}
+			*value = parsed
+		}
+	}
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > storeMaxLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", storeMaxLimit)
+		}
+		filter.Limit = parsed
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			filter.Before, err = strconv.ParseInt(string(decoded), 10, 64)
+		}
+		if err != nil || filter.Before <= 0 {
+			return filter, fmt.Errorf("invalid cursor")
+		}
+	}
+	return filter, nil
+}
+
+// run writes the queued records in batches and prunes the ones past
+// STORE_RETENTION every hour
+func (s *Store) run() {
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	s.prune()
+
+	for {
+		select {
+		case record := <-s.records:
+			batch := []Record{record}
+		drain:
+			for len(batch) < storeBatchSize {
+				select {
+				case record := <-s.records:
+					batch = append(batch, record)
+				default:
+					break drain
+				}
+			}
+			if err := s.insert(batch); err != nil {
+				log.Printf("Failed to store %d records: %v", len(batch), err)
+			}
+
+		case <-prune.C:
+			s.prune()
+		}
+	}
+}
+
+func (s *Store) insert(batch []Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO records (time, kind, token, action, target, status, duration, client, details) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, record := range batch {
+		var details any
+		if len(record.Details) > 0 {
+			encoded, err := json.Marshal(record.Details)
+			if err != nil {
+				return err
+			}
+			details = string(encoded)
+		}
+		if _, err := stmt.Exec(record.Time.UnixMilli(), record.Kind, record.Token, record.Action, record.Target,
+			record.Status, record.Duration, record.Client, details); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) prune() {
+	if s.retention <= 0 {
+		return
+	}
+	if _, err := s.db.Exec("DELETE FROM records WHERE time < ?", time.Now().Add(-s.retention).UnixMilli()); err != nil {
+		log.Printf("Failed to prune records: %v", err)
+	}
+}
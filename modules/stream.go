@@ -0,0 +1,288 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hlsSegmentSeconds is the duration of the segments of HLS playlists
+const hlsSegmentSeconds = 6
+
+// errTranscodeFailed marks media ffmpeg couldn't transcode
+var errTranscodeFailed = errors.New("transcoding failed")
+
+// REST API Handlers
+
+// StreamMedia transcodes a video or audio file with ffmpeg into a stream
+// browsers can play: a fragmented MP4 sent as it's encoded, or an HLS
+// playlist whose segments are each transcoded when requested, so players
+// can seek without the agent keeping any state
+func (fsm *FileSystemModule) StreamMedia(c *gin.Context) {
+	path := c.Query("path")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "path parameter is required"),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &path) {
+		return
+	}
+	options, err := parseStreamOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		c.JSON(http.StatusNotFound, FileOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Media streaming requires ffmpeg"),
+		})
+		return
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		if err == nil {
+			err = fmt.Errorf("%s: %w", path, syscall.EISDIR)
+		}
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stream media: %v", err),
+		})
+		return
+	}
+
+	switch {
+	case options.format == "mp4":
+		fsm.transcode(c, "video/mp4", options.mp4Args(path))
+	case options.segment >= 0:
+		fsm.transcode(c, "video/mp2t", options.segmentArgs(path))
+	default:
+		fsm.hlsPlaylist(c, path, options)
+	}
+}
+
+// Helper functions
+
+// streamOptions are the query parameters of a media stream
+type streamOptions struct {
+	format  string  // mp4 or hls
+	start   float64 // seconds into the media mp4 streams start at
+	height  int     // of the video, scaled down keeping the aspect ratio, 0 to keep it
+	segment int     // of an HLS playlist, -1 for the playlist itself
+}
+
+func parseStreamOptions(c *gin.Context) (streamOptions, error) {
+	options := streamOptions{format: c.DefaultQuery("format", "mp4"), segment: -1}
+	if options.format != "mp4" && options.format != "hls" {
+		return options, fmt.Errorf("unknown format %q, use mp4 or hls", options.format)
+	}
+	if value := c.Query("start"); value != "" {
+		start, err := strconv.ParseFloat(value, 64)
+		if err != nil || start < 0 || math.IsInf(start, 0) {
+			return options, fmt.Errorf("start must be a number of seconds")
+		}
+		options.start = start
+	}
+	if value := c.Query("height"); value != "" {
+		height, err := strconv.Atoi(value)
+		if err != nil || height < 144 || height > 4320 {
+			return options, fmt.Errorf("height must be between 144 and 4320")
+		}
+		options.height = height &^ 1 // libx264 needs even dimensions
+	}
+	if value := c.Query("segment"); value != "" {
+		segment, err := strconv.Atoi(value)
+		if err != nil || segment < 0 || options.format != "hls" {
+			return options, fmt.Errorf("segment must be a segment number of an hls stream")
+		}
+		options.segment = segment
+	}
+	return options, nil
+}
+
+// encodeArgs are the ffmpeg arguments encoding the first video and audio
+// streams as H.264 and AAC, the codecs every browser plays
+func (o streamOptions) encodeArgs() []string {
+	args := []string{
+		"-map", "0:v:0?", "-map", "0:a:0?", "-sn", "-dn",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "160k", "-ac", "2",
+	}
+	if o.height > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", o.height))
+	}
+	return args
+}
+
+func (o streamOptions) mp4Args(path string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	if o.start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(o.start, 'f', 3, 64))
+	}
+	args = append(args, "-i", path)
+	args = append(args, o.encodeArgs()...)
+	return append(args, "-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "pipe:1")
+}
+
+// segmentArgs transcode one segment of an HLS playlist, starting with a
+// keyframe and keeping the timestamps of the media so segments play on
+func (o streamOptions) segmentArgs(path string) []string {
+	start := strconv.Itoa(o.segment * hlsSegmentSeconds)
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-ss", start, "-t", strconv.Itoa(hlsSegmentSeconds), "-i", path,
+	}
+	args = append(args, o.encodeArgs()...)
+	return append(args, "-force_key_frames", "expr:gte(t,0)", "-output_ts_offset", start, "-f", "mpegts", "pipe:1")
+}
+
+// hlsPlaylist answers with a VOD playlist covering the duration of the
+// media, its segments pointing back to this endpoint
+func (fsm *FileSystemModule) hlsPlaylist(c *gin.Context, path string, options streamOptions) {
+	duration, err := probeDuration(c, path)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stream media: %v", err),
+		})
+		return
+	}
+
+	query := url.Values{"path": {path}, "format": {"hls"}}
+	if options.height > 0 {
+		query.Set("height", strconv.Itoa(options.height))
+	}
+	var playlist strings.Builder
+	fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", hlsSegmentSeconds)
+	for segment := 0; float64(segment*hlsSegmentSeconds) < duration; segment++ {
+		length := math.Min(hlsSegmentSeconds, duration-float64(segment*hlsSegmentSeconds))
+		query.Set("segment", strconv.Itoa(segment))
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\nstream?%s\n", length, query.Encode())
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist.String()))
+}
+
+// probeDuration returns the duration of media in seconds, with ffprobe
+func probeDuration(c *gin.Context, path string) (float64, error) {
+	output, err := exec.CommandContext(c.Request.Context(), "ffprobe", "-v", "error",
+		"-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return 0, fmt.Errorf("%w: %s", errTranscodeFailed, lastLine(exitErr.Stderr))
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			// ffprobe comes with ffmpeg, but packages may split them
+			return 0, fmt.Errorf("%w: %w", os.ErrNotExist, err)
+		}
+		return 0, err
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil || duration <= 0 || math.IsInf(duration, 0) {
+		return 0, fmt.Errorf("%w: %s has no duration", errTranscodeFailed, path)
+	}
+	return duration, nil
+}
+
+// transcode runs ffmpeg and sends its output as it's encoded. Failures
+// before the first byte get an error response; the response is cut short
+// by later ones, and ffmpeg is killed when the client goes away.
+func (fsm *FileSystemModule) transcode(c *gin.Context, contentType string, args []string) {
+	if fsm.transcodes != nil {
+		select {
+		case fsm.transcodes <- struct{}{}:
+			defer func() { <-fsm.transcodes }()
+		default:
+			err := fmt.Errorf("%w: %d media streams are being transcoded", errSessionLimit, cap(fsm.transcodes))
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to stream media: %v", err),
+			})
+			return
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(c.Request.Context(), "ffmpeg", args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stream media: %v", err),
+		})
+		return
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill() // stops a still running ffmpeg before waiting
+
+	output := bufio.NewReaderSize(stdout, 64<<10)
+	if _, err := output.Peek(1); err != nil {
+		err = cmd.Wait()
+		if err == nil {
+			err = errors.New("no output")
+		}
+		if line := lastLine(stderr.Bytes()); line != "" {
+			err = errors.New(line)
+		}
+		err = fmt.Errorf("%w: %v", errTranscodeFailed, err)
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to stream media: %v", err),
+		})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	buffer := make([]byte, 64<<10)
+	for {
+		n, err := output.Read(buffer)
+		if n > 0 {
+			if _, err := c.Writer.Write(buffer[:n]); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// lastLine returns the last non-empty line of the output of a program
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,659 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// structuredFormats are the formats of structured edits by file extension
+var structuredFormats = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+	".ini":  "ini",
+	".cfg":  "ini",
+}
+
+type StructuredEditRequest struct {
+	Path   string           `json:"path" binding:"required"`
+	Format string           `json:"format"` // json, yaml, toml or ini, from the extension when empty
+	Edits  []StructuredEdit `json:"edits" binding:"required,min=1,max=1000,dive"`
+	DryRun bool             `json:"dry_run"`
+}
+
+// StructuredEdit changes the value at a key path. Keys of arrays are their
+// indexes, and the keys of INI files are a section and a key, or only a key
+// for those before the first section.
+type StructuredEdit struct {
+	Op    string          `json:"op" binding:"required,oneof=set delete append"`
+	Key   []string        `json:"key" binding:"required,min=1"`
+	Value json.RawMessage `json:"value"` // of set and append
+}
+
+// REST API Handlers
+
+// EditStructured sets, deletes and appends to keys of a JSON, YAML, TOML or
+// INI file in place. Comments and the order of keys are kept, and the
+// layout as far as the format's editor can: TOML and INI files only change
+// on the lines edited, while JSON and YAML files are written back with the
+// indentation they had.
+func (fsm *FileSystemModule) EditStructured(c *gin.Context) {
+	var req StructuredEditRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !fsm.resolvePaths(c, &req.Path) {
+		return
+	}
+
+	format, err := structuredFormat(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "%v", err),
+		})
+		return
+	}
+
+	mode := os.FileMode(0644)
+	info, err := os.Stat(req.Path)
+	switch {
+	case err == nil && info.IsDir():
+		err = fmt.Errorf("%s: %w", req.Path, syscall.EISDIR)
+	case err == nil:
+		mode = info.Mode().Perm()
+		if max := fsm.config.ReadMaxSize; max > 0 && info.Size() > max {
+			c.JSON(http.StatusRequestEntityTooLarge, FileOperation{
+				Success: false,
+				Code:    ErrTooLarge,
+				Message: Localize(c, "File is %d bytes, over the %d byte limit for structured edits", info.Size(), max),
+			})
+			return
+		}
+	case os.IsNotExist(err) && slices.ContainsFunc(req.Edits, func(edit StructuredEdit) bool { return edit.Op != "delete" }):
+		// Edits setting keys create the file
+		err = nil
+	}
+	var content []byte
+	if err == nil && info != nil {
+		content, err = os.ReadFile(req.Path)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to read file: %v", err),
+		})
+		return
+	}
+
+	// The file is edited as UTF-8 with LF lines, and written back as it was
+	encoding := detectEncoding(content)
+	text, err := decodeText(content, encoding)
+	var edited []byte
+	var written TextFormat
+	if err == nil {
+		current := textFormat(text, encoding)
+		text = setLineEnding(strings.TrimPrefix(text, byteOrderMark), "lf")
+		var result string
+		if result, err = editStructured(format, text, req.Edits); err == nil {
+			edited, written, err = structuredWriteOptions(current).encode(req.Path, result)
+		}
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to edit file: %v", err),
+		})
+		return
+	}
+	changed := info == nil || !bytes.Equal(content, edited)
+
+	if req.DryRun {
+		result, _ := decodeText(edited, written.Encoding)
+		c.JSON(http.StatusOK, FileOperation{
+			Success: true,
+			Message: Localize(c, "File edited (dry run)"),
+			Data: map[string]interface{}{
+				"path":    req.Path,
+				"format":  format,
+				"changed": changed,
+				"content": strings.TrimPrefix(result, byteOrderMark),
+			},
+			Text: &written,
+		})
+		return
+	}
+
+	if changed {
+		token := RequestToken(c)
+		if err := fsm.quotas.Check(token, req.Path, int64(len(edited))); err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "%v", err),
+			})
+			return
+		}
+		if err := os.WriteFile(req.Path, edited, mode); err != nil {
+			c.JSON(errorStatus(err), FileOperation{
+				Success: false,
+				Code:    errorCode(err),
+				Message: Localize(c, "Failed to write file: %v", err),
+			})
+			return
+		}
+		fsm.quotas.Record(token, int64(len(edited)))
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "File edited successfully"),
+		Data: map[string]interface{}{
+			"path":    req.Path,
+			"format":  format,
+			"changed": changed,
+		},
+		Text: &written,
+	})
+}
+
+// Helper functions
+
+// structuredFormat returns the format of the file of a structured edit,
+// checking its edits can be applied
+func structuredFormat(req StructuredEditRequest) (string, error) {
+	format := req.Format
+	if format == "" {
+		format = structuredFormats[strings.ToLower(filepath.Ext(req.Path))]
+		if format == "" {
+			return "", fmt.Errorf("%w: format is required for %s files, use json, yaml, toml or ini", errInvalidRequest, filepath.Ext(req.Path))
+		}
+	}
+	switch format {
+	case "json", "yaml", "toml", "ini":
+	default:
+		return "", fmt.Errorf("%w: unknown format %q, use json, yaml, toml or ini", errInvalidRequest, format)
+	}
+
+	for _, edit := range req.Edits {
+		if edit.Op != "delete" && len(edit.Value) == 0 {
+			return "", fmt.Errorf("%w: %s of %s needs a value", errInvalidRequest, edit.Op, keyPath(edit.Key))
+		}
+		if format == "ini" && len(edit.Key) > 2 {
+			return "", fmt.Errorf("%w: %s has more than a section and a key", errInvalidRequest, keyPath(edit.Key))
+		}
+	}
+	return format, nil
+}
+
+// structuredWriteOptions write edited text the way the file stored it, with
+// new files in UTF-8 and LF lines
+func structuredWriteOptions(format TextFormat) TextWriteOptions {
+	options := TextWriteOptions{Encoding: format.Encoding, BOM: "remove"}
+	if format.BOM {
+		options.BOM = "add"
+	}
+	if format.LineEnding == "crlf" {
+		options.LineEnding = "crlf"
+	}
+	return options
+}
+
+// editStructured applies edits to the text of a file in a format
+func editStructured(format, text string, edits []StructuredEdit) (string, error) {
+	switch format {
+	case "json":
+		return editJSON(text, edits)
+	case "yaml":
+		return editYAML(text, edits)
+	case "toml":
+		return editTOML(text, edits)
+	}
+	return editINI(text, edits)
+}
+
+// editJSON applies edits to a JSON document, keeping the order of its keys
+// and its indentation
+func editJSON(text string, edits []StructuredEdit) (string, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if strings.TrimSpace(text) != "" {
+		var err error
+		if root, err = parseJSONNode([]byte(text)); err != nil {
+			return "", fmt.Errorf("%w: %v", errInvalidContent, err)
+		}
+	}
+	for _, edit := range edits {
+		if err := editNode(root, edit); err != nil {
+			return "", err
+		}
+	}
+
+	// The indentation of the first indented line, none for one line documents
+	indent := ""
+	if _, rest, ok := strings.Cut(strings.TrimSpace(text), "\n"); ok {
+		indent = rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+	} else if strings.TrimSpace(text) == "" {
+		indent = "  "
+	}
+	var edited strings.Builder
+	writeJSONNode(&edited, root, indent, 0)
+	if text == "" || strings.HasSuffix(text, "\n") {
+		edited.WriteString("\n")
+	}
+	return edited.String(), nil
+}
+
+// editYAML applies edits to the first document of a YAML file, keeping its
+// comments and indentation
+func editYAML(text string, edits []StructuredEdit) (string, error) {
+	var documents []*yaml.Node
+	decoder := yaml.NewDecoder(strings.NewReader(text))
+	for {
+		document := &yaml.Node{}
+		err := decoder.Decode(document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errInvalidContent, err)
+		}
+		documents = append(documents, document)
+	}
+	if len(documents) == 0 {
+		documents = append(documents, &yaml.Node{Kind: yaml.DocumentNode})
+	}
+	first := documents[0]
+	if len(first.Content) == 0 || first.Content[0].Tag == "!!null" {
+		first.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	for _, edit := range edits {
+		if err := editNode(first.Content[0], edit); err != nil {
+			return "", err
+		}
+	}
+
+	// The smallest indentation of the file, 2 spaces when it has none
+	indent := 0
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if spaces := len(line) - len(trimmed); spaces > 0 && trimmed != "" && !strings.HasPrefix(trimmed, "#") && (indent == 0 || spaces < indent) {
+			indent = spaces
+		}
+	}
+	var edited bytes.Buffer
+	encoder := yaml.NewEncoder(&edited)
+	encoder.SetIndent(min(max(indent, 2), 8))
+	for _, document := range documents {
+		if err := encoder.Encode(document); err != nil {
+			return "", err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return edited.String(), nil
+}
+
+// editNode applies an edit to a YAML node, which may be a parsed JSON
+// document. Deleting a key that doesn't exist changes nothing.
+func editNode(root *yaml.Node, edit StructuredEdit) error {
+	var value *yaml.Node
+	if edit.Op != "delete" {
+		var err error
+		if value, err = parseJSONNode(edit.Value); err != nil {
+			return fmt.Errorf("%w: value of %s: %v", errInvalidRequest, keyPath(edit.Key), err)
+		}
+	}
+
+	parent := root
+	for i, key := range edit.Key[:len(edit.Key)-1] {
+		child, err := nodeChild(parent, key, edit.Op != "delete", edit.Key[:i+1])
+		if err != nil || child == nil {
+			return err
+		}
+		parent = child
+	}
+
+	last := edit.Key[len(edit.Key)-1]
+	switch parent.Kind {
+	case yaml.MappingNode:
+		i := mappingIndex(parent, last)
+		switch {
+		case edit.Op == "delete":
+			if i >= 0 {
+				parent.Content = append(parent.Content[:i:i], parent.Content[i+2:]...)
+			}
+		case i < 0 && edit.Op == "append":
+			sequence := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{value}}
+			parent.Content = append(parent.Content, stringNode(last), sequence)
+		case i < 0:
+			parent.Content = append(parent.Content, stringNode(last), value)
+		case edit.Op == "append":
+			return appendNode(parent.Content[i+1], value, edit.Key)
+		default:
+			setNode(parent, i+1, value)
+		}
+		return nil
+
+	case yaml.SequenceNode:
+		index, err := strconv.Atoi(last)
+		if err != nil || index < 0 || index > len(parent.Content) || (index == len(parent.Content) && edit.Op != "set") {
+			if edit.Op == "delete" {
+				return nil
+			}
+			return fmt.Errorf("%w: %s is not an index of the array", errInvalidRequest, keyPath(edit.Key))
+		}
+		switch {
+		case edit.Op == "delete":
+			parent.Content = append(parent.Content[:index:index], parent.Content[index+1:]...)
+		case index == len(parent.Content):
+			parent.Content = append(parent.Content, value)
+		case edit.Op == "append":
+			return appendNode(parent.Content[index], value, edit.Key)
+		default:
+			setNode(parent, index, value)
+		}
+		return nil
+	}
+	if edit.Op == "delete" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not an object or array", errInvalidRequest, keyPath(edit.Key[:len(edit.Key)-1]))
+}
+
+// nodeChild returns the value of a key of an object or array node. Missing
+// keys of objects are added as objects when create is set, and are nil
+// otherwise.
+func nodeChild(parent *yaml.Node, key string, create bool, path []string) (*yaml.Node, error) {
+	switch parent.Kind {
+	case yaml.MappingNode:
+		if i := mappingIndex(parent, key); i >= 0 {
+			return parent.Content[i+1], nil
+		}
+		if !create {
+			return nil, nil
+		}
+		child := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		parent.Content = append(parent.Content, stringNode(key), child)
+		return child, nil
+	case yaml.SequenceNode:
+		index, err := strconv.Atoi(key)
+		if err == nil && index >= 0 && index < len(parent.Content) {
+			return parent.Content[index], nil
+		}
+		if !create {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %s is not an index of the array", errInvalidRequest, keyPath(path))
+	}
+	if !create {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: %s is not an object or array", errInvalidRequest, keyPath(path[:len(path)-1]))
+}
+
+// mappingIndex returns the index of the key node of a key in an object
+// node, -1 when it has none
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// setNode replaces a value of an object or array node, keeping the
+// comments of the value it replaces
+func setNode(parent *yaml.Node, i int, value *yaml.Node) {
+	previous := parent.Content[i]
+	value.HeadComment, value.LineComment, value.FootComment = previous.HeadComment, previous.LineComment, previous.FootComment
+	parent.Content[i] = value
+}
+
+func appendNode(target, value *yaml.Node, path []string) error {
+	if target.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%w: %s is not an array", errInvalidRequest, keyPath(path))
+	}
+	target.Content = append(target.Content, value)
+	return nil
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// parseJSONNode parses a JSON document into YAML nodes, which keep the
+// order of its keys
+func parseJSONNode(data []byte) (*yaml.Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	node, err := decodeJSONNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the document")
+	}
+	return node, nil
+}
+
+func decodeJSONNode(decoder *json.Decoder) (*yaml.Node, error) {
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if value == '{' {
+			node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for decoder.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, stringNode(key.(string)))
+			}
+			child, err := decodeJSONNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		// The closing delimiter
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return stringNode(value), nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(value.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(value)}, nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
+
+// writeJSONNode writes a node parsed from JSON as JSON, indenting each
+// level with indent, or on one line without it
+func writeJSONNode(b *strings.Builder, node *yaml.Node, indent string, depth int) {
+	if node.Kind == yaml.ScalarNode {
+		if node.Tag == "!!str" {
+			b.WriteString(jsonString(node.Value))
+		} else {
+			b.WriteString(node.Value)
+		}
+		return
+	}
+
+	open, close, step := "[", "]", 1
+	if node.Kind == yaml.MappingNode {
+		open, close, step = "{", "}", 2
+	}
+	b.WriteString(open)
+	for i := 0; i < len(node.Content); i += step {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		if indent != "" {
+			b.WriteString("\n" + strings.Repeat(indent, depth+1))
+		}
+		if step == 2 {
+			b.WriteString(jsonString(node.Content[i].Value))
+			b.WriteString(":")
+			if indent != "" {
+				b.WriteString(" ")
+			}
+		}
+		writeJSONNode(b, node.Content[i+step-1], indent, depth+1)
+	}
+	if indent != "" && len(node.Content) > 0 {
+		b.WriteString("\n" + strings.Repeat(indent, depth))
+	}
+	b.WriteString(close)
+}
+
+// jsonString quotes a string for JSON, leaving HTML characters as they are
+func jsonString(value string) string {
+	var quoted bytes.Buffer
+	encoder := json.NewEncoder(&quoted)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return strings.TrimSuffix(quoted.String(), "\n")
+}
+
+// jsonValue decodes a JSON value with integers as int64 and other numbers
+// as float64, as TOML tells them apart
+func jsonValue(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return convertNumbers(value), nil
+}
+
+func convertNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, child := range v {
+			v[key] = convertNumbers(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = convertNumbers(child)
+		}
+	}
+	return value
+}
+
+// editValue applies an edit at a key path below a decoded value, returning
+// the value edited
+func editValue(target any, key []string, op string, value any, path []string) (any, error) {
+	if len(key) == 0 {
+		if op == "set" {
+			return value, nil
+		}
+		list, ok := target.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not an array", errInvalidRequest, keyPath(path))
+		}
+		return append(list, value), nil
+	}
+
+	childPath := path[:len(path)-len(key)+1]
+	switch t := target.(type) {
+	case map[string]any:
+		child, ok := t[key[0]]
+		switch {
+		case len(key) == 1 && op == "delete":
+			delete(t, key[0])
+			return t, nil
+		case ok:
+		case op == "delete":
+			return t, nil
+		case len(key) > 1:
+			child = map[string]any{}
+		case op == "append":
+			child = []any{}
+		}
+		edited, err := editValue(child, key[1:], op, value, path)
+		if err != nil {
+			return nil, err
+		}
+		t[key[0]] = edited
+		return t, nil
+	case []any:
+		index, err := strconv.Atoi(key[0])
+		switch {
+		case err != nil || index < 0 || index > len(t) || (index == len(t) && (len(key) > 1 || op != "set")):
+			if op == "delete" {
+				return t, nil
+			}
+			return nil, fmt.Errorf("%w: %s is not an index of the array", errInvalidRequest, keyPath(childPath))
+		case len(key) == 1 && op == "delete":
+			return append(t[:index:index], t[index+1:]...), nil
+		case index == len(t):
+			return append(t, value), nil
+		}
+		edited, err := editValue(t[index], key[1:], op, value, path)
+		if err != nil {
+			return nil, err
+		}
+		t[index] = edited
+		return t, nil
+	}
+	if op == "delete" {
+		return target, nil
+	}
+	return nil, fmt.Errorf("%w: %s is not an object or array", errInvalidRequest, keyPath(childPath[:len(childPath)-1]))
+}
+
+// keyPath formats a key path for messages
+func keyPath(key []string) string {
+	if len(key) == 0 {
+		return "the document"
+	}
+	return strconv.Quote(strings.Join(key, "."))
+}
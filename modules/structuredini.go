@@ -0,0 +1,181 @@
+package modules
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// iniEntry is a key line of an INI file
+type iniEntry struct {
+	section string // empty before the first section
+	key     string
+	line    int
+	prefix  string // the key and separator as written, with the spaces after them
+}
+
+// Helper functions
+
+// editINI applies edits to an INI file line by line, so comments and the
+// layout of the lines not edited are kept. Keys listed more than once are
+// replaced by one line when set, and append adds another line of the key.
+func editINI(text string, edits []StructuredEdit) (string, error) {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+	for _, edit := range edits {
+		var err error
+		if lines, err = editINILines(lines, edit); err != nil {
+			return "", err
+		}
+	}
+
+	edited := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		edited += "\n"
+	}
+	return edited, nil
+}
+
+func editINILines(lines []string, edit StructuredEdit) ([]string, error) {
+	section, key := "", edit.Key[0]
+	if len(edit.Key) == 2 {
+		section, key = edit.Key[0], edit.Key[1]
+	}
+	var value string
+	if edit.Op != "delete" {
+		var err error
+		if value, err = iniValue(edit.Value); err != nil {
+			return nil, fmt.Errorf("%w: value of %s: %v", errInvalidRequest, keyPath(edit.Key), err)
+		}
+	}
+
+	sections, entries := parseINILines(lines)
+	var matches []iniEntry
+	for _, entry := range entries {
+		if entry.section == section && entry.key == key {
+			matches = append(matches, entry)
+		}
+	}
+
+	switch {
+	case edit.Op == "delete" || (edit.Op == "set" && len(matches) > 0):
+		// From the last, so the lines of the others stay where they are
+		for i := len(matches) - 1; i >= 0; i-- {
+			if edit.Op == "set" && i == 0 {
+				lines[matches[i].line] = matches[i].prefix + value
+			} else {
+				lines = slices.Delete(lines, matches[i].line, matches[i].line+1)
+			}
+		}
+		return lines, nil
+	case len(matches) > 0:
+		last := matches[len(matches)-1]
+		return slices.Insert(lines, last.line+1, last.prefix+value), nil
+	}
+
+	// A new key, after the last key of its section
+	line := key + iniSeparator(entries) + value
+	end, ok := sections[section]
+	if !ok {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		return append(lines, "["+section+"]", line), nil
+	}
+	if section == "" && end < len(lines) && iniSection(lines[end]) != "" {
+		// Keys before the first section stay apart from it
+		return slices.Insert(lines, end, line, ""), nil
+	}
+	return slices.Insert(lines, end, line), nil
+}
+
+// parseINILines finds the key lines of an INI file, and the line new keys
+// of each section are added at. Lines without a separator are keys without
+// a value, like the flags of my.cnf.
+func parseINILines(lines []string) (map[string]int, []iniEntry) {
+	sections := map[string]int{"": len(lines)}
+	var entries []iniEntry
+	section := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if name := iniSection(line); name != "" {
+			if section == "" && sections[""] == len(lines) {
+				// Without keys of its own, the global section ends at the
+				// first section
+				sections[""] = i
+			}
+			section = name
+			sections[section] = i + 1
+			continue
+		}
+
+		separator := strings.IndexAny(line, "=:")
+		if separator < 0 {
+			separator = len(line)
+		}
+		key := strings.TrimSpace(line[:separator])
+		prefix := line
+		if separator < len(line) {
+			rest := line[separator+1:]
+			prefix = line[:separator+1] + rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+		} else {
+			prefix += " = "
+		}
+		entries = append(entries, iniEntry{section: section, key: key, line: i, prefix: prefix})
+		sections[section] = i + 1
+	}
+	return sections, entries
+}
+
+// iniSection returns the name of the section a line starts, empty when
+// it doesn't start one
+func iniSection(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "[") {
+		return ""
+	}
+	name, _, ok := strings.Cut(trimmed[1:], "]")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// iniSeparator returns the separator the keys of an INI file use, " = "
+// when it has none
+func iniSeparator(entries []iniEntry) string {
+	for _, entry := range entries {
+		if separator := strings.TrimPrefix(strings.TrimLeft(entry.prefix, " \t"), entry.key); strings.TrimSpace(separator) != "" {
+			return separator
+		}
+	}
+	return " = "
+}
+
+// iniValue formats a string, number or boolean as the value of an INI key
+func iniValue(data []byte) (string, error) {
+	value, err := jsonValue(data)
+	if err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		if strings.ContainsAny(v, "\r\n") {
+			return "", fmt.Errorf("INI values can't span lines")
+		}
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("INI values are strings, numbers or booleans")
+}
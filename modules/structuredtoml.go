@@ -0,0 +1,385 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// tomlBareKey matches the keys TOML doesn't need quoted
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tomlTable is a [table] or [[array of tables]] header of a TOML file
+type tomlTable struct {
+	key   []string
+	line  int // of the header, -1 for the root table
+	array bool
+	end   int // the line new keys of the table are added at
+}
+
+// tomlEntry is a key/value line of a TOML file, whose value may continue
+// on the next lines
+type tomlEntry struct {
+	table      *tomlTable
+	key        []string // from the root, the keys of the table included
+	start, end int      // lines of the entry, end included
+	prefix     string   // the key and = as written, with the spaces after them
+	value      string
+	comment    string // after the value, with the spaces before it
+}
+
+// Helper functions
+
+// editTOML applies edits to a TOML file line by line, so comments and the
+// layout of the lines not edited are kept. Values of a key inside an inline
+// table or array are rewritten on one line.
+func editTOML(text string, edits []StructuredEdit) (string, error) {
+	var decoded map[string]any
+	if err := toml.Unmarshal([]byte(text), &decoded); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidContent, err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+	for _, edit := range edits {
+		var err error
+		if lines, err = editTOMLLines(lines, edit); err != nil {
+			return "", err
+		}
+	}
+
+	edited := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		edited += "\n"
+	}
+	var check map[string]any
+	if err := toml.Unmarshal([]byte(edited), &check); err != nil {
+		return "", fmt.Errorf("%w: the edits make the file invalid: %v", errInvalidRequest, err)
+	}
+	return edited, nil
+}
+
+func editTOMLLines(lines []string, edit StructuredEdit) ([]string, error) {
+	tables, entries, err := parseTOMLLines(lines)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if edit.Op != "delete" {
+		if value, err = jsonValue(edit.Value); err != nil {
+			return nil, fmt.Errorf("%w: value of %s: %v", errInvalidRequest, keyPath(edit.Key), err)
+		}
+	}
+
+	// The entry holding the key, whose value is edited in place
+	for _, entry := range entries {
+		if entry.table.array || len(entry.key) > len(edit.Key) || !slices.Equal(entry.key, edit.Key[:len(entry.key)]) {
+			continue
+		}
+		if len(entry.key) == len(edit.Key) && edit.Op == "delete" {
+			return slices.Delete(lines, entry.start, entry.end+1), nil
+		}
+
+		var current any
+		if len(entry.key) < len(edit.Key) || edit.Op == "append" {
+			var decoded map[string]any
+			if err := toml.Unmarshal([]byte("v = "+entry.value), &decoded); err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidContent, err)
+			}
+			current = decoded["v"]
+		}
+		edited, err := editValue(current, edit.Key[len(entry.key):], edit.Op, value, edit.Key)
+		if err != nil {
+			return nil, err
+		}
+		formatted, err := tomlValue(edited, edit.Key)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Replace(lines, entry.start, entry.end+1, entry.prefix+formatted+entry.comment), nil
+	}
+
+	// Tables at or below the key, which delete removes with their entries
+	var below []*tomlTable
+	for _, table := range tables {
+		if table.line >= 0 && len(table.key) >= len(edit.Key) && slices.Equal(table.key[:len(edit.Key)], edit.Key) {
+			below = append(below, table)
+		}
+	}
+	if edit.Op == "delete" {
+		// From the last, so the lines of the others stay where they are
+		for i := len(below) - 1; i >= 0; i-- {
+			lines = slices.Delete(lines, below[i].line, tomlTableEnd(tables, below[i], len(lines)))
+		}
+		return lines, nil
+	}
+	if len(below) > 0 {
+		return nil, fmt.Errorf("%w: %s is a table, edit its keys instead", errInvalidRequest, keyPath(edit.Key))
+	}
+
+	// A new key, in the deepest table holding it
+	table := tables[0]
+	for _, candidate := range tables {
+		if !candidate.array && len(candidate.key) > len(table.key) && len(candidate.key) < len(edit.Key) && slices.Equal(candidate.key, edit.Key[:len(candidate.key)]) {
+			table = candidate
+		}
+	}
+	if edit.Op == "append" {
+		value = []any{value}
+	}
+	formatted, err := tomlValue(value, edit.Key)
+	if err != nil {
+		return nil, err
+	}
+	if table.line < 0 && len(edit.Key) > 1 {
+		// Keys below a table that isn't there get one at the end
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		return append(lines, "["+tomlKey(edit.Key[:len(edit.Key)-1])+"]", tomlKey(edit.Key[len(edit.Key)-1:])+" = "+formatted), nil
+	}
+	line := tomlKey(edit.Key[len(table.key):]) + " = " + formatted
+	if table.line < 0 && table.end < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[table.end]), "[") {
+		// Keys of the root table go before the first header
+		return slices.Insert(lines, table.end, line, ""), nil
+	}
+	return slices.Insert(lines, table.end, line), nil
+}
+
+// parseTOMLLines finds the tables and entries of the lines of a TOML file.
+// The root table comes first.
+func parseTOMLLines(lines []string) ([]*tomlTable, []tomlEntry, error) {
+	root := &tomlTable{line: -1}
+	tables := []*tomlTable{root}
+	var entries []tomlEntry
+	current := root
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") {
+			array := strings.HasPrefix(trimmed, "[[")
+			header := strings.TrimPrefix(trimmed, "[")
+			if array {
+				header = strings.TrimPrefix(header, "[")
+			}
+			end := tomlKeyEnd(header, ']')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("%w: line %d: unterminated table header", errInvalidContent, i+1)
+			}
+			key, err := parseTOMLKey(header[:end])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: line %d: %v", errInvalidContent, i+1, err)
+			}
+			current = &tomlTable{key: key, line: i, array: array, end: i + 1}
+			tables = append(tables, current)
+			continue
+		}
+
+		separator := tomlKeyEnd(lines[i], '=')
+		if separator < 0 {
+			return nil, nil, fmt.Errorf("%w: line %d: expected a key", errInvalidContent, i+1)
+		}
+		key, err := parseTOMLKey(lines[i][:separator])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: line %d: %v", errInvalidContent, i+1, err)
+		}
+		rest := lines[i][separator+1:]
+		prefix := lines[i][:separator+1] + rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+
+		// The value runs over the lines until it parses, for multiline
+		// strings and arrays
+		entry := tomlEntry{table: current, key: append(slices.Clip(current.key), key...), start: i, prefix: prefix}
+		valueText := ""
+		for end := i; ; end++ {
+			if end == len(lines) {
+				return nil, nil, fmt.Errorf("%w: line %d: unterminated value", errInvalidContent, i+1)
+			}
+			valueText = strings.Join(append([]string{lines[i][len(prefix):]}, lines[i+1:end+1]...), "\n")
+			if validTOMLValue(valueText) {
+				entry.end = end
+				break
+			}
+		}
+		entry.value, entry.comment = strings.TrimRight(valueText, " \t"), ""
+		for j := strings.IndexByte(valueText, '#'); j >= 0; {
+			if value := strings.TrimRight(valueText[:j], " \t"); value != "" && validTOMLValue(value) {
+				entry.value, entry.comment = value, valueText[len(value):]
+				break
+			}
+			next := strings.IndexByte(valueText[j+1:], '#')
+			if next < 0 {
+				break
+			}
+			j += next + 1
+		}
+		entries = append(entries, entry)
+		current.end = entry.end + 1
+		i = entry.end
+	}
+
+	// Without keys of its own, the root table ends at the first header
+	root.end = len(lines)
+	if len(tables) > 1 {
+		root.end = tables[1].line
+	}
+	for _, entry := range entries {
+		if entry.table == root {
+			root.end = entry.end + 1
+		}
+	}
+	return tables, entries, nil
+}
+
+// tomlTableEnd returns the line after the last line of a table, the header
+// of the next one
+func tomlTableEnd(tables []*tomlTable, table *tomlTable, lines int) int {
+	for _, next := range tables {
+		if next.line > table.line {
+			return next.line
+		}
+	}
+	return lines
+}
+
+// tomlKeyEnd returns the index of the first delimiter outside quotes, -1
+// when there's none
+func tomlKeyEnd(text string, delimiter byte) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0:
+			if text[i] == '\\' && quote == '"' {
+				i++
+			} else if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '"' || text[i] == '\'':
+			quote = text[i]
+		case text[i] == delimiter:
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTOMLKey splits a dotted key into its keys, unquoting them
+func parseTOMLKey(text string) ([]string, error) {
+	var key []string
+	for text != "" {
+		end := tomlKeyEnd(text, '.')
+		if end < 0 {
+			end = len(text)
+		}
+		part := strings.TrimSpace(text[:end])
+		switch {
+		case strings.HasPrefix(part, `"`):
+			unquoted, err := strconv.Unquote(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s", part)
+			}
+			part = unquoted
+		case strings.HasPrefix(part, "'"):
+			if len(part) < 2 || !strings.HasSuffix(part, "'") {
+				return nil, fmt.Errorf("invalid key %s", part)
+			}
+			part = part[1 : len(part)-1]
+		case !tomlBareKey.MatchString(part):
+			return nil, fmt.Errorf("invalid key %q", part)
+		}
+		key = append(key, part)
+		text = text[min(end+1, len(text)):]
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return key, nil
+}
+
+// tomlKey formats keys as a dotted key, quoting those that need it
+func tomlKey(key []string) string {
+	parts := make([]string, len(key))
+	for i, part := range key {
+		parts[i] = part
+		if !tomlBareKey.MatchString(part) {
+			parts[i] = strconv.Quote(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func validTOMLValue(text string) bool {
+	var decoded map[string]any
+	return toml.Unmarshal([]byte("v = "+text), &decoded) == nil
+}
+
+// tomlValue formats a value on one line, with tables inline and strings
+// double quoted, as most TOML files write them
+func tomlValue(value any, path []string) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return jsonString(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			return "inf", nil
+		case math.IsInf(v, -1):
+			return "-inf", nil
+		case math.IsNaN(v):
+			return "nan", nil
+		}
+		formatted := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(formatted, ".e") {
+			formatted += ".0"
+		}
+		return formatted, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			formatted, err := tomlValue(item, path)
+			if err != nil {
+				return "", err
+			}
+			items[i] = formatted
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			formatted, err := tomlValue(v[key], path)
+			if err != nil {
+				return "", err
+			}
+			items[i] = tomlKey([]string{key}) + " = " + formatted
+		}
+		return "{" + strings.Join(items, ", ") + "}", nil
+	}
+
+	// Dates and times of the file
+	var formatted bytes.Buffer
+	err := toml.NewEncoder(&formatted).Encode(map[string]any{"v": value})
+	line, ok := strings.CutPrefix(strings.TrimSuffix(formatted.String(), "\n"), "v = ")
+	if err != nil || !ok {
+		return "", fmt.Errorf("%w: value of %s has no TOML representation", errInvalidRequest, keyPath(path))
+	}
+	return line, nil
+}
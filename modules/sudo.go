@@ -0,0 +1,67 @@
+package modules
+
+import (
+	"os"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Socket.IO Handlers
+
+// SendPassword types a password, e.g. for a sudo prompt, into a session. It
+// is only written while the terminal doesn't echo input, as at password
+// prompts, so it never shows in the output, and it isn't logged.
+func (sm *ShellModule) SendPassword(conn socketio.Conn, sessionID, password string) EventResult {
+	sm.mutex.RLock()
+	session, exists := sm.sessions[sessionID]
+	var ptmx *os.File
+	if exists {
+		ptmx = session.PTY
+	}
+	sm.mutex.RUnlock()
+
+	if !exists || !session.Active {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrNotFound,
+			"message":    localizeConn(conn, "Session not found"),
+			"session_id": sessionID,
+		})
+	}
+	if session.ClientID != conn.ID() {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrPermission,
+			"message":    localizeConn(conn, "Access denied"),
+			"session_id": sessionID,
+		})
+	}
+
+	echoes, err := terminalEchoes(ptmx)
+	if err != nil {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       errorCode(err),
+			"message":    localizeConn(conn, "Failed to send password: %v", err),
+			"session_id": sessionID,
+		})
+	}
+	if echoes {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       ErrConflict,
+			"message":    localizeConn(conn, "The terminal is echoing input, the password would be displayed"),
+			"session_id": sessionID,
+		})
+	}
+
+	if _, err := ptmx.Write([]byte(password + "\n")); err != nil {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":       errorCode(err),
+			"message":    localizeConn(conn, "Failed to send password: %v", err),
+			"session_id": sessionID,
+		})
+	}
+
+	return sm.emitter.Reply(conn, "shell:password:sent", map[string]interface{}{
+		"session_id": sessionID,
+		"timestamp":  time.Now(),
+	})
+}
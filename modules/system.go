@@ -0,0 +1,314 @@
+package modules
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Version is the agent version, set at build time with
+// -ldflags "-X github.com/sammwyy/ccw/modules.Version=..."
+var Version = "dev"
+
+// ProtocolVersion is bumped on breaking changes to the Socket.IO events
+const ProtocolVersion = 2
+
+// SystemModule handles connection-level sys:* events spanning all modules
+type SystemModule struct {
+	server      *socketio.Server
+	emitter     *Emitter
+	config      *Config
+	identity    *AgentIdentity
+	fs          *FileSystemModule
+	net         *NetworkModule
+	shell       *ShellModule
+	connections map[string]*connectionState
+	socket      SocketStats
+	mutex       sync.RWMutex
+}
+
+// SocketStats counts the failures of the Socket.IO server
+type SocketStats struct {
+	Serving     bool       `json:"serving"`  // the accept loop is running
+	Restarts    int        `json:"restarts"` // of the accept loop
+	Errors      int        `json:"errors"`   // of connections, reported by the server
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type connectionState struct {
+	conn      socketio.Conn
+	connected time.Time
+	lastSeen  time.Time // zero until the client answers a heartbeat
+}
+
+func NewSystemModule(server *socketio.Server, emitter *Emitter, config *Config, identity *AgentIdentity, fs *FileSystemModule, net *NetworkModule, shell *ShellModule) *SystemModule {
+	return &SystemModule{
+		server:      server,
+		emitter:     emitter,
+		config:      config,
+		identity:    identity,
+		fs:          fs,
+		net:         net,
+		shell:       shell,
+		connections: make(map[string]*connectionState),
+	}
+}
+
+// RegisterConnection starts tracking an authenticated connection
+func (sys *SystemModule) RegisterConnection(conn socketio.Conn) {
+	sys.mutex.Lock()
+	defer sys.mutex.Unlock()
+
+	sys.connections[conn.ID()] = &connectionState{
+		conn:      conn,
+		connected: time.Now(),
+	}
+}
+
+// StartHeartbeat periodically pings every connection and reaps the ones
+// that stopped answering
+func (sys *SystemModule) StartHeartbeat() {
+	if sys.config.HeartbeatInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(sys.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for _, conn := range sys.staleConnections() {
+				log.Printf("Reaping stale connection: %s", conn.ID())
+				conn.Close()
+			}
+
+			sys.mutex.RLock()
+			for _, state := range sys.connections {
+				sys.emitter.Emit(state.conn, "sys:ping", map[string]interface{}{
+					"timestamp": time.Now(),
+				})
+			}
+			sys.mutex.RUnlock()
+		}
+	}()
+}
+
+// Serve runs the accept loop of the Socket.IO server, restarting it with a
+// backoff when it fails so a fault doesn't take down the agent and its
+// shells. Connected clients are told with sys:error.
+func (sys *SystemModule) Serve() {
+	backoff := time.Second
+	for {
+		sys.mutex.Lock()
+		sys.socket.Serving = true
+		sys.mutex.Unlock()
+
+		started := time.Now()
+		err := sys.serveOnce()
+		if err == nil {
+			err = fmt.Errorf("accept loop stopped")
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Socket.IO server error, restarting in %s: %v", backoff, err)
+
+		sys.mutex.Lock()
+		sys.socket.Serving = false
+		sys.socket.Restarts++
+		sys.recordSocketError(err)
+		for _, state := range sys.connections {
+			sys.emitter.Emit(state.conn, "sys:error", map[string]interface{}{
+				"code":      ErrInternal,
+				"message":   localizeConn(state.conn, "Socket.IO server error, restarting: %v", err),
+				"restarts":  sys.socket.Restarts,
+				"timestamp": time.Now(),
+			})
+		}
+		sys.mutex.Unlock()
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// SocketError counts an error the Socket.IO server reports for a
+// connection, which may be nil when it failed before connecting
+func (sys *SystemModule) SocketError(conn socketio.Conn, err error) {
+	if conn != nil {
+		log.Printf("Socket.IO error on %s: %v", conn.ID(), err)
+	} else {
+		log.Printf("Socket.IO error: %v", err)
+	}
+
+	sys.mutex.Lock()
+	defer sys.mutex.Unlock()
+	sys.socket.Errors++
+	sys.recordSocketError(err)
+}
+
+// SocketStats returns the failure counters of the Socket.IO server
+func (sys *SystemModule) SocketStats() SocketStats {
+	sys.mutex.RLock()
+	defer sys.mutex.RUnlock()
+
+	return sys.socket
+}
+
+// Info describes the agent, its enabled modules and the protocol features
+// it supports, so clients can adapt to older or newer agents
+func (sys *SystemModule) Info() map[string]interface{} {
+	features := []string{
+		"acks",
+		"typed-payloads",
+		"binary-transfers",
+		"binary-streams",
+		"msgpack",
+		"watch-replay",
+		"shared-monitors",
+		"shell-viewers",
+		"shell-profiles",
+		"pagination",
+		"field-selection",
+		"conditional-requests",
+		"error-codes",
+		"i18n",
+		"rate-limits",
+		"port-processes",
+		"port-metrics",
+		"identity",
+	}
+	if sys.config.EmitBatchWindow > 0 {
+		features = append(features, "batching")
+	}
+	if sys.config.HeartbeatInterval > 0 {
+		features = append(features, "heartbeat")
+	}
+	if sys.config.ResumeWindow > 0 {
+		features = append(features, "resume")
+	}
+	if sys.config.CompressMinSize >= 0 {
+		features = append(features, "compression")
+	}
+	if sys.config.IdempotencyTTL > 0 {
+		features = append(features, "idempotency")
+	}
+	if sys.config.FleetAgents != "" {
+		features = append(features, "fleet")
+	}
+	if sys.config.FleetController != "" {
+		features = append(features, "fleet-registration")
+	}
+
+	return map[string]interface{}{
+		"id":        sys.identity.ID,
+		"name":      sys.identity.Name,
+		"labels":    sys.identity.Labels,
+		"tags":      sys.identity.Tags,
+		"version":   Version,
+		"protocol":  ProtocolVersion,
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+		"modules":   []string{"fs", "net", "shell", "sys"},
+		"features":  features,
+		"read_only": sys.config.ReadOnly,
+	}
+}
+
+// Socket.IO Handlers
+
+// Hello greets a new connection with the agent description
+func (sys *SystemModule) Hello(conn socketio.Conn, resumeToken string) {
+	hello := sys.Info()
+	hello["connection_id"] = conn.ID()
+	hello["encoding"] = ConnEncoding(conn)
+	if resumeToken != "" {
+		hello["resume_token"] = resumeToken
+	}
+	hello["timestamp"] = time.Now()
+	sys.emitter.Emit(conn, "sys:hello", hello)
+}
+
+// Heartbeat records that the client is alive, answering its ping if asked
+func (sys *SystemModule) Heartbeat(conn socketio.Conn, reply bool) {
+	sys.mutex.Lock()
+	if state, exists := sys.connections[conn.ID()]; exists {
+		state.lastSeen = time.Now()
+	}
+	sys.mutex.Unlock()
+
+	if reply {
+		sys.emitter.Emit(conn, "sys:pong", map[string]interface{}{
+			"timestamp": time.Now(),
+		})
+	}
+}
+
+// ListSubscriptions reports everything the connection is subscribed to, so
+// clients can resynchronize their state after a UI reload
+func (sys *SystemModule) ListSubscriptions(conn socketio.Conn) {
+	watches, transfers := sys.fs.Subscriptions(conn.ID())
+
+	sys.emitter.Emit(conn, "sys:subscriptions", map[string]interface{}{
+		"watches":   watches,
+		"transfers": transfers,
+		"monitors":  sys.net.Subscriptions(conn.ID()),
+		"shells":    sys.shell.Subscriptions(conn),
+		"rooms":     conn.Rooms(),
+		"timestamp": time.Now(),
+	})
+}
+
+// CleanupConnection stops tracking a disconnected client
+func (sys *SystemModule) CleanupConnection(clientID string) {
+	sys.mutex.Lock()
+	defer sys.mutex.Unlock()
+
+	delete(sys.connections, clientID)
+}
+
+// Helper functions
+
+// serveOnce runs the accept loop until it fails, turning a panic into an
+// error
+func (sys *SystemModule) serveOnce() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return sys.server.Serve()
+}
+
+// recordSocketError keeps the last error of the Socket.IO server. The
+// caller holds the mutex.
+func (sys *SystemModule) recordSocketError(err error) {
+	now := time.Now()
+	sys.socket.LastError = err.Error()
+	sys.socket.LastErrorAt = &now
+}
+
+// staleConnections returns the connections silent for longer than the
+// heartbeat timeout. Clients that never answered a heartbeat are left to
+// the transport's own ping timeout so older clients keep working.
+func (sys *SystemModule) staleConnections() []socketio.Conn {
+	sys.mutex.RLock()
+	defer sys.mutex.RUnlock()
+
+	var stale []socketio.Conn
+	if sys.config.HeartbeatTimeout <= 0 {
+		return stale
+	}
+
+	for _, state := range sys.connections {
+		if !state.lastSeen.IsZero() && time.Since(state.lastSeen) > sys.config.HeartbeatTimeout {
+			stale = append(stale, state.conn)
+		}
+	}
+	return stale
+}
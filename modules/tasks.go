@@ -0,0 +1,536 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// States of a task
+const (
+	TaskRunning   = "running"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled"
+)
+
+// Units of the progress of a task
+const (
+	unitBytes = "bytes"
+	unitSteps = "steps"
+)
+
+const (
+	// progressInterval is the minimum time between two progress events
+	progressInterval = 250 * time.Millisecond
+	// taskRetention is how long finished tasks can still be looked up
+	taskRetention = time.Hour
+	// taskHistory is the most finished tasks kept
+	taskHistory = 200
+)
+
+// errTaskCancelled is the cause of the context of a cancelled task
+var errTaskCancelled = errors.New("task cancelled")
+
+// Tasks tracks the long operations of every module, copies, transfers,
+// archives and provisioning runs, with their progress, so clients follow
+// and cancel them the same way. Connections subscribed with
+// tasks:subscribe get tasks:started, tasks:progress and tasks:finished
+// events for the tasks of their token.
+type Tasks struct {
+	emitter     *Emitter
+	tasks       map[string]*Task
+	subscribers map[string]socketio.Conn // by client ID
+	mutex       sync.RWMutex
+}
+
+// Task is a long operation run on behalf of a token. Progress is counted in
+// bytes, or in steps for operations without a size.
+type Task struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"` // e.g. copy, download, s3:get, archive or provision
+	Target   string     `json:"target,omitempty"`
+	Token    string     `json:"token"`
+	State    string     `json:"state"` // running, succeeded, failed or cancelled
+	Unit     string     `json:"unit"`  // bytes or steps
+	Done     int64      `json:"done"`
+	Total    int64      `json:"total,omitempty"` // 0 while unknown
+	Percent  float64    `json:"percent,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Code     string     `json:"code,omitempty"`
+	Error    string     `json:"error,omitempty"`
+
+	tasks    *Tasks
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	progress socketio.Conn // receiving net:progress events, if any
+	last     time.Time     // of the last progress event
+	mutex    sync.Mutex
+}
+
+type TaskRequest struct {
+	TaskID string `json:"task_id" binding:"required"`
+}
+
+type TaskOperation struct {
+	Success    bool   `json:"success"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	Data       any    `json:"data,omitempty"`
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func NewTasks(emitter *Emitter) *Tasks {
+	return &Tasks{
+		emitter:     emitter,
+		tasks:       make(map[string]*Task),
+		subscribers: make(map[string]socketio.Conn),
+	}
+}
+
+// Start registers a task for a request and names it in the X-Task-ID
+// header of the response. Its context is done when the task is cancelled or
+// the client goes away.
+func (t *Tasks) Start(c *gin.Context, kind, target, unit string) *Task {
+	ctx, cancel := context.WithCancelCause(c.Request.Context())
+	task := &Task{
+		ID:      uuid.New().String(),
+		Type:    kind,
+		Target:  target,
+		State:   TaskRunning,
+		Unit:    unit,
+		Started: time.Now(),
+		tasks:   t,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if token := RequestToken(c); token != nil {
+		task.Token = token.Name
+	}
+	c.Header("X-Task-ID", task.ID)
+
+	t.mutex.Lock()
+	t.prune()
+	t.tasks[task.ID] = task
+	t.mutex.Unlock()
+
+	t.emit(task, "tasks:started")
+	return task
+}
+
+// REST API Handlers
+
+// ListTasks lists the running and recently finished tasks of the token, or
+// of every token with the audit permission, newest first. The state query
+// parameter keeps the tasks in one state.
+func (t *Tasks) ListTasks(c *gin.Context) {
+	token := RequestToken(c)
+	state := c.Query("state")
+
+	t.mutex.RLock()
+	tasks := make([]*Task, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		if snapshot := task.snapshot(); task.visibleTo(token) && (state == "" || snapshot.State == state) {
+			tasks = append(tasks, snapshot)
+		}
+	}
+	t.mutex.RUnlock()
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Started.After(tasks[j].Started) })
+
+	page, total, next, err := paginate(c, tasks)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, TaskOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, TaskOperation{
+		Success:    true,
+		Message:    Localize(c, "Tasks retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// GetTask returns a task by ID
+func (t *Tasks) GetTask(c *gin.Context) {
+	task := t.lookup(c.Param("id"), RequestToken(c))
+	if task == nil {
+		c.JSON(http.StatusNotFound, TaskOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Task not found"),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, TaskOperation{
+		Success: true,
+		Message: Localize(c, "Task retrieved"),
+		Data:    task.snapshot(),
+	})
+}
+
+// CancelTask cancels a running task. The task ends as cancelled once the
+// operation notices, which the response doesn't wait for.
+func (t *Tasks) CancelTask(c *gin.Context) {
+	task := t.lookup(c.Param("id"), RequestToken(c))
+	if task == nil {
+		c.JSON(http.StatusNotFound, TaskOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Task not found"),
+		})
+		return
+	}
+	if !task.Cancel() {
+		c.JSON(http.StatusConflict, TaskOperation{
+			Success: false,
+			Code:    ErrConflict,
+			Message: Localize(c, "Task already finished"),
+			Data:    task.snapshot(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, TaskOperation{
+		Success: true,
+		Message: Localize(c, "Task cancellation requested"),
+		Data:    task.snapshot(),
+	})
+}
+
+// Socket.IO Handlers
+
+// Subscribe starts sending the task events of the token of a connection,
+// replying with its running tasks
+func (t *Tasks) Subscribe(conn socketio.Conn) EventResult {
+	token := ConnToken(conn)
+
+	t.mutex.Lock()
+	t.subscribers[conn.ID()] = conn
+	running := []*Task{}
+	for _, task := range t.tasks {
+		if snapshot := task.snapshot(); snapshot.State == TaskRunning && task.visibleTo(token) {
+			running = append(running, snapshot)
+		}
+	}
+	t.mutex.Unlock()
+	sort.Slice(running, func(i, j int) bool { return running[i].Started.Before(running[j].Started) })
+
+	return t.emitter.Reply(conn, "tasks:subscribed", map[string]interface{}{
+		"tasks":     running,
+		"timestamp": time.Now(),
+	})
+}
+
+// Unsubscribe stops sending task events to a connection
+func (t *Tasks) Unsubscribe(conn socketio.Conn) EventResult {
+	t.mutex.Lock()
+	delete(t.subscribers, conn.ID())
+	t.mutex.Unlock()
+
+	return t.emitter.Reply(conn, "tasks:unsubscribed", map[string]interface{}{
+		"timestamp": time.Now(),
+	})
+}
+
+// Abort cancels a running task of the token of a connection
+func (t *Tasks) Abort(conn socketio.Conn, taskID string) EventResult {
+	task := t.lookup(taskID, ConnToken(conn))
+	if task == nil {
+		return t.emitter.Fail(conn, "tasks:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "Task not found"),
+			"task_id": taskID,
+		})
+	}
+	if !task.Cancel() {
+		return t.emitter.Fail(conn, "tasks:error", map[string]interface{}{
+			"code":    ErrConflict,
+			"message": localizeConn(conn, "Task already finished"),
+			"task_id": taskID,
+		})
+	}
+
+	return t.emitter.Reply(conn, "tasks:cancelling", map[string]interface{}{
+		"task_id":   taskID,
+		"timestamp": time.Now(),
+	})
+}
+
+// CleanupConnection stops sending task events to a disconnected client
+func (t *Tasks) CleanupConnection(clientID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.subscribers, clientID)
+}
+
+// Context is done when the task is cancelled or its client goes away
+func (task *Task) Context() context.Context {
+	return task.ctx
+}
+
+// Cancel asks the operation of a running task to stop, reporting whether it
+// was running
+func (task *Task) Cancel() bool {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	if task.State != TaskRunning {
+		return false
+	}
+	task.cancel(errTaskCancelled)
+	return true
+}
+
+// ReportTo also sends net:progress events to conn, the connection named in
+// the socket_id of a request, if any
+func (task *Task) ReportTo(conn socketio.Conn) {
+	task.mutex.Lock()
+	task.progress = conn
+	task.mutex.Unlock()
+}
+
+// SetTotal updates the expected progress once it is known
+func (task *Task) SetTotal(total int64) {
+	task.mutex.Lock()
+	task.Total = total
+	task.mutex.Unlock()
+}
+
+// Add records n more bytes or steps done, emitting tasks:progress if the
+// last event is old enough
+func (task *Task) Add(n int64) {
+	task.mutex.Lock()
+	task.Done += n
+	due := time.Since(task.last) >= progressInterval
+	if due {
+		task.last = time.Now()
+	}
+	task.mutex.Unlock()
+
+	if due {
+		task.tasks.emit(task, "tasks:progress")
+		task.emitProgress(false)
+	}
+}
+
+// Reader counts the bytes read from r, failing once the task is cancelled
+func (task *Task) Reader(r io.Reader) io.Reader {
+	return &taskReader{Reader: r, task: task}
+}
+
+// Writer counts the bytes written to w, failing once the task is cancelled
+func (task *Task) Writer(w io.Writer) io.Writer {
+	return &taskWriter{Writer: w, task: task}
+}
+
+// Finish ends a task with the error of its operation, if any, and emits
+// tasks:finished. A task whose context was cancelled ends as cancelled.
+func (task *Task) Finish(err error) {
+	now := time.Now()
+
+	task.mutex.Lock()
+	if task.State != TaskRunning {
+		task.mutex.Unlock()
+		return
+	}
+	task.Finished = &now
+	switch {
+	case err == nil:
+		task.State = TaskSucceeded
+	case task.ctx.Err() != nil:
+		task.State, task.Code, task.Error = TaskCancelled, ErrCancelled, context.Cause(task.ctx).Error()
+	default:
+		task.State, task.Code, task.Error = TaskFailed, errorCode(err), err.Error()
+	}
+	task.mutex.Unlock()
+	task.cancel(nil)
+
+	task.tasks.emit(task, "tasks:finished")
+	if err == nil {
+		task.emitProgress(true)
+	}
+}
+
+// Helper functions
+
+// Err returns the error a cancelled task fails with, nil while it runs
+func (task *Task) Err() error {
+	if task.ctx.Err() == nil {
+		return nil
+	}
+	if cause := context.Cause(task.ctx); errors.Is(cause, errTaskCancelled) {
+		return cause
+	}
+	return fmt.Errorf("%w: %v", errTaskCancelled, context.Cause(task.ctx))
+}
+
+// snapshot copies the public fields of a task under its mutex
+func (task *Task) snapshot() *Task {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	snapshot := &Task{
+		ID:       task.ID,
+		Type:     task.Type,
+		Target:   task.Target,
+		Token:    task.Token,
+		State:    task.State,
+		Unit:     task.Unit,
+		Done:     task.Done,
+		Total:    task.Total,
+		Started:  task.Started,
+		Finished: task.Finished,
+		Code:     task.Code,
+		Error:    task.Error,
+	}
+	if task.Total > 0 {
+		snapshot.Percent = float64(task.Done) * 100 / float64(task.Total)
+	}
+	return snapshot
+}
+
+// emitProgress sends the net:progress event of the task to the connection
+// it reports to
+func (task *Task) emitProgress(done bool) {
+	snapshot := task.snapshot()
+	task.mutex.Lock()
+	conn := task.progress
+	task.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+
+	event := map[string]interface{}{
+		"job_id":    snapshot.ID,
+		"operation": snapshot.Type,
+		"bytes":     snapshot.Done,
+		"done":      done,
+		"timestamp": time.Now(),
+	}
+	if snapshot.Total > 0 {
+		event["total"] = snapshot.Total
+		event["percent"] = snapshot.Percent
+	}
+	task.tasks.emitter.Emit(conn, "net:progress", event)
+}
+
+// visibleTo reports whether a token can see a task: its own, or any with
+// the audit permission
+func (task *Task) visibleTo(token *Token) bool {
+	return token != nil && (task.Token == token.Name || token.HasScope(ScopeAudit))
+}
+
+// lookup returns a task visible to a token, or nil
+func (t *Tasks) lookup(id string, token *Token) *Task {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if task, exists := t.tasks[id]; exists && task.visibleTo(token) {
+		return task
+	}
+	return nil
+}
+
+// emit sends an event of a task to the subscribers allowed to see it
+func (t *Tasks) emit(task *Task, event string) {
+	snapshot := task.snapshot()
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, conn := range t.subscribers {
+		if task.visibleTo(ConnToken(conn)) {
+			t.emitter.Emit(conn, event, map[string]interface{}{
+				"task":      snapshot,
+				"timestamp": time.Now(),
+			})
+		}
+	}
+}
+
+// prune forgets the tasks finished past taskRetention, and the oldest
+// finished ones past taskHistory. The caller holds the mutex.
+func (t *Tasks) prune() {
+	var finished []*Task
+	for id, task := range t.tasks {
+		snapshot := task.snapshot()
+		if snapshot.Finished == nil {
+			continue
+		}
+		if time.Since(*snapshot.Finished) > taskRetention {
+			delete(t.tasks, id)
+			continue
+		}
+		finished = append(finished, snapshot)
+	}
+	if len(finished) <= taskHistory {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(*finished[j].Finished) })
+	for _, task := range finished[:len(finished)-taskHistory] {
+		delete(t.tasks, task.ID)
+	}
+}
+
+type taskReader struct {
+	io.Reader
+	task *Task
+}
+
+func (r *taskReader) Read(buf []byte) (int, error) {
+	if err := r.task.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.Reader.Read(buf)
+	r.task.Add(int64(n))
+	return n, err
+}
+
+type taskWriter struct {
+	io.Writer
+	task *Task
+}
+
+func (w *taskWriter) Write(buf []byte) (int, error) {
+	if err := w.task.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.Writer.Write(buf)
+	w.task.Add(int64(n))
+	return n, err
+}
+
+// requestConn returns the connection socketID named in a request, if it
+// belongs to the token of the request
+func requestConn(c *gin.Context, emitter *Emitter, socketID string) socketio.Conn {
+	if socketID == "" {
+		return nil
+	}
+	conn := emitter.Lookup(socketID)
+	if conn == nil {
+		return nil
+	}
+	connToken, requestToken := ConnToken(conn), RequestToken(c)
+	if connToken == nil || requestToken == nil || connToken.Name != requestToken.Name {
+		return nil
+	}
+	return conn
+}
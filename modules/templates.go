@@ -0,0 +1,401 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// templateNamePattern matches template and parameter names
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// templatePlaceholder matches the {{param}} placeholders of templates
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_-]+)\s*\}\}`)
+
+// defaultParamPattern accepts words, paths and host names, but no option
+// that could change the meaning of the command
+const defaultParamPattern = `^[A-Za-z0-9_.:/@=+][A-Za-z0-9_.:/@=+-]*$`
+
+// CommandTemplate is a named command that clients run with parameters,
+// without a shell, so values can't inject other commands
+type CommandTemplate struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Command     []string                 `json:"command" binding:"required,min=1"` // program and arguments, with {{param}} placeholders
+	Params      map[string]TemplateParam `json:"params,omitempty"`
+	WorkDir     string                   `json:"workdir,omitempty"`
+	Env         map[string]string        `json:"env,omitempty"`
+	Timeout     int                      `json:"timeout,omitempty" binding:"min=0"` // in seconds
+	Scopes      []string                 `json:"scopes,omitempty"`                  // any of them allows running it, none allows every token
+}
+
+// TemplateParam is a parameter of a command template
+type TemplateParam struct {
+	Description string `json:"description,omitempty"`
+	Pattern     string `json:"pattern,omitempty"` // regular expression values must match, a safe default when empty
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+type TemplateRunRequest struct {
+	Variables map[string]string `json:"variables"`
+}
+
+// REST API Handlers
+
+// ListTemplates lists the command templates the token may run
+func (sm *ShellModule) ListTemplates(c *gin.Context) {
+	token := RequestToken(c)
+	sm.templatesMu.Lock()
+	templates := make([]*CommandTemplate, 0, len(sm.templates))
+	for _, template := range sm.templates {
+		if template.allows(token) {
+			templates = append(templates, template)
+		}
+	}
+	sm.templatesMu.Unlock()
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Templates retrieved"),
+		Data:    templates,
+	})
+}
+
+// CreateTemplate adds or replaces a command template, and saves the
+// templates to SHELL_TEMPLATES when set
+func (sm *ShellModule) CreateTemplate(c *gin.Context) {
+	if !sm.templatesAuthorized(c) {
+		return
+	}
+	var template CommandTemplate
+	if err := c.ShouldBindJSON(&template); err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !sm.resolvePaths(c, &template.WorkDir) {
+		return
+	}
+	if err := template.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	sm.templatesMu.Lock()
+	defer sm.templatesMu.Unlock()
+	previous := sm.templates[template.Name]
+	sm.templates[template.Name] = &template
+	if err := sm.saveTemplates(); err != nil {
+		if previous != nil {
+			sm.templates[template.Name] = previous
+		} else {
+			delete(sm.templates, template.Name)
+		}
+		c.JSON(errorStatus(err), ShellOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to save template: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Template %s saved", template.Name),
+		Data:    template,
+	})
+}
+
+// DeleteTemplate removes a command template
+func (sm *ShellModule) DeleteTemplate(c *gin.Context) {
+	if !sm.templatesAuthorized(c) {
+		return
+	}
+	name := c.Param("name")
+
+	sm.templatesMu.Lock()
+	defer sm.templatesMu.Unlock()
+	template, exists := sm.templates[name]
+	if !exists {
+		c.JSON(http.StatusNotFound, ShellOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Template %s not found", name),
+		})
+		return
+	}
+	delete(sm.templates, name)
+	if err := sm.saveTemplates(); err != nil {
+		sm.templates[name] = template
+		c.JSON(errorStatus(err), ShellOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to save template: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Template %s deleted", name),
+	})
+}
+
+// RunTemplate runs a command template with the given variables, if one of
+// its scopes is granted to the token
+func (sm *ShellModule) RunTemplate(c *gin.Context) {
+	name := c.Param("name")
+	sm.templatesMu.Lock()
+	template, exists := sm.templates[name]
+	sm.templatesMu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, ShellOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "Template %s not found", name),
+		})
+		return
+	}
+	if !template.allows(RequestToken(c)) {
+		c.JSON(http.StatusForbidden, ShellOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Running template %s requires one of the permissions %s", name, strings.Join(template.Scopes, ", ")),
+		})
+		return
+	}
+
+	var req TemplateRunRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ShellOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", err),
+			})
+			return
+		}
+	}
+	args, err := template.expand(req.Variables)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	history := map[string]any{"template": name, "command": strings.Join(args, " ")}
+	recordAs(c, RecordCommand, "", history)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = template.WorkDir
+	cmd.Env = os.Environ()
+	for key, value := range template.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	startTime := time.Now()
+	stdout, stderr, exitCode, terminated, timedOut := sm.executeWithTimeout(cmd, template.Timeout)
+	history["exit_code"] = exitCode
+	result := CommandResult{
+		Command:    strings.Join(args, " "),
+		ExitCode:   exitCode,
+		Stdout:     stdout,
+		Stderr:     stderr,
+		Duration:   time.Since(startTime).String(),
+		Terminated: terminated,
+	}
+
+	if timedOut {
+		c.JSON(http.StatusGatewayTimeout, ShellOperation{
+			Success: false,
+			Code:    ErrTimeout,
+			Message: Localize(c, "Command timed out after %d seconds", template.Timeout),
+			Data:    result,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "Command executed"),
+		Data:    result,
+	})
+}
+
+// Helper functions
+
+// loadCommandTemplates reads the templates file, a JSON object of templates
+// by name. A missing file means no templates yet.
+func loadCommandTemplates(path string) (map[string]*CommandTemplate, error) {
+	templates := make(map[string]*CommandTemplate)
+	if path == "" {
+		return templates, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return templates, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("command templates: %w", err)
+	}
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("command templates: %s: %w", path, err)
+	}
+	for name, template := range templates {
+		if template == nil {
+			return nil, fmt.Errorf("command templates: %s: template %q is empty", path, name)
+		}
+		template.Name = name
+		if err := template.compile(); err != nil {
+			return nil, fmt.Errorf("command templates: %s: template %q: %w", path, name, err)
+		}
+	}
+	return templates, nil
+}
+
+// saveTemplates writes the templates to SHELL_TEMPLATES, replacing the file
+// so it's never half written. The caller holds templatesMu.
+func (sm *ShellModule) saveTemplates() error {
+	path := sm.config.ShellTemplates
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(sm.templates, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".ccw-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (sm *ShellModule) templatesAuthorized(c *gin.Context) bool {
+	if !RequestToken(c).HasScope(ScopeTemplates) {
+		c.JSON(http.StatusForbidden, ShellOperation{
+			Success: false,
+			Code:    ErrPermission,
+			Message: Localize(c, "Managing templates requires the templates permission"),
+		})
+		return false
+	}
+	return true
+}
+
+// compile checks a template and compiles the patterns of its parameters.
+// Every placeholder must be a declared parameter.
+func (t *CommandTemplate) compile() error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("template names are made of letters, digits, '_' and '-'")
+	}
+	if len(t.Command) == 0 || t.Command[0] == "" {
+		return fmt.Errorf("command is required")
+	}
+	for name, param := range t.Params {
+		if !templateNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid parameter name %q", name)
+		}
+		pattern := param.Pattern
+		if pattern == "" {
+			pattern = defaultParamPattern
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("parameter %s: %v", name, err)
+		}
+		param.pattern = compiled
+		if param.Default != "" && !compiled.MatchString(param.Default) {
+			return fmt.Errorf("parameter %s: the default doesn't match the pattern", name)
+		}
+		t.Params[name] = param
+	}
+	for _, arg := range t.Command {
+		for _, match := range templatePlaceholder.FindAllStringSubmatch(arg, -1) {
+			if _, declared := t.Params[match[1]]; !declared {
+				return fmt.Errorf("undeclared parameter %s", match[1])
+			}
+		}
+	}
+	return nil
+}
+
+// expand fills the placeholders of the command with the variables, or the
+// defaults, after checking them against the parameter patterns
+func (t *CommandTemplate) expand(variables map[string]string) ([]string, error) {
+	for name := range variables {
+		if _, declared := t.Params[name]; !declared {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+	values := make(map[string]string, len(t.Params))
+	for name, param := range t.Params {
+		value, given := variables[name]
+		if !given {
+			if param.Required {
+				return nil, fmt.Errorf("parameter %s is required", name)
+			}
+			value = param.Default
+		}
+		if value != "" && !param.pattern.MatchString(value) {
+			return nil, fmt.Errorf("parameter %s doesn't match %s", name, param.pattern)
+		}
+		values[name] = value
+	}
+
+	args := make([]string, len(t.Command))
+	for i, arg := range t.Command {
+		args[i] = templatePlaceholder.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			return values[templatePlaceholder.FindStringSubmatch(placeholder)[1]]
+		})
+	}
+	return args, nil
+}
+
+// allows reports whether token may run the template
+func (t *CommandTemplate) allows(token *Token) bool {
+	if len(t.Scopes) == 0 {
+		return token != nil
+	}
+	for _, scope := range t.Scopes {
+		if token.HasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
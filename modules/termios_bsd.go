@@ -0,0 +1,7 @@
+//go:build darwin || freebsd || openbsd || netbsd
+
+package modules
+
+import "syscall"
+
+const ioctlReadTermios = syscall.TIOCGETA
@@ -0,0 +1,5 @@
+package modules
+
+import "syscall"
+
+const ioctlReadTermios = syscall.TCGETS
@@ -0,0 +1,121 @@
+package modules
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttle limits the bandwidth of transfers started by the agent: all of
+// them share the global limit, and each one also has its own job limit
+type Throttle struct {
+	global   *rateLimiter
+	jobLimit int64
+}
+
+// rateLimiter is a token bucket allowing a number of bytes per second, with
+// bursts of up to one second. A nil limiter is unlimited.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+type throttledReader struct {
+	reader   io.Reader
+	limiters []*rateLimiter
+}
+
+type throttledWriter struct {
+	writer   io.Writer
+	limiters []*rateLimiter
+}
+
+func NewThrottle(config *Config) *Throttle {
+	return &Throttle{
+		global:   newRateLimiter(config.RateLimit),
+		jobLimit: config.RateLimitJob,
+	}
+}
+
+// Reader limits the bytes read from r to the global limit and rate, the
+// limit of the job in bytes per second
+func (t *Throttle) Reader(rate int64, r io.Reader) io.Reader {
+	limiters := t.limiters(rate)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{reader: r, limiters: limiters}
+}
+
+// Writer limits the bytes written to w to the global limit and rate, the
+// limit of the job in bytes per second
+func (t *Throttle) Writer(rate int64, w io.Writer) io.Writer {
+	limiters := t.limiters(rate)
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{writer: w, limiters: limiters}
+}
+
+// Helper functions
+
+// limiters returns the limiters of a new job. The job limit is the
+// requested rate, which can't exceed the configured job limit.
+func (t *Throttle) limiters(rate int64) []*rateLimiter {
+	if rate <= 0 || (t.jobLimit > 0 && rate > t.jobLimit) {
+		rate = t.jobLimit
+	}
+
+	var limiters []*rateLimiter
+	if job := newRateLimiter(rate); job != nil {
+		limiters = append(limiters, job)
+	}
+	if t.global != nil {
+		limiters = append(limiters, t.global)
+	}
+	return limiters
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes fit in the limit. Larger amounts than the burst
+// are let through by going into debt, which delays the following calls.
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (r *throttledReader) Read(buf []byte) (int, error) {
+	n, err := r.reader.Read(buf)
+	for _, limiter := range r.limiters {
+		limiter.wait(n)
+	}
+	return n, err
+}
+
+func (w *throttledWriter) Write(buf []byte) (int, error) {
+	for _, limiter := range w.limiters {
+		limiter.wait(len(buf))
+	}
+	return w.writer.Write(buf)
+}
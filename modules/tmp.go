@@ -0,0 +1,345 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TmpSpaces hands out temporary files and directories under TMP_DIR, which
+// are removed once their TTL runs out. Only paths recorded in its index are
+// ever removed, and the index survives restarts.
+type TmpSpaces struct {
+	dir        string
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	entries    map[string]*TmpEntry // by ID
+	mutex      sync.Mutex
+}
+
+// TmpEntry is a managed temporary file or directory
+type TmpEntry struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Type    string    `json:"type"` // file or directory
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	timer *time.Timer
+}
+
+type TmpRequest struct {
+	Type   string `json:"type" binding:"omitempty,oneof=file directory"` // directory by default
+	TTL    int    `json:"ttl" binding:"min=0"`                           // seconds, TMP_DEFAULT_TTL when 0
+	Prefix string `json:"prefix"`                                        // start of the name
+	Suffix string `json:"suffix"`                                        // end of the name, e.g. an extension
+}
+
+type TmpExtendRequest struct {
+	TTL int `json:"ttl" binding:"min=0"` // seconds from now, TMP_DEFAULT_TTL when 0
+}
+
+func NewTmpSpaces(config *Config) (*TmpSpaces, error) {
+	ts := &TmpSpaces{
+		dir:        config.TmpDir,
+		defaultTTL: config.TmpDefaultTTL,
+		maxTTL:     config.TmpMaxTTL,
+		entries:    make(map[string]*TmpEntry),
+	}
+	if err := os.MkdirAll(filepath.Join(ts.dir, "spaces"), 0700); err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(ts.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		var entries []*TmpEntry
+		if err := json.Unmarshal(content, &entries); err != nil {
+			log.Printf("Ignoring corrupt temporary space index: %v", err)
+		}
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+		for _, entry := range entries {
+			if filepath.Dir(entry.Path) != filepath.Join(ts.dir, "spaces") {
+				continue
+			}
+			ts.entries[entry.ID] = entry
+			ts.schedule(entry)
+		}
+	}
+	return ts, nil
+}
+
+// REST API Handlers
+
+// CreateTmp allocates a temporary file or directory, removed after its TTL
+func (fsm *FileSystemModule) CreateTmp(c *gin.Context) {
+	var req TmpRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, FileOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", err),
+			})
+			return
+		}
+	}
+
+	entry, err := fsm.tmp.create(req)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to create temporary space: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Temporary space created"),
+		Data:    entry,
+	})
+}
+
+// ListTmp lists the temporary files and directories, oldest first
+func (fsm *FileSystemModule) ListTmp(c *gin.Context) {
+	entries := fsm.tmp.list()
+	page, total, next, err := paginate(c, entries)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success:    true,
+		Message:    Localize(c, "Temporary spaces retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// ExtendTmp sets a new TTL for a temporary file or directory, from now
+func (fsm *FileSystemModule) ExtendTmp(c *gin.Context) {
+	var req TmpExtendRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, FileOperation{
+				Success: false,
+				Code:    ErrInvalidRequest,
+				Message: Localize(c, "Invalid request: %v", err),
+			})
+			return
+		}
+	}
+
+	entry, err := fsm.tmp.extend(c.Param("id"), req.TTL)
+	if err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to extend temporary space: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Temporary space extended"),
+		Data:    entry,
+	})
+}
+
+// DeleteTmp removes a temporary file or directory before its TTL runs out
+func (fsm *FileSystemModule) DeleteTmp(c *gin.Context) {
+	if err := fsm.tmp.remove(c.Param("id")); err != nil {
+		c.JSON(errorStatus(err), FileOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to delete temporary space: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success: true,
+		Message: Localize(c, "Temporary space deleted"),
+	})
+}
+
+// Helper functions
+
+// create allocates a temporary file or directory; entries are returned as
+// copies, the originals change under the mutex
+func (ts *TmpSpaces) create(req TmpRequest) (TmpEntry, error) {
+	entry := &TmpEntry{ID: uuid.NewString(), Type: req.Type, Created: time.Now()}
+	if entry.Type == "" {
+		entry.Type = "directory"
+	}
+	ttl, err := ts.ttl(req.TTL)
+	if err != nil {
+		return TmpEntry{}, err
+	}
+	if strings.ContainsAny(req.Prefix+req.Suffix, `/\`) {
+		return TmpEntry{}, fmt.Errorf("%w: prefix and suffix can't contain path separators", errInvalidRequest)
+	}
+
+	pattern := req.Prefix + "*" + req.Suffix
+	dir := filepath.Join(ts.dir, "spaces")
+	if entry.Type == "file" {
+		file, err := os.CreateTemp(dir, pattern)
+		if err != nil {
+			return TmpEntry{}, err
+		}
+		file.Close()
+		entry.Path = file.Name()
+	} else {
+		entry.Path, err = os.MkdirTemp(dir, pattern)
+		if err != nil {
+			return TmpEntry{}, err
+		}
+	}
+	entry.Expires = entry.Created.Add(ttl)
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.entries[entry.ID] = entry
+	ts.schedule(entry)
+	if err := ts.save(); err != nil {
+		log.Printf("Failed to save temporary space index: %v", err)
+	}
+	return *entry, nil
+}
+
+func (ts *TmpSpaces) list() []TmpEntry {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	entries := make([]TmpEntry, 0, len(ts.entries))
+	for _, entry := range ts.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Created.Equal(entries[j].Created) {
+			return entries[i].Created.Before(entries[j].Created)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+func (ts *TmpSpaces) extend(id string, seconds int) (TmpEntry, error) {
+	ttl, err := ts.ttl(seconds)
+	if err != nil {
+		return TmpEntry{}, err
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	entry, exists := ts.entries[id]
+	if !exists {
+		return TmpEntry{}, fmt.Errorf("temporary space %s: %w", id, os.ErrNotExist)
+	}
+	entry.Expires = time.Now().Add(ttl)
+	ts.schedule(entry)
+	if err := ts.save(); err != nil {
+		log.Printf("Failed to save temporary space index: %v", err)
+	}
+	return *entry, nil
+}
+
+// remove deletes a temporary file or directory and forgets it
+func (ts *TmpSpaces) remove(id string) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	entry, exists := ts.entries[id]
+	if !exists {
+		return fmt.Errorf("temporary space %s: %w", id, os.ErrNotExist)
+	}
+	if err := os.RemoveAll(entry.Path); err != nil {
+		return err
+	}
+	entry.timer.Stop()
+	delete(ts.entries, id)
+	if err := ts.save(); err != nil {
+		log.Printf("Failed to save temporary space index: %v", err)
+	}
+	return nil
+}
+
+// ttl returns the TTL of a request in seconds, the default when 0, within
+// TMP_MAX_TTL
+func (ts *TmpSpaces) ttl(seconds int) (time.Duration, error) {
+	ttl := time.Duration(seconds) * time.Second
+	if ttl == 0 {
+		ttl = ts.defaultTTL
+	}
+	if ts.maxTTL > 0 && ttl > ts.maxTTL {
+		return 0, fmt.Errorf("%w: ttl is over the %d second limit", errInvalidRequest, int(ts.maxTTL/time.Second))
+	}
+	return ttl, nil
+}
+
+// schedule removes an entry when it expires. The caller holds the mutex.
+func (ts *TmpSpaces) schedule(entry *TmpEntry) {
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.timer = time.AfterFunc(time.Until(entry.Expires), func() {
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+
+		if ts.entries[entry.ID] != entry || time.Now().Before(entry.Expires) {
+			return
+		}
+		if err := os.RemoveAll(entry.Path); err != nil {
+			log.Printf("Failed to remove temporary space %s: %v", entry.Path, err)
+			return
+		}
+		delete(ts.entries, entry.ID)
+		if err := ts.save(); err != nil {
+			log.Printf("Failed to save temporary space index: %v", err)
+		}
+	})
+}
+
+// save writes the index. The caller holds the mutex.
+func (ts *TmpSpaces) save() error {
+	entries := make([]*TmpEntry, 0, len(ts.entries))
+	for _, entry := range ts.entries {
+		entries = append(entries, entry)
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := ts.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.indexPath())
+}
+
+func (ts *TmpSpaces) indexPath() string {
+	return filepath.Join(ts.dir, "index.json")
+}
@@ -0,0 +1,215 @@
+package modules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// tmuxNamePattern matches the session names accepted, without the ':' and
+// '.' tmux uses in targets
+var tmuxNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// errTmuxSessionExists marks names already taken by a tmux session
+var errTmuxSessionExists = errors.New("tmux session already exists")
+
+// TmuxSession is a session of the tmux server of the agent's user
+type TmuxSession struct {
+	Name     string    `json:"name"`
+	Windows  int       `json:"windows"`
+	Attached int       `json:"attached"` // clients attached, ccw terminals included
+	Created  time.Time `json:"created"`
+	Activity time.Time `json:"activity"`
+}
+
+type TmuxRequest struct {
+	Name    string `json:"name" binding:"required"`
+	Command string `json:"command"` // run in the first window instead of the default shell
+	Cwd     string `json:"cwd"`
+}
+
+// REST API Handlers
+
+// GetTmuxSessions lists the tmux sessions on the host
+func (sm *ShellModule) GetTmuxSessions(c *gin.Context) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		c.JSON(http.StatusNotFound, ShellOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "tmux is not installed"),
+		})
+		return
+	}
+
+	sessions, err := tmuxSessions()
+	if err != nil {
+		c.JSON(errorStatus(err), ShellOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to list tmux sessions: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "tmux sessions retrieved"),
+		Data:    sessions,
+	})
+}
+
+// CreateTmuxSession creates a detached tmux session, to attach terminals to
+// with shell:spawn
+func (sm *ShellModule) CreateTmuxSession(c *gin.Context) {
+	var req TmuxRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+	if !sm.resolvePaths(c, &req.Cwd) {
+		return
+	}
+	if !tmuxNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, ShellOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "tmux session names are made of letters, digits, '_' and '-'"),
+		})
+		return
+	}
+	if _, err := exec.LookPath("tmux"); err != nil {
+		c.JSON(http.StatusNotFound, ShellOperation{
+			Success: false,
+			Code:    ErrNotFound,
+			Message: Localize(c, "tmux is not installed"),
+		})
+		return
+	}
+
+	if err := createTmuxSession(req); err != nil {
+		status, code := errorStatus(err), errorCode(err)
+		if errors.Is(err, errTmuxSessionExists) {
+			status, code = http.StatusConflict, ErrExists
+		}
+		c.JSON(status, ShellOperation{
+			Success: false,
+			Code:    code,
+			Message: Localize(c, "Failed to create tmux session: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ShellOperation{
+		Success: true,
+		Message: Localize(c, "tmux session %s created", req.Name),
+		Data:    map[string]interface{}{"name": req.Name},
+	})
+}
+
+// Socket.IO Handlers
+
+// SpawnTmux spawns a terminal attached to an existing tmux session. Killing
+// the terminal only detaches it; the tmux session keeps running.
+func (sm *ShellModule) SpawnTmux(conn socketio.Conn, name string, policy DisconnectPolicy) EventResult {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "tmux is not installed"),
+		})
+	}
+	if !tmuxNamePattern.MatchString(name) || exec.Command("tmux", "has-session", "-t", "="+name).Run() != nil {
+		return sm.emitter.Fail(conn, "shell:error", map[string]interface{}{
+			"code":    ErrNotFound,
+			"message": localizeConn(conn, "tmux session %s not found", name),
+		})
+	}
+
+	profile := &ShellProfile{Command: "tmux", Args: []string{"attach-session", "-t", "=" + name}}
+	// tmux refuses to attach without a terminal type, which services lack
+	if os.Getenv("TERM") == "" {
+		profile.Env = map[string]string{"TERM": "xterm-256color"}
+	}
+	return sm.spawn(conn, profile, policy)
+}
+
+// Helper functions
+
+// tmuxSessions lists the sessions of the tmux server; no server running
+// means no sessions
+func tmuxSessions() ([]TmuxSession, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("tmux", "list-sessions", "-F", "#{session_name}\t#{session_windows}\t#{session_attached}\t#{session_created}\t#{session_activity}")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "no server running") || strings.Contains(message, "error connecting") {
+			return []TmuxSession{}, nil
+		}
+		return nil, fmt.Errorf("%v: %s", err, message)
+	}
+
+	sessions := []TmuxSession{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		windows, _ := strconv.Atoi(fields[1])
+		attached, _ := strconv.Atoi(fields[2])
+		created, _ := strconv.ParseInt(fields[3], 10, 64)
+		activity, _ := strconv.ParseInt(fields[4], 10, 64)
+		sessions = append(sessions, TmuxSession{
+			Name:     fields[0],
+			Windows:  windows,
+			Attached: attached,
+			Created:  time.Unix(created, 0),
+			Activity: time.Unix(activity, 0),
+		})
+	}
+	return sessions, nil
+}
+
+func createTmuxSession(req TmuxRequest) error {
+	if exec.Command("tmux", "has-session", "-t", "="+req.Name).Run() == nil {
+		return fmt.Errorf("%w: %s", errTmuxSessionExists, req.Name)
+	}
+
+	args := []string{"new-session", "-d", "-s", req.Name}
+	if req.Cwd != "" {
+		info, err := os.Stat(req.Cwd)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s: %w", req.Cwd, syscall.ENOTDIR)
+		}
+		args = append(args, "-c", req.Cwd)
+	}
+	if req.Command != "" {
+		args = append(args, req.Command)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("tmux", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package modules
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	socketio "github.com/googollee/go-socket.io"
+	"github.com/googollee/go-socket.io/parser"
+)
+
+const (
+	transferChunkSize = 64 * 1024
+	transferWindow    = 8 // unacknowledged chunks in flight during downloads
+)
+
+type FileTransfer struct {
+	ID        string
+	ClientID  string
+	Path      string
+	Direction string // "upload" or "download"
+	Size      int64
+	Bytes     int64
+	file      *os.File
+	writer    io.Writer // file wrapped by the quota checks and rate limits, for uploads
+	reader    io.Reader // file wrapped by the rate limits, for downloads
+	acks      chan int64
+	done      chan struct{}
+}
+
+// Socket.IO Handlers
+
+// StartUpload prepares a chunked binary upload to the given path
+func (fsm *FileSystemModule) StartUpload(conn socketio.Conn, path string, size, rateLimit int64) EventResult {
+	if path == "" {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "path is required"),
+		})
+	}
+	if err := fsm.paths.Resolve(&path); err != nil {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+			"path":    path,
+		})
+	}
+
+	token := ConnToken(conn)
+	if err := fsm.quotas.Check(token, path, size); err != nil {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+			"path":    path,
+		})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to create directory: %v", err),
+			"path":    path,
+		})
+	}
+
+	// Write to a partial file so an aborted upload never clobbers the target
+	file, err := os.Create(path + ".ccw-part")
+	if err != nil {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to create file: %v", err),
+			"path":    path,
+		})
+	}
+
+	transfer := &FileTransfer{
+		ID:        uuid.New().String(),
+		ClientID:  conn.ID(),
+		Path:      path,
+		Direction: "upload",
+		Size:      size,
+		file:      file,
+		writer:    fsm.throttle.Writer(rateLimit, fsm.quotas.Writer(token, path, file)),
+		done:      make(chan struct{}),
+	}
+
+	fsm.mutex.Lock()
+	fsm.transfers[transfer.ID] = transfer
+	fsm.mutex.Unlock()
+
+	return fsm.emitter.Reply(conn, "fs:transfer:ready", map[string]interface{}{
+		"transfer_id": transfer.ID,
+		"direction":   transfer.Direction,
+		"path":        path,
+		"size":        size,
+		"chunk_size":  transferChunkSize,
+	})
+}
+
+// ReceiveChunk appends a binary chunk to an upload in progress
+func (fsm *FileSystemModule) ReceiveChunk(conn socketio.Conn, transferID string, data parser.Buffer) {
+	transfer, _ := fsm.getTransfer(conn, transferID, "upload")
+	if transfer == nil {
+		return
+	}
+
+	n, err := transfer.writer.Write(data.Data)
+	if err != nil {
+		fsm.abortTransfer(transfer)
+		fsm.emitter.Emit(conn, "fs:transfer:error", map[string]interface{}{
+			"code":        errorCode(err),
+			"message":     localizeConn(conn, "Failed to write chunk: %v", err),
+			"transfer_id": transferID,
+		})
+		return
+	}
+	transfer.Bytes += int64(n)
+
+	fsm.emitter.Emit(conn, "fs:transfer:ack", map[string]interface{}{
+		"transfer_id": transferID,
+		"received":    transfer.Bytes,
+		"size":        transfer.Size,
+		"progress":    transferProgress(transfer),
+	})
+}
+
+// FinishUpload moves a completed upload into place
+func (fsm *FileSystemModule) FinishUpload(conn socketio.Conn, transferID string) EventResult {
+	transfer, result := fsm.getTransfer(conn, transferID, "upload")
+	if transfer == nil {
+		return result
+	}
+
+	fsm.mutex.Lock()
+	delete(fsm.transfers, transferID)
+	fsm.mutex.Unlock()
+
+	partPath := transfer.file.Name()
+	if err := transfer.file.Close(); err != nil {
+		os.Remove(partPath)
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":        errorCode(err),
+			"message":     localizeConn(conn, "Failed to close file: %v", err),
+			"transfer_id": transferID,
+		})
+	}
+
+	if transfer.Size > 0 && transfer.Bytes != transfer.Size {
+		os.Remove(partPath)
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":        ErrInvalidRequest,
+			"message":     localizeConn(conn, "Size mismatch: expected %d bytes, received %d", transfer.Size, transfer.Bytes),
+			"transfer_id": transferID,
+		})
+	}
+
+	if err := os.Rename(partPath, transfer.Path); err != nil {
+		os.Remove(partPath)
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":        errorCode(err),
+			"message":     localizeConn(conn, "Failed to finalize file: %v", err),
+			"transfer_id": transferID,
+		})
+	}
+
+	return fsm.emitter.Reply(conn, "fs:transfer:complete", map[string]interface{}{
+		"transfer_id": transferID,
+		"direction":   transfer.Direction,
+		"path":        transfer.Path,
+		"bytes":       transfer.Bytes,
+		"timestamp":   time.Now(),
+	})
+}
+
+// StartDownload streams a file to the client as binary chunks
+func (fsm *FileSystemModule) StartDownload(conn socketio.Conn, path string, rateLimit int64) EventResult {
+	if err := fsm.paths.Resolve(&path); err != nil {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "%v", err),
+			"path":    path,
+		})
+	}
+	if envFile(path) && !ConnToken(conn).HasScope(ScopeEnvReveal) {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    ErrPermission,
+			"message": localizeConn(conn, "Reading env files requires the env.reveal permission"),
+			"path":    path,
+		})
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Failed to open file: %v", err),
+			"path":    path,
+		})
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":    ErrInvalidRequest,
+			"message": localizeConn(conn, "Path is not a regular file"),
+			"path":    path,
+		})
+	}
+
+	transfer := &FileTransfer{
+		ID:        uuid.New().String(),
+		ClientID:  conn.ID(),
+		Path:      path,
+		Direction: "download",
+		Size:      info.Size(),
+		file:      file,
+		reader:    fsm.throttle.Reader(rateLimit, file),
+		acks:      make(chan int64, transferWindow),
+		done:      make(chan struct{}),
+	}
+
+	fsm.mutex.Lock()
+	fsm.transfers[transfer.ID] = transfer
+	fsm.mutex.Unlock()
+
+	result := fsm.emitter.Reply(conn, "fs:transfer:ready", map[string]interface{}{
+		"transfer_id": transfer.ID,
+		"direction":   transfer.Direction,
+		"path":        path,
+		"size":        transfer.Size,
+		"chunk_size":  transferChunkSize,
+	})
+
+	go fsm.runDownload(conn, transfer)
+	return result
+}
+
+// AckChunk records that the client received a download chunk
+func (fsm *FileSystemModule) AckChunk(conn socketio.Conn, transferID string, received int64) {
+	fsm.mutex.RLock()
+	transfer, exists := fsm.transfers[transferID]
+	fsm.mutex.RUnlock()
+
+	// Acks may trail the final chunk, so unknown transfers are ignored
+	if !exists || transfer.ClientID != conn.ID() || transfer.Direction != "download" {
+		return
+	}
+
+	select {
+	case transfer.acks <- received:
+	default:
+		// More acks than chunks in flight, nothing is waiting on them
+	}
+}
+
+// CancelTransfer aborts an upload or download in progress
+func (fsm *FileSystemModule) CancelTransfer(conn socketio.Conn, transferID string) EventResult {
+	transfer, result := fsm.getTransfer(conn, transferID, "")
+	if transfer == nil {
+		return result
+	}
+
+	fsm.abortTransfer(transfer)
+	return fsm.emitter.Reply(conn, "fs:transfer:cancelled", map[string]interface{}{
+		"transfer_id": transferID,
+		"timestamp":   time.Now(),
+	})
+}
+
+// Helper functions
+
+func (fsm *FileSystemModule) getTransfer(conn socketio.Conn, transferID, direction string) (*FileTransfer, EventResult) {
+	fsm.mutex.RLock()
+	transfer, exists := fsm.transfers[transferID]
+	fsm.mutex.RUnlock()
+
+	if !exists || (direction != "" && transfer.Direction != direction) {
+		return nil, fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":        ErrNotFound,
+			"message":     localizeConn(conn, "Transfer not found"),
+			"transfer_id": transferID,
+		})
+	}
+
+	// Verify client owns this transfer
+	if transfer.ClientID != conn.ID() {
+		return nil, fsm.emitter.Fail(conn, "fs:transfer:error", map[string]interface{}{
+			"code":        ErrPermission,
+			"message":     localizeConn(conn, "Access denied"),
+			"transfer_id": transferID,
+		})
+	}
+
+	return transfer, EventResult{Success: true}
+}
+
+// abortTransfer stops a transfer and discards partial uploads
+func (fsm *FileSystemModule) abortTransfer(transfer *FileTransfer) {
+	fsm.mutex.Lock()
+	_, exists := fsm.transfers[transfer.ID]
+	delete(fsm.transfers, transfer.ID)
+	fsm.mutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	close(transfer.done)
+	if transfer.Direction == "upload" {
+		transfer.file.Close()
+		os.Remove(transfer.file.Name())
+	}
+}
+
+func (fsm *FileSystemModule) runDownload(conn socketio.Conn, transfer *FileTransfer) {
+	defer transfer.file.Close()
+
+	buf := make([]byte, transferChunkSize)
+	inFlight := 0
+
+	for {
+		// Wait for the client to catch up once the window is full
+		for inFlight >= transferWindow {
+			select {
+			case <-transfer.done:
+				return
+			case <-transfer.acks:
+				inFlight--
+			}
+		}
+
+		n, err := transfer.reader.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+
+			if !fsm.emitter.Send(conn, "fs:transfer:chunk", map[string]interface{}{
+				"transfer_id": transfer.ID,
+				"offset":      transfer.Bytes,
+				"data":        &parser.Buffer{Data: chunk},
+			}) {
+				fsm.abortTransfer(transfer)
+				return
+			}
+
+			transfer.Bytes += int64(n)
+			inFlight++
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fsm.abortTransfer(transfer)
+			fsm.emitter.Emit(conn, "fs:transfer:error", map[string]interface{}{
+				"code":        errorCode(err),
+				"message":     localizeConn(conn, "Failed to read file: %v", err),
+				"transfer_id": transfer.ID,
+			})
+			return
+		}
+
+		select {
+		case <-transfer.done:
+			return
+		default:
+		}
+	}
+
+	fsm.mutex.Lock()
+	delete(fsm.transfers, transfer.ID)
+	fsm.mutex.Unlock()
+
+	fsm.emitter.Emit(conn, "fs:transfer:complete", map[string]interface{}{
+		"transfer_id": transfer.ID,
+		"direction":   transfer.Direction,
+		"path":        transfer.Path,
+		"bytes":       transfer.Bytes,
+		"timestamp":   time.Now(),
+	})
+}
+
+func transferProgress(transfer *FileTransfer) float64 {
+	if transfer.Size <= 0 {
+		return 0
+	}
+	return float64(transfer.Bytes) / float64(transfer.Size) * 100
+}
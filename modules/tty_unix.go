@@ -0,0 +1,46 @@
+//go:build !windows
+
+package modules
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// terminalEchoes reports whether the terminal of a pty echoes input; the
+// master reads the attributes of the terminal side
+func terminalEchoes(ptmx *os.File) (bool, error) {
+	raw, err := ptmx.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var termios syscall.Termios
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlReadTermios, uintptr(unsafe.Pointer(&termios)))
+	}); err != nil {
+		return false, err
+	}
+	if errno != 0 {
+		return false, errno
+	}
+	return termios.Lflag&syscall.ECHO != 0, nil
+}
+
+// foregroundProcessGroup returns the foreground process group of the
+// terminal of a pty, 0 when it can't be read
+func foregroundProcessGroup(ptmx *os.File) int {
+	raw, err := ptmx.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var pgrp int32
+	raw.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+		if errno != 0 {
+			pgrp = 0
+		}
+	})
+	return int(pgrp)
+}
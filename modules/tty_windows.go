@@ -0,0 +1,16 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+)
+
+// terminalEchoes fails, Windows has no pty to read the attributes of
+func terminalEchoes(ptmx *os.File) (bool, error) {
+	return false, fmt.Errorf("%w: reading terminal attributes", errUnsupported)
+}
+
+// foregroundProcessGroup is unknown without a pty
+func foregroundProcessGroup(ptmx *os.File) int {
+	return 0
+}
@@ -0,0 +1,311 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upnpServices are the WAN connection services managing port mappings, in
+// order of preference
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// upnpMapper manages port mappings through the WAN connection service of a
+// UPnP Internet Gateway Device
+type upnpMapper struct {
+	client      *http.Client
+	host        string
+	controlURL  string
+	serviceType string
+}
+
+// upnpError is a SOAP fault returned by the gateway
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// discoverUPnP finds the gateway by SSDP unless its description URL is
+// given, and its WAN connection service. The description URL comes from
+// any host of the LAN, so it's fetched through the outbound policy.
+func discoverUPnP(client *http.Client, location string) (*upnpMapper, error) {
+	if location == "" {
+		var err error
+		if location, err = ssdpSearch(2 * time.Second); err != nil {
+			return nil, err
+		}
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s responded %s", errUpstream, location, resp.Status)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("%w: invalid device description: %v", errUpstream, err)
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, fmt.Errorf("%w: invalid URLBase: %v", errUpstream, err)
+		}
+	}
+
+	for _, serviceType := range upnpServices {
+		if service := findUPnPService(root.Device, serviceType); service != nil {
+			control, err := base.Parse(service.ControlURL)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid control URL: %v", errUpstream, err)
+			}
+			return &upnpMapper{
+				client:      client,
+				host:        control.Hostname(),
+				controlURL:  control.String(),
+				serviceType: serviceType,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no WAN connection service", location)
+}
+
+func (u *upnpMapper) name() string {
+	return "upnp"
+}
+
+func (u *upnpMapper) gateway() string {
+	return u.host
+}
+
+func (u *upnpMapper) externalIP() (string, error) {
+	values, err := u.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return "", err
+	}
+	return values["NewExternalIPAddress"], nil
+}
+
+// mappings reads the mapping table entry by entry, until the gateway
+// answers the index is out of range
+func (u *upnpMapper) mappings() ([]PortMapping, error) {
+	mappings := []PortMapping{}
+	for i := 0; i < 1024; i++ {
+		values, err := u.call("GetGenericPortMappingEntry", [][2]string{{"NewPortMappingIndex", strconv.Itoa(i)}})
+		var upnpErr *upnpError
+		if errors.As(err, &upnpErr) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		externalPort, _ := strconv.Atoi(values["NewExternalPort"])
+		internalPort, _ := strconv.Atoi(values["NewInternalPort"])
+		lease, _ := strconv.Atoi(values["NewLeaseDuration"])
+		mappings = append(mappings, PortMapping{
+			Protocol:       strings.ToLower(values["NewProtocol"]),
+			ExternalPort:   externalPort,
+			InternalClient: values["NewInternalClient"],
+			InternalPort:   internalPort,
+			RemoteHost:     values["NewRemoteHost"],
+			Description:    values["NewPortMappingDescription"],
+			Enabled:        values["NewEnabled"] == "1",
+			Lease:          lease,
+		})
+	}
+	return mappings, nil
+}
+
+func (u *upnpMapper) add(mapping PortMapping) (PortMapping, error) {
+	_, err := u.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(mapping.ExternalPort)},
+		{"NewProtocol", strings.ToUpper(mapping.Protocol)},
+		{"NewInternalPort", strconv.Itoa(mapping.InternalPort)},
+		{"NewInternalClient", mapping.InternalClient},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", mapping.Description},
+		{"NewLeaseDuration", strconv.Itoa(mapping.Lease)},
+	})
+	return mapping, err
+}
+
+func (u *upnpMapper) remove(protocol string, externalPort int) error {
+	_, err := u.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+	})
+	return err
+}
+
+// Helper functions
+
+// call invokes an action of the WAN connection service, returning the
+// values of the response by element name
+func (u *upnpMapper) call(action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	values, err := soapValues(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid SOAP response: %v", errUpstream, err)
+	}
+	if code, ok := values["errorCode"]; ok {
+		upnpErr := &upnpError{Description: values["errorDescription"]}
+		upnpErr.Code, _ = strconv.Atoi(code)
+		switch upnpErr.Code {
+		case 714: // NoSuchEntryInArray
+			return nil, fmt.Errorf("%w: %w", errMappingNotFound, upnpErr)
+		case 718: // ConflictInMappingEntry
+			return nil, fmt.Errorf("%w: %w", errMappingConflict, upnpErr)
+		}
+		return nil, fmt.Errorf("%w: %w", errUpstream, upnpErr)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: gateway responded %s", errUpstream, resp.Status)
+	}
+	return values, nil
+}
+
+// soapValues collects the text of the leaf elements of a SOAP message
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+	var name string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+func findUPnPService(device upnpDevice, serviceType string) *upnpService {
+	for i := range device.Services {
+		if device.Services[i].ServiceType == serviceType {
+			return &device.Services[i]
+		}
+	}
+	for _, child := range device.Devices {
+		if service := findUPnPService(child, serviceType); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+// ssdpSearch multicasts an M-SEARCH for Internet Gateway Devices, returning
+// the description URL of the first one answering
+func ssdpSearch(timeout time.Duration) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	for _, target := range []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	} {
+		search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: " + target + "\r\n\r\n"
+		if _, err := conn.WriteTo([]byte(search), group); err != nil {
+			return "", err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", errors.New("no Internet Gateway Device answered")
+		}
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); resp.StatusCode == http.StatusOK && location != "" {
+			return location, nil
+		}
+	}
+}
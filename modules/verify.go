@@ -0,0 +1,248 @@
+package modules
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// maxSignatureSize bounds the detached signatures fetched for downloads
+const maxSignatureSize = 1 << 20
+
+// checksumAlgorithms are the digests accepted in download checksums
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksum is the expected digest of downloaded content
+type checksum struct {
+	algorithm string
+	expected  string
+}
+
+// Verification is the outcome of checking a download against its expected
+// checksums and signature
+type Verification struct {
+	Verified  bool             `json:"verified"`
+	Checksums []ChecksumResult `json:"checksums,omitempty"`
+	Signature *SignatureResult `json:"signature,omitempty"`
+}
+
+type ChecksumResult struct {
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+	Valid     bool   `json:"valid"`
+}
+
+type SignatureResult struct {
+	Valid  bool   `json:"valid"`
+	KeyID  string `json:"key_id,omitempty"`
+	Signer string `json:"signer,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// VerificationError reports downloaded content failing its verification
+type VerificationError struct {
+	Verification *Verification
+	err          error
+}
+
+func (e *VerificationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.err
+}
+
+// downloadVerifier checks downloads against the expected checksums and a
+// detached OpenPGP signature. A nil verifier accepts any content.
+type downloadVerifier struct {
+	checksums []*checksum
+	signature []byte
+	keyring   openpgp.EntityList
+}
+
+// Helper functions
+
+// parseChecksum parses "<algorithm>:<hex>", defaulting to sha256 when the
+// algorithm is omitted
+func parseChecksum(value string) (*checksum, error) {
+	if value == "" {
+		return nil, nil
+	}
+	algorithm, digest, found := strings.Cut(value, ":")
+	if !found {
+		algorithm, digest = "sha256", value
+	}
+	algorithm = strings.ToLower(algorithm)
+
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	decoded, err := hex.DecodeString(digest)
+	if err != nil || len(decoded) != newHash().Size() {
+		return nil, fmt.Errorf("checksum is not a valid %s digest", algorithm)
+	}
+	return &checksum{algorithm: algorithm, expected: hex.EncodeToString(decoded)}, nil
+}
+
+// parseChecksums collects the checksums of a download request
+func parseChecksums(req DownloadRequest) ([]*checksum, error) {
+	values := []string{req.Checksum}
+	if req.SHA256 != "" {
+		values = append(values, "sha256:"+req.SHA256)
+	}
+	if req.MD5 != "" {
+		values = append(values, "md5:"+req.MD5)
+	}
+
+	var checksums []*checksum
+	for _, value := range values {
+		sum, err := parseChecksum(value)
+		if err != nil {
+			return nil, err
+		}
+		if sum != nil {
+			checksums = append(checksums, sum)
+		}
+	}
+	return checksums, nil
+}
+
+// loadSignature reads the keyring and fetches the detached signature of a
+// download request, if it has one
+func loadSignature(client *http.Client, req DownloadRequest) ([]byte, openpgp.EntityList, error) {
+	if req.SignatureURL == "" {
+		return nil, nil, nil
+	}
+
+	var keyring openpgp.EntityList
+	switch {
+	case req.PublicKey != "":
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(req.PublicKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid public_key: %v", errInvalidRequest, err)
+		}
+		keyring = entities
+	case req.Keyring != "":
+		content, err := os.ReadFile(req.Keyring)
+		if err != nil {
+			return nil, nil, err
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+		if err != nil {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid keyring %s: %v", errInvalidRequest, req.Keyring, err)
+		}
+		keyring = entities
+	}
+
+	resp, err := client.Get(req.SignatureURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: HTTP error: %s", errUpstream, resp.Status)
+	}
+	signature, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	return signature, keyring, nil
+}
+
+// verify reads the size bytes of file once, checking them against every
+// checksum and the signature
+func (v *downloadVerifier) verify(file *os.File, size int64) (*Verification, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	digests := make([]hash.Hash, len(v.checksums))
+	writers := make([]io.Writer, len(v.checksums))
+	for i, sum := range v.checksums {
+		digests[i] = checksumAlgorithms[sum.algorithm]()
+		writers[i] = digests[i]
+	}
+	content := io.TeeReader(io.NewSectionReader(file, 0, size), io.MultiWriter(writers...))
+
+	verification := &Verification{Verified: true}
+	var failure error
+	if v.signature != nil {
+		result := checkSignature(v.keyring, content, v.signature)
+		verification.Signature = result
+		if !result.Valid {
+			failure = fmt.Errorf("%w: %s", errSignatureInvalid, result.Error)
+		}
+	}
+	// The signature check may stop early on a bad signature
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		return nil, err
+	}
+
+	for i, sum := range v.checksums {
+		actual := hex.EncodeToString(digests[i].Sum(nil))
+		valid := actual == sum.expected
+		verification.Checksums = append(verification.Checksums, ChecksumResult{
+			Algorithm: sum.algorithm,
+			Expected:  sum.expected,
+			Actual:    actual,
+			Valid:     valid,
+		})
+		if !valid && failure == nil {
+			failure = fmt.Errorf("%w: expected %s %s, got %s", errChecksumMismatch, sum.algorithm, sum.expected, actual)
+		}
+	}
+
+	if failure != nil {
+		verification.Verified = false
+		return verification, &VerificationError{Verification: verification, err: failure}
+	}
+	return verification, nil
+}
+
+// checkSignature verifies an armored or binary detached signature of content
+func checkSignature(keyring openpgp.EntityList, content io.Reader, signature []byte) *SignatureResult {
+	var signatureReader io.Reader = bytes.NewReader(signature)
+	if block, err := armor.Decode(bytes.NewReader(signature)); err == nil {
+		signatureReader = block.Body
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(keyring, content, signatureReader)
+	if err != nil {
+		return &SignatureResult{Valid: false, Error: err.Error()}
+	}
+
+	result := &SignatureResult{Valid: true, KeyID: signer.PrimaryKey.KeyIdString()}
+	var identities []string
+	for name := range signer.Identities {
+		identities = append(identities, name)
+	}
+	if len(identities) > 0 {
+		sort.Strings(identities)
+		result.Signer = identities[0]
+	}
+	return result
+}
@@ -0,0 +1,256 @@
+package modules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errWalkLimit marks recursive operations stopped by the walk limits
+var errWalkLimit = errors.New("walk limit exceeded")
+
+// networkFilesystems are the filesystem types served over the network,
+// which can block walks for minutes when the server doesn't answer
+var networkFilesystems = map[string]bool{
+	"nfs": true, "nfs4": true, "cifs": true, "smb3": true, "smbfs": true,
+	"ncpfs": true, "afs": true, "ceph": true, "glusterfs": true, "9p": true,
+	"lustre": true, "gpfs": true, "davfs": true, "fuse.sshfs": true,
+	"fuse.glusterfs": true, "fuse.s3fs": true, "fuse.rclone": true,
+	"fuse.gcsfuse": true, "fuse.davfs2": true,
+}
+
+// WalkOptions limits recursive walks at the filesystems mounted below the
+// walked directory
+type WalkOptions struct {
+	OneFileSystem bool `json:"one_file_system"` // don't descend into other mounts, bind mounts included
+	SkipNetwork   bool `json:"skip_network"`    // don't descend into network filesystems
+}
+
+// walkLimits caps a recursive walk by WALK_MAX_DEPTH, WALK_MAX_ENTRIES and
+// WALK_MAX_DURATION, so one request can't traverse a whole filesystem
+type walkLimits struct {
+	maxDepth   int
+	maxEntries int
+	maxTime    time.Duration
+	deadline   time.Time
+	entries    int
+}
+
+// walkLimitError reports the limit a walk exceeded
+type walkLimitError struct {
+	Limit string `json:"limit"` // depth, entries or duration
+	Max   int64  `json:"max"`   // levels, entries or seconds
+	Path  string `json:"path"`  // where the walk stopped
+}
+
+func (e *walkLimitError) Error() string {
+	switch e.Limit {
+	case "depth":
+		return fmt.Sprintf("%v: deeper than %d levels at %s", errWalkLimit, e.Max, e.Path)
+	case "entries":
+		return fmt.Sprintf("%v: more than %d entries at %s", errWalkLimit, e.Max, e.Path)
+	}
+	return fmt.Sprintf("%v: longer than %d seconds at %s", errWalkLimit, e.Max, e.Path)
+}
+
+func (e *walkLimitError) Unwrap() error {
+	return errWalkLimit
+}
+
+// newWalkLimits starts the limits of a walk, its duration counting from now
+func newWalkLimits(config *Config) *walkLimits {
+	l := &walkLimits{
+		maxDepth:   config.WalkMaxDepth,
+		maxEntries: config.WalkMaxEntries,
+		maxTime:    config.WalkMaxDuration,
+	}
+	if l.maxTime > 0 {
+		l.deadline = time.Now().Add(l.maxTime)
+	}
+	return l
+}
+
+// walk walks root like filepath.WalkDir, failing with a *walkLimitError
+// once the walk goes past the limits. Entries are counted across walks
+// sharing the limits; nil limits walk the whole tree.
+func (l *walkLimits) walk(root string, fn fs.WalkDirFunc) error {
+	if l == nil {
+		return filepath.WalkDir(root, fn)
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err := l.check(root, path); err != nil {
+			return err
+		}
+		return fn(path, d, err)
+	})
+}
+
+// check counts an entry of a walk of root against the limits
+func (l *walkLimits) check(root, path string) error {
+	l.entries++
+	if l.maxEntries > 0 && l.entries > l.maxEntries {
+		return &walkLimitError{Limit: "entries", Max: int64(l.maxEntries), Path: path}
+	}
+	if l.maxDepth > 0 && path != root {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && strings.Count(rel, string(filepath.Separator))+1 > l.maxDepth {
+			return &walkLimitError{Limit: "depth", Max: int64(l.maxDepth), Path: path}
+		}
+	}
+	if !l.deadline.IsZero() && time.Now().After(l.deadline) {
+		return &walkLimitError{Limit: "duration", Max: int64(l.maxTime / time.Second), Path: path}
+	}
+	return nil
+}
+
+// MountEntry is a filesystem mounted on the host
+type MountEntry struct {
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	Type    string `json:"type"`
+	Options string `json:"options"`
+	Network bool   `json:"network"` // served over the network
+}
+
+// walkBoundary tells which directories of a walk are mount points it must
+// not descend into. Mount points are found in the mount table rather than by
+// stat, which hangs on unresponsive network mounts.
+type walkBoundary struct {
+	root    string
+	options WalkOptions
+	mounts  map[string]string // fstype of the mount points below root, by relative path
+	device  uint64            // of root, compared when the mount table can't be read
+}
+
+// newWalkBoundary returns the boundary of a walk of root, nil when the
+// options don't limit it
+func newWalkBoundary(root string, options WalkOptions) *walkBoundary {
+	if !options.OneFileSystem && !options.SkipNetwork {
+		return nil
+	}
+
+	b := &walkBoundary{root: root, options: options}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		resolved, err = filepath.Abs(resolved)
+	}
+	mounts, mountsErr := readMountTable()
+	if err != nil || mountsErr != nil {
+		if info, err := os.Stat(root); err == nil {
+			b.device = fileDevice(info)
+		}
+		return b
+	}
+
+	prefix := resolved
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	b.mounts = make(map[string]string)
+	for _, mount := range mounts {
+		if rel, ok := strings.CutPrefix(mount.Target, prefix); ok && rel != "" {
+			b.mounts[rel] = mount.Type // later mounts hide earlier ones
+		}
+	}
+	return b
+}
+
+// excludes reports whether the walk must skip the directory at path, below
+// the root of the walk
+func (b *walkBoundary) excludes(path string, d fs.DirEntry) bool {
+	if b == nil || !d.IsDir() {
+		return false
+	}
+	rel, err := filepath.Rel(b.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+
+	if b.mounts == nil {
+		if !b.options.OneFileSystem || b.device == 0 {
+			return false
+		}
+		info, err := d.Info()
+		return err == nil && fileDevice(info) != b.device
+	}
+
+	fsType, mounted := b.mounts[rel]
+	if !mounted {
+		return false
+	}
+	return b.options.OneFileSystem || b.options.SkipNetwork && networkFilesystems[fsType]
+}
+
+// Helper functions
+
+// walkOptionsQuery reads the walk options from the one_file_system and
+// skip_network query parameters
+func walkOptionsQuery(c *gin.Context) WalkOptions {
+	return WalkOptions{
+		OneFileSystem: c.Query("one_file_system") == "true",
+		SkipNetwork:   c.Query("skip_network") == "true",
+	}
+}
+
+// readMountTable reads the filesystems mounted on the host from
+// /proc/self/mountinfo, in mount order
+func readMountTable() ([]MountEntry, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []MountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// id parent major:minor root point options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 6 || separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, MountEntry{
+			Source:  unescapeMountField(fields[separator+2]),
+			Target:  unescapeMountField(fields[4]),
+			Type:    fields[separator+1],
+			Options: fields[5],
+			Network: networkFilesystems[fields[separator+1]],
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountField decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in the mount table
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if code, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,187 @@
+package modules
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// watchKey identifies a shared watch: clients watching a path with the same
+// walk options share one stream
+type watchKey struct {
+	path    string
+	options WalkOptions
+}
+
+// sharedWatch is a watch stream fanned out to the clients watching its
+// path, counted by its subscribers and closed when the last one leaves
+type sharedWatch struct {
+	key         watchKey
+	stream      *watchStream
+	started     time.Time
+	subscribers map[string]*watchSubscriber // by client ID
+	mutex       sync.Mutex
+}
+
+// watchSubscriber is a client of a shared watch
+type watchSubscriber struct {
+	conn      socketio.Conn
+	checksums watchChecksums // nil unless in checksum mode
+	since     time.Time
+}
+
+// WatchInfo describes an active watch and the clients sharing it
+type WatchInfo struct {
+	Path string `json:"path"`
+	WalkOptions
+	Mode    string        `json:"mode"` // inotify or polling
+	Started time.Time     `json:"started"`
+	Clients []WatchClient `json:"clients"`
+}
+
+// WatchClient is a client of an active watch
+type WatchClient struct {
+	ID       string    `json:"id"`
+	Checksum bool      `json:"checksum"`
+	Since    time.Time `json:"since"`
+}
+
+// REST API Handlers
+
+// ListWatches lists the active watches, one per path and walk options, with
+// the clients sharing each
+func (fsm *FileSystemModule) ListWatches(c *gin.Context) {
+	fsm.mutex.RLock()
+	watches := make([]WatchInfo, 0, len(fsm.watches))
+	for _, watch := range fsm.watches {
+		watches = append(watches, watch.info())
+	}
+	fsm.mutex.RUnlock()
+
+	sort.Slice(watches, func(i, j int) bool {
+		if watches[i].Path != watches[j].Path {
+			return watches[i].Path < watches[j].Path
+		}
+		return watches[i].Started.Before(watches[j].Started)
+	})
+
+	page, total, next, err := paginate(c, watches)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, FileOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileOperation{
+		Success:    true,
+		Message:    Localize(c, "Watches retrieved"),
+		Data:       page,
+		Total:      &total,
+		NextCursor: next,
+	})
+}
+
+// Helper functions
+
+// subscribeWatch adds a client to the watch of a key, starting it if it's
+// the first. The caller holds the module mutex.
+func (fsm *FileSystemModule) subscribeWatch(conn socketio.Conn, key watchKey, checksum bool) (*sharedWatch, error) {
+	watch, exists := fsm.watches[key]
+	if !exists {
+		stream, err := newWatchStream(key.path, key.options, fsm.config)
+		if err != nil {
+			return nil, err
+		}
+		watch = &sharedWatch{
+			key:         key,
+			stream:      stream,
+			started:     time.Now(),
+			subscribers: make(map[string]*watchSubscriber),
+		}
+		fsm.watches[key] = watch
+		go watch.run(fsm.emitter)
+	}
+
+	subscriber := &watchSubscriber{conn: conn, since: time.Now()}
+	if checksum {
+		subscriber.checksums = make(watchChecksums)
+		subscriber.checksums.seed(key.path, watch.stream.boundary, newWalkLimits(fsm.config))
+	}
+	watch.mutex.Lock()
+	watch.subscribers[conn.ID()] = subscriber
+	watch.mutex.Unlock()
+	return watch, nil
+}
+
+// unsubscribeWatch removes a client from the watch of a key, closing it once
+// it has no clients left. The caller holds the module mutex.
+func (fsm *FileSystemModule) unsubscribeWatch(key watchKey, clientID string) {
+	watch, exists := fsm.watches[key]
+	if !exists {
+		return
+	}
+
+	watch.mutex.Lock()
+	delete(watch.subscribers, clientID)
+	idle := len(watch.subscribers) == 0
+	watch.mutex.Unlock()
+
+	if idle {
+		watch.stream.Close()
+		delete(fsm.watches, key)
+	}
+}
+
+// run sends the events and errors of the stream to every subscriber until
+// the stream is closed
+func (sw *sharedWatch) run(emitter *Emitter) {
+	for {
+		select {
+		case event, ok := <-sw.stream.Events:
+			if !ok {
+				return
+			}
+			sw.mutex.Lock()
+			for _, subscriber := range sw.subscribers {
+				event := event
+				if subscriber.checksums != nil && !subscriber.checksums.changed(&event) {
+					continue
+				}
+				emitter.Emit(subscriber.conn, "fs:change", event)
+			}
+			sw.mutex.Unlock()
+
+		case err := <-sw.stream.Errors:
+			sw.mutex.Lock()
+			for _, subscriber := range sw.subscribers {
+				emitter.Emit(subscriber.conn, "fs:error", watchErrorPayload(subscriber.conn, sw.key.path, err))
+			}
+			sw.mutex.Unlock()
+		}
+	}
+}
+
+func (sw *sharedWatch) info() WatchInfo {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	info := WatchInfo{
+		Path:        sw.key.path,
+		WalkOptions: sw.key.options,
+		Mode:        sw.stream.Mode(),
+		Started:     sw.started,
+		Clients:     make([]WatchClient, 0, len(sw.subscribers)),
+	}
+	for id, subscriber := range sw.subscribers {
+		info.Clients = append(info.Clients, WatchClient{ID: id, Checksum: subscriber.checksums != nil, Since: subscriber.since})
+	}
+	sort.Slice(info.Clients, func(i, j int) bool { return info.Clients[i].Since.Before(info.Clients[j].Since) })
+	return info
+}
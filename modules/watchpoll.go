@@ -0,0 +1,216 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// errWatchLimit marks watches that exhausted the inotify limits of the user
+var errWatchLimit = errors.New("inotify limit reached")
+
+// watchLimitError reports the inotify limits a watch ran into, after which
+// it polls the tree instead
+type watchLimitError struct {
+	MaxUserWatches   int `json:"max_user_watches"`
+	MaxUserInstances int `json:"max_user_instances"`
+	err              error
+}
+
+// pollEntry is the state of a file in a snapshot of a polled tree
+type pollEntry struct {
+	treeEntry
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+func (e *watchLimitError) Error() string {
+	return fmt.Sprintf("%v: %v (fs.inotify.max_user_watches=%d, fs.inotify.max_user_instances=%d)", errWatchLimit, e.err, e.MaxUserWatches, e.MaxUserInstances)
+}
+
+func (e *watchLimitError) Unwrap() []error {
+	return []error{errWatchLimit, e.err}
+}
+
+// Helper functions
+
+// watchLimit returns the limit error matching err, or nil when err isn't
+// caused by the inotify limits: ENOSPC when adding more watches than
+// max_user_watches, EMFILE when creating more than max_user_instances
+func watchLimit(err error) *watchLimitError {
+	if !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EMFILE) {
+		return nil
+	}
+	return &watchLimitError{
+		MaxUserWatches:   readProcInt("/proc/sys/fs/inotify/max_user_watches"),
+		MaxUserInstances: readProcInt("/proc/sys/fs/inotify/max_user_instances"),
+		err:              err,
+	}
+}
+
+// watchErrorPayload builds the fs:error event of a watcher error, with the
+// limits and the polling fallback when inotify ran out of watches
+func watchErrorPayload(conn socketio.Conn, path string, err error) map[string]interface{} {
+	var limitErr *watchLimitError
+	if !errors.As(err, &limitErr) {
+		return map[string]interface{}{
+			"code":    errorCode(err),
+			"message": localizeConn(conn, "Watcher error: %v", err),
+			"path":    path,
+		}
+	}
+	return map[string]interface{}{
+		"code":     ErrWatchLimit,
+		"message":  localizeConn(conn, "inotify limits reached, polling the directory instead: %v", err),
+		"path":     path,
+		"limits":   limitErr,
+		"fallback": "polling",
+	}
+}
+
+// poll reports the changes of the tree by comparing snapshots taken every
+// poll interval, until the stream is closed
+func (ws *watchStream) poll() {
+	previous := snapshotTree(ws.root, ws.boundary)
+	if ws.limit != nil {
+		// Files created since inotify stopped are reported by the first poll
+		for path := range previous {
+			if _, known := ws.inodes[path]; !known {
+				delete(previous, path)
+			}
+		}
+	}
+	ticker := time.NewTicker(ws.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+		}
+
+		current := snapshotTree(ws.root, ws.boundary)
+		for _, event := range diffSnapshots(previous, current, time.Now()) {
+			ws.Events <- event
+		}
+		previous = current
+	}
+}
+
+// snapshotTree records every file of a tree within its boundary;
+// unreadable parts are skipped and a missing root is an empty tree
+func snapshotTree(root string, boundary *walkBoundary) map[string]pollEntry {
+	snapshot := make(map[string]pollEntry)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if boundary.excludes(path, d) {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		snapshot[path] = pollEntry{
+			treeEntry: newTreeEntry(info),
+			size:      info.Size(),
+			modTime:   info.ModTime(),
+			mode:      info.Mode(),
+		}
+		return nil
+	})
+	return snapshot
+}
+
+// diffSnapshots returns the events turning one snapshot into the next.
+// Files that changed path but kept their inode and mtime were renamed, and
+// the files below a renamed directory moved along with it.
+func diffSnapshots(previous, current map[string]pollEntry, now time.Time) []WatchEvent {
+	gone := make(map[uint64]string)
+	for path, entry := range previous {
+		if _, exists := current[path]; !exists && entry.inode != 0 {
+			gone[entry.inode] = path
+		}
+	}
+
+	paths := make([]string, 0, len(current))
+	for path := range current {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var events []WatchEvent
+	moved := make(map[string]bool)         // old paths of renamed files
+	renamedDirs := make(map[string]string) // old paths of renamed directories, by new path
+	for _, path := range paths {
+		entry := current[path]
+		old, existed := previous[path]
+		switch {
+		case !existed:
+			from, found := gone[entry.inode]
+			if found && previous[from].dir == entry.dir && previous[from].modTime.Equal(entry.modTime) {
+				moved[from] = true
+				if movedWithParent(path, from, renamedDirs) {
+					continue
+				}
+				if entry.dir {
+					renamedDirs[path] = from
+				}
+				events = append(events, WatchEvent{Path: path, Operation: "renamed", From: from, To: path, Timestamp: now})
+				continue
+			}
+			events = append(events, WatchEvent{Path: path, Operation: "CREATE", Timestamp: now})
+		case !entry.dir && (entry.size != old.size || !entry.modTime.Equal(old.modTime)):
+			events = append(events, WatchEvent{Path: path, Operation: "WRITE", Timestamp: now})
+		case entry.mode != old.mode:
+			events = append(events, WatchEvent{Path: path, Operation: "CHMOD", Timestamp: now})
+		}
+	}
+
+	removed := make([]string, 0)
+	for path := range previous {
+		if _, exists := current[path]; !exists && !moved[path] {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		events = append(events, WatchEvent{Path: path, Operation: "REMOVE", Timestamp: now})
+	}
+	return events
+}
+
+// movedWithParent reports whether a file renamed from one path to another
+// kept its place below a renamed directory
+func movedWithParent(path, from string, renamedDirs map[string]string) bool {
+	for to, dirFrom := range renamedDirs {
+		if rel, ok := strings.CutPrefix(path, to+string(filepath.Separator)); ok && from == filepath.Join(dirFrom, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func readProcInt(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return value
+}
@@ -0,0 +1,413 @@
+package modules
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchChecksumMaxSize is the size of the largest files hashed in checksum
+// mode, larger ones are always reported
+const watchChecksumMaxSize = 64 << 20
+
+// renameWindow is how long the old name of a rename waits for the new one
+// before it's reported as a plain RENAME, e.g. moved out of the tree
+const renameWindow = 100 * time.Millisecond
+
+// WatchEvent is a change of a watched tree, as sent in fs:change events
+type WatchEvent struct {
+	Path      string    `json:"path"`
+	Operation string    `json:"operation"`
+	From      string    `json:"from,omitempty"` // old path of a renamed file
+	To        string    `json:"to,omitempty"`   // new path of a renamed file
+	Hash      string    `json:"hash,omitempty"` // sha256 of the new content, in checksum mode
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// watchChecksums holds the hash of the files of a tree in checksum mode, as
+// seen at their last reported change
+type watchChecksums map[string]string
+
+// watchStream watches a tree and turns the raw events of fsnotify into
+// watch events. inotify reports a rename as the RENAME of the old name and
+// the CREATE of the new one, which are paired by inode into a single
+// "renamed" event so file trees can move nodes instead of re-adding them.
+// When the inotify limits are reached the tree is polled instead.
+type watchStream struct {
+	watcher  *fsnotify.Watcher
+	Events   chan WatchEvent      // closed once the watcher is closed
+	Errors   chan error           // never closed, read until Events is closed
+	Fallback *watchLimitError     // set when the tree is polled from the start
+	inodes   map[string]treeEntry // every path in the tree
+	queue    []queuedEvent        // held back while a rename waits for its new name
+	moved    map[string]string    // new paths of renamed directories, by old path
+	limit    *watchLimitError     // reached while watching, switching to polling
+
+	root         string
+	boundary     *walkBoundary
+	pollInterval time.Duration
+	done         chan struct{}
+	closeOnce    sync.Once
+	polling      atomic.Bool // set once the tree is polled
+}
+
+// treeEntry identifies a file of a watched tree across renames
+type treeEntry struct {
+	inode uint64
+	dir   bool
+}
+
+// queuedEvent is an event held back to keep events in order
+type queuedEvent struct {
+	event   WatchEvent
+	inode   uint64               // of a rename waiting for its new name, 0 once resolved
+	entries map[string]treeEntry // below a renamed directory, by relative path
+	unwatch bool                 // fsnotify dropped the watches of the renamed directory
+}
+
+// newWatchStream watches path and every directory below it within the walk
+// options and limits, or polls it every WATCH_POLL_INTERVAL when that would
+// exceed the inotify limits
+func newWatchStream(path string, options WalkOptions, config *Config) (*watchStream, error) {
+	ws := &watchStream{
+		Events:       make(chan WatchEvent, 64),
+		Errors:       make(chan error, 8),
+		inodes:       make(map[string]treeEntry),
+		moved:        make(map[string]string),
+		root:         path,
+		boundary:     newWalkBoundary(path, options),
+		pollInterval: max(config.WatchPollInterval, time.Second),
+		done:         make(chan struct{}),
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		ws.watcher = watcher
+		err = ws.add(path, newWalkLimits(config))
+	}
+	if err != nil {
+		if ws.watcher != nil {
+			ws.watcher.Close()
+			ws.watcher = nil
+		}
+		if ws.Fallback = watchLimit(err); ws.Fallback == nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+
+	go ws.run()
+	return ws, nil
+}
+
+// Close stops watching; Events is closed once the last events are sent
+func (ws *watchStream) Close() error {
+	ws.closeOnce.Do(func() { close(ws.done) })
+	if ws.watcher != nil {
+		return ws.watcher.Close()
+	}
+	return nil
+}
+
+// Mode returns how the tree is watched, "inotify" or "polling"
+func (ws *watchStream) Mode() string {
+	if ws.Fallback != nil || ws.polling.Load() {
+		return "polling"
+	}
+	return "inotify"
+}
+
+// Helper functions
+
+func (ws *watchStream) run() {
+	defer close(ws.Events)
+
+	if ws.watcher != nil && !ws.notify() {
+		return
+	}
+	ws.polling.Store(true)
+	ws.poll()
+}
+
+// notify turns the events of fsnotify into watch events until the watcher
+// is closed, or until the inotify limits are reached while adding the
+// directories created in the tree; it then reports the limits and returns
+// true to poll the tree instead
+func (ws *watchStream) notify() bool {
+	timer := time.NewTimer(renameWindow)
+	timer.Stop()
+	errors := ws.watcher.Errors
+	for {
+		select {
+		case event, ok := <-ws.watcher.Events:
+			if !ok {
+				ws.expire(time.Time{})
+				return false
+			}
+			ws.handle(event)
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			select {
+			case ws.Errors <- err:
+			default:
+			}
+		case <-timer.C:
+			ws.expire(time.Now().Add(-renameWindow))
+		}
+
+		if ws.limit != nil {
+			ws.expire(time.Time{})
+			ws.watcher.Close()
+			select {
+			case ws.Errors <- ws.limit:
+			default:
+			}
+			return true
+		}
+
+		if len(ws.queue) > 0 {
+			timer.Reset(time.Until(ws.queue[0].event.Timestamp.Add(renameWindow)))
+		}
+	}
+}
+
+// handle queues the event of a change, tracking the inodes of the tree
+func (ws *watchStream) handle(event fsnotify.Event) {
+	now := time.Now()
+	name := event.Name
+
+	switch {
+	case event.Has(fsnotify.Rename):
+		// A renamed directory also reports its own move, before or after
+		// its new name, when fsnotify drops its watches; they are set up
+		// again under the new path
+		if to, moved := ws.moved[name]; moved {
+			delete(ws.moved, name)
+			ws.rewatch(name, to)
+			return
+		}
+		if rename := ws.pending(name); rename != nil {
+			rename.unwatch = true
+			return
+		}
+		if entry, known := ws.inodes[name]; known && entry.inode != 0 {
+			ws.queue = append(ws.queue, queuedEvent{
+				event:   WatchEvent{Path: name, Operation: event.Op.String(), Timestamp: now},
+				inode:   entry.inode,
+				entries: ws.forget(name),
+			})
+			return
+		}
+
+	case event.Has(fsnotify.Create):
+		info, err := os.Lstat(name)
+		if err != nil {
+			break
+		}
+		entry := newTreeEntry(info)
+		for i := range ws.queue {
+			rename := &ws.queue[i]
+			if entry.inode == 0 || rename.inode != entry.inode {
+				continue
+			}
+			ws.inodes[name] = entry
+			for rel, child := range rename.entries {
+				ws.inodes[filepath.Join(name, rel)] = child
+			}
+			from := rename.event.Path
+			if rename.unwatch {
+				ws.rewatch(from, name)
+			} else if entry.dir {
+				ws.moved[from] = name
+			}
+			rename.event = WatchEvent{Path: name, Operation: "renamed", From: from, To: name, Timestamp: rename.event.Timestamp}
+			rename.inode, rename.entries = 0, nil
+			ws.flush()
+			return
+		}
+		if entry.dir {
+			ws.watch(name)
+		}
+		ws.inodes[name] = entry
+
+	case event.Has(fsnotify.Remove):
+		ws.forget(name)
+	}
+
+	ws.queue = append(ws.queue, queuedEvent{event: WatchEvent{Path: name, Operation: event.Op.String(), Timestamp: now}})
+	ws.flush()
+}
+
+// pending returns the rename of path waiting for its new name, if any
+func (ws *watchStream) pending(path string) *queuedEvent {
+	for i := range ws.queue {
+		if ws.queue[i].inode != 0 && ws.queue[i].event.Path == path {
+			return &ws.queue[i]
+		}
+	}
+	return nil
+}
+
+// add watches root and every directory below it, and indexes its files
+func (ws *watchStream) add(root string, limits *walkLimits) error {
+	return limits.walk(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ws.boundary.excludes(path, d) {
+			return fs.SkipDir
+		}
+		if info, err := d.Info(); err == nil {
+			ws.inodes[path] = newTreeEntry(info)
+		}
+		if d.IsDir() {
+			return ws.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// rewatch moves the watches of a renamed directory to its new path.
+// fsnotify keeps reporting the old names of the directories below it until
+// their watches are removed and added again.
+func (ws *watchStream) rewatch(from, to string) {
+	prefix := to + string(filepath.Separator)
+	for path, entry := range ws.inodes {
+		if rel, ok := strings.CutPrefix(path, prefix); ok && entry.dir {
+			ws.watcher.Remove(filepath.Join(from, rel))
+		}
+	}
+	ws.watch(to)
+}
+
+// watch adds the watches of a directory that entered the tree, noting when
+// that reached the inotify limits
+func (ws *watchStream) watch(root string) {
+	if limit := watchLimit(ws.add(root, nil)); limit != nil {
+		ws.limit = limit
+	}
+}
+
+// expire gives up waiting for the new name of renames older than before,
+// all of them when before is zero: they left the tree, and so do the
+// directories below them
+func (ws *watchStream) expire(before time.Time) {
+	for i := range ws.queue {
+		rename := &ws.queue[i]
+		if rename.inode == 0 || !before.IsZero() && !rename.event.Timestamp.Before(before) {
+			continue
+		}
+		for rel, entry := range rename.entries {
+			if entry.dir {
+				ws.watcher.Remove(filepath.Join(rename.event.Path, rel))
+			}
+		}
+		rename.inode, rename.entries = 0, nil
+	}
+	ws.flush()
+}
+
+// flush sends the queued events up to the first rename still waiting
+func (ws *watchStream) flush() {
+	sent := 0
+	for sent < len(ws.queue) && ws.queue[sent].inode == 0 {
+		ws.Events <- ws.queue[sent].event
+		sent++
+	}
+	ws.queue = ws.queue[sent:]
+}
+
+// forget drops a path and, for directories, everything below it from the
+// index, and returns the entries below it by relative path
+func (ws *watchStream) forget(name string) map[string]treeEntry {
+	entry := ws.inodes[name]
+	delete(ws.inodes, name)
+	if !entry.dir {
+		return nil
+	}
+
+	entries := make(map[string]treeEntry)
+	prefix := name + string(filepath.Separator)
+	for path, child := range ws.inodes {
+		if rel, ok := strings.CutPrefix(path, prefix); ok {
+			entries[rel] = child
+			delete(ws.inodes, path)
+		}
+	}
+	return entries
+}
+
+// seed hashes the regular files of a tree within its boundary and the walk
+// limits, so a no-op rewrite of a file that was there when the watch started
+// is suppressed too. Files past the limits are reported on their first change.
+func (wc watchChecksums) seed(root string, boundary *walkBoundary, limits *walkLimits) {
+	limits.walk(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if boundary.excludes(path, d) {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > watchChecksumMaxSize {
+			return nil
+		}
+		if sum, err := sha256File(path); err == nil {
+			wc[path] = sum
+		}
+		return nil
+	})
+}
+
+// changed reports whether an event changed the content of a file, and sets
+// its hash. A file renamed over another one is compared with the hash of
+// the file it replaced, so an atomic save of the same content is suppressed.
+func (wc watchChecksums) changed(event *WatchEvent) bool {
+	switch event.Operation {
+	case fsnotify.Create.String(), fsnotify.Write.String(), "renamed":
+	case fsnotify.Remove.String(), fsnotify.Rename.String():
+		delete(wc, event.Path)
+		return true
+	default:
+		return true
+	}
+	if event.From != "" {
+		delete(wc, event.From)
+	}
+
+	info, err := os.Stat(event.Path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > watchChecksumMaxSize {
+		delete(wc, event.Path)
+		return true
+	}
+	sum, err := sha256File(event.Path)
+	if err != nil {
+		delete(wc, event.Path)
+		return true
+	}
+
+	previous, known := wc[event.Path]
+	wc[event.Path] = sum
+	if known && previous == sum {
+		return false
+	}
+	event.Hash = sum
+	return true
+}
+
+func newTreeEntry(info fs.FileInfo) treeEntry {
+	return treeEntry{dir: info.IsDir(), inode: fileInode(info)}
+}
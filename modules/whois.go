@@ -0,0 +1,365 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// whoisTimeout bounds each RDAP request and WHOIS connection
+const whoisTimeout = 10 * time.Second
+
+// whoisReferral matches the lines of WHOIS responses pointing to the server
+// with the full record
+var whoisReferral = regexp.MustCompile(`(?im)^\s*(?:refer|whois|registrar whois server):\s*(\S+)\s*$`)
+
+// asnPattern matches autonomous system numbers such as AS13335
+var asnPattern = regexp.MustCompile(`(?i)^as([0-9]{1,10})$`)
+
+// errRDAPNotFound marks lookups the RDAP servers have no record for
+var errRDAPNotFound = errors.New("no RDAP record found")
+
+// WhoisResult is the registration record of a domain, IP address or
+// autonomous system
+type WhoisResult struct {
+	Target      string            `json:"target"`
+	Type        string            `json:"type"`   // domain, ip or autnum
+	Source      string            `json:"source"` // rdap or whois
+	Server      string            `json:"server"`
+	Name        string            `json:"name,omitempty"`   // domain, network or AS name
+	Handle      string            `json:"handle,omitempty"` // registry identifier
+	Range       string            `json:"range,omitempty"`  // addresses or AS numbers of the allocation
+	Country     string            `json:"country,omitempty"`
+	Status      []string          `json:"status,omitempty"`
+	Registrar   string            `json:"registrar,omitempty"`
+	Registrant  string            `json:"registrant,omitempty"`
+	AbuseEmail  string            `json:"abuse_email,omitempty"`
+	Nameservers []string          `json:"nameservers,omitempty"`
+	Events      map[string]string `json:"events,omitempty"` // dates by action, e.g. registration or expiration
+	ReverseDNS  []string          `json:"reverse_dns,omitempty"`
+	Reputation  []DNSBLResult     `json:"reputation,omitempty"`
+	Text        string            `json:"text,omitempty"` // WHOIS response, when RDAP has no record
+	RDAP        json.RawMessage   `json:"rdap,omitempty"` // full RDAP response, with raw=true
+}
+
+// DNSBLResult tells whether a DNS blocklist lists an address
+type DNSBLResult struct {
+	Zone   string   `json:"zone"`
+	Listed bool     `json:"listed"`
+	Codes  []string `json:"codes,omitempty"` // return addresses, giving the reason on most lists
+	Error  string   `json:"error,omitempty"`
+}
+
+// rdapObject holds the RDAP fields of domains, IP networks and autonomous
+// systems (RFC 9083) that make up a WhoisResult
+type rdapObject struct {
+	Handle      string   `json:"handle"`
+	LDHName     string   `json:"ldhName"`
+	Name        string   `json:"name"`
+	Country     string   `json:"country"`
+	Status      []string `json:"status"`
+	StartAddr   string   `json:"startAddress"`
+	EndAddr     string   `json:"endAddress"`
+	StartAutnum int64    `json:"startAutnum"`
+	EndAutnum   int64    `json:"endAutnum"`
+	Nameservers []struct {
+		LDHName string `json:"ldhName"`
+	} `json:"nameservers"`
+	Events []struct {
+		Action string `json:"eventAction"`
+		Date   string `json:"eventDate"`
+	} `json:"events"`
+	Entities []rdapEntity `json:"entities"`
+}
+
+type rdapEntity struct {
+	Roles      []string          `json:"roles"`
+	VCardArray []json.RawMessage `json:"vcardArray"`
+	Entities   []rdapEntity      `json:"entities"`
+}
+
+// REST API Handlers
+
+// Whois looks up the registration of a domain, IP address or AS number over
+// RDAP, falling back to WHOIS for registries without RDAP. IP lookups also
+// resolve reverse DNS, and with reputation=true check DNS blocklists.
+func (nm *NetworkModule) Whois(c *gin.Context) {
+	target := strings.TrimSuffix(strings.TrimSpace(c.Query("target")), ".")
+	kind := ""
+	switch {
+	case net.ParseIP(target) != nil:
+		kind = "ip"
+	case asnPattern.MatchString(target):
+		kind = "autnum"
+		target = asnPattern.FindStringSubmatch(target)[1]
+	case strings.Contains(target, ".") && hostnamePattern.MatchString(target):
+		kind = "domain"
+		target = strings.ToLower(target)
+	default:
+		c.JSON(http.StatusBadRequest, NetworkOperation{
+			Success: false,
+			Code:    ErrInvalidRequest,
+			Message: Localize(c, "Invalid request: %v", "target must be a domain, an IP address or an AS number"),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	result, err := nm.rdapLookup(ctx, kind, target, c.Query("raw") == "true")
+	if errors.Is(err, errRDAPNotFound) {
+		result, err = nm.whoisLookup(kind, target)
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), NetworkOperation{
+			Success: false,
+			Code:    errorCode(err),
+			Message: Localize(c, "Failed to look up %s: %v", target, err),
+		})
+		return
+	}
+
+	if kind == "ip" {
+		result.ReverseDNS, _ = net.DefaultResolver.LookupAddr(ctx, target)
+		if c.Query("reputation") == "true" {
+			result.Reputation = checkDNSBL(ctx, net.ParseIP(target), strings.Split(nm.config.DNSBLZones, ","))
+		}
+	}
+
+	c.JSON(http.StatusOK, NetworkOperation{
+		Success: true,
+		Message: Localize(c, "Lookup completed"),
+		Data:    result,
+	})
+}
+
+// Helper functions
+
+// rdapLookup queries RDAP_URL, a bootstrap service redirecting to the
+// registry of the target by default
+func (nm *NetworkModule) rdapLookup(ctx context.Context, kind, target string, raw bool) (*WhoisResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, whoisTimeout)
+	defer cancel()
+
+	endpoint := strings.TrimRight(nm.config.RDAPURL, "/") + "/" + kind + "/" + target
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+
+	resp, err := nm.outbound.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errRDAPNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: RDAP server responded with %s", errUpstream, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	var object rdapObject
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, fmt.Errorf("%w: invalid RDAP response: %v", errUpstream, err)
+	}
+
+	result := &WhoisResult{
+		Target:  target,
+		Type:    kind,
+		Source:  "rdap",
+		Server:  resp.Request.URL.Host,
+		Name:    object.Name,
+		Handle:  object.Handle,
+		Country: object.Country,
+		Status:  object.Status,
+	}
+	switch kind {
+	case "domain":
+		result.Name = strings.ToLower(object.LDHName)
+	case "ip":
+		if object.StartAddr != "" {
+			result.Range = object.StartAddr + " - " + object.EndAddr
+		}
+	case "autnum":
+		result.Target = "AS" + target
+		if object.StartAutnum != 0 {
+			result.Range = fmt.Sprintf("AS%d - AS%d", object.StartAutnum, object.EndAutnum)
+		}
+	}
+	for _, nameserver := range object.Nameservers {
+		result.Nameservers = append(result.Nameservers, strings.ToLower(nameserver.LDHName))
+	}
+	if len(object.Events) > 0 {
+		result.Events = make(map[string]string)
+		for _, event := range object.Events {
+			result.Events[event.Action] = event.Date
+		}
+	}
+	for _, entity := range flattenEntities(object.Entities) {
+		for _, role := range entity.Roles {
+			switch {
+			case role == "registrar" && result.Registrar == "":
+				result.Registrar = vcardField(entity, "fn")
+			case role == "registrant" && result.Registrant == "":
+				result.Registrant = vcardField(entity, "fn")
+			case role == "abuse" && result.AbuseEmail == "":
+				result.AbuseEmail = vcardField(entity, "email")
+			}
+		}
+	}
+	if raw {
+		result.RDAP = body
+	}
+	return result, nil
+}
+
+// whoisLookup queries WHOIS_SERVER, following referrals to the server with
+// the full record
+func (nm *NetworkModule) whoisLookup(kind, target string) (*WhoisResult, error) {
+	query := target
+	if kind == "autnum" {
+		query = "AS" + target
+	}
+
+	server, text := nm.config.WhoisServer, ""
+	for hops := 0; hops < 3; hops++ {
+		response, err := nm.whoisQuery(server, query)
+		if err != nil {
+			if text != "" {
+				break // keep the registry's record when the referred server fails
+			}
+			return nil, err
+		}
+		text = response
+
+		match := whoisReferral.FindStringSubmatch(response)
+		if match == nil || strings.EqualFold(match[1], server) {
+			break
+		}
+		server = strings.TrimPrefix(strings.ToLower(match[1]), "whois://")
+	}
+
+	return &WhoisResult{
+		Target: query,
+		Type:   kind,
+		Source: "whois",
+		Server: server,
+		Text:   text,
+	}, nil
+}
+
+// whoisQuery sends a query to a WHOIS server, port 43 unless given
+func (nm *NetworkModule) whoisQuery(server, query string) (string, error) {
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "43")
+	}
+
+	conn, err := nm.outbound.DialTimeout("tcp", addr, whoisTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(whoisTimeout))
+
+	if _, err := conn.Write([]byte(query + "\r\n")); err != nil {
+		return "", err
+	}
+	response, err := io.ReadAll(io.LimitReader(conn, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(response)), nil
+}
+
+// checkDNSBL looks ip up in DNS blocklist zones, in parallel. Lists answer
+// with an address in 127.0.0.0/8 for listed IPs, and NXDOMAIN otherwise.
+func checkDNSBL(ctx context.Context, ip net.IP, zones []string) []DNSBLResult {
+	var name string
+	if ip4 := ip.To4(); ip4 != nil {
+		name = fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	} else {
+		// IPv6 addresses are listed by their nibbles in reverse order
+		nibbles := make([]string, 0, 32)
+		for i := len(ip) - 1; i >= 0; i-- {
+			nibbles = append(nibbles, strconv.FormatUint(uint64(ip[i]&0x0f), 16), strconv.FormatUint(uint64(ip[i]>>4), 16))
+		}
+		name = strings.Join(nibbles, ".")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, whoisTimeout)
+	defer cancel()
+
+	results := make([]DNSBLResult, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		zone = strings.TrimSpace(zone)
+		wg.Add(1)
+		go func(result *DNSBLResult, zone string) {
+			defer wg.Done()
+			result.Zone = zone
+			addrs, err := net.DefaultResolver.LookupHost(ctx, name+"."+zone)
+			var dnsErr *net.DNSError
+			switch {
+			case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			case err != nil:
+				result.Error = err.Error()
+			default:
+				result.Listed = true
+				result.Codes = addrs
+			}
+		}(&results[i], zone)
+	}
+	wg.Wait()
+	return results
+}
+
+// flattenEntities lists entities along with the entities they contain, such
+// as the abuse contact of a registrar
+func flattenEntities(entities []rdapEntity) []rdapEntity {
+	var flat []rdapEntity
+	for _, entity := range entities {
+		flat = append(flat, entity)
+		flat = append(flat, flattenEntities(entity.Entities)...)
+	}
+	return flat
+}
+
+// vcardField returns a text property of a jCard (RFC 7095), such as
+// ["vcard", [["fn", {}, "text", "Example Inc."], ...]]
+func vcardField(entity rdapEntity, name string) string {
+	if len(entity.VCardArray) < 2 {
+		return ""
+	}
+	var properties [][]json.RawMessage
+	if json.Unmarshal(entity.VCardArray[1], &properties) != nil {
+		return ""
+	}
+	for _, property := range properties {
+		if len(property) < 4 {
+			continue
+		}
+		var key, value string
+		if json.Unmarshal(property[0], &key) == nil && key == name && json.Unmarshal(property[3], &value) == nil {
+			return value
+		}
+	}
+	return ""
+}